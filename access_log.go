@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultAccessLogSkipPaths are left out of the access log unless they fail or are slow: load balancers and
+// orchestrators poll them constantly
+var defaultAccessLogSkipPaths = []string{"/", "/ping", "/healthz", "/readyz"}
+
+// ParseAccessLogSkipRegexes compiles `access_log_skip_regexes` into AccessLogSkipRegexps
+func (a *AppConfig) ParseAccessLogSkipRegexes() error {
+	a.AccessLogSkipRegexps = nil
+	for _, expr := range a.AccessLogSkipRegexes {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("access_log_skip_regexes '%s': %w", expr, err)
+		}
+		a.AccessLogSkipRegexps = append(a.AccessLogSkipRegexps, re)
+	}
+	return nil
+}
+
+// ValidateAccessLogSampleRate checks access_log_sample_rate is a fraction; 0 leaves fast 2xx responses out entirely
+func (a *AppConfig) ValidateAccessLogSampleRate() error {
+	if a.AccessLogSampleRate < 0 || a.AccessLogSampleRate > 1 {
+		return fmt.Errorf("access_log_sample_rate %v is outside 0-1", a.AccessLogSampleRate)
+	}
+	return nil
+}
+
+// skipAccessLog reports whether a request to path is left out of the access log when it succeeds quickly
+func (a *AppConfig) skipAccessLog(path string) bool {
+	if slices.Contains(a.AccessLogSkipPaths, path) {
+		return true
+	}
+	return slices.ContainsFunc(a.AccessLogSkipRegexps, func(re *regexp.Regexp) bool { return re.MatchString(path) })
+}
+
+// mwAccessLog writes one structured record per request to logger. Skipped paths and unsampled 2xx responses are
+// left out, but 5xx responses (logged as errors) and slow requests (warnings) always are logged. Register it right
+// after mwRequestID, so its latency covers the rest of the middleware chain.
+func mwAccessLog(cfg *AppConfig, logger *slog.Logger) gin.HandlerFunc {
+	slow := time.Duration(cfg.AccessLogSlowThreshold) * time.Millisecond
+	return func(c *gin.Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+		c.Next()
+
+		latency := time.Since(start)
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case slow > 0 && latency >= slow:
+			level = slog.LevelWarn
+		case cfg.skipAccessLog(path):
+			return
+		case status < 300 && rand.Float64() >= cfg.AccessLogSampleRate:
+			return
+		}
+
+		// The session is only there for routes registered after the session middleware (not health probes or
+		// public/ files), and by now it has already been loaded
+		var username string
+		if s, ok := c.Get(sessions.DefaultKey); ok {
+			username = getUser(s.(sessions.Session)).Username
+		}
+
+		logger.LogAttrs(c.Request.Context(), level, "request",
+			slog.String("method", c.Request.Method),
+			slog.String("route", c.FullPath()),
+			slog.String("path", path),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(latency.Microseconds())/1000),
+			slog.Int("bytes", max(c.Writer.Size(), 0)),
+			slog.String("client_ip", c.ClientIP()),
+			slog.String("user_agent", c.Request.UserAgent()),
+			slog.String("request_id", requestID(c)),
+			slog.String("username", username),
+		)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/securecookie"
+)
+
+func TestAccessLog(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// records serves each path through mwAccessLog configured by cfg, returning the records logged
+	records := func(t *testing.T, cfg *AppConfig, paths ...string) []map[string]any {
+		t.Helper()
+		if err := cfg.ParseAccessLogSkipRegexes(); err != nil {
+			t.Fatalf("ParseAccessLogSkipRegexes(): %v", err)
+		}
+		var buf bytes.Buffer
+		r := gin.New()
+		r.Use(mwRequestID(), mwAccessLog(cfg, slog.New(slog.NewJSONHandler(&buf, nil))))
+		r.GET("/books/:id", func(c *gin.Context) { c.String(http.StatusOK, "book") })
+		r.GET("/fail", func(c *gin.Context) { c.Status(http.StatusInternalServerError) })
+		r.GET("/slow", func(c *gin.Context) {
+			time.Sleep(20 * time.Millisecond)
+			c.Status(http.StatusOK)
+		})
+		for _, path := range paths {
+			req, _ := http.NewRequest("GET", path, nil)
+			req.Header.Set("User-Agent", "test-agent")
+			req.Header.Set("X-Request-ID", "req-123")
+			r.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		var out []map[string]any
+		for line := range strings.Lines(buf.String()) {
+			var rec map[string]any
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatalf("Expected JSON records, got %q: %v", line, err)
+			}
+			out = append(out, rec)
+		}
+		return out
+	}
+	config := func() *AppConfig {
+		return &AppConfig{AccessLogSkipPaths: defaultAccessLogSkipPaths, AccessLogSampleRate: 1, AccessLogSlowThreshold: 10}
+	}
+
+	t.Run("Fields", func(t *testing.T) {
+		recs := records(t, config(), "/books/7")
+		if len(recs) != 1 {
+			t.Fatalf("Expected 1 record, got %v", recs)
+		}
+		for key, want := range map[string]any{
+			"level": "INFO", "msg": "request", "method": "GET", "route": "/books/:id", "path": "/books/7",
+			"status": 200.0, "bytes": 4.0, "user_agent": "test-agent", "request_id": "req-123", "username": "",
+		} {
+			if got := recs[0][key]; got != want {
+				t.Errorf("Expected %s %v, got %v", key, want, got)
+			}
+		}
+		if _, ok := recs[0]["latency_ms"].(float64); !ok {
+			t.Errorf("Expected a numeric latency_ms, got %v", recs[0]["latency_ms"])
+		}
+	})
+
+	t.Run("Levels", func(t *testing.T) {
+		recs := records(t, config(), "/fail", "/slow", "/no/such/page")
+		want := []string{"ERROR", "WARN", "INFO"}
+		if len(recs) != len(want) {
+			t.Fatalf("Expected %d records, got %v", len(want), recs)
+		}
+		for i, rec := range recs {
+			if rec["level"] != want[i] {
+				t.Errorf("Expected %s for %s, got %v", want[i], rec["path"], rec["level"])
+			}
+		}
+	})
+
+	t.Run("SkipPaths", func(t *testing.T) {
+		cfg := config()
+		cfg.AccessLogSkipPaths = []string{"/books/1", "/fail", "/slow"}
+		cfg.AccessLogSkipRegexes = []string{`^/books/[2-3]$`}
+		recs := records(t, cfg, "/books/1", "/books/2", "/books/3", "/books/4", "/fail", "/slow")
+		var paths []string
+		for _, rec := range recs {
+			paths = append(paths, rec["path"].(string))
+		}
+		// Failures and slow requests are logged regardless
+		if strings.Join(paths, " ") != "/books/4 /fail /slow" {
+			t.Errorf("Unexpected records for %v", paths)
+		}
+	})
+
+	t.Run("SamplesSuccessesOnly", func(t *testing.T) {
+		cfg := config()
+		cfg.AccessLogSampleRate = 0 // Never sampled
+		recs := records(t, cfg, "/books/1", "/no/such/page", "/fail")
+		if len(recs) != 2 || recs[0]["status"] != 404.0 || recs[1]["status"] != 500.0 {
+			t.Errorf("Expected only the 404 and the 500, got %v", recs)
+		}
+	})
+
+	t.Run("SampleRateRange", func(t *testing.T) {
+		for rate, valid := range map[float64]bool{0: true, 0.25: true, 1: true, -0.1: false, 1.5: false} {
+			cfg := &AppConfig{AccessLogSampleRate: rate}
+			if err := cfg.ValidateAccessLogSampleRate(); (err == nil) != valid {
+				t.Errorf("%v: expected valid=%v, got %v", rate, valid, err)
+			}
+		}
+	})
+
+	t.Run("BadRegex", func(t *testing.T) {
+		cfg := &AppConfig{AccessLogSkipRegexes: []string{"("}}
+		if err := cfg.ParseAccessLogSkipRegexes(); err == nil {
+			t.Error("Expected an invalid regex to be rejected")
+		}
+	})
+}
+
+func TestAccessLogUsername(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store, err := instantiateSessionStore(&AppConfig{
+		SecureCookieSigningKey:    securecookie.GenerateRandomKey(64),
+		SecureCookieEncryptionKey: securecookie.GenerateRandomKey(32),
+		SessionStore:              SESSION_STORE__COOKIE,
+	}, nil)
+	if err != nil {
+		t.Fatalf("instantiateSessionStore(): %v", err)
+	}
+
+	var buf bytes.Buffer
+	r := gin.New()
+	r.Use(mwAccessLog(&AppConfig{AccessLogSampleRate: 1}, slog.New(slog.NewJSONHandler(&buf, nil))))
+	r.Use(sessions.Sessions("test-session", store))
+	r.GET("/login", func(c *gin.Context) {
+		setUser(&SessionUser{Username: "alice", Authenticated: true}, sessions.Default(c))
+		c.Status(http.StatusNoContent)
+	})
+	req, _ := http.NewRequest("GET", "/login", nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !strings.Contains(buf.String(), `"username":"alice"`) {
+		t.Errorf("Expected the session's username in the record, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Personal access token scopes. Each scope also grants the matching SESSUSR__* role bits (see apiTokenRole).
+const (
+	APISCOPE__READ  = "read"  // GET endpoints
+	APISCOPE__WRITE = "write" // Endpoints that create/modify/delete data
+	APISCOPE__ADMIN = "admin" // Admin-only endpoints; only grantable by admins
+)
+
+var apiScopes = []string{APISCOPE__READ, APISCOPE__WRITE, APISCOPE__ADMIN}
+
+// Prefix makes tokens recognizable (e.g. by secret scanners) and tells us which credential type we're looking at
+const apiTokenPrefix = "ggs_"
+
+// Gin context keys set by mwAPIAuth
+const (
+	ctxKeyAPIUser  = "api_user"
+	ctxKeyAPIToken = "api_token"
+)
+
+// How often LastUsedAt is written; avoids a DB write on every API request
+const apiTokenLastUsedResolution = time.Minute
+
+// APIToken is a personal access token for scripts/API clients. Only a hash of the token is stored.
+type APIToken struct {
+	ID         uint   `gorm:"primaryKey"`
+	UserID     uint   `gorm:"index;not null"`
+	Name       string `gorm:"not null"`
+	Hint       string // First few characters of the token, to help users tell tokens apart
+	TokenHash  string `gorm:"uniqueIndex;not null"`
+	Scopes     string // Space-separated
+	Role       uint64 // SESSUSR__* bits granted to requests using this token
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+
+	CreatedAt time.Time
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	return slices.Contains(strings.Fields(t.Scopes), scope)
+}
+
+func (t *APIToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+func (t *APIToken) Active() bool {
+	return t.RevokedAt == nil && !t.Expired()
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiTokenRole maps scopes to role bits, never granting more than the owning user has
+func apiTokenRole(userRole uint64, scopes []string) uint64 {
+	var role uint64
+	if slices.Contains(scopes, APISCOPE__READ) || slices.Contains(scopes, APISCOPE__WRITE) {
+		role |= SESSUSR__USER
+	}
+	if slices.Contains(scopes, APISCOPE__ADMIN) {
+		role |= SESSUSR__ADMIN
+	}
+	return role & userRole
+}
+
+// permissionScope is the token scope a permission needs: admin for AdminOnly ones, write for the rest (they all
+// change data)
+func permissionScope(p Permission) string {
+	if p.AdminOnly {
+		return APISCOPE__ADMIN
+	}
+	return APISCOPE__WRITE
+}
+
+// apiTokenNamedRoles keeps the named roles whose every permission t's scopes cover, so that, like its role bits, a
+// token never carries more than its scopes allow
+func apiTokenNamedRoles(cfg *AppConfig, roles []string, t *APIToken) []string {
+	var kept []string
+	for _, role := range roles {
+		covered := !slices.ContainsFunc(permissionRegistry, func(p Permission) bool {
+			return cfg.rolesGrant([]string{role}, p.Name) && !t.HasScope(permissionScope(p))
+		})
+		if covered {
+			kept = append(kept, role)
+		}
+	}
+	return kept
+}
+
+// createAPIToken issues a new token for u, returning the plaintext (shown to the user exactly once)
+func createAPIToken(db *gorm.DB, u *User, name string, scopes []string, ttl time.Duration) (string, *APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil, errors.New("name is required")
+	}
+	var granted []string
+	for _, s := range scopes {
+		if !slices.Contains(apiScopes, s) {
+			return "", nil, fmt.Errorf("unknown scope '%s'", s)
+		}
+		if s == APISCOPE__ADMIN && u.Role&SESSUSR__ADMIN == 0 {
+			return "", nil, errors.New("only admins may create admin-scoped tokens")
+		}
+		if !slices.Contains(granted, s) {
+			granted = append(granted, s)
+		}
+	}
+	if len(granted) == 0 {
+		return "", nil, errors.New("at least one scope is required")
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, fmt.Errorf("rand.Read(): %w", err)
+	}
+	plaintext := apiTokenPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+
+	t := &APIToken{
+		UserID:    u.ID,
+		Name:      name,
+		Hint:      plaintext[:len(apiTokenPrefix)+4],
+		TokenHash: hashAPIToken(plaintext),
+		Scopes:    strings.Join(granted, " "),
+		Role:      apiTokenRole(u.Role, granted),
+	}
+	if ttl > 0 {
+		exp := time.Now().Add(ttl)
+		t.ExpiresAt = &exp
+	}
+	if err := db.Create(t).Error; err != nil {
+		return "", nil, fmt.Errorf("db.Create(): %w", err)
+	}
+	return plaintext, t, nil
+}
+
+func listAPITokens(db *gorm.DB, userID uint) ([]APIToken, error) {
+	var tokens []APIToken
+	err := db.Where("user_id = ?", userID).Order("created_at DESC").Find(&tokens).Error
+	if err != nil {
+		return nil, fmt.Errorf("db.Find(): %w", err)
+	}
+	return tokens, nil
+}
+
+func revokeAPIToken(db *gorm.DB, userID uint, id uint) (bool, error) {
+	res := db.Model(&APIToken{}).
+		Where("user_id = ? AND id = ? AND revoked_at IS NULL", userID, id).
+		Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return false, fmt.Errorf("db.Update(): %w", res.Error)
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// authenticateAPIToken resolves a plaintext bearer token to its (active) token record and owning user
+func authenticateAPIToken(db *gorm.DB, plaintext string) (*APIToken, *User, error) {
+	if !strings.HasPrefix(plaintext, apiTokenPrefix) {
+		return nil, nil, errors.New("malformed token")
+	}
+	var t APIToken
+	if err := db.Where("token_hash = ?", hashAPIToken(plaintext)).First(&t).Error; err != nil {
+		return nil, nil, fmt.Errorf("db.First(): %w", err)
+	}
+	if !t.Active() {
+		return nil, nil, errors.New("token revoked or expired")
+	}
+	u, err := findUserByID(db, t.UserID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("findUserByID(): %w", err)
+	}
+	if u.Disabled {
+		return nil, nil, errors.New("account disabled")
+	}
+
+	if t.LastUsedAt == nil || time.Since(*t.LastUsedAt) > apiTokenLastUsedResolution {
+		now := time.Now()
+		t.LastUsedAt = &now
+		if err := db.Model(&t).Update("last_used_at", now).Error; err != nil {
+			return nil, nil, fmt.Errorf("db.Update(): %w", err)
+		}
+	}
+	return &t, u, nil
+}
+
+// mwAPIAuth authenticates /api requests. An `Authorization: Bearer <token>` header wins; without one, a valid
+// cookie session is accepted (so the site's own JavaScript can call the API). The resulting SessionUser carries
+// the token's role bits, so IsRole()/IsAdmin() checks work the same for both.
+func mwAPIAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := dso.Logger
+
+		if header := c.GetHeader("Authorization"); header != "" {
+			scheme, plaintext, _ := strings.Cut(header, " ")
+			if !strings.EqualFold(scheme, "Bearer") {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unsupported authorization scheme"})
+				return
+			}
+			t, u, err := authenticateAPIToken(dso.DB, strings.TrimSpace(plaintext))
+			if err != nil {
+				logger.Info("api token rejected", "error", err)
+				c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired token"})
+				return
+			}
+			// Role bits were fixed when the token was issued; they only count while the user still has them
+			su := u.SessionUser()
+			su.Role = t.Role & u.Role
+			su.Roles = apiTokenNamedRoles(dso.AppConfig, su.Roles, t)
+			c.Set(ctxKeyAPIUser, su)
+			c.Set(ctxKeyAPIToken, t)
+			c.Next()
+			return
+		}
+
+		// mwSessionValidity has already dropped the user from a revoked or stale session, so getUser is enough here
+		user := getUser(sessions.Default(c))
+		if !user.SessionIsValid() {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+			return
+		}
+		c.Set(ctxKeyAPIUser, &user)
+		c.Next()
+	}
+}
+
+// mwRequireAPIScope rejects token-authenticated requests whose token lacks scope (session requests pass through;
+// they are limited by role checks alone)
+func mwRequireAPIScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if t, ok := c.Get(ctxKeyAPIToken); ok && !t.(*APIToken).HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("token lacks the '%s' scope", scope)})
+			return
+		}
+		c.Next()
+	}
+}
+
+// getAPIUser returns the SessionUser established by mwAPIAuth
+func getAPIUser(c *gin.Context) *SessionUser {
+	return c.MustGet(ctxKeyAPIUser).(*SessionUser)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+)
+
+func apiRequest(t *testing.T, tc *testClient, method, path, token string, body []byte) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if method != "GET" {
+		req.Header.Set(csrfHeader, tc.csrfToken())
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return tc.do(req)
+}
+
+func TestAPITokens(t *testing.T) {
+	t.Run("CreatedFromAccountPageAndShownOnce", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO()
+		u, err := createUser(dso.DB, "frank", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		tc := newTestClient(t, router)
+		tc.login("frank", "correct horse")
+
+		w := tc.postForm("/account/tokens", url.Values{
+			"name": {"Backup script"}, "scopes": {"read"}, "expires_in_days": {"30"},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		plaintext := regexp.MustCompile(apiTokenPrefix + `[a-z2-7]+`).FindString(w.Body.String())
+		if plaintext == "" {
+			t.Fatal("Expected the new token to be displayed")
+		}
+
+		tokens, _ := listAPITokens(dso.DB, u.ID)
+		if len(tokens) != 1 || tokens[0].TokenHash == plaintext || tokens[0].TokenHash != hashAPIToken(plaintext) {
+			t.Fatalf("Expected one token stored hashed, got %+v", tokens)
+		}
+		if tokens[0].ExpiresAt == nil {
+			t.Error("Expected token to have an expiry")
+		}
+
+		if w := tc.get("/account/tokens"); bytes.Contains(w.Body.Bytes(), []byte(plaintext)) {
+			t.Error("Expected the token to only be shown once")
+		}
+	})
+
+	t.Run("BearerAuth", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO()
+		u, err := createUser(dso.DB, "frank", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		token, _, err := createAPIToken(dso.DB, u, "ci", []string{APISCOPE__READ}, 0)
+		if err != nil {
+			t.Fatalf("createAPIToken(): %v", err)
+		}
+		tc := newTestClient(t, router)
+
+		if w := apiRequest(t, tc, "GET", "/api/books", "", nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 without credentials, got %d", w.Code)
+		}
+		if w := apiRequest(t, tc, "GET", "/api/books", apiTokenPrefix+"bogus", nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for unknown token, got %d", w.Code)
+		}
+
+		w := apiRequest(t, tc, "GET", "/api/books", token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 with a valid token, got %d", w.Code)
+		}
+		var res struct{ Books []Book }
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || len(res.Books) != 3 {
+			t.Errorf("Expected 3 books, got %s", w.Body.String())
+		}
+
+		tokens, _ := listAPITokens(dso.DB, u.ID)
+		if tokens[0].LastUsedAt == nil {
+			t.Error("Expected last-used time to be recorded")
+		}
+	})
+
+	t.Run("ScopesEnforced", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO()
+		u, err := createUser(dso.DB, "frank", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		readOnly, _, _ := createAPIToken(dso.DB, u, "ro", []string{APISCOPE__READ}, 0)
+		readWrite, _, _ := createAPIToken(dso.DB, u, "rw", []string{APISCOPE__READ, APISCOPE__WRITE}, 0)
+		tc := newTestClient(t, router)
+		body := []byte(`{"title":"T","author":"A","isbn":"1"}`)
+
+		if w := apiRequest(t, tc, "POST", "/api/books", readOnly, body); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for read-only token, got %d", w.Code)
+		}
+		if w := apiRequest(t, tc, "POST", "/api/books", readWrite, body); w.Code != http.StatusCreated {
+			t.Errorf("Expected 201 for write token, got %d", w.Code)
+		}
+	})
+
+	t.Run("RoleBitsComeFromToken", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO()
+		admin, err := createUser(dso.DB, "grace", "correct horse", SESSUSR__USER|SESSUSR__ADMIN)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		user, err := createUser(dso.DB, "heidi", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		plain, _, _ := createAPIToken(dso.DB, admin, "plain", []string{APISCOPE__READ}, 0)
+		elevated, _, _ := createAPIToken(dso.DB, admin, "admin", []string{APISCOPE__READ, APISCOPE__ADMIN}, 0)
+		tc := newTestClient(t, router)
+
+		isAdmin := func(token string) bool {
+			w := apiRequest(t, tc, "GET", "/api/me", token, nil)
+			var res struct {
+				IsAdmin bool `json:"is_admin"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &res)
+			return res.IsAdmin
+		}
+		if isAdmin(plain) {
+			t.Error("Expected a token without the admin scope to lack admin role bits")
+		}
+		if !isAdmin(elevated) {
+			t.Error("Expected an admin-scoped token to carry admin role bits")
+		}
+
+		if _, _, err := createAPIToken(dso.DB, user, "sneaky", []string{APISCOPE__ADMIN}, 0); err == nil {
+			t.Error("Expected a non-admin to be refused an admin-scoped token")
+		}
+
+		// Demoting the owner takes the admin bits away from tokens issued before
+		if w := apiRequest(t, tc, "GET", "/api/admin/log-levels", elevated, nil); w.Code != http.StatusOK {
+			t.Fatalf("Expected the admin-scoped token to reach admin routes, got %d", w.Code)
+		}
+		dso.DB.Model(admin).Update("role", SESSUSR__USER)
+		if w := apiRequest(t, tc, "GET", "/api/admin/log-levels", elevated, nil); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 once the owner is no longer an admin, got %d", w.Code)
+		}
+		if isAdmin(elevated) {
+			t.Error("Expected a demoted owner's token to lose its admin role bits")
+		}
+	})
+
+	t.Run("NamedRolesLimitedByScope", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO(func(cfg *AppConfig) {
+			cfg.Roles = map[string][]string{"editor": {"books.*"}}
+		})
+		u, err := createUser(dso.DB, "ivan", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		dso.DB.Model(u).Update("roles", "editor")
+		readOnly, _, _ := createAPIToken(dso.DB, u, "ro", []string{APISCOPE__READ}, 0)
+		readWrite, _, _ := createAPIToken(dso.DB, u, "rw", []string{APISCOPE__READ, APISCOPE__WRITE}, 0)
+		tc := newTestClient(t, router)
+
+		permissions := func(token string) []string {
+			var res struct {
+				Permissions []string `json:"permissions"`
+			}
+			json.Unmarshal(apiRequest(t, tc, "GET", "/api/me", token, nil).Body.Bytes(), &res)
+			return res.Permissions
+		}
+		if slices.Contains(permissions(readOnly), PERM__BOOKS_DELETE) {
+			t.Error("Expected a read-only token not to carry the editor role")
+		}
+		if !slices.Contains(permissions(readWrite), PERM__BOOKS_DELETE) {
+			t.Error("Expected a write token to carry the editor role")
+		}
+	})
+
+	t.Run("RevokedAndExpiredRejected", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO()
+		u, err := createUser(dso.DB, "frank", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		revoked, rt, _ := createAPIToken(dso.DB, u, "old", []string{APISCOPE__READ}, 0)
+		expired, et, _ := createAPIToken(dso.DB, u, "short", []string{APISCOPE__READ}, time.Hour)
+		dso.DB.Model(et).Update("expires_at", time.Now().Add(-time.Minute))
+
+		tc := newTestClient(t, router)
+		tc.login("frank", "correct horse")
+		tc.postForm("/account/tokens/"+itoa(rt.ID)+"/revoke", url.Values{})
+
+		if w := apiRequest(t, tc, "GET", "/api/books", revoked, nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for revoked token, got %d", w.Code)
+		}
+		if w := apiRequest(t, tc, "GET", "/api/books", expired, nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for expired token, got %d", w.Code)
+		}
+	})
+
+	t.Run("RevokeIsScopedToOwner", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO()
+		owner, err := createUser(dso.DB, "frank", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		if _, err := createUser(dso.DB, "ivan", "correct horse", SESSUSR__USER); err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		token, rec, _ := createAPIToken(dso.DB, owner, "ci", []string{APISCOPE__READ}, 0)
+
+		tc := newTestClient(t, router)
+		tc.login("ivan", "correct horse")
+		tc.postForm("/account/tokens/"+itoa(rec.ID)+"/revoke", url.Values{})
+
+		if w := apiRequest(t, tc, "GET", "/api/books", token, nil); w.Code != http.StatusOK {
+			t.Errorf("Expected another user's token to survive a revoke attempt, got %d", w.Code)
+		}
+	})
+}
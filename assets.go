@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// publicPrefix is the URL path the public/ directory is served under
+const publicPrefix = "/public/"
+
+// VendoredAsset is a third-party file the layout loads. They're committed under public/ and always served from
+// there; URL is only where `make assets` fetches a missing one from (checking Integrity) before it's committed.
+type VendoredAsset struct {
+	Path      string // Relative to public/
+	URL       string // Upstream copy
+	Integrity string // Subresource Integrity hash of that copy
+}
+
+var vendoredAssets = []VendoredAsset{
+	{"vendor/jquery/jquery.min.js", "https://code.jquery.com/jquery-3.4.1.min.js",
+		"sha256-CSXorXvZcTkaix6Yvo6HppcZGetbYMGWSFlBw8HfCJo="},
+	{"vendor/popper/popper.min.js", "https://cdn.jsdelivr.net/npm/popper.js@1.16.0/dist/umd/popper.min.js",
+		"sha384-Q6E9RHvbIyZFJoft+2mJbHaEWldlvI9IOYy5n3zV9zzTtmI3UksdQRVvoxMfooAo"},
+	{"vendor/bootstrap/css/bootstrap.min.css", "https://stackpath.bootstrapcdn.com/bootstrap/4.4.1/css/bootstrap.min.css",
+		"sha384-Vkoo8x4CGsO3+Hhxv8T/Q5PaXtkKtu6ug5TOeNV6gBiFeWPGFN9MuhOf23Q9Ifjh"},
+	{"vendor/bootstrap/js/bootstrap.min.js", "https://stackpath.bootstrapcdn.com/bootstrap/4.4.1/js/bootstrap.min.js",
+		"sha384-wfSDF2E50Y2D1uUdj0O3uMBJnjuUD4Ih7YwaYd1iqfktj0Uod8GCExl3Og8ifwB6"},
+}
+
+func findVendoredAsset(name string) (VendoredAsset, bool) {
+	for _, va := range vendoredAssets {
+		if va.Path == name {
+			return va, true
+		}
+	}
+	return VendoredAsset{}, false
+}
+
+// publicAssets fingerprints the files under public/ so pages can link them with far-future caching: the `asset`
+// template func adds the content hash to the URL, which changes whenever the file does.
+type publicAssets struct {
+	fsys   fs.FS
+	reload bool // Re-hash on every lookup, so edits show up without a restart (cache_templates = false)
+
+	mu     sync.Mutex
+	hashes map[string]assetHash
+}
+
+type assetHash struct {
+	version   string // Short content hash, the `v` URL param
+	integrity string // sha384 SRI value
+}
+
+// newPublicAssets serves fsys (the root of the public/ tree)
+func newPublicAssets(fsys fs.FS, reload bool) *publicAssets {
+	return &publicAssets{fsys: fsys, reload: reload, hashes: map[string]assetHash{}}
+}
+
+// lookup hashes name, reporting fs.ErrNotExist for files that aren't there
+func (p *publicAssets) lookup(name string) (assetHash, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h, ok := p.hashes[name]; ok && !p.reload {
+		return h, nil
+	}
+	f, err := p.fsys.Open(name)
+	if err != nil {
+		return assetHash{}, err
+	}
+	defer f.Close()
+	s256, s384 := sha256.New(), sha512.New384()
+	if _, err := io.Copy(io.MultiWriter(s256, s384), f); err != nil {
+		return assetHash{}, fmt.Errorf("io.Copy(): %w", err)
+	}
+	h := assetHash{
+		version:   hex.EncodeToString(s256.Sum(nil))[:16],
+		integrity: "sha384-" + base64.StdEncoding.EncodeToString(s384.Sum(nil)),
+	}
+	p.hashes[name] = h
+	return h, nil
+}
+
+// URL returns the content-hashed URL of a file under public/ (the `asset` template func). A vendored library
+// that's missing (main() won't start without them, but one can vanish from disk in development) still gets its
+// unhashed local URL, never a third-party one.
+func (p *publicAssets) URL(name string) (string, error) {
+	h, err := p.lookup(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, ok := findVendoredAsset(name); ok {
+			return publicPrefix + strings.TrimPrefix(name, "/"), nil
+		}
+		return "", fmt.Errorf("asset '%s' not found in public/", name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return publicPrefix + strings.TrimPrefix(name, "/") + "?v=" + h.version, nil
+}
+
+// Integrity returns the Subresource Integrity value of a file under public/ (the `asset_sri` template func). For a
+// missing vendored library it's the pinned hash, so only the expected file is accepted once it's added.
+func (p *publicAssets) Integrity(name string) (string, error) {
+	h, err := p.lookup(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		if va, ok := findVendoredAsset(name); ok {
+			return va.Integrity, nil
+		}
+		return "", fmt.Errorf("asset '%s' not found in public/", name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return h.integrity, nil
+}
+
+// ServeHTTP serves a file under public/ (the request path minus publicPrefix). A URL carrying the file's current
+// hash is cached for a year as immutable; anything else must be revalidated.
+func (p *publicAssets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), publicPrefix)
+	h, err := p.lookup(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", `"`+h.version+`"`)
+	if r.URL.Query().Get("v") == h.version {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeFileFS(w, r, p.fsys, name)
+}
+
+// cliDownloadAssets fetches the vendoredAssets missing from dir (the public/ directory), refusing any whose
+// content doesn't match its Integrity hash
+func cliDownloadAssets(dir string) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	for _, va := range vendoredAssets {
+		dest := filepath.Join(dir, filepath.FromSlash(va.Path))
+		if _, err := os.Stat(dest); err == nil {
+			fmt.Printf("%s: already present\n", va.Path)
+			continue
+		}
+
+		resp, err := client.Get(va.URL)
+		if err != nil {
+			return fmt.Errorf("client.Get(): %w", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("io.ReadAll(): %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: unexpected status %s", va.URL, resp.Status)
+		}
+		if got := sriHash(va.Integrity, body); got != va.Integrity {
+			return fmt.Errorf("%s: integrity mismatch (got %s)", va.URL, got)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return fmt.Errorf("os.MkdirAll(): %w", err)
+		}
+		if err := os.WriteFile(dest, body, 0644); err != nil {
+			return fmt.Errorf("os.WriteFile(): %w", err)
+		}
+		fmt.Printf("%s: downloaded from %s\n", va.Path, va.URL)
+	}
+	return nil
+}
+
+// verifyVendoredAssets checks every vendoredAssets file is in fsys (the root of the public/ tree) and matches its
+// Integrity hash, listing all the problems in the error
+func verifyVendoredAssets(fsys fs.FS) error {
+	var problems []string
+	for _, va := range vendoredAssets {
+		body, err := fs.ReadFile(fsys, va.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			problems = append(problems, va.Path+": missing (run `make assets` and commit it)")
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("fs.ReadFile(): %w", err)
+		}
+		if got := sriHash(va.Integrity, body); got != va.Integrity {
+			problems = append(problems, fmt.Sprintf("%s: integrity mismatch (got %s)", va.Path, got))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("vendored assets not ready:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// cliCheckAssets verifies the vendored libraries committed under dir (the public/ directory), so a build can't
+// ship without them. Unlike cliDownloadAssets it needs no network.
+func cliCheckAssets(dir string) error {
+	if err := verifyVendoredAssets(os.DirFS(dir)); err != nil {
+		return err
+	}
+	fmt.Printf("All %d vendored assets present and intact\n", len(vendoredAssets))
+	return nil
+}
+
+// sriHash computes the SRI value of body using the same algorithm as want
+func sriHash(want string, body []byte) string {
+	var sum []byte
+	switch {
+	case strings.HasPrefix(want, "sha256-"):
+		s := sha256.Sum256(body)
+		sum = s[:]
+	case strings.HasPrefix(want, "sha512-"):
+		s := sha512.Sum512(body)
+		sum = s[:]
+	default:
+		s := sha512.Sum384(body)
+		sum = s[:]
+	}
+	algo, _, _ := strings.Cut(want, "-")
+	return algo + "-" + base64.StdEncoding.EncodeToString(sum)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestPublicAssets(t *testing.T) {
+	assets := newPublicAssets(fstest.MapFS{
+		"css/app.css": {Data: []byte("body { color: red; }")},
+	}, false)
+
+	url, err := assets.URL("css/app.css")
+	if err != nil || !strings.HasPrefix(url, "/public/css/app.css?v=") || len(url) != len("/public/css/app.css?v=")+16 {
+		t.Fatalf("Unexpected URL %q (%v)", url, err)
+	}
+	if _, err := assets.URL("css/missing.css"); err == nil {
+		t.Error("Expected an unknown asset to be an error")
+	}
+
+	// A missing vendored library still resolves locally (never to a third-party host), pinned to its expected hash
+	va := vendoredAssets[0]
+	if url, _ := assets.URL(va.Path); url != publicPrefix+va.Path {
+		t.Errorf("Expected the local URL %s, got %s", publicPrefix+va.Path, url)
+	}
+	if sri, _ := assets.Integrity(va.Path); sri != va.Integrity {
+		t.Errorf("Expected the pinned integrity %s, got %s", va.Integrity, sri)
+	}
+	if err := verifyVendoredAssets(assets.fsys); err == nil || strings.Count(err.Error(), ": missing") != len(vendoredAssets) {
+		t.Errorf("Expected every vendored asset to be reported missing, got %v", err)
+	}
+
+	t.Run("Caching", func(t *testing.T) {
+		for _, tc := range []struct {
+			path, cacheControl string
+			code               int
+		}{
+			{url, "public, max-age=31536000, immutable", http.StatusOK},
+			{"/public/css/app.css", "no-cache", http.StatusOK},
+			{"/public/css/app.css?v=stale", "no-cache", http.StatusOK},
+			{"/public/css/missing.css", "", http.StatusNotFound},
+			{"/public/../go.mod", "", http.StatusNotFound},
+		} {
+			w := httptest.NewRecorder()
+			assets.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+			if w.Code != tc.code || w.Header().Get("Cache-Control") != tc.cacheControl {
+				t.Errorf("%s: got %d %q", tc.path, w.Code, w.Header().Get("Cache-Control"))
+			}
+		}
+	})
+}
+
+func TestVendoredFontAwesome(t *testing.T) {
+	// The committed copy must be byte-for-byte the one the CDN serves (this is its published SRI hash)
+	assets := newPublicAssets(os.DirFS("public"), false)
+	sri, err := assets.Integrity("vendor/font-awesome/css/font-awesome.min.css")
+	if err != nil || sri != "sha384-wvfXpqpZZVQGK6TAh5PVlGOfQNHSoD2xbE+QkPxCAFlNEevoEH3Sl0sibVcOQVnN" {
+		t.Errorf("Unexpected Font Awesome integrity %q (%v)", sri, err)
+	}
+
+	// Pages link it locally, and it's served without session cookies
+	tc := newTestClient(t, setupTestRouter())
+	page := tc.get("/books").Body.String()
+	url, _ := assets.URL("vendor/font-awesome/css/font-awesome.min.css")
+	if !strings.Contains(page, `href="`+url+`"`) {
+		t.Errorf("Expected the layout to link %s", url)
+	}
+	w := tc.get(url)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/css") {
+		t.Errorf("Expected the stylesheet to be served, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if w.Header().Get("Set-Cookie") != "" {
+		t.Error("Expected public files to be served without a session")
+	}
+}
+
+func TestSRIHash(t *testing.T) {
+	body := []byte("alert(1)")
+	for _, want := range []string{
+		"sha256-bhHHL3z2vDgxUt0W3dWQOrprscmda2Y5pLsLg4GF+pI=",
+		"sha384-HT2E9NfWiuQ/w1PRai+hTyqW16NIoCGA/m8VQDUopfAtcz6YQjtsMmQd5uRbVDpW",
+	} {
+		if got := sriHash(want, body); got != want {
+			t.Errorf("sriHash() = %s, want %s", got, want)
+		}
+	}
+}
+
+func TestCheckAssets(t *testing.T) {
+	dir := t.TempDir()
+	if err := cliCheckAssets(dir); err == nil || !strings.Contains(err.Error(), vendoredAssets[0].Path+": missing") {
+		t.Errorf("Expected missing libraries to be reported, got %v", err)
+	}
+
+	// A file that isn't the pinned upstream copy is refused
+	va := vendoredAssets[0]
+	if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(va.Path)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, va.Path), []byte("alert(1)"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cliCheckAssets(dir); err == nil || !strings.Contains(err.Error(), va.Path+": integrity mismatch") {
+		t.Errorf("Expected a tampered library to be refused, got %v", err)
+	}
+}
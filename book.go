@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Book is the example resource used by the books pages and API
+type Book struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Title     string    `gorm:"not null" json:"title"`
+	Author    string    `gorm:"not null" json:"author"`
+	ISBN      string    `gorm:"not null" json:"isbn"`
+	CreatedBy uint      `gorm:"index" json:"created_by"` // Owner's user ID; 0 for books nobody owns (e.g. the seed data)
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// OwnerID implements Owned
+func (b *Book) OwnerID() uint {
+	return b.CreatedBy
+}
+
+// BookInput is the editable part of a Book (what forms and API clients may set)
+type BookInput struct {
+	Title  string `json:"title" form:"title"`
+	Author string `json:"author" form:"author"`
+	ISBN   string `json:"isbn" form:"isbn"`
+}
+
+func (in *BookInput) validate() error {
+	in.Title = strings.TrimSpace(in.Title)
+	in.Author = strings.TrimSpace(in.Author)
+	in.ISBN = strings.TrimSpace(in.ISBN)
+	if in.Title == "" || in.Author == "" || in.ISBN == "" {
+		return errors.New("title, author and isbn are required")
+	}
+	return nil
+}
+
+// seedBooks adds the example books to an empty table
+func seedBooks(db *gorm.DB) error {
+	var n int64
+	if err := db.Model(&Book{}).Count(&n).Error; err != nil {
+		return fmt.Errorf("db.Count(): %w", err)
+	}
+	if n > 0 {
+		return nil
+	}
+	books := []Book{
+		{ID: 1, Title: "The Go Programming Language", Author: "Alan A. A. Donovan", ISBN: "978-0134190440"},
+		{ID: 2, Title: "Learning Go", Author: "Jon Bodner", ISBN: "978-1492077213"},
+		{ID: 3, Title: "Concurrency in Go", Author: "Katherine Cox-Buday", ISBN: "978-1491941294"},
+	}
+	if err := db.Create(&books).Error; err != nil {
+		return fmt.Errorf("db.Create(): %w", err)
+	}
+	return nil
+}
+
+func listBooks(db *gorm.DB) ([]Book, error) {
+	var books []Book
+	if err := db.Order("id").Find(&books).Error; err != nil {
+		return nil, fmt.Errorf("db.Find(): %w", err)
+	}
+	return books, nil
+}
+
+func findBookByID(db *gorm.DB, id uint) (*Book, error) {
+	var b Book
+	if err := db.First(&b, id).Error; err != nil {
+		return nil, fmt.Errorf("db.First(): %w", err)
+	}
+	return &b, nil
+}
+
+func createBook(db *gorm.DB, in BookInput, ownerID uint) (*Book, error) {
+	if err := in.validate(); err != nil {
+		return nil, err
+	}
+	b := &Book{Title: in.Title, Author: in.Author, ISBN: in.ISBN, CreatedBy: ownerID}
+	if err := db.Create(b).Error; err != nil {
+		return nil, fmt.Errorf("db.Create(): %w", err)
+	}
+	return b, nil
+}
+
+func updateBook(db *gorm.DB, b *Book, in BookInput) error {
+	if err := in.validate(); err != nil {
+		return err
+	}
+	b.Title, b.Author, b.ISBN = in.Title, in.Author, in.ISBN
+	err := db.Model(b).Updates(map[string]any{"title": b.Title, "author": b.Author, "isbn": b.ISBN}).Error
+	if err != nil {
+		return fmt.Errorf("db.Updates(): %w", err)
+	}
+	return nil
+}
+
+func deleteBook(db *gorm.DB, b *Book) error {
+	if err := db.Delete(b).Error; err != nil {
+		return fmt.Errorf("db.Delete(): %w", err)
+	}
+	return nil
+}
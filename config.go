@@ -1,11 +1,13 @@
 package main
 
 import (
+	"cmp"
 	"encoding/hex"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/davecgh/go-spew/spew"
@@ -17,23 +19,131 @@ type AppConfig struct {
 	// Web server configuration
 	HostPort                     string `mapstructure:"host_port"`
 	LogFile                      string `mapstructure:"log_file"`
+	LogMaxSizeMB                 int    `mapstructure:"log_max_size_mb"`
+	LogRotateInterval            int    `mapstructure:"log_rotate_interval"`
+	LogMaxBackups                int    `mapstructure:"log_max_backups"`
+	LogMaxAge                    int    `mapstructure:"log_max_age"`
+	LogCompress                  bool   `mapstructure:"log_compress"`
 	LogLevel                     int    `mapstructure:"log_level"`
+	LogFormat                    string `mapstructure:"log_format"`
+	LogModules                   string `mapstructure:"log_modules"`
+	LogModuleLevels              map[string]slog.Level
+	LogRedactKeys                []string `mapstructure:"log_redact_keys"`
+	LogRedactPatterns            []string `mapstructure:"log_redact_patterns"`
+	LogRedactRegexps             []*regexp.Regexp
 	RegenerateSecureKeys         bool   `mapstructure:"regenerate_secure_keys"`
 	SSLDisabled                  bool   `mapstructure:"ssl_disabled"`
 	SSLCertFile                  string `mapstructure:"ssl_cert_file"`
 	SSLKeyFile                   string `mapstructure:"ssl_key_file"`
-	CacheBustVal                 string `mapstructure:"cache_bust"`
 	CacheTemplates               bool   `mapstructure:"cache_templates"`
+	ShutdownDelay                int    `mapstructure:"shutdown_delay"`
+	ShutdownTimeout              int    `mapstructure:"shutdown_timeout"`
+	HealthToken                  string `mapstructure:"health_token"`
+	HealthCheckTimeout           int    `mapstructure:"health_check_timeout"`
+	HealthCacheTTL               int    `mapstructure:"health_cache_ttl"`
+	HealthMinFreeDiskMB          int    `mapstructure:"health_min_free_disk_mb"`
+	MetricsListenAddr            string `mapstructure:"metrics_listen_addr"`
+	MetricsUsername              string `mapstructure:"metrics_username"`
+	MetricsPassword              string `mapstructure:"metrics_password"`
 	SecureCookieSigningKey       []byte
 	SecureCookieSigningKeyHex    string `mapstructure:"secure_cookie_signing_key"`
 	SecureCookieEncryptionKey    []byte
 	SecureCookieEncryptionKeyHex string `mapstructure:"secure_cookie_encryption_key"`
 	SecureCookieMaxAge           int    `mapstructure:"secure_cookie_max_age"`
+	SessionStore                 string `mapstructure:"session_store"`
+	SessionDir                   string `mapstructure:"session_dir"`
+	SessionLifetime              int    `mapstructure:"session_lifetime"`
+	SessionReapInterval          int    `mapstructure:"session_reap_interval"`
+	SessionSameSite              string `mapstructure:"session_same_site"`
+
+	// Secure cookie key pairs, newest first (supports rotation); overrides the single signing/encryption keys above
+	SecureCookieKeys []SecureCookieKeyPair `mapstructure:"secure_cookie_keys"`
+
+	// Database configuration
+	DBConnStr string `mapstructure:"db_conn_str"`
+
+	// Mail configuration
+	BaseURL      string `mapstructure:"base_url"` // Public URL of the site, for links in emails
+	Mailer       string `mapstructure:"mailer"`
+	MailFrom     string `mapstructure:"mail_from"`
+	OutboxDir    string `mapstructure:"outbox_dir"`
+	SMTPHost     string `mapstructure:"smtp_host"`
+	SMTPPort     int    `mapstructure:"smtp_port"`
+	SMTPUsername string `mapstructure:"smtp_username"`
+	SMTPPassword string `mapstructure:"smtp_password"`
+
+	// Authentication configuration
+	TOTPIssuer            string   `mapstructure:"totp_issuer"`
+	WebAuthnRPID          string   `mapstructure:"webauthn_rp_id"`
+	WebAuthnRPDisplayName string   `mapstructure:"webauthn_rp_display_name"`
+	WebAuthnRPOrigins     []string `mapstructure:"webauthn_rp_origins"`
+
+	// Login brute-force protection
+	LoginThrottleFreeAttempts int `mapstructure:"login_throttle_free_attempts"`
+	LoginThrottleMaxDelay     int `mapstructure:"login_throttle_max_delay"`
+	LoginLockoutThreshold     int `mapstructure:"login_lockout_threshold"`
+	LoginLockoutDuration      int `mapstructure:"login_lockout_duration"`
+
+	// Security headers (see security_headers.go)
+	CSP               string `mapstructure:"csp"` // {nonce} is replaced with the per-request nonce
+	CSPReportOnly     bool   `mapstructure:"csp_report_only"`
+	FrameAncestors    string `mapstructure:"frame_ancestors"`
+	ReferrerPolicy    string `mapstructure:"referrer_policy"`
+	PermissionsPolicy string `mapstructure:"permissions_policy"`
+	HSTSMaxAge        int    `mapstructure:"hsts_max_age"`
+
+	// Tracing configuration (see tracing.go)
+	TracingExporter    string  `mapstructure:"tracing_exporter"`
+	TracingFile        string  `mapstructure:"tracing_file"`
+	TracingEndpoint    string  `mapstructure:"tracing_endpoint"`
+	TracingSampleRatio float64 `mapstructure:"tracing_sample_ratio"`
+	TracingServiceName string  `mapstructure:"tracing_service_name"`
+
+	// Access log configuration (see access_log.go)
+	AccessLogSkipPaths     []string `mapstructure:"access_log_skip_paths"`
+	AccessLogSkipRegexes   []string `mapstructure:"access_log_skip_regexes"`
+	AccessLogSkipRegexps   []*regexp.Regexp
+	AccessLogSampleRate    float64 `mapstructure:"access_log_sample_rate"`
+	AccessLogSlowThreshold int     `mapstructure:"access_log_slow_threshold"`
+
+	// Error reporting configuration (see error_report.go)
+	ErrorReportingDSN          string `mapstructure:"error_reporting_dsn"`
+	ErrorReportingEndpoint     string
+	ErrorReportingKey          string
+	ErrorReportingEnvironment  string `mapstructure:"error_reporting_environment"`
+	ErrorReportingRelease      string `mapstructure:"error_reporting_release"`
+	ErrorReportingQueueSize    int    `mapstructure:"error_reporting_queue_size"`
+	ErrorReportingDedupeWindow int    `mapstructure:"error_reporting_dedupe_window"`
+
+	// Roles as named permission sets (see permissions.go); overrides/extends the built-in "admin" and "user"
+	Roles map[string][]string `mapstructure:"roles"`
 
 	WorkingDir  string
 	DebugConfig bool `mapstructure:"debug_config"`
 }
 
+// SecureCookieKeyPair is one signing+encryption key pair. The first configured pair encodes new cookies; every
+// pair is tried when decoding, so old keys keep working while they're rotated out.
+type SecureCookieKeyPair struct {
+	SigningKey       []byte
+	SigningKeyHex    string `mapstructure:"signing_key"`
+	EncryptionKey    []byte
+	EncryptionKeyHex string `mapstructure:"encryption_key"`
+}
+
+// SecureCookieKeyPairs returns every configured key pair flattened as securecookie expects
+// (signing1, encryption1, signing2, encryption2, ...), newest first
+func (a *AppConfig) SecureCookieKeyPairs() [][]byte {
+	if len(a.SecureCookieKeys) == 0 {
+		return [][]byte{a.SecureCookieSigningKey, a.SecureCookieEncryptionKey}
+	}
+	pairs := make([][]byte, 0, len(a.SecureCookieKeys)*2)
+	for _, kp := range a.SecureCookieKeys {
+		pairs = append(pairs, kp.SigningKey, kp.EncryptionKey)
+	}
+	return pairs
+}
+
 func NewAppConfigFromFile(filename string) (*AppConfig, error) {
 	// Get current executable's directory
 	ex, err := os.Executable()
@@ -86,12 +196,40 @@ func NewAppConfigFromFile(filename string) (*AppConfig, error) {
 		os.Exit(0)
 	}
 
+	// Add CLI subcommand to rotate secure cookie keys (uses the raw, un-expanded config values)
+	if len(os.Args) > 2 && os.Args[1] == "keys" && os.Args[2] == "rotate" {
+		fmt.Print(rotateSecureKeys(&ac))
+		os.Exit(0)
+	}
+
 	// Parse all values for any environmental variable inclusions
 	ac.ParseEnvVariables()
 
 	// Validate and parse secure cookie keys
 	ac.ParseSecureKeys()
 
+	if err := ac.ValidateRoles(); err != nil {
+		return nil, fmt.Errorf("ac.ValidateRoles(): %w", err)
+	}
+	if err := ac.ParseAccessLogSkipRegexes(); err != nil {
+		return nil, fmt.Errorf("ac.ParseAccessLogSkipRegexes(): %w", err)
+	}
+	if err := ac.ValidateAccessLogSampleRate(); err != nil {
+		return nil, fmt.Errorf("ac.ValidateAccessLogSampleRate(): %w", err)
+	}
+	if err := ac.ValidateTracingSampleRatio(); err != nil {
+		return nil, fmt.Errorf("ac.ValidateTracingSampleRatio(): %w", err)
+	}
+	if err := ac.ParseLogSettings(); err != nil {
+		return nil, fmt.Errorf("ac.ParseLogSettings(): %w", err)
+	}
+	if err := ac.ParseLogRedactPatterns(); err != nil {
+		return nil, fmt.Errorf("ac.ParseLogRedactPatterns(): %w", err)
+	}
+	if err := ac.ParseErrorReportingDSN(); err != nil {
+		return nil, fmt.Errorf("ac.ParseErrorReportingDSN(): %w", err)
+	}
+
 	// Save the determination for working directory (where the config file lives)
 	if cfgPath := viper.ConfigFileUsed(); cfgPath != "" {
 		ac.WorkingDir = filepath.Dir(cfgPath)
@@ -103,10 +241,141 @@ func NewAppConfigFromFile(filename string) (*AppConfig, error) {
 	if !strings.HasPrefix(ac.HostPort, ":") {
 		ac.HostPort = fmt.Sprintf(":%s", ac.HostPort)
 	}
+	if ac.LogRedactKeys == nil {
+		ac.LogRedactKeys = defaultLogRedactKeys
+	}
+	if ac.LogMaxSizeMB <= 0 {
+		ac.LogMaxSizeMB = 100
+	}
+	if ac.ShutdownTimeout <= 0 {
+		ac.ShutdownTimeout = 30
+	}
+	if ac.HealthCheckTimeout <= 0 {
+		ac.HealthCheckTimeout = 2
+	}
+	if ac.HealthCacheTTL <= 0 {
+		ac.HealthCacheTTL = 5
+	}
+	if ac.HealthMinFreeDiskMB <= 0 {
+		ac.HealthMinFreeDiskMB = 100
+	}
+	if ac.AccessLogSkipPaths == nil {
+		ac.AccessLogSkipPaths = defaultAccessLogSkipPaths
+	}
+	// 0 is a valid rate (no fast 2xx responses logged), so only default when the option is missing
+	if !viper.IsSet("access_log_sample_rate") {
+		ac.AccessLogSampleRate = 1
+	}
+	if ac.AccessLogSlowThreshold <= 0 {
+		ac.AccessLogSlowThreshold = 1000
+	}
+	if ac.TracingExporter == "" {
+		ac.TracingExporter = TRACING_EXPORTER__NONE
+	}
+	if ac.TracingEndpoint == "" {
+		ac.TracingEndpoint = "http://localhost:4318"
+	}
+	// Likewise 0 is a valid ratio (no new traces recorded)
+	if !viper.IsSet("tracing_sample_ratio") {
+		ac.TracingSampleRatio = 1
+	}
+	if ac.TracingServiceName == "" {
+		ac.TracingServiceName = "go-gin-starter"
+	}
+	if ac.ErrorReportingEnvironment == "" {
+		ac.ErrorReportingEnvironment = cmp.Or(os.Getenv("ENVIRONMENT"), "development")
+	}
+	if ac.ErrorReportingQueueSize <= 0 {
+		ac.ErrorReportingQueueSize = 100
+	}
+	if ac.ErrorReportingDedupeWindow <= 0 {
+		ac.ErrorReportingDedupeWindow = 60
+	}
+	if ac.SessionStore == "" {
+		ac.SessionStore = SESSION_STORE__COOKIE
+	}
+	if ac.SessionDir == "" {
+		ac.SessionDir = filepath.Join(ac.WorkingDir, "sessions")
+	}
+	if ac.SessionLifetime <= 0 {
+		ac.SessionLifetime = 86400
+	}
+	if ac.SessionReapInterval <= 0 {
+		ac.SessionReapInterval = 600
+	}
+	if ac.SessionSameSite == "" {
+		ac.SessionSameSite = "lax"
+	}
+	if ac.DBConnStr == "" {
+		ac.DBConnStr = filepath.Join(ac.WorkingDir, "app.db")
+	}
+	if ac.BaseURL == "" {
+		scheme := "https"
+		if ac.SSLDisabled {
+			scheme = "http"
+		}
+		ac.BaseURL = fmt.Sprintf("%s://localhost%s", scheme, ac.HostPort)
+	}
+	ac.BaseURL = strings.TrimRight(ac.BaseURL, "/")
+	if ac.Mailer == "" {
+		ac.Mailer = MAILER__OUTBOX
+	}
+	if ac.MailFrom == "" {
+		ac.MailFrom = "noreply@localhost"
+	}
+	if ac.OutboxDir == "" {
+		ac.OutboxDir = filepath.Join(ac.WorkingDir, "outbox")
+	}
+	if ac.SMTPPort == 0 {
+		ac.SMTPPort = 587
+	}
+	if ac.TOTPIssuer == "" {
+		ac.TOTPIssuer = "My App"
+	}
+	if ac.LoginThrottleFreeAttempts <= 0 {
+		ac.LoginThrottleFreeAttempts = 3
+	}
+	if ac.LoginThrottleMaxDelay <= 0 {
+		ac.LoginThrottleMaxDelay = 60
+	}
+	if ac.LoginLockoutThreshold <= 0 {
+		ac.LoginLockoutThreshold = 10
+	}
+	if ac.LoginLockoutDuration <= 0 {
+		ac.LoginLockoutDuration = 900
+	}
+	if ac.CSP == "" {
+		ac.CSP = defaultCSP
+	}
+	if ac.FrameAncestors == "" {
+		ac.FrameAncestors = "'none'"
+	}
+	if ac.ReferrerPolicy == "" {
+		ac.ReferrerPolicy = "strict-origin-when-cross-origin"
+	}
+	if ac.PermissionsPolicy == "" {
+		ac.PermissionsPolicy = "camera=(), microphone=(), geolocation=(), payment=(), usb=()"
+	}
+	if ac.HSTSMaxAge <= 0 {
+		ac.HSTSMaxAge = 31536000
+	}
+	if ac.WebAuthnRPID == "" {
+		ac.WebAuthnRPID = "localhost"
+	}
+	if ac.WebAuthnRPDisplayName == "" {
+		ac.WebAuthnRPDisplayName = "My App"
+	}
+	if len(ac.WebAuthnRPOrigins) == 0 {
+		scheme := "https"
+		if ac.SSLDisabled {
+			scheme = "http"
+		}
+		ac.WebAuthnRPOrigins = []string{fmt.Sprintf("%s://%s%s", scheme, ac.WebAuthnRPID, ac.HostPort)}
+	}
 
-	// Dump config if flag set
+	// Dump config if flag set (secrets masked)
 	if ac.DebugConfig {
-		spew.Dump(ac)
+		spew.Dump(ac.Redacted())
 		os.Exit(0)
 	}
 
@@ -138,45 +407,149 @@ func (a *AppConfig) ParseEnvVariables() {
 	if SecureCookieEncryptionKeyHex != "" {
 		a.SecureCookieEncryptionKeyHex = SecureCookieEncryptionKeyHex
 	}
+	SessionDir := os.ExpandEnv(a.SessionDir)
+	if SessionDir != "" {
+		a.SessionDir = SessionDir
+	}
+	for i := range a.SecureCookieKeys {
+		a.SecureCookieKeys[i].SigningKeyHex = os.ExpandEnv(a.SecureCookieKeys[i].SigningKeyHex)
+		a.SecureCookieKeys[i].EncryptionKeyHex = os.ExpandEnv(a.SecureCookieKeys[i].EncryptionKeyHex)
+	}
+	DBConnStr := os.ExpandEnv(a.DBConnStr)
+	if DBConnStr != "" {
+		a.DBConnStr = DBConnStr
+	}
+	BaseURL := os.ExpandEnv(a.BaseURL)
+	if BaseURL != "" {
+		a.BaseURL = BaseURL
+	}
+	OutboxDir := os.ExpandEnv(a.OutboxDir)
+	if OutboxDir != "" {
+		a.OutboxDir = OutboxDir
+	}
+	SMTPHost := os.ExpandEnv(a.SMTPHost)
+	if SMTPHost != "" {
+		a.SMTPHost = SMTPHost
+	}
+	SMTPUsername := os.ExpandEnv(a.SMTPUsername)
+	if SMTPUsername != "" {
+		a.SMTPUsername = SMTPUsername
+	}
+	SMTPPassword := os.ExpandEnv(a.SMTPPassword)
+	if SMTPPassword != "" {
+		a.SMTPPassword = SMTPPassword
+	}
+	// Unlike the above, an unset variable leaves no credential rather than the literal (and guessable) '${...}'
+	a.HealthToken = os.ExpandEnv(a.HealthToken)
+	a.MetricsListenAddr = os.ExpandEnv(a.MetricsListenAddr)
+	a.MetricsUsername = os.ExpandEnv(a.MetricsUsername)
+	a.MetricsPassword = os.ExpandEnv(a.MetricsPassword)
+	TracingFile := os.ExpandEnv(a.TracingFile)
+	if TracingFile != "" {
+		a.TracingFile = TracingFile
+	}
+	TracingEndpoint := os.ExpandEnv(a.TracingEndpoint)
+	if TracingEndpoint != "" {
+		a.TracingEndpoint = TracingEndpoint
+	}
+	a.ErrorReportingDSN = os.ExpandEnv(a.ErrorReportingDSN)
 }
 
 func (a *AppConfig) ParseSecureKeys() {
-	if a.SecureCookieSigningKeyHex == "" {
-		slog.Error("No 'secure_cookie_signing_key' found in config file")
+	// Preferred: an ordered list of key pairs (supports rotation)
+	if len(a.SecureCookieKeys) > 0 {
+		if a.SecureCookieSigningKeyHex != "" || a.SecureCookieEncryptionKeyHex != "" {
+			slog.Warn("Both 'secure_cookie_keys' and 'secure_cookie_signing_key'/'secure_cookie_encryption_key' are set; ignoring the latter")
+		}
+		for i := range a.SecureCookieKeys {
+			kp := &a.SecureCookieKeys[i]
+			if err := kp.decode(); err != nil {
+				slog.Error(fmt.Sprintf("Error in 'secure_cookie_keys' entry %d", i+1), "error", err)
+				os.Exit(1)
+			}
+		}
+		a.SecureCookieSigningKey = a.SecureCookieKeys[0].SigningKey
+		a.SecureCookieEncryptionKey = a.SecureCookieKeys[0].EncryptionKey
+		return
+	}
+
+	// Legacy: a single signing + encryption key
+	kp := SecureCookieKeyPair{SigningKeyHex: a.SecureCookieSigningKeyHex, EncryptionKeyHex: a.SecureCookieEncryptionKeyHex}
+	if err := kp.decode(); err != nil {
+		slog.Error("Error in 'secure_cookie_signing_key'/'secure_cookie_encryption_key'", "error", err)
 		os.Exit(1)
 	}
-	secureCookieSigningKey, err := hex.DecodeString(a.SecureCookieSigningKeyHex)
+	a.SecureCookieSigningKey = kp.SigningKey
+	a.SecureCookieEncryptionKey = kp.EncryptionKey
+}
+
+// decode validates and decodes the hex keys of the pair
+func (kp *SecureCookieKeyPair) decode() error {
+	if kp.SigningKeyHex == "" {
+		return fmt.Errorf("no signing key found")
+	}
+	signingKey, err := hex.DecodeString(kp.SigningKeyHex)
 	if err != nil {
-		slog.Error("Error decoding 'secure_cookie_signing_key' from hex", "error", err)
-		os.Exit(1)
+		return fmt.Errorf("hex.DecodeString(signing key): %w", err)
 	}
-	if len(secureCookieSigningKey) != 64 {
-		slog.Error("Error 'secure_cookie_signing_key' must be 64 bytes long")
-		os.Exit(1)
+	if len(signingKey) != 64 {
+		return fmt.Errorf("signing key must be 64 bytes long")
 	}
-	a.SecureCookieSigningKey = secureCookieSigningKey
 
-	if a.SecureCookieEncryptionKeyHex == "" {
-		slog.Error("No 'secure_cookie_encryption_key' found in config file")
-		os.Exit(1)
+	if kp.EncryptionKeyHex == "" {
+		return fmt.Errorf("no encryption key found")
 	}
-	secureCookieEncryptionKey, err := hex.DecodeString(a.SecureCookieEncryptionKeyHex)
+	encryptionKey, err := hex.DecodeString(kp.EncryptionKeyHex)
 	if err != nil {
-		slog.Error("Error decoding 'secure_cookie_encryption_key' from hex", "error", err)
-		os.Exit(1)
+		return fmt.Errorf("hex.DecodeString(encryption key): %w", err)
 	}
-	if len(secureCookieEncryptionKey) != 32 {
-		slog.Error("Error 'secure_cookie_encryption_key' must be 64 bytes long")
-		os.Exit(1)
+	if len(encryptionKey) != 32 {
+		return fmt.Errorf("encryption key must be 32 bytes long")
+	}
+
+	kp.SigningKey = signingKey
+	kp.EncryptionKey = encryptionKey
+	return nil
+}
+
+// newSecureKeyPairHex generates a fresh signing (64 byte) and encryption (32 byte) key, hex encoded
+func newSecureKeyPairHex() (signingKey string, encryptionKey string) {
+	return hex.EncodeToString(securecookie.GenerateRandomKey(64)), hex.EncodeToString(securecookie.GenerateRandomKey(32))
+}
+
+// rotateSecureKeys returns a `secure_cookie_keys` setting with a freshly generated pair prepended to the currently
+// configured pair(s). Values are printed as written in the config (e.g. '${ENV_VAR}' references stay as-is).
+func rotateSecureKeys(a *AppConfig) string {
+	current := a.SecureCookieKeys
+	if len(current) == 0 && a.SecureCookieSigningKeyHex != "" {
+		current = []SecureCookieKeyPair{{SigningKeyHex: a.SecureCookieSigningKeyHex, EncryptionKeyHex: a.SecureCookieEncryptionKeyHex}}
+	}
+	signingKey, encryptionKey := newSecureKeyPairHex()
+	pairs := append([]SecureCookieKeyPair{{SigningKeyHex: signingKey, EncryptionKeyHex: encryptionKey}}, current...)
+
+	var b strings.Builder
+	b.WriteString("\n* * * Start rotated secure keys * * *\n")
+	b.WriteString("secure_cookie_keys = [\n")
+	for i, kp := range pairs {
+		note := ""
+		if i == 0 {
+			note = " # New: encodes all new cookies"
+		}
+		fmt.Fprintf(&b, "  { signing_key = '%s', encryption_key = '%s' },%s\n", kp.SigningKeyHex, kp.EncryptionKeyHex, note)
 	}
-	a.SecureCookieEncryptionKey = secureCookieEncryptionKey
+	b.WriteString("]\n")
+	b.WriteString("* * * Finished rotated secure keys * * *\n")
+	b.WriteString("Replace 'secure_cookie_keys' (and remove 'secure_cookie_signing_key'/'secure_cookie_encryption_key', if present) in your config with the above.\n")
+	b.WriteString("Older pairs still decode existing cookies; drop them once every session issued under them has expired.\n")
+	return b.String()
 }
 
 func generateNewSecureKeys() {
 	// Generate and print out new keys
+	signingKey, encryptionKey := newSecureKeyPairHex()
 	fmt.Println("\n* * * Start generating new secure keys * * *")
-	fmt.Printf("secure_cookie_signing_key = '%s'\n", hex.EncodeToString(securecookie.GenerateRandomKey(64)))
-	fmt.Printf("secure_cookie_encryption_key = '%s'\n", hex.EncodeToString(securecookie.GenerateRandomKey(32)))
+	fmt.Printf("secure_cookie_signing_key = '%s'\n", signingKey)
+	fmt.Printf("secure_cookie_encryption_key = '%s'\n", encryptionKey)
 	fmt.Println("* * * Finished generating new secure keys * * *")
 	fmt.Println("Set config option 'regenerate_secure_keys' to false (no quotes) to permit the application to start normally")
 }
@@ -192,8 +565,7 @@ func generateConfig(filename string, wd string) error {
 	}
 
 	// Generate fresh secure cookie keys
-	signingKey := hex.EncodeToString(securecookie.GenerateRandomKey(64))
-	encryptionKey := hex.EncodeToString(securecookie.GenerateRandomKey(32))
+	signingKey, encryptionKey := newSecureKeyPairHex()
 
 	// Prep file contents with helpful comments and good defaults
 	configContent := fmt.Sprintf(`# debug_config = true
@@ -201,13 +573,37 @@ func generateConfig(filename string, wd string) error {
 # Web Server Configuration
 # These values can be overridden via environment variables using ${VAR_NAME} syntax
 host_port = '8080'        # Can also use: '${HOST_PORT}' to load from env var
-cache_bust = 'abc'
 # log_file = './log.log'  # Can also use: '${LOG_FILE}'. If not set, logs to STDOUT
+log_max_size_mb = 100     # Rotate log_file once it reaches this size
+log_rotate_interval = 24  # ...or every this many hours (0 to rotate by size only). Also reopened on SIGHUP, for external logrotate
+log_max_backups = 7       # Rotated files kept (0 keeps all)
+log_max_age = 30          # Days rotated files are kept (0 keeps them regardless of age)
+log_compress = true       # Gzip rotated files
 log_level = 3             # Detail of logging (1-5): 1 is fatal-level only, 5 is trace-level detail. Level 3 is recommended for production.
+# log_modules = 'db=debug, http=warn'  # Per-module levels (trace, debug, info, warn, error) overriding log_level; modules: db, http
+log_format = 'json'       # 'json', or 'text' for easier reading in a local terminal
+log_redact_keys = ['password', 'token', 'secure_cookie_*', 'authorization', 'email']  # Log attributes masked; plain words also match a suffix (api_token)
+# log_redact_patterns = ['\bssn=\d+']  # Regexes masked in log messages and values (card numbers always are)
 cache_templates = false   # TURN ON (set to true) IN PRODUCTION for better performance!!!
 ssl_disabled = true       # TURN OFF (set to false) IN PRODUCTION!!!
 # ssl_cert_file = './tls/cert.pem'  # Can also use: '${SSL_CERT_FILE}'
 # ssl_key_file = './tls/key.pem'    # Can also use: '${SSL_KEY_FILE}'
+shutdown_delay = 0        # Seconds to keep serving after SIGTERM while /ping reports 503, so load balancers stop routing here first
+shutdown_timeout = 30     # Seconds in-flight requests get to finish on shutdown before their connections are closed
+# health_token = '${HEALTH_TOKEN}'  # Send as 'Authorization: Bearer ...' to get per-check detail from /healthz and /readyz
+health_check_timeout = 2  # Seconds each health check gets before it's counted as failed
+health_cache_ttl = 5      # Seconds health check results are reused for, so frequent probes stay cheap
+health_min_free_disk_mb = 100 # /readyz fails when the disk holding log_file has less than this free
+# Prometheus /metrics is only served once one of these is set: on its own listener (keep it off the public network)...
+# metrics_listen_addr = '127.0.0.1:9090'
+# ...and/or behind HTTP basic auth (on the main server when metrics_listen_addr isn't set)
+# metrics_username = 'prometheus'
+# metrics_password = '${METRICS_PASSWORD}'
+# Access log: one JSON record per request. 5xx responses and slow requests are always logged; the rest can be trimmed
+access_log_skip_paths = ['/', '/ping', '/healthz', '/readyz']  # Exact paths left out (load balancers abuse them)
+# access_log_skip_regexes = ['^/public/']  # Paths matching any of these are left out too
+access_log_sample_rate = 1.0     # Fraction of 2xx responses logged (0-1, defaults to 1); 3xx/4xx are always logged
+access_log_slow_threshold = 1000 # Milliseconds; slower requests are logged as warnings
 
 # Session/Cookie Configuration
 secure_cookie_max_age = 0 # In seconds, e.g. 86400*7=604800; 0 means cookie persists for this session only
@@ -216,6 +612,67 @@ secure_cookie_max_age = 0 # In seconds, e.g. 86400*7=604800; 0 means cookie pers
 secure_cookie_signing_key = '%s'
 secure_cookie_encryption_key = '%s'
 regenerate_secure_keys = false # Set to true and execute the binary to generate new keys and then exit
+# To rotate keys without logging everyone out, run '<binary> keys rotate' and use the list it prints instead:
+# secure_cookie_keys = [
+#   { signing_key = '${NEW_SIGNING_KEY}', encryption_key = '${NEW_ENCRYPTION_KEY}' }, # Encodes new cookies
+#   { signing_key = '${OLD_SIGNING_KEY}', encryption_key = '${OLD_ENCRYPTION_KEY}' }, # Still decodes old ones
+# ]
+session_store = 'cookie'  # 'cookie' (all data in the cookie, ~4KB max), 'filesystem' or 'database' (cookie holds only an ID)
+# session_dir = './sessions'  # For session_store = 'filesystem'. Can also use: '${SESSION_DIR}'
+session_lifetime = 86400  # Seconds an idle server-side session is kept when secure_cookie_max_age is 0
+session_reap_interval = 600 # Seconds between sweeps deleting expired server-side sessions
+session_same_site = 'lax'  # SameSite attribute of the session cookie: 'lax', 'strict' or 'none' (requires TLS)
+
+# Database Configuration
+db_conn_str = './app.db'  # SQLite database file. Can also use: '${DB_CONN_STR}'
+
+# Mail Configuration (password reset and email verification links)
+# base_url = 'https://app.example.com'  # Public URL used in emailed links. Defaults to http(s)://localhost<host_port>
+mailer = 'outbox'         # 'outbox' writes emails to outbox_dir (and the log) instead of sending them; 'smtp' delivers them
+mail_from = 'My App <noreply@example.com>'
+# outbox_dir = './outbox'
+# smtp_host = 'smtp.example.com'       # Can also use: '${SMTP_HOST}'
+# smtp_port = 587                      # STARTTLS is used when the server supports it
+# smtp_username = '${SMTP_USERNAME}'
+# smtp_password = '${SMTP_PASSWORD}'
+
+# Authentication Configuration
+totp_issuer = 'My App'    # Name shown in users' authenticator apps for two-factor authentication
+# Passkeys (WebAuthn): the RP ID is your site's domain; origins are the exact URLs users load the site from
+webauthn_rp_id = 'localhost'
+webauthn_rp_display_name = 'My App'
+# webauthn_rp_origins = ['https://app.example.com']  # Defaults to http(s)://<webauthn_rp_id><host_port>
+# Brute-force protection: failed logins are counted per username and per client IP
+login_throttle_free_attempts = 3 # Failures per username before each further attempt is delayed (1s, 2s, 4s, ...)
+login_throttle_max_delay = 60    # Cap, in seconds, on that delay
+login_lockout_threshold = 10     # Failures per username that lock the account; per IP, failures before delays start
+login_lockout_duration = 900     # Seconds an account stays locked (admins can unlock sooner); failures older than this are forgotten
+# Roles are named sets of permissions (books.create, books.update, books.delete, users.manage, users.impersonate,
+# audit.view, logs.manage; 'books.*' and '*' are wildcards). 'admin' (everything) and 'user' (books.create) are
+# built in and follow the account's role bits; other roles are assigned per user on the admin user page.
+# roles = { editor = ['books.*'], support = ['users.manage', 'audit.view'] }
+
+# Security Headers (sent on every response)
+# csp = "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'nonce-{nonce}'"  # Defaults to a same-origin policy like this one; {nonce} is per request
+csp_report_only = false   # Report violations to /csp-report (logged) without blocking anything; handy while tightening the policy
+frame_ancestors = "'none'"  # Who may frame the site: "'none'", "'self'" or a list of origins
+referrer_policy = 'strict-origin-when-cross-origin'
+permissions_policy = 'camera=(), microphone=(), geolocation=(), payment=(), usb=()'
+hsts_max_age = 31536000   # Strict-Transport-Security max-age in seconds; only sent when TLS is on
+
+# Tracing (OpenTelemetry; W3C traceparent headers are honoured whatever the exporter)
+tracing_exporter = 'none'  # 'none', 'stdout' (JSON spans to tracing_file, or STDOUT) or 'otlp' (OTLP/HTTP to tracing_endpoint)
+# tracing_file = './traces.json'  # Can also use: '${TRACING_FILE}'
+# tracing_endpoint = 'http://localhost:4318'  # OTLP/HTTP collector; Can also use: '${OTEL_COLLECTOR_URL}'
+tracing_sample_ratio = 1.0  # Fraction of new traces recorded (0-1, defaults to 1); requests continuing a caller's trace follow its decision
+tracing_service_name = 'go-gin-starter'
+
+# Error reporting to Sentry, or anything speaking its protocol (GlitchTip, Bugsink); off until a DSN is set
+# error_reporting_dsn = '${SENTRY_DSN}'  # https://<key>@<host>/<project_id>
+# error_reporting_environment = 'production'  # Defaults to $ENVIRONMENT, or 'development'
+# error_reporting_release = ''  # Defaults to the git commit the binary was built from
+error_reporting_queue_size = 100  # Events waiting to be sent; more are dropped
+error_reporting_dedupe_window = 60  # Seconds during which repeats of an error (same fingerprint) aren't sent again
 `, signingKey, encryptionKey)
 
 	err := os.WriteFile(configPath, []byte(configContent), 0644)
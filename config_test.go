@@ -1,8 +1,13 @@
 package main
 
 import (
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+
+	gsessions "github.com/gorilla/sessions"
+	"github.com/spf13/viper"
 )
 
 func TestParseEnvVariables(t *testing.T) {
@@ -112,3 +117,72 @@ func TestParseEnvVariables(t *testing.T) {
 		}
 	})
 }
+
+// parseTestConfig unmarshals a TOML snippet the same way NewAppConfigFromFile does
+func parseTestConfig(t *testing.T, toml string) *AppConfig {
+	v := viper.New()
+	v.SetConfigType("toml")
+	if err := v.ReadConfig(strings.NewReader(toml)); err != nil {
+		t.Fatalf("viper.ReadConfig(): %v", err)
+	}
+	ac := AppConfig{}
+	if err := v.Unmarshal(&ac); err != nil {
+		t.Fatalf("viper.Unmarshal(): %v", err)
+	}
+	ac.ParseEnvVariables()
+	ac.ParseSecureKeys()
+	return &ac
+}
+
+func TestSecureCookieKeyRotation(t *testing.T) {
+	signingKey, encryptionKey := newSecureKeyPairHex()
+	legacy := parseTestConfig(t, "secure_cookie_signing_key = '"+signingKey+"'\nsecure_cookie_encryption_key = '"+encryptionKey+"'\n")
+	if pairs := legacy.SecureCookieKeyPairs(); len(pairs) != 2 {
+		t.Fatalf("Expected the legacy keys to form a single pair, got %d keys", len(pairs))
+	}
+
+	// Rotating the legacy config yields a list with the new pair first and the old pair second
+	out := rotateSecureKeys(legacy)
+	start, end := strings.Index(out, "secure_cookie_keys"), strings.LastIndex(out, "]")
+	if start < 0 || end < start {
+		t.Fatalf("Expected a secure_cookie_keys setting in output, got:\n%s", out)
+	}
+	rotated := parseTestConfig(t, out[start:end+1])
+	if len(rotated.SecureCookieKeys) != 2 {
+		t.Fatalf("Expected 2 key pairs after rotation, got %d", len(rotated.SecureCookieKeys))
+	}
+	if rotated.SecureCookieKeys[1].SigningKeyHex != signingKey || rotated.SecureCookieKeys[1].EncryptionKeyHex != encryptionKey {
+		t.Error("Expected the previous pair to be kept after the new one")
+	}
+	if string(rotated.SecureCookieSigningKey) != string(rotated.SecureCookieKeys[0].SigningKey) {
+		t.Error("Expected the new pair to become the primary key")
+	}
+
+	// A cookie issued under the old key still decodes after rotation; new cookies use the new key
+	oldStore := gsessions.NewCookieStore(legacy.SecureCookieKeyPairs()...)
+	newStore := gsessions.NewCookieStore(rotated.SecureCookieKeyPairs()...)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	session, _ := oldStore.New(req, "s")
+	session.Values["user"] = "alice"
+	w := httptest.NewRecorder()
+	if err := oldStore.Save(req, w, session); err != nil {
+		t.Fatalf("oldStore.Save(): %v", err)
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(w.Result().Cookies()[0])
+	session, err := newStore.New(req, "s")
+	if err != nil || session.Values["user"] != "alice" {
+		t.Errorf("Expected an old cookie to decode after rotation, got %v (%v)", session.Values, err)
+	}
+
+	w = httptest.NewRecorder()
+	if err := newStore.Save(req, w, session); err != nil {
+		t.Fatalf("newStore.Save(): %v", err)
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(w.Result().Cookies()[0])
+	if _, err := oldStore.New(req, "s"); err == nil {
+		t.Error("Expected a new cookie to be encoded with the new key")
+	}
+}
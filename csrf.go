@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// CSRF protection uses a synchronizer token: a random value kept in the session that every unsafe request
+// (POST/PUT/PATCH/DELETE) must echo back, either as the csrf_token form field (see the csrf_field template func) or
+// in the X-CSRF-Token header (for fetch/XHR; pages expose the token in a <meta name="csrf-token"> tag). Requests
+// authenticated by a bearer token carry no ambient credentials and are exempt, as are the browser's CSP violation
+// reports (which can't carry a token and change nothing).
+const (
+	sessionKeyCSRF = "csrf_token"
+	csrfFormField  = "csrf_token"
+	csrfHeader     = "X-CSRF-Token"
+)
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("rand.Read(): %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// sessionCSRFToken returns the session's CSRF token ("" before mwCSRF has issued one)
+func sessionCSRFToken(session sessions.Session) string {
+	token, _ := session.Get(sessionKeyCSRF).(string)
+	return token
+}
+
+// csrfField renders the hidden form input carrying su's CSRF token (the csrf_field template func)
+func csrfField(su *SessionUser) template.HTML {
+	token := ""
+	if su != nil {
+		token = su.CSRFToken
+	}
+	return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, csrfFormField, template.HTMLEscapeString(token)))
+}
+
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// mwCSRF issues each session a CSRF token and rejects unsafe requests that don't present it. Register after the
+// sessions and DSO middleware and before any route.
+func mwCSRF() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := dso.Logger
+
+		// A cross-site form can't set Authorization, so bearer-token requests can't be forged this way. Check before
+		// touching the session so API clients don't get (and store) a session per call.
+		if scheme, _, _ := strings.Cut(c.GetHeader("Authorization"), " "); strings.EqualFold(scheme, "Bearer") {
+			c.Next()
+			return
+		}
+
+		session := sessions.Default(c)
+		token := sessionCSRFToken(session)
+		if token == "" {
+			var err error
+			if token, err = newCSRFToken(); err != nil {
+				logger.Error("failed to generate csrf token", "error", err)
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			session.Set(sessionKeyCSRF, token)
+			if err := session.Save(); err != nil {
+				logger.Error("failed to save csrf token", "error", err)
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if csrfSafeMethod(c.Request.Method) {
+			// Let scripts pick the token up from any page or API response, too
+			c.Header(csrfHeader, token)
+			c.Next()
+			return
+		}
+		if c.Request.URL.Path == cspReportPath {
+			c.Next()
+			return
+		}
+		submitted := c.GetHeader(csrfHeader)
+		if submitted == "" {
+			submitted = c.PostForm(csrfFormField)
+		}
+		if subtle.ConstantTimeCompare([]byte(submitted), []byte(token)) == 1 {
+			c.Next()
+			return
+		}
+
+		logSecurityEvent(logger, "csrf_rejected", "path", c.Request.URL.Path, "method", c.Request.Method,
+			"ip", c.ClientIP(), "missing", submitted == "")
+		if strings.HasPrefix(c.Request.URL.Path, "/api/") {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid or missing csrf token"})
+			return
+		}
+		addFlash("Your form expired, please go back, reload the page and try again", session)
+		renderForbidden(c)
+		c.Abort()
+	}
+}
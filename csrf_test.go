@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	router, dso := setupTestRouterWithDSO()
+	u, err := createUser(dso.DB, "carol", "correct horse", SESSUSR__USER)
+	if err != nil {
+		t.Fatalf("createUser(): %v", err)
+	}
+	tc := newTestClient(t, router)
+	tc.login("carol", "correct horse")
+	token := tc.csrfToken()
+	book := url.Values{"title": {"Forged"}, "author": {"Mallory"}, "isbn": {"1"}}
+
+	t.Run("FormsCarryTheToken", func(t *testing.T) {
+		body := tc.get("/books/new").Body.String()
+		if !strings.Contains(body, `name="csrf_token" value="`+token+`"`) {
+			t.Error("Expected the form to include the session's CSRF token")
+		}
+		if !strings.Contains(body, `<meta name="csrf-token" content="`+token+`">`) {
+			t.Error("Expected the page to expose the CSRF token for scripts")
+		}
+	})
+
+	t.Run("RejectsMissingOrWrongToken", func(t *testing.T) {
+		for _, submitted := range []string{"", "not-the-token"} {
+			form := url.Values{"title": book["title"], "author": book["author"], "isbn": book["isbn"]}
+			form.Set(csrfFormField, submitted)
+			if w := tc.postForm("/books", form); w.Code != http.StatusForbidden {
+				t.Errorf("Expected token %q to be rejected, got %d", submitted, w.Code)
+			}
+		}
+		if books, _ := listBooks(dso.DB); len(books) != 3 {
+			t.Errorf("Expected no book to be created, got %d books", len(books))
+		}
+	})
+
+	t.Run("AcceptsHeader", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/books", strings.NewReader(book.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(csrfHeader, token)
+		if w := tc.do(req); w.Code != http.StatusSeeOther {
+			t.Errorf("Expected the header token to be accepted, got %d", w.Code)
+		}
+	})
+
+	t.Run("API", func(t *testing.T) {
+		body := []byte(`{"title":"Via API","author":"Carol","isbn":"2"}`)
+
+		// Cookie-authenticated API calls need the header...
+		req, _ := http.NewRequest("POST", "/api/books", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if w := tc.do(req); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "csrf") {
+			t.Errorf("Expected a JSON 403 without the header, got %d %s", w.Code, w.Body.String())
+		}
+		if w := apiRequest(t, tc, "POST", "/api/books", "", body); w.Code != http.StatusCreated {
+			t.Errorf("Expected 201 with the header, got %d", w.Code)
+		}
+
+		// ...bearer-token calls don't (a cross-site form can't send one)
+		plaintext, _, err := createAPIToken(dso.DB, u, "script", []string{APISCOPE__WRITE}, 0)
+		if err != nil {
+			t.Fatalf("createAPIToken(): %v", err)
+		}
+		if w := apiRequest(t, newTestClient(t, router), "POST", "/api/books", plaintext, body); w.Code != http.StatusCreated {
+			t.Errorf("Expected bearer requests to be exempt, got %d", w.Code)
+		}
+
+		// ...and aren't given a session (and a stored session record) per call
+		for _, method := range []string{"GET", "POST"} {
+			var reqBody []byte
+			if method == "POST" {
+				reqBody = body
+			}
+			w := apiRequest(t, newTestClient(t, router), method, "/api/books", plaintext, reqBody)
+			if cookie := w.Header().Get("Set-Cookie"); cookie != "" || w.Header().Get(csrfHeader) != "" {
+				t.Errorf("Expected %s with a bearer token to get no session or CSRF token, got Set-Cookie %q", method, cookie)
+			}
+		}
+	})
+
+	t.Run("NewTokenAfterLogout", func(t *testing.T) {
+		tc.get("/logout")
+		if tc.csrfToken() == token {
+			t.Error("Expected logging out to discard the CSRF token")
+		}
+	})
+}
+
+func TestCookieSameSite(t *testing.T) {
+	for _, tc := range []struct {
+		value       string
+		sslDisabled bool
+		want        http.SameSite
+		wantErr     bool
+	}{
+		{"", true, http.SameSiteLaxMode, false},
+		{"Strict", true, http.SameSiteStrictMode, false},
+		{"none", false, http.SameSiteNoneMode, false},
+		{"none", true, 0, true},
+		{"sometimes", false, 0, true},
+	} {
+		got, err := cookieSameSite(&AppConfig{SessionSameSite: tc.value, SSLDisabled: tc.sslDisabled})
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("cookieSameSite(%q) = %v, %v", tc.value, got, err)
+		}
+	}
+
+	w := newTestClient(t, setupTestRouter()).get("/ping")
+	if cookie := w.Header().Get("Set-Cookie"); !strings.Contains(cookie, "SameSite=Lax") {
+		t.Errorf("Expected the session cookie to default to SameSite=Lax, got %q", cookie)
+	}
+}
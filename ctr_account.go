@@ -0,0 +1,586 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Session key holding a not-yet-confirmed TOTP secret during enrollment
+const sessionKeyTOTPEnrollSecret = "totp_enroll_secret"
+
+func route_Account_Index() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_Index()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+		flashes := getFlashes(session)
+
+		u, err := findUserByID(dso.DB, user.UserID)
+		if err != nil {
+			logger.Error("account not found", "user_id", user.UserID, "error", err)
+			addFlash("Account not found", session)
+			c.Redirect(http.StatusSeeOther, "/")
+			return
+		}
+
+		remaining, err := countUnusedRecoveryCodes(dso.DB, u.ID)
+		if err != nil {
+			logger.Error("failed to count recovery codes", "user_id", u.ID, "error", err)
+		}
+
+		c.HTML(http.StatusOK, "account/index", struct {
+			AppConfig              *AppConfig
+			SessionUser            *SessionUser
+			Flash                  []string
+			User                   *User
+			RecoveryCodesRemaining int64
+		}{
+			dso.AppConfig,
+			&user,
+			flashes,
+			u,
+			remaining,
+		})
+	}
+}
+
+func route_Account_TOTP_Setup() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_TOTP_Setup()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+		flashes := getFlashes(session)
+
+		// Reuse the pending secret across reloads so an already-scanned QR code stays valid
+		secret, _ := session.Get(sessionKeyTOTPEnrollSecret).(string)
+		if secret == "" {
+			secret = newTOTPSecret()
+			session.Set(sessionKeyTOTPEnrollSecret, secret)
+			if err := session.Save(); err != nil {
+				panic(err.Error())
+			}
+		}
+
+		qr, err := totpQRCode(totpURL(dso.AppConfig.TOTPIssuer, user.Username, secret))
+		if err != nil {
+			logger.Error("failed to render 2fa qr code", "error", err)
+			addFlash("Unable to start two-factor enrollment", session)
+			c.Redirect(http.StatusSeeOther, "/account")
+			return
+		}
+
+		c.HTML(http.StatusOK, "account/totp_setup", struct {
+			AppConfig   *AppConfig
+			SessionUser *SessionUser
+			Flash       []string
+			Secret      string
+			QRCode      template.URL
+		}{
+			dso.AppConfig,
+			&user,
+			flashes,
+			secret,
+			qr,
+		})
+	}
+}
+
+func route_Account_TOTP_Setup_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_TOTP_Setup_POST()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		secret, _ := session.Get(sessionKeyTOTPEnrollSecret).(string)
+		if secret == "" {
+			addFlash("Your enrollment session expired, please try again", session)
+			c.Redirect(http.StatusSeeOther, "/account/2fa/setup")
+			return
+		}
+
+		step, ok := totpValidate(secret, c.PostForm("code"), time.Now(), 0)
+		if !ok {
+			addFlash("That code didn't match, please try again", session)
+			c.Redirect(http.StatusSeeOther, "/account/2fa/setup")
+			return
+		}
+
+		codes, err := enableUserTOTP(dso.DB, user.UserID, secret, step)
+		if err != nil {
+			logger.Error("failed to enable 2fa", "user_id", user.UserID, "error", err)
+			addFlash("Unable to enable two-factor authentication", session)
+			c.Redirect(http.StatusSeeOther, "/account")
+			return
+		}
+		session.Delete(sessionKeyTOTPEnrollSecret)
+		addFlash("Two-factor authentication is now enabled", session)
+		logger.Info("2fa enabled", "username", user.Username)
+
+		renderRecoveryCodes(c, &user, codes)
+	}
+}
+
+func route_Account_TOTP_Disable_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_TOTP_Disable_POST()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		u, err := findUserByID(dso.DB, user.UserID)
+		if err != nil || !u.CheckPassword(c.PostForm("password")) {
+			addFlash("Incorrect password", session)
+			c.Redirect(http.StatusSeeOther, "/account")
+			return
+		}
+
+		if err := resetUserTOTP(dso.DB, u.ID); err != nil {
+			logger.Error("failed to disable 2fa", "user_id", u.ID, "error", err)
+			addFlash("Unable to disable two-factor authentication", session)
+			c.Redirect(http.StatusSeeOther, "/account")
+			return
+		}
+
+		logger.Info("2fa disabled", "username", u.Username)
+		addFlash("Two-factor authentication has been disabled", session)
+		c.Redirect(http.StatusSeeOther, "/account")
+	}
+}
+
+func route_Account_TOTP_RecoveryCodes_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_TOTP_RecoveryCodes_POST()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		u, err := findUserByID(dso.DB, user.UserID)
+		if err != nil || !u.CheckPassword(c.PostForm("password")) {
+			addFlash("Incorrect password", session)
+			c.Redirect(http.StatusSeeOther, "/account")
+			return
+		}
+		if !u.TOTPEnabled {
+			addFlash("Two-factor authentication is not enabled", session)
+			c.Redirect(http.StatusSeeOther, "/account")
+			return
+		}
+
+		codes, err := replaceRecoveryCodes(dso.DB, u.ID)
+		if err != nil {
+			logger.Error("failed to regenerate recovery codes", "user_id", u.ID, "error", err)
+			addFlash("Unable to generate new recovery codes", session)
+			c.Redirect(http.StatusSeeOther, "/account")
+			return
+		}
+
+		logger.Info("recovery codes regenerated", "username", u.Username)
+		renderRecoveryCodes(c, &user, codes)
+	}
+}
+
+// renderRecoveryCodes shows freshly generated recovery codes. This is the only time they are ever visible.
+func renderRecoveryCodes(c *gin.Context, user *SessionUser, codes []string) {
+	dso := c.MustGet("dso").(*DataSourceOrchestration)
+	session := sessions.Default(c)
+	flashes := getFlashes(session)
+
+	c.HTML(http.StatusOK, "account/recovery_codes", struct {
+		AppConfig     *AppConfig
+		SessionUser   *SessionUser
+		Flash         []string
+		RecoveryCodes []string
+	}{
+		dso.AppConfig,
+		user,
+		flashes,
+		codes,
+	})
+}
+
+func route_Account_Passkeys_Index() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_Passkeys_Index()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+		flashes := getFlashes(session)
+
+		passkeys, err := listWebAuthnCredentials(dso.DB, user.UserID)
+		if err != nil {
+			logger.Error("failed to list passkeys", "user_id", user.UserID, "error", err)
+			addFlash("Unable to load your passkeys", session)
+			c.Redirect(http.StatusSeeOther, "/account")
+			return
+		}
+
+		c.HTML(http.StatusOK, "account/passkeys", struct {
+			AppConfig   *AppConfig
+			SessionUser *SessionUser
+			Flash       []string
+			Passkeys    []WebAuthnCredential
+		}{
+			dso.AppConfig,
+			&user,
+			flashes,
+			passkeys,
+		})
+	}
+}
+
+func route_Account_Passkeys_Begin_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_Passkeys_Begin_POST()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		u, err := findUserByID(dso.DB, user.UserID)
+		if err != nil {
+			logger.Error("account not found", "user_id", user.UserID, "error", err)
+			c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+			return
+		}
+		wu, err := loadWebAuthnUser(dso.DB, u)
+		if err != nil {
+			logger.Error("failed to load passkeys", "user_id", u.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to start passkey registration"})
+			return
+		}
+
+		// Exclude already-registered authenticators so the same device isn't registered twice
+		creation, data, err := dso.WebAuthn.BeginRegistration(wu,
+			webauthn.WithExclusions(webauthn.Credentials(wu.credentials).CredentialDescriptors()))
+		if err != nil {
+			logger.Error("failed to begin passkey registration", "user_id", u.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to start passkey registration"})
+			return
+		}
+		if err := saveWebAuthnSession(session, sessionKeyWebAuthnRegistration, data); err != nil {
+			logger.Error("failed to save passkey registration session", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to start passkey registration"})
+			return
+		}
+
+		c.JSON(http.StatusOK, creation)
+	}
+}
+
+func route_Account_Passkeys_Finish_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_Passkeys_Finish_POST()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		data, err := popWebAuthnSession(session, sessionKeyWebAuthnRegistration)
+		if err != nil {
+			logger.Info("passkey registration without a pending challenge", "error", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Passkey registration expired, please try again"})
+			return
+		}
+
+		u, err := findUserByID(dso.DB, user.UserID)
+		if err != nil {
+			logger.Error("account not found", "user_id", user.UserID, "error", err)
+			c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+			return
+		}
+		wu, err := loadWebAuthnUser(dso.DB, u)
+		if err != nil {
+			logger.Error("failed to load passkeys", "user_id", u.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to register passkey"})
+			return
+		}
+
+		cred, err := dso.WebAuthn.FinishRegistration(wu, *data, c.Request)
+		if err != nil {
+			logger.Info("passkey registration failed", "user_id", u.ID, "error", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Passkey registration failed"})
+			return
+		}
+
+		name := strings.TrimSpace(c.Query("name"))
+		if name == "" {
+			name = "Passkey"
+		}
+		if err := saveWebAuthnCredential(dso.DB, u.ID, name, cred); err != nil {
+			logger.Error("failed to save passkey", "user_id", u.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to register passkey"})
+			return
+		}
+
+		logger.Info("passkey registered", "username", u.Username, "name", name)
+		addFlash(fmt.Sprintf("Passkey '%s' added", name), session)
+		c.JSON(http.StatusOK, gin.H{"redirect": "/account/passkeys"})
+	}
+}
+
+func route_Account_Passkeys_Delete_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_Passkeys_Delete_POST()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			logger.Error("invalid passkey id", "id", c.Param("id"))
+			addFlash("Passkey not found", session)
+			c.Redirect(http.StatusSeeOther, "/account/passkeys")
+			return
+		}
+
+		// Scoped to the current user, so one user can never delete another's passkey
+		deleted, err := deleteWebAuthnCredential(dso.DB, user.UserID, uint(id))
+		if err != nil || !deleted {
+			logger.Error("failed to delete passkey", "user_id", user.UserID, "id", id, "error", err)
+			addFlash("Passkey not found", session)
+			c.Redirect(http.StatusSeeOther, "/account/passkeys")
+			return
+		}
+
+		logger.Info("passkey removed", "username", user.Username, "id", id)
+		addFlash("Passkey removed", session)
+		c.Redirect(http.StatusSeeOther, "/account/passkeys")
+	}
+}
+
+// Expiry choices offered when creating a personal access token (days; 0 = never expires)
+var apiTokenExpiryDays = []int{7, 30, 90, 365, 0}
+
+func route_Account_Tokens_Index() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_Tokens_Index()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+		flashes := getFlashes(session)
+
+		tokens, err := listAPITokens(dso.DB, user.UserID)
+		if err != nil {
+			logger.Error("failed to list api tokens", "user_id", user.UserID, "error", err)
+			addFlash("Unable to load your access tokens", session)
+			c.Redirect(http.StatusSeeOther, "/account")
+			return
+		}
+
+		renderAPITokens(c, &user, flashes, tokens, "")
+	}
+}
+
+func route_Account_Tokens_Create_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_Tokens_Create_POST()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		u, err := findUserByID(dso.DB, user.UserID)
+		if err != nil {
+			logger.Error("account not found", "user_id", user.UserID, "error", err)
+			addFlash("Account not found", session)
+			c.Redirect(http.StatusSeeOther, "/account/tokens")
+			return
+		}
+
+		days, err := strconv.Atoi(c.PostForm("expires_in_days"))
+		if err != nil || days < 0 {
+			addFlash("Invalid expiry", session)
+			c.Redirect(http.StatusSeeOther, "/account/tokens")
+			return
+		}
+
+		plaintext, t, err := createAPIToken(dso.DB, u, c.PostForm("name"), c.PostFormArray("scopes"),
+			time.Duration(days)*24*time.Hour)
+		if err != nil {
+			logger.Info("api token not created", "user_id", u.ID, "error", err)
+			addFlash(fmt.Sprintf("Unable to create token: %s", err), session)
+			c.Redirect(http.StatusSeeOther, "/account/tokens")
+			return
+		}
+		logger.Info("api token created", "username", u.Username, "token_id", t.ID, "scopes", t.Scopes)
+
+		tokens, err := listAPITokens(dso.DB, u.ID)
+		if err != nil {
+			logger.Error("failed to list api tokens", "user_id", u.ID, "error", err)
+		}
+
+		// Rendered directly (not redirected) so the plaintext never touches the session cookie
+		addFlash("Token created. Copy it now, it won't be shown again.", session)
+		renderAPITokens(c, &user, getFlashes(session), tokens, plaintext)
+	}
+}
+
+func route_Account_Tokens_Revoke_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_Tokens_Revoke_POST()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			logger.Error("invalid api token id", "id", c.Param("id"))
+			addFlash("Token not found", session)
+			c.Redirect(http.StatusSeeOther, "/account/tokens")
+			return
+		}
+
+		// Scoped to the current user, so one user can never revoke another's token
+		revoked, err := revokeAPIToken(dso.DB, user.UserID, uint(id))
+		if err != nil || !revoked {
+			logger.Error("failed to revoke api token", "user_id", user.UserID, "id", id, "error", err)
+			addFlash("Token not found", session)
+			c.Redirect(http.StatusSeeOther, "/account/tokens")
+			return
+		}
+
+		logger.Info("api token revoked", "username", user.Username, "token_id", id)
+		addFlash("Token revoked", session)
+		c.Redirect(http.StatusSeeOther, "/account/tokens")
+	}
+}
+
+func renderAPITokens(c *gin.Context, user *SessionUser, flashes []string, tokens []APIToken, newToken string) {
+	dso := c.MustGet("dso").(*DataSourceOrchestration)
+
+	c.HTML(http.StatusOK, "account/tokens", struct {
+		AppConfig   *AppConfig
+		SessionUser *SessionUser
+		Flash       []string
+		Tokens      []APIToken
+		NewToken    string
+		Scopes      []string
+		ExpiryDays  []int
+	}{
+		dso.AppConfig,
+		user,
+		flashes,
+		tokens,
+		newToken,
+		apiScopes,
+		apiTokenExpiryDays,
+	})
+}
+
+func route_Account_Sessions_Index() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_Sessions_Index()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+		flashes := getFlashes(session)
+
+		userSessions, err := listUserSessions(dso.DB, user.UserID)
+		if err != nil {
+			logger.Error("failed to list sessions", "user_id", user.UserID, "error", err)
+			addFlash("Unable to load your sessions", session)
+			c.Redirect(http.StatusSeeOther, "/account")
+			return
+		}
+
+		c.HTML(http.StatusOK, "account/sessions", struct {
+			AppConfig   *AppConfig
+			SessionUser *SessionUser
+			Flash       []string
+			Sessions    []UserSession
+		}{
+			dso.AppConfig,
+			&user,
+			flashes,
+			userSessions,
+		})
+	}
+}
+
+func route_Account_Sessions_Revoke_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_Sessions_Revoke_POST()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		// Scoped to the current user, so one user can never revoke another's session
+		id := c.Param("id")
+		revoked, err := revokeUserSession(dso.DB, user.UserID, id)
+		if err != nil || !revoked {
+			logger.Error("failed to revoke session", "user_id", user.UserID, "session_id", id, "error", err)
+			addFlash("Session not found", session)
+			c.Redirect(http.StatusSeeOther, "/account/sessions")
+			return
+		}
+
+		logger.Info("session revoked", "username", user.Username, "session_id", id)
+		if id == user.SessionID {
+			session.Clear()
+			addFlash("You have been logged out", session)
+			c.Redirect(http.StatusSeeOther, "/")
+			return
+		}
+		addFlash("Session signed out", session)
+		c.Redirect(http.StatusSeeOther, "/account/sessions")
+	}
+}
+
+func route_Account_Sessions_RevokeAll_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_Sessions_RevokeAll_POST()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		if err := revokeAllUserSessions(dso.DB, user.UserID); err != nil {
+			logger.Error("failed to sign out everywhere", "user_id", user.UserID, "error", err)
+			addFlash("Unable to sign out your other sessions", session)
+			c.Redirect(http.StatusSeeOther, "/account/sessions")
+			return
+		}
+
+		logger.Info("signed out everywhere", "username", user.Username)
+		session.Clear()
+		addFlash("You have been signed out everywhere", session)
+		c.Redirect(http.StatusSeeOther, "/login")
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+const adminUsersPageSize = 200
+
+func route_Admin_Users_Index() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Admin_Users_Index()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+		flashes := getFlashes(session)
+
+		query := c.Query("q")
+		users, err := searchUsers(dso.DB, query, adminUsersPageSize)
+		if err != nil {
+			logger.Error("failed to list users", "error", err)
+			flashes = append(flashes, "Unable to load users")
+		}
+
+		c.HTML(http.StatusOK, "admin/users_index", struct {
+			AppConfig   *AppConfig
+			SessionUser *SessionUser
+			Flash       []string
+			Users       []User
+			Query       string
+			Limit       int
+		}{
+			dso.AppConfig,
+			&user,
+			flashes,
+			users,
+			query,
+			adminUsersPageSize,
+		})
+	}
+}
+
+func route_Admin_Users_New() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Admin_Users_New()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+		flashes := getFlashes(session)
+
+		c.HTML(http.StatusOK, "admin/users_new", struct {
+			AppConfig   *AppConfig
+			SessionUser *SessionUser
+			Flash       []string
+			Roles       []RoleBit
+			NamedRoles  []string
+			DefaultRole uint64
+		}{
+			dso.AppConfig,
+			&user,
+			flashes,
+			roleBits,
+			dso.AppConfig.namedRoles(),
+			SESSUSR__USER,
+		})
+	}
+}
+
+func route_Admin_Users_Create_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Admin_Users_Create_POST()")
+
+		session := sessions.Default(c)
+
+		email := strings.TrimSpace(c.PostForm("email"))
+		if err := validateEmail(email); err != nil {
+			addFlash(fmt.Sprintf("Unable to create user: %s", err), session)
+			c.Redirect(http.StatusSeeOther, "/admin/users/new")
+			return
+		}
+		if c.PostForm("password") != c.PostForm("password_confirm") {
+			addFlash("Unable to create user: passwords do not match", session)
+			c.Redirect(http.StatusSeeOther, "/admin/users/new")
+			return
+		}
+		role := parseRoleBits(c.PostFormArray("role"))
+		named := dso.AppConfig.parseNamedRoles(c.PostFormArray("named_role"))
+
+		u, err := createUser(dso.DB, c.PostForm("username"), c.PostForm("password"), role)
+		if err != nil {
+			logger.Info("admin user creation rejected", "username", c.PostForm("username"), "error", err)
+			addFlash(fmt.Sprintf("Unable to create user: %s", err), session)
+			c.Redirect(http.StatusSeeOther, "/admin/users/new")
+			return
+		}
+		if err := updateUserProfile(dso.DB, u, c.PostForm("first_name"), c.PostForm("last_name"), role, named); err != nil {
+			logger.Error("failed to save new user's profile", "username", u.Username, "error", err)
+		}
+		if err := updateUserEmail(dso.DB, u, email); err != nil {
+			logger.Error("failed to save new user's email", "username", u.Username, "error", err)
+		}
+
+		recordAudit(c, AUDIT__USER_CREATE, u, "roles: "+strings.Join(append(roleNames(role), named...), ", "))
+		addFlash(fmt.Sprintf("User '%s' created", u.Username), session)
+		c.Redirect(http.StatusSeeOther, adminUserPath(u))
+	}
+}
+
+func route_Admin_Users_Show() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Admin_Users_Show()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		u, ok := adminTargetUser(c)
+		if !ok {
+			return
+		}
+		flashes := getFlashes(session)
+
+		lockedUntil, locked, err := userLockedUntil(dso.DB, dso.AppConfig.loginThrottlePolicy(), u.Username, time.Now())
+		if err != nil {
+			logger.Error("failed to check lockout", "user_id", u.ID, "error", err)
+		}
+		userSessions, err := listUserSessions(dso.DB, u.ID)
+		if err != nil {
+			logger.Error("failed to list sessions", "user_id", u.ID, "error", err)
+		}
+		events, err := listAuditEvents(dso.DB, auditFilter{TargetID: u.ID}, 20)
+		if err != nil {
+			logger.Error("failed to list audit events", "user_id", u.ID, "error", err)
+		}
+
+		c.HTML(http.StatusOK, "admin/users_show", struct {
+			AppConfig    *AppConfig
+			SessionUser  *SessionUser
+			Flash        []string
+			User         *User
+			Roles        []RoleBit
+			NamedRoles   []string
+			Locked       bool
+			LockedUntil  time.Time
+			SessionCount int
+			AuditEvents  []AuditEvent
+		}{
+			dso.AppConfig,
+			&user,
+			flashes,
+			u,
+			roleBits,
+			dso.AppConfig.namedRoles(),
+			locked,
+			lockedUntil,
+			len(userSessions),
+			events,
+		})
+	}
+}
+
+func route_Admin_Users_Update_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Admin_Users_Update_POST()")
+
+		session := sessions.Default(c)
+		admin := getUser(session)
+
+		u, ok := adminTargetUser(c)
+		if !ok {
+			return
+		}
+
+		role := parseRoleBits(c.PostFormArray("role"))
+		named := dso.AppConfig.parseNamedRoles(c.PostFormArray("named_role"))
+		// Admins can't lock themselves out; another admin has to do it, so there's always one left
+		if u.ID == admin.UserID && !dso.AppConfig.rolesGrant(append(roleNames(role), named...), PERM__USERS_MANAGE) {
+			addFlash("You can't remove your own access to user management", session)
+			c.Redirect(http.StatusSeeOther, adminUserPath(u))
+			return
+		}
+		if err := updateUserEmail(dso.DB, u, c.PostForm("email")); err != nil {
+			addFlash(fmt.Sprintf("Unable to update user: %s", err), session)
+			c.Redirect(http.StatusSeeOther, adminUserPath(u))
+			return
+		}
+
+		oldRoles := strings.Join(append(roleNames(u.Role), u.RoleList()...), ", ")
+		if err := updateUserProfile(dso.DB, u, c.PostForm("first_name"), c.PostForm("last_name"), role, named); err != nil {
+			logger.Error("failed to update user", "user_id", u.ID, "error", err)
+			addFlash("Unable to update user", session)
+			c.Redirect(http.StatusSeeOther, adminUserPath(u))
+			return
+		}
+
+		detail := ""
+		flash := fmt.Sprintf("User '%s' updated", u.Username)
+		if newRoles := strings.Join(append(roleNames(role), named...), ", "); newRoles != oldRoles {
+			detail = fmt.Sprintf("roles: %s -> %s", oldRoles, newRoles)
+			// Sessions carry the roles they were started with, so end them; the next login picks up the new roles
+			if err := revokeAllUserSessions(dso.DB, u.ID); err != nil {
+				logger.Error("failed to revoke sessions after role change", "username", u.Username, "error", err)
+			}
+			flash = fmt.Sprintf("User '%s' updated; their roles changed, so they have been signed out everywhere", u.Username)
+		}
+		recordAudit(c, AUDIT__USER_UPDATE, u, detail)
+		addFlash(flash, session)
+		c.Redirect(http.StatusSeeOther, adminUserPath(u))
+	}
+}
+
+func route_Admin_Users_Disable_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Admin_Users_Disable_POST()")
+
+		session := sessions.Default(c)
+		admin := getUser(session)
+
+		u, ok := adminTargetUser(c)
+		if !ok {
+			return
+		}
+		if u.ID == admin.UserID {
+			addFlash("You can't disable your own account", session)
+			c.Redirect(http.StatusSeeOther, adminUserPath(u))
+			return
+		}
+
+		if err := setUserDisabled(dso.DB, u, true); err != nil {
+			logger.Error("failed to disable user", "user_id", u.ID, "error", err)
+			addFlash("Unable to disable the account", session)
+			c.Redirect(http.StatusSeeOther, adminUserPath(u))
+			return
+		}
+
+		recordAudit(c, AUDIT__USER_DISABLE, u, "")
+		addFlash(fmt.Sprintf("'%s' has been disabled", u.Username), session)
+		c.Redirect(http.StatusSeeOther, adminUserPath(u))
+	}
+}
+
+func route_Admin_Users_Enable_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Admin_Users_Enable_POST()")
+
+		session := sessions.Default(c)
+
+		u, ok := adminTargetUser(c)
+		if !ok {
+			return
+		}
+
+		if err := setUserDisabled(dso.DB, u, false); err != nil {
+			logger.Error("failed to enable user", "user_id", u.ID, "error", err)
+			addFlash("Unable to enable the account", session)
+			c.Redirect(http.StatusSeeOther, adminUserPath(u))
+			return
+		}
+
+		recordAudit(c, AUDIT__USER_ENABLE, u, "")
+		addFlash(fmt.Sprintf("'%s' has been enabled", u.Username), session)
+		c.Redirect(http.StatusSeeOther, adminUserPath(u))
+	}
+}
+
+func route_Admin_Users_Password_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Admin_Users_Password_POST()")
+
+		session := sessions.Default(c)
+
+		u, ok := adminTargetUser(c)
+		if !ok {
+			return
+		}
+
+		password := c.PostForm("password")
+		if password != c.PostForm("password_confirm") {
+			addFlash("Passwords do not match", session)
+			c.Redirect(http.StatusSeeOther, adminUserPath(u))
+			return
+		}
+		if err := updateUserPassword(dso.DB, u, password); err != nil {
+			logger.Info("admin password reset rejected", "username", u.Username, "error", err)
+			addFlash(fmt.Sprintf("Unable to reset the password: %s", err), session)
+			c.Redirect(http.StatusSeeOther, adminUserPath(u))
+			return
+		}
+
+		// Same as a self-service reset: end existing sessions and lift any lockout
+		if err := revokeAllUserSessions(dso.DB, u.ID); err != nil {
+			logger.Error("failed to revoke sessions after password reset", "username", u.Username, "error", err)
+		}
+		if err := clearLoginFailures(dso.DB, u.Username); err != nil {
+			logger.Error("failed to clear login failures after password reset", "username", u.Username, "error", err)
+		}
+
+		recordAudit(c, AUDIT__USER_PASSWORD, u, "")
+		addFlash(fmt.Sprintf("Password reset for '%s'; they have been signed out everywhere", u.Username), session)
+		c.Redirect(http.StatusSeeOther, adminUserPath(u))
+	}
+}
+
+func route_Admin_Users_TOTP_Reset_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Admin_Users_TOTP_Reset_POST()")
+
+		session := sessions.Default(c)
+		admin := getUser(session)
+
+		u, ok := adminTargetUser(c)
+		if !ok {
+			return
+		}
+
+		if err := resetUserTOTP(dso.DB, u.ID); err != nil {
+			logger.Error("failed to reset 2fa", "user_id", u.ID, "error", err)
+			addFlash("Unable to reset two-factor authentication", session)
+			c.Redirect(http.StatusSeeOther, adminUserPath(u))
+			return
+		}
+
+		logger.Warn("2fa reset by admin", "username", u.Username, "admin", admin.Username)
+		recordAudit(c, AUDIT__USER_TOTP_RESET, u, "")
+		addFlash(fmt.Sprintf("Two-factor authentication reset for '%s'", u.Username), session)
+		c.Redirect(http.StatusSeeOther, adminUserPath(u))
+	}
+}
+
+func route_Admin_Users_Sessions_Revoke_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Admin_Users_Sessions_Revoke_POST()")
+
+		session := sessions.Default(c)
+		admin := getUser(session)
+
+		u, ok := adminTargetUser(c)
+		if !ok {
+			return
+		}
+
+		if err := revokeAllUserSessions(dso.DB, u.ID); err != nil {
+			logger.Error("failed to revoke sessions", "user_id", u.ID, "error", err)
+			addFlash("Unable to sign the user out", session)
+			c.Redirect(http.StatusSeeOther, adminUserPath(u))
+			return
+		}
+
+		logger.Warn("user signed out by admin", "username", u.Username, "admin", admin.Username)
+		recordAudit(c, AUDIT__USER_SESSIONS_KILL, u, "")
+		addFlash(fmt.Sprintf("'%s' has been signed out everywhere", u.Username), session)
+		c.Redirect(http.StatusSeeOther, adminUserPath(u))
+	}
+}
+
+func route_Admin_Users_Unlock_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Admin_Users_Unlock_POST()")
+
+		session := sessions.Default(c)
+		admin := getUser(session)
+
+		u, ok := adminTargetUser(c)
+		if !ok {
+			return
+		}
+
+		if err := clearLoginFailures(dso.DB, u.Username); err != nil {
+			logger.Error("failed to unlock user", "user_id", u.ID, "error", err)
+			addFlash("Unable to unlock the account", session)
+			c.Redirect(http.StatusSeeOther, adminUserPath(u))
+			return
+		}
+
+		logSecurityEvent(logger, "account_unlocked", "username", u.Username, "admin", admin.Username)
+		recordAudit(c, AUDIT__USER_UNLOCK, u, "")
+		addFlash(fmt.Sprintf("'%s' has been unlocked", u.Username), session)
+		c.Redirect(http.StatusSeeOther, adminUserPath(u))
+	}
+}
+
+func route_Admin_Users_Impersonate_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Admin_Users_Impersonate_POST()")
+
+		session := sessions.Default(c)
+		admin := getUser(session)
+
+		u, ok := adminTargetUser(c)
+		if !ok {
+			return
+		}
+		if u.ID == admin.UserID || u.Disabled {
+			addFlash("You can't impersonate that user", session)
+			c.Redirect(http.StatusSeeOther, adminUserPath(u))
+			return
+		}
+
+		// Audit while the admin is still the session user
+		recordAudit(c, AUDIT__IMPERSONATE_START, u, "")
+		logSecurityEvent(logger, "impersonation_started", "username", u.Username, "admin", admin.Username)
+		startImpersonation(&admin, u.SessionUser(), session)
+		addFlash(fmt.Sprintf("You are now viewing the site as '%s'", u.Username), session)
+		c.Redirect(http.StatusSeeOther, "/")
+	}
+}
+
+// route_Impersonation_Stop_POST lives outside the /admin group: the session user is the impersonated one until
+// it returns
+func route_Impersonation_Stop_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Impersonation_Stop_POST()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		if _, ok := stopImpersonation(session); !ok {
+			c.Redirect(http.StatusSeeOther, "/")
+			return
+		}
+
+		target, err := findUserByID(dso.DB, user.UserID)
+		if err != nil {
+			logger.Error("impersonated user not found", "id", user.UserID, "error", err)
+			target = &User{ID: user.UserID, Username: user.Username}
+		}
+		recordAudit(c, AUDIT__IMPERSONATE_STOP, target, "")
+		logSecurityEvent(logger, "impersonation_stopped", "username", user.Username, "admin", user.Impersonator)
+		addFlash(fmt.Sprintf("You are no longer impersonating '%s'", user.Username), session)
+		c.Redirect(http.StatusSeeOther, adminUserPath(target))
+	}
+}
+
+func route_Admin_Audit_Index() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Admin_Audit_Index()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+		flashes := getFlashes(session)
+
+		filter := auditFilter{Action: c.Query("action"), Query: c.Query("q")}
+		events, err := listAuditEvents(dso.DB, filter, 500)
+		if err != nil {
+			logger.Error("failed to list audit events", "error", err)
+			flashes = append(flashes, "Unable to load the audit log")
+		}
+
+		c.HTML(http.StatusOK, "admin/audit", struct {
+			AppConfig   *AppConfig
+			SessionUser *SessionUser
+			Flash       []string
+			AuditEvents []AuditEvent
+			Filter      auditFilter
+		}{
+			dso.AppConfig,
+			&user,
+			flashes,
+			events,
+			filter,
+		})
+	}
+}
+
+func adminUserPath(u *User) string {
+	return fmt.Sprintf("/admin/users/%d", u.ID)
+}
+
+// adminTargetUser loads the user named by the :id route param, or flashes and redirects back to the user list
+func adminTargetUser(c *gin.Context) (*User, bool) {
+	dso := c.MustGet("dso").(*DataSourceOrchestration)
+	logger := loggerFrom(c)
+	session := sessions.Default(c)
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		logger.Error("invalid user id", "id", c.Param("id"))
+		addFlash("User not found", session)
+		c.Redirect(http.StatusSeeOther, "/admin/users")
+		return nil, false
+	}
+	u, err := findUserByID(dso.DB, uint(id))
+	if err != nil {
+		logger.Error("user not found", "id", id, "error", err)
+		addFlash("User not found", session)
+		c.Redirect(http.StatusSeeOther, "/admin/users")
+		return nil, false
+	}
+	return u, true
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAdminUsers(t *testing.T) {
+	// setup creates an admin (logged in) and a regular user
+	setup := func(t *testing.T) (*testClient, *DataSourceOrchestration, *User, *User) {
+		router, dso := setupTestRouterWithDSO()
+		root, err := createUser(dso.DB, "root", "correct horse", SESSUSR__USER|SESSUSR__ADMIN)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		u, err := createUser(dso.DB, "alice", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		admin := newTestClient(t, router)
+		admin.login("root", "correct horse")
+		return admin, dso, root, u
+	}
+	lastAudit := func(t *testing.T, dso *DataSourceOrchestration) AuditEvent {
+		events, err := listAuditEvents(dso.DB, auditFilter{}, 1)
+		if err != nil || len(events) != 1 {
+			t.Fatalf("Expected an audit event, got %d (%v)", len(events), err)
+		}
+		return events[0]
+	}
+
+	t.Run("RequiresAdmin", func(t *testing.T) {
+		admin, _, _, _ := setup(t)
+		tc := newTestClient(t, admin.router)
+		tc.login("alice", "correct horse")
+		if w := tc.get("/admin/users"); w.Code != http.StatusSeeOther {
+			t.Errorf("Expected non-admin to be redirected, got %d", w.Code)
+		}
+		if w := admin.get("/admin/users"); w.Code != http.StatusOK {
+			t.Errorf("Expected admin to see the user list, got %d", w.Code)
+		}
+	})
+
+	t.Run("ListAndSearch", func(t *testing.T) {
+		admin, _, _, _ := setup(t)
+		body := admin.get("/admin/users").Body.String()
+		if !strings.Contains(body, "alice") || !strings.Contains(body, "root") {
+			t.Error("Expected both users to be listed")
+		}
+		body = admin.get("/admin/users?q=ali").Body.String()
+		if !strings.Contains(body, "alice") || strings.Contains(body, ">root<") {
+			t.Error("Expected search to narrow the list to alice")
+		}
+	})
+
+	t.Run("Create", func(t *testing.T) {
+		admin, dso, _, _ := setup(t)
+		w := admin.postForm("/admin/users", url.Values{
+			"username":         {"Bob"},
+			"first_name":       {"Bob"},
+			"email":            {"bob@example.com"},
+			"password":         {"hunter2hunter2"},
+			"password_confirm": {"hunter2hunter2"},
+			"role":             {itoa(SESSUSR__USER), itoa(SESSUSR__ADMIN)},
+		})
+		u, err := findUserByUsername(dso.DB, "bob")
+		if err != nil {
+			t.Fatalf("Expected bob to be created: %v", err)
+		}
+		if loc := w.Header().Get("Location"); loc != adminUserPath(u) {
+			t.Errorf("Expected redirect to the new user's page, got %s", loc)
+		}
+		if u.Role != SESSUSR__USER|SESSUSR__ADMIN || u.FirstName != "Bob" || u.Email != "bob@example.com" {
+			t.Errorf("Unexpected new user %+v", u)
+		}
+		if e := lastAudit(t, dso); e.Action != AUDIT__USER_CREATE || e.Actor != "root" || e.TargetID != u.ID {
+			t.Errorf("Unexpected audit event %+v", e)
+		}
+
+		admin.postForm("/admin/users", url.Values{"username": {"carol"}, "password": {"hunter2hunter2"}, "password_confirm": {"nope"}})
+		if _, err := findUserByUsername(dso.DB, "carol"); err == nil {
+			t.Error("Expected mismatched passwords to be rejected")
+		}
+	})
+
+	t.Run("EditRoles", func(t *testing.T) {
+		admin, dso, root, u := setup(t)
+		if body := admin.get(adminUserPath(u)).Body.String(); !strings.Contains(body, "Never") {
+			t.Error("Expected the user page to show last login")
+		}
+		tc := newTestClient(t, admin.router)
+		tc.login("alice", "correct horse")
+
+		admin.postForm(adminUserPath(u), url.Values{"first_name": {"Alice"}, "role": {itoa(SESSUSR__USER), itoa(SESSUSR__ADMIN), "1024"}})
+		u, _ = findUserByID(dso.DB, u.ID)
+		if u.Role != SESSUSR__USER|SESSUSR__ADMIN || u.FirstName != "Alice" {
+			t.Errorf("Expected alice promoted (unknown bits ignored), got role %d", u.Role)
+		}
+		if e := lastAudit(t, dso); e.Action != AUDIT__USER_UPDATE || !strings.Contains(e.Detail, "admin") {
+			t.Errorf("Unexpected audit event %+v", e)
+		}
+		if w := tc.get("/account"); w.Code == http.StatusOK {
+			t.Error("Expected a role change to end the user's sessions, which carry the old roles")
+		}
+		tc.login("alice", "correct horse")
+		admin.postForm(adminUserPath(u), url.Values{"first_name": {"Alicia"}, "role": {itoa(SESSUSR__USER), itoa(SESSUSR__ADMIN)}})
+		if w := tc.get("/account"); w.Code != http.StatusOK {
+			t.Errorf("Expected an edit that leaves the roles alone to keep sessions, got %d", w.Code)
+		}
+
+		// Admins can't demote themselves
+		admin.postForm(adminUserPath(root), url.Values{"role": {itoa(SESSUSR__USER)}})
+		root, _ = findUserByID(dso.DB, root.ID)
+		if !root.HasRole(SESSUSR__ADMIN) {
+			t.Error("Expected self-demotion to be refused")
+		}
+	})
+
+	t.Run("DisableAndEnable", func(t *testing.T) {
+		admin, dso, root, u := setup(t)
+		tc := newTestClient(t, admin.router)
+		tc.login("alice", "correct horse")
+
+		admin.postForm(adminUserPath(u)+"/disable", url.Values{})
+		if w := tc.get("/account"); w.Code == http.StatusOK {
+			t.Error("Expected disabling to end the user's sessions")
+		}
+		if loc := tc.login("alice", "correct horse"); loc == "/" {
+			t.Error("Expected a disabled user to be unable to log in")
+		}
+		if e := lastAudit(t, dso); e.Action != AUDIT__USER_DISABLE {
+			t.Errorf("Unexpected audit event %+v", e)
+		}
+
+		admin.postForm(adminUserPath(u)+"/enable", url.Values{})
+		if loc := tc.login("alice", "correct horse"); loc != "/" {
+			t.Errorf("Expected an enabled user to log in, redirected to %s", loc)
+		}
+
+		admin.postForm(adminUserPath(root)+"/disable", url.Values{})
+		if root, _ = findUserByID(dso.DB, root.ID); root.Disabled {
+			t.Error("Expected admins to be unable to disable themselves")
+		}
+	})
+
+	t.Run("ResetPassword", func(t *testing.T) {
+		admin, dso, _, u := setup(t)
+		tc := newTestClient(t, admin.router)
+		tc.login("alice", "correct horse")
+
+		admin.postForm(adminUserPath(u)+"/password", url.Values{"password": {"battery staple"}, "password_confirm": {"battery staple"}})
+		if w := tc.get("/account"); w.Code == http.StatusOK {
+			t.Error("Expected a password reset to sign the user out")
+		}
+		if loc := tc.login("alice", "battery staple"); loc != "/" {
+			t.Errorf("Expected the new password to work, redirected to %s", loc)
+		}
+		if e := lastAudit(t, dso); e.Action != AUDIT__USER_PASSWORD || e.Target != "alice" {
+			t.Errorf("Unexpected audit event %+v", e)
+		}
+	})
+
+	t.Run("AuditLog", func(t *testing.T) {
+		admin, _, _, u := setup(t)
+		admin.postForm(adminUserPath(u)+"/sessions/revoke", url.Values{})
+		body := admin.get("/admin/audit?action=" + AUDIT__USER_SESSIONS_KILL).Body.String()
+		if !strings.Contains(body, AUDIT__USER_SESSIONS_KILL) || !strings.Contains(body, "alice") {
+			t.Error("Expected the audit log to show the forced sign-out")
+		}
+		body = admin.get("/admin/audit?action=" + AUDIT__USER_DISABLE).Body.String()
+		if strings.Contains(body, AUDIT__USER_SESSIONS_KILL) {
+			t.Error("Expected the action filter to apply")
+		}
+	})
+}
+
+func TestAdminImpersonation(t *testing.T) {
+	setup := func(t *testing.T) (*testClient, *DataSourceOrchestration, *User, *User) {
+		router, dso := setupTestRouterWithDSO()
+		root, err := createUser(dso.DB, "root", "correct horse", SESSUSR__USER|SESSUSR__ADMIN)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		u, err := createUser(dso.DB, "alice", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		admin := newTestClient(t, router)
+		admin.login("root", "correct horse")
+		return admin, dso, root, u
+	}
+
+	t.Run("StartAndStop", func(t *testing.T) {
+		admin, dso, _, u := setup(t)
+
+		w := admin.postForm(adminUserPath(u)+"/impersonate", url.Values{})
+		if loc := w.Header().Get("Location"); loc != "/" {
+			t.Fatalf("Expected redirect to /, got %s", loc)
+		}
+		body := admin.get("/account").Body.String()
+		if !strings.Contains(body, "impersonationBanner") || !strings.Contains(body, "<strong>alice</strong>") {
+			t.Error("Expected the impersonation banner on every page")
+		}
+
+		w = admin.postForm("/impersonation/stop", url.Values{})
+		if loc := w.Header().Get("Location"); loc != adminUserPath(u) {
+			t.Errorf("Expected redirect back to the user's admin page, got %s", loc)
+		}
+		if w := admin.get("/admin/users"); w.Code != http.StatusOK {
+			t.Errorf("Expected admin access restored, got %d", w.Code)
+		}
+		if strings.Contains(admin.get("/account").Body.String(), "impersonationBanner") {
+			t.Error("Expected the banner to go away")
+		}
+
+		events, _ := listAuditEvents(dso.DB, auditFilter{TargetID: u.ID}, 10)
+		if len(events) != 2 || events[0].Action != AUDIT__IMPERSONATE_STOP || events[1].Action != AUDIT__IMPERSONATE_START {
+			t.Fatalf("Expected start and stop audit events, got %+v", events)
+		}
+		if events[0].Actor != "root" || events[1].Actor != "root" {
+			t.Error("Expected both events to be attributed to the admin")
+		}
+	})
+
+	t.Run("NoEscalation", func(t *testing.T) {
+		admin, dso, _, _ := setup(t)
+		other, err := createUser(dso.DB, "ops", "correct horse", SESSUSR__USER|SESSUSR__ADMIN)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+
+		// Even impersonating another admin doesn't carry admin rights
+		admin.postForm(adminUserPath(other)+"/impersonate", url.Values{})
+		if w := admin.get("/admin/users"); w.Code != http.StatusSeeOther {
+			t.Errorf("Expected admin routes to be blocked while impersonating, got %d", w.Code)
+		}
+		admin.postForm(adminUserPath(other)+"/impersonate", url.Values{})
+		if events, _ := listAuditEvents(dso.DB, auditFilter{Action: AUDIT__IMPERSONATE_START}, 10); len(events) != 1 {
+			t.Error("Expected nested impersonation to be refused")
+		}
+
+		// ...nor can the admin act as the user
+		admin.postForm("/account/tokens", url.Values{"name": {"sneaky"}, "scopes": {APISCOPE__READ}})
+		if tokens, _ := listAPITokens(dso.DB, other.ID); len(tokens) != 0 {
+			t.Error("Expected account changes to be blocked while impersonating")
+		}
+	})
+
+	t.Run("ReadOnlyEverywhere", func(t *testing.T) {
+		admin, dso, _, u := setup(t)
+		before, _ := listBooks(dso.DB)
+		admin.postForm(adminUserPath(u)+"/impersonate", url.Values{})
+
+		book := url.Values{"title": {"Impersonated"}, "author": {"Root"}, "isbn": {"1"}}
+		if w := admin.postForm("/books", book); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/account" {
+			t.Errorf("Expected the book form to be refused, got %d to %s", w.Code, w.Header().Get("Location"))
+		}
+		w := apiRequest(t, admin, "POST", "/api/books", "", []byte(`{"title":"Impersonated","author":"Root","isbn":"2"}`))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected a cookie API write to be refused, got %d", w.Code)
+		}
+		if books, _ := listBooks(dso.DB); len(books) != len(before) {
+			t.Errorf("Expected no book to be created while impersonating, got %d books", len(books))
+		}
+
+		// Stopping stays open, and the admin can make changes again afterwards
+		admin.postForm("/impersonation/stop", url.Values{})
+		if w := admin.postForm("/books", book); w.Code != http.StatusSeeOther || w.Header().Get("Location") == "/account" {
+			t.Errorf("Expected the book to be created after stopping, got %d to %s", w.Code, w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("RefusesSelfAndDisabled", func(t *testing.T) {
+		admin, dso, root, u := setup(t)
+		admin.postForm(adminUserPath(root)+"/impersonate", url.Values{})
+		setUserDisabled(dso.DB, u, true)
+		admin.postForm(adminUserPath(u)+"/impersonate", url.Values{})
+		if strings.Contains(admin.get("/account").Body.String(), "impersonationBanner") {
+			t.Error("Expected impersonating yourself or a disabled user to be refused")
+		}
+	})
+
+	t.Run("EndsWithAdminSession", func(t *testing.T) {
+		admin, dso, root, u := setup(t)
+		admin.postForm(adminUserPath(u)+"/impersonate", url.Values{})
+		if err := revokeAllUserSessions(dso.DB, root.ID); err != nil {
+			t.Fatalf("revokeAllUserSessions(): %v", err)
+		}
+		if w := admin.get("/account"); w.Code == http.StatusOK {
+			t.Error("Expected impersonation to end when the admin's own session is revoked")
+		}
+	})
+}
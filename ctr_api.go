@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// JSON API, authenticated by mwAPIAuth (bearer token or cookie session)
+
+func route_Api_Me() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Api_Me()")
+
+		user := getAPIUser(c)
+
+		c.JSON(http.StatusOK, gin.H{
+			"user_id":     user.UserID,
+			"username":    user.Username,
+			"is_admin":    user.IsAdmin(),
+			"roles":       user.RoleNames(),
+			"permissions": userPermissions(dso.AppConfig, user),
+		})
+	}
+}
+
+func route_Api_Books_Index() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Api_Books_Index()")
+
+		if !getAPIUser(c).IsRole(SESSUSR__USER) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+
+		books, err := listBooks(dso.DB)
+		if err != nil {
+			logger.Error("failed to list books", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"books": books})
+	}
+}
+
+func route_Api_Books_Show() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Api_Books_Show()")
+
+		if !getAPIUser(c).IsRole(SESSUSR__USER) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+
+		book, ok := apiLoadBook(c)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, book)
+	}
+}
+
+func route_Api_Books_Create_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Api_Books_Create_POST()")
+
+		user := getAPIUser(c)
+		if !dso.AppConfig.Authorize(user, ACTION__CREATE, (*Book)(nil)) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+
+		var in BookInput
+		if err := c.ShouldBindJSON(&in); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "title, author and isbn are required"})
+			return
+		}
+		book, err := createBook(dso.DB, in, user.UserID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "title, author and isbn are required"})
+			return
+		}
+
+		logger.Debug("book created successfully", "id", book.ID, "title", book.Title, "owner", user.Username)
+		c.JSON(http.StatusCreated, book)
+	}
+}
+
+func route_Api_Books_Update_PUT() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Api_Books_Update_PUT()")
+
+		book, ok := apiLoadBook(c)
+		if !ok {
+			return
+		}
+		if !dso.AppConfig.Authorize(getAPIUser(c), ACTION__UPDATE, book) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+
+		var in BookInput
+		if err := c.ShouldBindJSON(&in); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "title, author and isbn are required"})
+			return
+		}
+		if err := updateBook(dso.DB, book, in); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "title, author and isbn are required"})
+			return
+		}
+		c.JSON(http.StatusOK, book)
+	}
+}
+
+func route_Api_Books_Delete() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Api_Books_Delete()")
+
+		book, ok := apiLoadBook(c)
+		if !ok {
+			return
+		}
+		if !dso.AppConfig.Authorize(getAPIUser(c), ACTION__DELETE, book) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+
+		if err := deleteBook(dso.DB, book); err != nil {
+			logger.Error("failed to delete book", "id", book.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// apiLoadBook fetches the book named by the :id route param, or responds 404
+func apiLoadBook(c *gin.Context) (*Book, bool) {
+	dso := c.MustGet("dso").(*DataSourceOrchestration)
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "book not found"})
+		return nil, false
+	}
+	book, err := findBookByID(dso.DB, uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "book not found"})
+		return nil, false
+	}
+	return book, true
+}
+
+// logLevelsJSON is the current log levels, as the log levels API reports them
+func logLevelsJSON(levels *LogLevels) gin.H {
+	modules := gin.H{}
+	for module, level := range levels.Modules() {
+		modules[module] = logLevelName(level)
+	}
+	return gin.H{"level": logLevelName(levels.Level()), "modules": modules}
+}
+
+func route_Api_Admin_LogLevels_Index() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Api_Admin_LogLevels_Index()")
+
+		c.JSON(http.StatusOK, logLevelsJSON(dso.LogLevels))
+	}
+}
+
+// LogLevelsInput changes the log levels: the base level and/or module overrides, where "" drops a module's override
+type LogLevelsInput struct {
+	Level   string            `json:"level"`
+	Modules map[string]string `json:"modules"`
+}
+
+// route_Api_Admin_LogLevels_Update_PUT changes log levels until the next restart (or DELETE)
+func route_Api_Admin_LogLevels_Update_PUT() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Api_Admin_LogLevels_Update_PUT()")
+
+		var in LogLevelsInput
+		if err := c.ShouldBindJSON(&in); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expected {\"level\": ..., \"modules\": {...}}"})
+			return
+		}
+
+		// Validate everything before changing anything
+		var level slog.Level
+		var err error
+		if in.Level != "" {
+			if level, err = parseLogLevel(in.Level); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		modules := map[string]slog.Level{}
+		for module, name := range in.Modules {
+			if name == "" {
+				continue
+			}
+			if modules[module], err = parseLogLevel(name); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: %v", module, err)})
+				return
+			}
+		}
+
+		if in.Level != "" {
+			dso.LogLevels.SetLevel(level)
+		}
+		for module, name := range in.Modules {
+			if name == "" {
+				dso.LogLevels.ClearModule(module)
+			} else {
+				dso.LogLevels.SetModule(module, modules[module])
+			}
+		}
+		out := logLevelsJSON(dso.LogLevels)
+		// Warn, so it shows at all but the quietest levels
+		logger.Warn("log levels changed", "level", out["level"], "modules", out["modules"])
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+// route_Api_Admin_LogLevels_Reset_DELETE restores the configured log levels
+func route_Api_Admin_LogLevels_Reset_DELETE() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Api_Admin_LogLevels_Reset_DELETE()")
+
+		dso.LogLevels.Reset()
+		out := logLevelsJSON(dso.LogLevels)
+		logger.Warn("log levels reset", "level", out["level"], "modules", out["modules"])
+		c.JSON(http.StatusOK, out)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func route_Auth_Login() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Auth_Login()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+		flashes := getFlashes(session)
+
+		if user.SessionIsValid() {
+			c.Redirect(http.StatusSeeOther, "/")
+			return
+		}
+
+		c.HTML(http.StatusOK, "auth/login", struct {
+			AppConfig   *AppConfig
+			SessionUser *SessionUser
+			Flash       []string
+		}{
+			dso.AppConfig,
+			&user,
+			flashes,
+		})
+	}
+}
+
+func route_Auth_Login_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Auth_Login_POST()")
+
+		session := sessions.Default(c)
+
+		username := c.PostForm("username")
+		password := c.PostForm("password")
+
+		// Throttled attempts aren't checked at all, so guessing can't continue while blocked
+		if loginThrottled(c, username) {
+			c.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+
+		u, err := authenticateUser(dso.DB, username, password)
+		if err != nil {
+			logger.Info("login failed", "username", username, "error", err)
+			recordFailedLogin(c, username, "password")
+			addFlash("Invalid username or password", session)
+			c.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+
+		// Accounts with 2FA enrolled must pass the TOTP challenge before the session is authenticated
+		if u.TOTPEnabled {
+			setUser(NewTOTPPendingSessionUser(u), session)
+			c.Redirect(http.StatusSeeOther, "/login/2fa")
+			return
+		}
+
+		startUserSession(c, u, "password")
+		c.Redirect(http.StatusSeeOther, "/")
+	}
+}
+
+// startUserSession marks the session as authenticated for u (the caller decides where to send them next)
+func startUserSession(c *gin.Context, u *User, method string) {
+	dso := c.MustGet("dso").(*DataSourceOrchestration)
+	logger := loggerFrom(c)
+	session := sessions.Default(c)
+
+	if err := recordLogin(dso.DB, u); err != nil {
+		logger.Error("failed to record login", "username", u.Username, "error", err)
+	}
+	if err := clearLoginFailures(dso.DB, u.Username); err != nil {
+		logger.Error("failed to clear login failures", "username", u.Username, "error", err)
+	}
+
+	su := u.SessionUser()
+	us, err := createUserSession(dso.DB, u.ID, method, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		// Still log the user in; the session just won't be listed (generation checks keep applying)
+		logger.Error("failed to record session", "username", u.Username, "error", err)
+	} else {
+		su.SessionID = us.ID
+	}
+
+	// Issue a new session ID on login, so one obtained beforehand can't ride along into the authenticated session
+	renewSessionID(session)
+	setUser(su, session)
+	logger.Info("login succeeded", "username", u.Username, "method", method)
+}
+
+// loginThrottled reports (and flashes) whether login attempts for username, or from the client's IP, are currently
+// blocked by backoff or lockout. The message is the same either way and whether or not the account exists.
+func loginThrottled(c *gin.Context, username string) bool {
+	dso := c.MustGet("dso").(*DataSourceOrchestration)
+	logger := loggerFrom(c)
+
+	until, blocked, err := checkLoginThrottle(dso.DB, username, c.ClientIP(), time.Now())
+	if err != nil {
+		// Fail open: a broken throttle table shouldn't stop everyone logging in
+		logger.Error("failed to check login throttle", "username", username, "error", err)
+		return false
+	}
+	if !blocked {
+		return false
+	}
+	logSecurityEvent(logger, "login_throttled", "username", username, "ip", c.ClientIP(), "until", until)
+	addFlash("Too many failed login attempts, please try again later", sessions.Default(c))
+	return true
+}
+
+// recordFailedLogin counts a failed password or 2FA attempt towards backoff and lockout
+func recordFailedLogin(c *gin.Context, username string, method string) {
+	dso := c.MustGet("dso").(*DataSourceOrchestration)
+	logger := loggerFrom(c)
+
+	logSecurityEvent(logger, "login_failed", "username", username, "ip", c.ClientIP(), "method", method)
+	locked, err := recordLoginFailure(dso.DB, dso.AppConfig.loginThrottlePolicy(), username, c.ClientIP(), time.Now())
+	if err != nil {
+		logger.Error("failed to record login failure", "username", username, "error", err)
+		return
+	}
+	if locked {
+		logSecurityEvent(logger, "account_locked", "username", username, "ip", c.ClientIP(),
+			"duration", time.Duration(dso.AppConfig.LoginLockoutDuration)*time.Second)
+	}
+}
+
+func route_Auth_TOTP() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Auth_TOTP()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+		flashes := getFlashes(session)
+
+		if !user.TOTPPending || time.Now().After(user.AuthExpiration) {
+			addFlash("Please log in to continue", session)
+			c.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+
+		c.HTML(http.StatusOK, "auth/totp", struct {
+			AppConfig   *AppConfig
+			SessionUser *SessionUser
+			Flash       []string
+		}{
+			dso.AppConfig,
+			&user,
+			flashes,
+		})
+	}
+}
+
+func route_Auth_TOTP_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Auth_TOTP_POST()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		if !user.TOTPPending || time.Now().After(user.AuthExpiration) {
+			addFlash("Your login attempt expired, please log in again", session)
+			c.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+
+		u, err := findUserByID(dso.DB, user.UserID)
+		if err != nil || u.Disabled || !u.TOTPEnabled {
+			logger.Error("2fa challenge for unknown or ineligible user", "user_id", user.UserID, "error", err)
+			addFlash("Please log in to continue", session)
+			c.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+
+		if loginThrottled(c, u.Username) {
+			c.Redirect(http.StatusSeeOther, "/login/2fa")
+			return
+		}
+
+		code := c.PostForm("code")
+		recoveryCode := c.PostForm("recovery_code")
+
+		var ok bool
+		if recoveryCode != "" {
+			ok, err = consumeRecoveryCode(dso.DB, u.ID, recoveryCode)
+			if ok {
+				logger.Warn("recovery code used for login", "username", u.Username)
+			}
+		} else if step, valid := totpValidate(u.TOTPSecret, code, time.Now(), u.TOTPLastStep); valid {
+			// Atomically burn the step so the same code can't be replayed (even concurrently)
+			ok, err = consumeTOTPStep(dso.DB, u.ID, step)
+		}
+		if err != nil {
+			logger.Error("2fa verification failed", "username", u.Username, "error", err)
+		}
+		if !ok {
+			logger.Info("2fa challenge failed", "username", u.Username)
+			recordFailedLogin(c, u.Username, "totp")
+			addFlash("Invalid authentication code", session)
+			c.Redirect(http.StatusSeeOther, "/login/2fa")
+			return
+		}
+
+		startUserSession(c, u, "totp")
+		c.Redirect(http.StatusSeeOther, "/")
+	}
+}
+
+// route_Auth_Passkey_Begin_POST starts a discoverable-credential (passkey) login: no username is needed, the
+// authenticator tells us who the user is via the user handle in its assertion
+func route_Auth_Passkey_Begin_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Auth_Passkey_Begin_POST()")
+
+		session := sessions.Default(c)
+
+		assertion, data, err := dso.WebAuthn.BeginDiscoverableLogin()
+		if err != nil {
+			logger.Error("failed to begin passkey login", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to start passkey sign-in"})
+			return
+		}
+		if err := saveWebAuthnSession(session, sessionKeyWebAuthnLogin, data); err != nil {
+			logger.Error("failed to save passkey login session", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to start passkey sign-in"})
+			return
+		}
+
+		c.JSON(http.StatusOK, assertion)
+	}
+}
+
+func route_Auth_Passkey_Finish_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Auth_Passkey_Finish_POST()")
+
+		session := sessions.Default(c)
+
+		data, err := popWebAuthnSession(session, sessionKeyWebAuthnLogin)
+		if err != nil {
+			logger.Info("passkey login without a pending challenge", "error", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Passkey sign-in expired, please try again"})
+			return
+		}
+
+		var wu *webauthnUser
+		handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+			wu, err = findWebAuthnUserByHandle(dso.DB, userHandle)
+			return wu, err
+		}
+		_, cred, err := dso.WebAuthn.FinishPasskeyLogin(handler, *data, c.Request)
+		if err != nil {
+			logger.Info("passkey login failed", "error", err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey sign-in failed"})
+			return
+		}
+		if wu.user.Disabled {
+			logger.Info("passkey login for disabled account", "username", wu.user.Username)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey sign-in failed"})
+			return
+		}
+		if cred.Authenticator.CloneWarning {
+			logger.Warn("passkey sign counter went backwards, possible cloned authenticator", "username", wu.user.Username)
+		}
+		if err := updateWebAuthnCredential(dso.DB, cred); err != nil {
+			logger.Error("failed to update passkey", "username", wu.user.Username, "error", err)
+		}
+
+		// A user-verified passkey is already two factors (possession plus PIN/biometric), so it skips the TOTP
+		// challenge. Without UV (e.g. a bare security key) it's only possession, so accounts with 2FA still get it.
+		if wu.user.TOTPEnabled && !cred.Flags.UserVerified {
+			setUser(NewTOTPPendingSessionUser(wu.user), session)
+			c.JSON(http.StatusOK, gin.H{"redirect": "/login/2fa"})
+			return
+		}
+		startUserSession(c, wu.user, "passkey")
+		c.JSON(http.StatusOK, gin.H{"redirect": "/"})
+	}
+}
+
+func route_Auth_Logout() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Auth_Logout()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+		// Logging out while impersonating ends the admin's own session
+		if admin, ok := getImpersonator(session); ok {
+			user = admin
+		}
+
+		if user.SessionID != "" {
+			if _, err := revokeUserSession(dso.DB, user.UserID, user.SessionID); err != nil {
+				logger.Error("failed to end session", "username", user.Username, "error", err)
+			}
+		}
+
+		// Move to a fresh ID too, so a server-side store drops the old record and that ID can't be replayed
+		session.Clear()
+		renewSessionID(session)
+		addFlash("You have been logged out", session)
+		logger.Info("logout", "username", user.Username)
+		c.Redirect(http.StatusSeeOther, "/")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testClient issues requests against a router while carrying cookies (i.e. the session) between them
+type testClient struct {
+	t         *testing.T
+	router    *gin.Engine
+	cookies   map[string]*http.Cookie
+	userAgent string
+}
+
+func newTestClient(t *testing.T, router *gin.Engine) *testClient {
+	return &testClient{t: t, router: router, cookies: map[string]*http.Cookie{}}
+}
+
+func (tc *testClient) do(req *http.Request) *httptest.ResponseRecorder {
+	if tc.userAgent != "" {
+		req.Header.Set("User-Agent", tc.userAgent)
+	}
+	for _, c := range tc.cookies {
+		req.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	tc.router.ServeHTTP(w, req)
+	for _, c := range w.Result().Cookies() {
+		tc.cookies[c.Name] = c
+	}
+	return w
+}
+
+func (tc *testClient) get(path string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		tc.t.Fatalf("Failed to create request: %v", err)
+	}
+	return tc.do(req)
+}
+
+// csrfToken returns the session's current CSRF token, as mwCSRF exposes it on GET responses
+func (tc *testClient) csrfToken() string {
+	token := tc.get("/ping").Header().Get(csrfHeader)
+	if token == "" {
+		tc.t.Fatal("Expected a CSRF token header")
+	}
+	return token
+}
+
+// postForm posts form, adding a valid CSRF token unless the form already carries one
+func (tc *testClient) postForm(path string, form url.Values) *httptest.ResponseRecorder {
+	if !form.Has(csrfFormField) {
+		form.Set(csrfFormField, tc.csrfToken())
+	}
+	req, err := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	if err != nil {
+		tc.t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return tc.do(req)
+}
+
+// login posts credentials and returns the redirect location
+func (tc *testClient) login(username, password string) string {
+	w := tc.postForm("/login", url.Values{"username": {username}, "password": {password}})
+	if w.Code != http.StatusSeeOther {
+		tc.t.Fatalf("Expected login to redirect, got %d", w.Code)
+	}
+	return w.Header().Get("Location")
+}
+
+func TestAuthLogin(t *testing.T) {
+	t.Run("ValidCredentials", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO()
+		if _, err := createUser(dso.DB, "alice", "correct horse", SESSUSR__USER); err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		tc := newTestClient(t, router)
+
+		if loc := tc.login("Alice", "correct horse"); loc != "/" {
+			t.Errorf("Expected redirect to '/', got '%s'", loc)
+		}
+		if w := tc.get("/account"); w.Code != http.StatusOK {
+			t.Errorf("Expected account page to be accessible after login, got %d", w.Code)
+		}
+	})
+
+	t.Run("WrongPassword", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO()
+		if _, err := createUser(dso.DB, "alice", "correct horse", SESSUSR__USER); err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		tc := newTestClient(t, router)
+
+		if loc := tc.login("alice", "wrong password"); loc != "/login" {
+			t.Errorf("Expected redirect to '/login', got '%s'", loc)
+		}
+		if w := tc.get("/account"); w.Code != http.StatusSeeOther {
+			t.Errorf("Expected account page to redirect when not logged in, got %d", w.Code)
+		}
+	})
+
+	t.Run("UnknownUser", func(t *testing.T) {
+		router := setupTestRouter()
+		tc := newTestClient(t, router)
+
+		if loc := tc.login("nobody", "whatever1"); loc != "/login" {
+			t.Errorf("Expected redirect to '/login', got '%s'", loc)
+		}
+	})
+}
+
+func TestAuthTOTP(t *testing.T) {
+	setup := func(t *testing.T) (*testClient, *DataSourceOrchestration, *User, []string) {
+		router, dso := setupTestRouterWithDSO()
+		u, err := createUser(dso.DB, "bob", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		u.TOTPSecret = newTOTPSecret()
+		codes, err := enableUserTOTP(dso.DB, u.ID, u.TOTPSecret, 0)
+		if err != nil {
+			t.Fatalf("enableUserTOTP(): %v", err)
+		}
+		return newTestClient(t, router), dso, u, codes
+	}
+	currentCode := func(t *testing.T, secret string) string {
+		code, err := totpCode(secret, totpStep(time.Now()))
+		if err != nil {
+			t.Fatalf("totpCode(): %v", err)
+		}
+		return code
+	}
+
+	t.Run("PasswordAloneIsNotEnough", func(t *testing.T) {
+		tc, _, _, _ := setup(t)
+
+		if loc := tc.login("bob", "correct horse"); loc != "/login/2fa" {
+			t.Fatalf("Expected redirect to '/login/2fa', got '%s'", loc)
+		}
+		if w := tc.get("/account"); w.Code != http.StatusSeeOther {
+			t.Errorf("Expected account page to be inaccessible before 2FA, got %d", w.Code)
+		}
+	})
+
+	t.Run("ValidCodeCompletesLogin", func(t *testing.T) {
+		tc, _, u, _ := setup(t)
+		tc.login("bob", "correct horse")
+
+		w := tc.postForm("/login/2fa", url.Values{"code": {currentCode(t, u.TOTPSecret)}})
+		if loc := w.Header().Get("Location"); loc != "/" {
+			t.Fatalf("Expected redirect to '/', got '%s'", loc)
+		}
+		if w := tc.get("/account"); w.Code != http.StatusOK {
+			t.Errorf("Expected account page to be accessible after 2FA, got %d", w.Code)
+		}
+	})
+
+	t.Run("CodeCannotBeReplayed", func(t *testing.T) {
+		tc, _, u, _ := setup(t)
+		code := currentCode(t, u.TOTPSecret)
+
+		tc.login("bob", "correct horse")
+		tc.postForm("/login/2fa", url.Values{"code": {code}})
+
+		second := newTestClient(t, tc.router)
+		second.login("bob", "correct horse")
+		w := second.postForm("/login/2fa", url.Values{"code": {code}})
+		if loc := w.Header().Get("Location"); loc != "/login/2fa" {
+			t.Errorf("Expected replayed code to be rejected, got redirect to '%s'", loc)
+		}
+	})
+
+	t.Run("RecoveryCodeIsSingleUse", func(t *testing.T) {
+		tc, dso, u, codes := setup(t)
+
+		tc.login("bob", "correct horse")
+		w := tc.postForm("/login/2fa", url.Values{"recovery_code": {codes[0]}})
+		if loc := w.Header().Get("Location"); loc != "/" {
+			t.Fatalf("Expected recovery code to complete login, got redirect to '%s'", loc)
+		}
+
+		second := newTestClient(t, tc.router)
+		second.login("bob", "correct horse")
+		w = second.postForm("/login/2fa", url.Values{"recovery_code": {codes[0]}})
+		if loc := w.Header().Get("Location"); loc != "/login/2fa" {
+			t.Errorf("Expected reused recovery code to be rejected, got redirect to '%s'", loc)
+		}
+
+		remaining, err := countUnusedRecoveryCodes(dso.DB, u.ID)
+		if err != nil {
+			t.Fatalf("countUnusedRecoveryCodes(): %v", err)
+		}
+		if remaining != recoveryCodeCount-1 {
+			t.Errorf("Expected %d unused recovery codes, got %d", recoveryCodeCount-1, remaining)
+		}
+	})
+
+	t.Run("AdminCanReset2FA", func(t *testing.T) {
+		tc, dso, u, _ := setup(t)
+		if _, err := createUser(dso.DB, "admin", "correct horse", SESSUSR__ADMIN); err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		tc.login("admin", "correct horse")
+
+		tc.postForm("/admin/users/"+itoa(u.ID)+"/2fa/reset", url.Values{})
+
+		u, err := findUserByID(dso.DB, u.ID)
+		if err != nil {
+			t.Fatalf("findUserByID(): %v", err)
+		}
+		if u.TOTPEnabled || u.TOTPSecret != "" {
+			t.Error("Expected 2FA to be reset")
+		}
+		if remaining, _ := countUnusedRecoveryCodes(dso.DB, u.ID); remaining != 0 {
+			t.Errorf("Expected recovery codes to be removed, got %d", remaining)
+		}
+	})
+
+	t.Run("NonAdminCannotReset2FA", func(t *testing.T) {
+		tc, dso, u, _ := setup(t)
+		if _, err := createUser(dso.DB, "carol", "correct horse", SESSUSR__USER); err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		tc.login("carol", "correct horse")
+
+		tc.postForm("/admin/users/"+itoa(u.ID)+"/2fa/reset", url.Values{})
+
+		u, err := findUserByID(dso.DB, u.ID)
+		if err != nil {
+			t.Fatalf("findUserByID(): %v", err)
+		}
+		if !u.TOTPEnabled {
+			t.Error("Expected 2FA to remain enabled")
+		}
+	})
+}
+
+func itoa(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
@@ -3,40 +3,32 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 )
 
-# EXAMPLE ROUTES, REMOVE FOR ACTUAL USE
+// EXAMPLE ROUTES, REMOVE FOR ACTUAL USE
 
-# This struct would normally be defined elsewhere, such as in a models file/package. Defined here for simplicity (because this whole file is disposable).
-type Book struct {
-	ID     string
-	Title  string
-	Author string
-	ISBN   string
-}
-
-func getMockBooks() []Book {
-	return []Book{
-		{ID: "1", Title: "The Go Programming Language", Author: "Alan A. A. Donovan", ISBN: "978-0134190440"},
-		{ID: "2", Title: "Learning Go", Author: "Jon Bodner", ISBN: "978-1492077213"},
-		{ID: "3", Title: "Concurrency in Go", Author: "Katherine Cox-Buday", ISBN: "978-1491941294"},
-	}
-}
+// Books demonstrate per-record authorization: anyone may browse, users with books.create may add books, and a
+// book's owner (or anyone with books.update/books.delete) may change it. See policy.go.
 
 func route_Books_Index() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		dso := c.MustGet("dso").(*DataSourceOrchestration)
-		logger := dso.Logger
+		logger := loggerFrom(c)
 		logger.Debug("calling route_Books_Index()")
 
 		session := sessions.Default(c)
 		user := getUser(session)
 		flashes := getFlashes(session)
 
-		books := getMockBooks()
+		books, err := listBooks(dso.DB)
+		if err != nil {
+			logger.Error("failed to list books", "error", err)
+			flashes = append(flashes, "Unable to load books")
+		}
 
 		c.HTML(http.StatusOK, "books/index", struct {
 			AppConfig   *AppConfig
@@ -55,30 +47,17 @@ func route_Books_Index() gin.HandlerFunc {
 func route_Books_Show() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		dso := c.MustGet("dso").(*DataSourceOrchestration)
-		logger := dso.Logger
+		logger := loggerFrom(c)
 		logger.Debug("calling route_Books_Show()")
 
 		session := sessions.Default(c)
 		user := getUser(session)
-		flashes := getFlashes(session)
 
-		id := c.Param("id")
-		books := getMockBooks()
-
-		var book *Book
-		for _, b := range books {
-			if b.ID == id {
-				book = &b
-				break
-			}
-		}
-
-		if book == nil {
-			logger.Error("book not found", "id", id)
-			addFlash("Book not found", session)
-			c.Redirect(http.StatusSeeOther, "/books")
+		book, ok := loadBook(c)
+		if !ok {
 			return
 		}
+		flashes := getFlashes(session)
 
 		c.HTML(http.StatusOK, "books/show", struct {
 			AppConfig   *AppConfig
@@ -97,11 +76,16 @@ func route_Books_Show() gin.HandlerFunc {
 func route_Books_New() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		dso := c.MustGet("dso").(*DataSourceOrchestration)
-		logger := dso.Logger
+		logger := loggerFrom(c)
 		logger.Debug("calling route_Books_New()")
 
 		session := sessions.Default(c)
 		user := getUser(session)
+
+		if !dso.AppConfig.Authorize(&user, ACTION__CREATE, (*Book)(nil)) {
+			renderForbidden(c)
+			return
+		}
 		flashes := getFlashes(session)
 
 		c.HTML(http.StatusOK, "books/new", struct {
@@ -119,24 +103,147 @@ func route_Books_New() gin.HandlerFunc {
 func route_Books_Create_POST() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		dso := c.MustGet("dso").(*DataSourceOrchestration)
-		logger := dso.Logger
+		logger := loggerFrom(c)
 		logger.Debug("calling route_Books_Create_POST()")
 
 		session := sessions.Default(c)
+		user := getUser(session)
 
-		title := c.PostForm("title")
-		author := c.PostForm("author")
-		isbn := c.PostForm("isbn")
+		if !dso.AppConfig.Authorize(&user, ACTION__CREATE, (*Book)(nil)) {
+			renderForbidden(c)
+			return
+		}
 
-		if title == "" || author == "" || isbn == "" {
-			logger.Error("validation failed: missing required fields")
+		in := BookInput{Title: c.PostForm("title"), Author: c.PostForm("author"), ISBN: c.PostForm("isbn")}
+		book, err := createBook(dso.DB, in, user.UserID)
+		if err != nil {
+			logger.Error("failed to create book", "error", err)
 			addFlash("All fields are required", session)
 			c.Redirect(http.StatusSeeOther, "/books/new")
 			return
 		}
 
-		logger.Debug("book created successfully", "title", title, "author", author, "isbn", isbn)
-		addFlash(fmt.Sprintf("Book '%s' created successfully", title), session)
+		logger.Debug("book created successfully", "id", book.ID, "title", book.Title, "owner", user.Username)
+		addFlash(fmt.Sprintf("Book '%s' created successfully", book.Title), session)
+		c.Redirect(http.StatusSeeOther, "/books")
+	}
+}
+
+func route_Books_Edit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Books_Edit()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		book, ok := loadBook(c)
+		if !ok {
+			return
+		}
+		if !dso.AppConfig.Authorize(&user, ACTION__UPDATE, book) {
+			renderForbidden(c)
+			return
+		}
+		flashes := getFlashes(session)
+
+		c.HTML(http.StatusOK, "books/edit", struct {
+			AppConfig   *AppConfig
+			SessionUser *SessionUser
+			Flash       []string
+			Book        *Book
+		}{
+			dso.AppConfig,
+			&user,
+			flashes,
+			book,
+		})
+	}
+}
+
+func route_Books_Update_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Books_Update_POST()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		book, ok := loadBook(c)
+		if !ok {
+			return
+		}
+		if !dso.AppConfig.Authorize(&user, ACTION__UPDATE, book) {
+			logger.Warn("book update denied", "id", book.ID, "username", user.Username)
+			renderForbidden(c)
+			return
+		}
+
+		in := BookInput{Title: c.PostForm("title"), Author: c.PostForm("author"), ISBN: c.PostForm("isbn")}
+		if err := updateBook(dso.DB, book, in); err != nil {
+			logger.Error("failed to update book", "id", book.ID, "error", err)
+			addFlash("All fields are required", session)
+			c.Redirect(http.StatusSeeOther, fmt.Sprintf("/books/%d/edit", book.ID))
+			return
+		}
+
+		addFlash(fmt.Sprintf("Book '%s' updated", book.Title), session)
+		c.Redirect(http.StatusSeeOther, fmt.Sprintf("/books/%d", book.ID))
+	}
+}
+
+func route_Books_Delete_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Books_Delete_POST()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		book, ok := loadBook(c)
+		if !ok {
+			return
+		}
+		if !dso.AppConfig.Authorize(&user, ACTION__DELETE, book) {
+			logger.Warn("book delete denied", "id", book.ID, "username", user.Username)
+			renderForbidden(c)
+			return
+		}
+
+		if err := deleteBook(dso.DB, book); err != nil {
+			logger.Error("failed to delete book", "id", book.ID, "error", err)
+			addFlash("Unable to delete the book", session)
+			c.Redirect(http.StatusSeeOther, fmt.Sprintf("/books/%d", book.ID))
+			return
+		}
+
+		addFlash(fmt.Sprintf("Book '%s' deleted", book.Title), session)
+		c.Redirect(http.StatusSeeOther, "/books")
+	}
+}
+
+// loadBook fetches the book named by the :id route param, or flashes and redirects back to the list
+func loadBook(c *gin.Context) (*Book, bool) {
+	dso := c.MustGet("dso").(*DataSourceOrchestration)
+	logger := loggerFrom(c)
+	session := sessions.Default(c)
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		logger.Error("book not found", "id", c.Param("id"))
+		addFlash("Book not found", session)
+		c.Redirect(http.StatusSeeOther, "/books")
+		return nil, false
+	}
+	book, err := findBookByID(dso.DB, uint(id))
+	if err != nil {
+		logger.Error("book not found", "id", id, "error", err)
+		addFlash("Book not found", session)
 		c.Redirect(http.StatusSeeOther, "/books")
+		return nil, false
 	}
+	return book, true
 }
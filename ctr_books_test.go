@@ -1,22 +1,31 @@
 package main
 
 import (
+	"html/template"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/securecookie"
 )
 
 // setupTestRouter creates a test Gin engine with routes and minimal DSO configuration
-func setupTestRouter() *gin.Engine {
+func setupTestRouter(configure ...func(*AppConfig)) *gin.Engine {
+	r, _ := setupTestRouterWithDSO(configure...)
+	return r
+}
+
+// setupTestRouterWithDSO is setupTestRouter, but also returns the DSO so tests can seed/inspect the (in-memory) database.
+// Optional configure funcs adjust the AppConfig before anything is built from it.
+func setupTestRouterWithDSO(configure ...func(*AppConfig)) (*gin.Engine, *DataSourceOrchestration) {
 	gin.SetMode(gin.TestMode)
 
 	r := gin.New()
@@ -29,35 +38,127 @@ func setupTestRouter() *gin.Engine {
 		SecureCookieMaxAge:        3600,
 		SSLDisabled:               true,
 		LogLevel:                  1,
+		TOTPIssuer:                "Test",
+		WebAuthnRPID:              "localhost",
+		WebAuthnRPDisplayName:     "Test",
+		WebAuthnRPOrigins:         []string{"http://localhost"},
+		SessionStore:              SESSION_STORE__COOKIE,
+		SessionLifetime:           3600,
+		BaseURL:                   "http://localhost",
+		LoginThrottleFreeAttempts: 3,
+		LoginThrottleMaxDelay:     60,
+		LoginLockoutThreshold:     10,
+		LoginLockoutDuration:      900,
+		HealthCheckTimeout:        2,
+	}
+	for _, fn := range configure {
+		fn(appConfig)
 	}
 
-	// Setup session store
-	store := cookie.NewStore(appConfig.SecureCookieSigningKey, appConfig.SecureCookieEncryptionKey)
-	store.Options(sessions.Options{
-		Path:     "/",
-		MaxAge:   appConfig.SecureCookieMaxAge,
-		Secure:   false,
-		HttpOnly: true,
-	})
-	r.Use(sessions.Sessions("test-session", store))
+	// Fresh in-memory database per router
+	db, err := bootstrapSqliteDb(":memory:")
+	if err != nil {
+		panic(err)
+	}
 
-	// Load templates for testing
+	// Setup session store (same one the app uses, so SessionUser is registered with gob)
+	store, err := instantiateSessionStore(appConfig, db)
+	if err != nil {
+		panic(err)
+	}
+	metrics, err := newMetrics(db)
+	if err != nil {
+		panic(err)
+	}
 	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
-	r.SetFuncMap(customTmplFuncMap(appConfig, logger))
-	r.LoadHTMLGlob("templates/**/*")
+	reporter := newErrorReporter(appConfig)
+	r.Use(mwRequestID(), mwErrorReporting(reporter), mwAccessLog(appConfig, logger), mwMetrics(metrics), mwTracing(), mwRecovery(logger, reporter))
+
+	// Load templates for testing
+	assets := newPublicAssets(os.DirFS("public"), false)
+	pages := newHTMLRender(template.Must(template.New("").Funcs(customTmplFuncMap(appConfig, logger, assets)).ParseGlob("templates/**/*")))
+	pages.observe = metrics.observeRender
+	r.HTMLRender = pages
+
+	// Serving as far as /ping and /readyz are concerned (Lifecycle.Serve isn't used in tests)
+	lifecycle := newLifecycle(logger, 0, time.Second)
+	lifecycle.state.Store(LIFECYCLE__READY)
+
+	// Serve health probes and public/ ahead of the session middleware, as main() does
+	health := newHealth(appConfig, lifecycle)
+	health.AddLiveness("templates", templatesHealthCheck(pages))
+	health.AddReadiness("database", dbHealthCheck(db))
+	register_health_routes(r, health)
+	if _, err := serveMetrics(r, metrics, appConfig, lifecycle, logger); err != nil {
+		panic(err)
+	}
+	r.GET(publicPrefix+"*filepath", gin.WrapH(assets))
+	r.Use(sessions.Sessions("test-session", metrics.instrumentSessionStore(traceSessionStore(store))))
+
+	wa, err := newWebAuthn(appConfig)
+	if err != nil {
+		panic(err)
+	}
+
+	mailTemplates, err := loadMailTemplates(appConfig)
+	if err != nil {
+		panic(err)
+	}
 
 	// Create minimal DSO & inject it into middleware
 	dso := &DataSourceOrchestration{
-		AppConfig: appConfig,
-		Logger:    logger,
-		DB:        nil,
+		AppConfig:     appConfig,
+		Logger:        logger,
+		DB:            db,
+		WebAuthn:      wa,
+		Mailer:        &recordingMailer{},
+		MailTemplates: mailTemplates,
+		Lifecycle:     lifecycle,
+		LogLevels:     newLogLevels(slog.LevelInfo, nil),
 	}
 	r.Use(mwDSO(dso))
+	r.Use(mwSecurityHeaders())
+	r.Use(mwSessionValidity())
+	r.Use(mwCSRF())
+	r.Use(mwReadOnlyWhenImpersonating())
 
 	// Register routes
 	register_routes(r)
 
-	return r
+	return r, dso
+}
+
+// setupTestRouterAsUser is setupTestRouter plus the session cookies of a logged-in regular user
+func setupTestRouterAsUser(t *testing.T) (*gin.Engine, []*http.Cookie) {
+	router, dso := setupTestRouterWithDSO()
+	if _, err := createUser(dso.DB, "reader", "correct horse", SESSUSR__USER); err != nil {
+		t.Fatalf("createUser(): %v", err)
+	}
+	tc := newTestClient(t, router)
+	tc.login("reader", "correct horse")
+	var cookies []*http.Cookie
+	for _, c := range tc.cookies {
+		cookies = append(cookies, c)
+	}
+	return router, cookies
+}
+
+// fetchCSRFToken returns the CSRF token of the session carried by cookies (mwCSRF sends it on GET responses)
+func fetchCSRFToken(t *testing.T, router *gin.Engine, cookies []*http.Cookie) string {
+	req, err := http.NewRequest("GET", "/ping", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	token := w.Header().Get(csrfHeader)
+	if token == "" {
+		t.Fatal("Expected a CSRF token header")
+	}
+	return token
 }
 
 // TestBooksShow tests the GET /books/:id route with multiple scenarios (table-driven)
@@ -138,10 +239,11 @@ func TestBooksShow(t *testing.T) {
 // TestBooksCreate tests the POST /books route
 func TestBooksCreate(t *testing.T) {
 	t.Run("ValidFormSubmission", func(t *testing.T) {
-		router := setupTestRouter()
+		router, cookies := setupTestRouterAsUser(t)
 
 		// Create form data
 		form := url.Values{}
+		form.Add(csrfFormField, fetchCSRFToken(t, router, cookies))
 		form.Add("title", "Test Book")
 		form.Add("author", "Test Author")
 		form.Add("isbn", "978-1234567890")
@@ -151,6 +253,9 @@ func TestBooksCreate(t *testing.T) {
 			t.Fatalf("Failed to create request: %v", err)
 		}
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
 
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
@@ -167,9 +272,10 @@ func TestBooksCreate(t *testing.T) {
 	})
 
 	t.Run("MissingTitle", func(t *testing.T) {
-		router := setupTestRouter()
+		router, cookies := setupTestRouterAsUser(t)
 
 		form := url.Values{}
+		form.Add(csrfFormField, fetchCSRFToken(t, router, cookies))
 		form.Add("author", "Test Author")
 		form.Add("isbn", "978-1234567890")
 
@@ -178,6 +284,9 @@ func TestBooksCreate(t *testing.T) {
 			t.Fatalf("Failed to create request: %v", err)
 		}
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
 
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
@@ -194,9 +303,10 @@ func TestBooksCreate(t *testing.T) {
 	})
 
 	t.Run("MissingAuthor", func(t *testing.T) {
-		router := setupTestRouter()
+		router, cookies := setupTestRouterAsUser(t)
 
 		form := url.Values{}
+		form.Add(csrfFormField, fetchCSRFToken(t, router, cookies))
 		form.Add("title", "Test Book")
 		form.Add("isbn", "978-1234567890")
 
@@ -205,6 +315,9 @@ func TestBooksCreate(t *testing.T) {
 			t.Fatalf("Failed to create request: %v", err)
 		}
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
 
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
@@ -220,9 +333,10 @@ func TestBooksCreate(t *testing.T) {
 	})
 
 	t.Run("MissingISBN", func(t *testing.T) {
-		router := setupTestRouter()
+		router, cookies := setupTestRouterAsUser(t)
 
 		form := url.Values{}
+		form.Add(csrfFormField, fetchCSRFToken(t, router, cookies))
 		form.Add("title", "Test Book")
 		form.Add("author", "Test Author")
 
@@ -231,6 +345,9 @@ func TestBooksCreate(t *testing.T) {
 			t.Fatalf("Failed to create request: %v", err)
 		}
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
 
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
@@ -246,15 +363,19 @@ func TestBooksCreate(t *testing.T) {
 	})
 
 	t.Run("AllFieldsMissing", func(t *testing.T) {
-		router := setupTestRouter()
+		router, cookies := setupTestRouterAsUser(t)
 
 		form := url.Values{}
+		form.Add(csrfFormField, fetchCSRFToken(t, router, cookies))
 
 		req, err := http.NewRequest("POST", "/books", strings.NewReader(form.Encode()))
 		if err != nil {
 			t.Fatalf("Failed to create request: %v", err)
 		}
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
 
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
@@ -268,6 +389,41 @@ func TestBooksCreate(t *testing.T) {
 			t.Errorf("Expected redirect to '/books/new', got '%s'", location)
 		}
 	})
+
+	t.Run("MissingCSRFToken", func(t *testing.T) {
+		router, cookies := setupTestRouterAsUser(t)
+
+		form := url.Values{}
+		form.Add("title", "Test Book")
+		form.Add("author", "Test Author")
+		form.Add("isbn", "978-1234567890")
+
+		req, err := http.NewRequest("POST", "/books", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+		}
+	})
+
+	t.Run("RequiresPermission", func(t *testing.T) {
+		tc := newTestClient(t, setupTestRouter())
+
+		// Anonymous visitors (with a valid CSRF token) don't hold books.create
+		w := tc.postForm("/books", url.Values{"title": {"Test Book"}, "author": {"Test Author"}, "isbn": {"978-1234567890"}})
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+		}
+	})
 }
 
 // TestBooksIndex tests the GET /books route
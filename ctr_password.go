@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Self-service password reset and email verification, both driven by signed, emailed links (see usertoken.go)
+
+func route_Password_Forgot() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Password_Forgot()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+		flashes := getFlashes(session)
+
+		c.HTML(http.StatusOK, "auth/password_forgot", struct {
+			AppConfig   *AppConfig
+			SessionUser *SessionUser
+			Flash       []string
+		}{
+			dso.AppConfig,
+			&user,
+			flashes,
+		})
+	}
+}
+
+func route_Password_Forgot_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Password_Forgot_POST()")
+
+		session := sessions.Default(c)
+
+		// Same response whether or not the account exists, so this can't be used to discover accounts. That includes
+		// how long it takes: the email is sent in the background, not while the browser waits.
+		u, err := findUserByLogin(dso.DB, c.PostForm("login"))
+		switch {
+		case err != nil:
+			logger.Info("password reset requested for unknown account", "error", err)
+		case u.Email == "" || u.Disabled:
+			logger.Info("password reset requested for account without a usable email", "username", u.Username)
+		default:
+			token := signUserToken(dso.AppConfig, USERTOKEN__PASSWORD_RESET, u, passwordResetTokenTTL)
+			dso.Lifecycle.Go(c.Request.Context(), "password reset email", func(ctx context.Context) {
+				err := sendTemplatedMail(ctx, dso, u.Email, "email/password_reset", struct {
+					User      *User
+					Link      string
+					ExpiresIn string
+				}{
+					u,
+					dso.AppConfig.BaseURL + "/password/reset?token=" + url.QueryEscape(token),
+					humanizeDuration(passwordResetTokenTTL),
+				})
+				if err != nil {
+					logger.Error("failed to send password reset email", "username", u.Username, "error", err)
+				} else {
+					logger.Info("password reset email sent", "username", u.Username)
+				}
+			})
+		}
+
+		addFlash("If that account exists and has an email address, we've sent it a link to reset your password", session)
+		c.Redirect(http.StatusSeeOther, "/login")
+	}
+}
+
+func route_Password_Reset() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Password_Reset()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+		flashes := getFlashes(session)
+
+		token := c.Query("token")
+		if _, err := userFromToken(c, USERTOKEN__PASSWORD_RESET, token); err != nil {
+			logger.Info("invalid password reset link", "error", err)
+			addFlash("That password reset link is invalid or has expired", session)
+			c.Redirect(http.StatusSeeOther, "/password/forgot")
+			return
+		}
+
+		// Keep the token out of Referer headers sent to anything this page loads
+		c.Header("Referrer-Policy", "no-referrer")
+		c.HTML(http.StatusOK, "auth/password_reset", struct {
+			AppConfig   *AppConfig
+			SessionUser *SessionUser
+			Flash       []string
+			Token       string
+		}{
+			dso.AppConfig,
+			&user,
+			flashes,
+			token,
+		})
+	}
+}
+
+func route_Password_Reset_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Password_Reset_POST()")
+
+		session := sessions.Default(c)
+
+		token := c.PostForm("token")
+		u, err := userFromToken(c, USERTOKEN__PASSWORD_RESET, token)
+		if err != nil {
+			logger.Info("invalid password reset link", "error", err)
+			addFlash("That password reset link is invalid or has expired", session)
+			c.Redirect(http.StatusSeeOther, "/password/forgot")
+			return
+		}
+
+		back := "/password/reset?token=" + url.QueryEscape(token)
+		password := c.PostForm("password")
+		if password != c.PostForm("password_confirm") {
+			addFlash("The passwords don't match", session)
+			c.Redirect(http.StatusSeeOther, back)
+			return
+		}
+		if err := updateUserPassword(dso.DB, u, password); err != nil {
+			logger.Info("password reset rejected", "username", u.Username, "error", err)
+			addFlash(fmt.Sprintf("Unable to reset your password: %s", err), session)
+			c.Redirect(http.StatusSeeOther, back)
+			return
+		}
+
+		// Whoever knew the old password shouldn't stay signed in
+		if err := revokeAllUserSessions(dso.DB, u.ID); err != nil {
+			logger.Error("failed to revoke sessions after password reset", "username", u.Username, "error", err)
+		}
+		// ...and the owner shouldn't stay locked out by someone else's guessing
+		if err := clearLoginFailures(dso.DB, u.Username); err != nil {
+			logger.Error("failed to clear login failures after password reset", "username", u.Username, "error", err)
+		}
+		// Following the emailed link proves the address works
+		if u.EmailVerifiedAt == nil {
+			if err := markUserEmailVerified(dso.DB, u); err != nil {
+				logger.Error("failed to mark email verified", "username", u.Username, "error", err)
+			}
+		}
+
+		logger.Info("password reset", "username", u.Username)
+		session.Clear()
+		addFlash("Your password has been reset. Please log in.", session)
+		c.Redirect(http.StatusSeeOther, "/login")
+	}
+}
+
+func route_Email_Verify() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Email_Verify()")
+
+		session := sessions.Default(c)
+
+		u, err := userFromToken(c, USERTOKEN__VERIFY_EMAIL, c.Query("token"))
+		if err != nil {
+			logger.Info("invalid email verification link", "error", err)
+			addFlash("That verification link is invalid or has expired", session)
+			c.Redirect(http.StatusSeeOther, "/")
+			return
+		}
+		if err := markUserEmailVerified(dso.DB, u); err != nil {
+			logger.Error("failed to mark email verified", "username", u.Username, "error", err)
+			addFlash("Unable to verify your email address", session)
+			c.Redirect(http.StatusSeeOther, "/")
+			return
+		}
+
+		logger.Info("email verified", "username", u.Username, "email", u.Email)
+		addFlash("Your email address has been verified", session)
+		c.Redirect(http.StatusSeeOther, "/")
+	}
+}
+
+func route_Account_Email_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_Email_POST()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		u, err := findUserByID(dso.DB, user.UserID)
+		if err != nil {
+			logger.Error("account not found", "user_id", user.UserID, "error", err)
+			addFlash("Account not found", session)
+			c.Redirect(http.StatusSeeOther, "/account")
+			return
+		}
+		previous := u.Email
+		if err := updateUserEmail(dso.DB, u, c.PostForm("email")); err != nil {
+			logger.Info("email update rejected", "username", u.Username, "error", err)
+			addFlash(fmt.Sprintf("Unable to update your email address: %s", err), session)
+			c.Redirect(http.StatusSeeOther, "/account")
+			return
+		}
+		if u.Email == previous {
+			c.Redirect(http.StatusSeeOther, "/account")
+			return
+		}
+
+		logger.Info("email updated", "username", u.Username)
+		if u.Email == "" {
+			addFlash("Your email address has been removed", session)
+		} else if err := sendVerificationEmail(c, u); err != nil {
+			logger.Error("failed to send verification email", "username", u.Username, "error", err)
+			addFlash("Your email address has been updated, but we couldn't send a verification email", session)
+		} else {
+			addFlash(fmt.Sprintf("Your email address has been updated. We've sent a verification link to %s.", u.Email), session)
+		}
+		c.Redirect(http.StatusSeeOther, "/account")
+	}
+}
+
+func route_Account_Email_Verify_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		logger := loggerFrom(c)
+		logger.Debug("calling route_Account_Email_Verify_POST()")
+
+		session := sessions.Default(c)
+		user := getUser(session)
+
+		u, err := findUserByID(dso.DB, user.UserID)
+		if err != nil {
+			logger.Error("account not found", "user_id", user.UserID, "error", err)
+			addFlash("Account not found", session)
+			c.Redirect(http.StatusSeeOther, "/account")
+			return
+		}
+		if u.Email == "" || u.EmailVerifiedAt != nil {
+			addFlash("There's no email address waiting to be verified", session)
+			c.Redirect(http.StatusSeeOther, "/account")
+			return
+		}
+
+		if err := sendVerificationEmail(c, u); err != nil {
+			logger.Error("failed to send verification email", "username", u.Username, "error", err)
+			addFlash("Unable to send a verification email", session)
+			c.Redirect(http.StatusSeeOther, "/account")
+			return
+		}
+
+		addFlash(fmt.Sprintf("We've sent a verification link to %s", u.Email), session)
+		c.Redirect(http.StatusSeeOther, "/account")
+	}
+}
+
+func sendVerificationEmail(c *gin.Context, u *User) error {
+	dso := c.MustGet("dso").(*DataSourceOrchestration)
+
+	token := signUserToken(dso.AppConfig, USERTOKEN__VERIFY_EMAIL, u, verifyEmailTokenTTL)
+	return sendTemplatedMail(c.Request.Context(), dso, u.Email, "email/verify_email", struct {
+		User      *User
+		Link      string
+		ExpiresIn string
+	}{
+		u,
+		dso.AppConfig.BaseURL + "/email/verify?token=" + url.QueryEscape(token),
+		humanizeDuration(verifyEmailTokenTTL),
+	})
+}
+
+// userFromToken loads the user a signed token is for and verifies the token against them
+func userFromToken(c *gin.Context, purpose string, token string) (*User, error) {
+	dso := c.MustGet("dso").(*DataSourceOrchestration)
+
+	id, err := parseUserToken(purpose, token)
+	if err != nil {
+		return nil, fmt.Errorf("parseUserToken(): %w", err)
+	}
+	u, err := findUserByID(dso.DB, id)
+	if err != nil {
+		return nil, fmt.Errorf("findUserByID(): %w", err)
+	}
+	if u.Disabled {
+		return nil, fmt.Errorf("account disabled")
+	}
+	if err := verifyUserToken(dso.AppConfig, purpose, u, token); err != nil {
+		return nil, fmt.Errorf("verifyUserToken(): %w", err)
+	}
+	return u, nil
+}
+
+// humanizeDuration renders e.g. "1 hour" or "2 days" for email copy
+func humanizeDuration(d time.Duration) string {
+	n, unit := int(d/time.Minute), "minute"
+	switch {
+	case d >= 24*time.Hour && d%(24*time.Hour) == 0:
+		n, unit = int(d/(24*time.Hour)), "day"
+	case d >= time.Hour && d%time.Hour == 0:
+		n, unit = int(d/time.Hour), "hour"
+	}
+	if n == 1 {
+		return fmt.Sprintf("1 %s", unit)
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
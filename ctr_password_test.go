@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+var linkPattern = regexp.MustCompile(`http://localhost(/\S+)`)
+
+// mailSent waits for mail being sent in the background (see Lifecycle.Go), then returns the test mailer
+func mailSent(t *testing.T, dso *DataSourceOrchestration) *recordingMailer {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := dso.Lifecycle.WaitTasks(ctx); err != nil {
+		t.Fatalf("WaitTasks(): %v", err)
+	}
+	return dso.Mailer.(*recordingMailer)
+}
+
+// blockingMailer stands in for a mail server that takes until release is closed to accept a message
+type blockingMailer struct {
+	release chan struct{}
+}
+
+func (b blockingMailer) Send(ctx context.Context, m Mail) error {
+	<-b.release
+	return nil
+}
+
+// emailedPath pulls the (path part of the) link out of the last email sent
+func emailedPath(t *testing.T, dso *DataSourceOrchestration) string {
+	m := mailSent(t, dso).last(t)
+	match := linkPattern.FindStringSubmatch(m.Body)
+	if match == nil {
+		t.Fatalf("Expected a link in the email, got:\n%s", m.Body)
+	}
+	return match[1]
+}
+
+func TestPasswordReset(t *testing.T) {
+	setup := func(t *testing.T) (*testClient, *DataSourceOrchestration, *User) {
+		router, dso := setupTestRouterWithDSO()
+		u, err := createUser(dso.DB, "lena", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		if err := updateUserEmail(dso.DB, u, "lena@example.com"); err != nil {
+			t.Fatalf("updateUserEmail(): %v", err)
+		}
+		return newTestClient(t, router), dso, u
+	}
+	resetPassword := func(tc *testClient, path string, password string) string {
+		token, _ := url.ParseQuery(strings.TrimPrefix(path, "/password/reset?"))
+		w := tc.postForm("/password/reset", url.Values{
+			"token": {token.Get("token")}, "password": {password}, "password_confirm": {password},
+		})
+		return w.Header().Get("Location")
+	}
+
+	t.Run("ResetByEmailLink", func(t *testing.T) {
+		tc, dso, _ := setup(t)
+		other := newTestClient(t, tc.router)
+		other.login("lena", "correct horse")
+
+		tc.postForm("/password/forgot", url.Values{"login": {"lena@example.com"}})
+		m := mailSent(t, dso).last(t)
+		if m.To != "lena@example.com" || m.Subject != "Reset your password" {
+			t.Errorf("Unexpected email: %+v", m)
+		}
+		path := emailedPath(t, dso)
+
+		if w := tc.get(path); w.Code != http.StatusOK {
+			t.Fatalf("Expected reset page to load, got %d", w.Code)
+		}
+		if loc := resetPassword(tc, path, "battery staple"); loc != "/login" {
+			t.Fatalf("Expected redirect to '/login', got '%s'", loc)
+		}
+
+		if loc := tc.login("lena", "battery staple"); loc != "/" {
+			t.Error("Expected login with the new password to succeed")
+		}
+		if other.get("/account").Code == http.StatusOK {
+			t.Error("Expected existing sessions to be signed out by a password reset")
+		}
+	})
+
+	t.Run("LinkIsSingleUse", func(t *testing.T) {
+		tc, dso, _ := setup(t)
+		tc.postForm("/password/forgot", url.Values{"login": {"lena"}})
+		path := emailedPath(t, dso)
+
+		resetPassword(tc, path, "battery staple")
+		if loc := resetPassword(tc, path, "another password"); loc != "/password/forgot" {
+			t.Errorf("Expected a used link to be rejected, got redirect to '%s'", loc)
+		}
+		if loc := tc.login("lena", "battery staple"); loc != "/" {
+			t.Error("Expected the first reset to stand")
+		}
+	})
+
+	t.Run("MismatchedPasswordsRejected", func(t *testing.T) {
+		tc, dso, _ := setup(t)
+		tc.postForm("/password/forgot", url.Values{"login": {"lena"}})
+		token, _ := url.ParseQuery(strings.TrimPrefix(emailedPath(t, dso), "/password/reset?"))
+
+		tc.postForm("/password/reset", url.Values{
+			"token": {token.Get("token")}, "password": {"battery staple"}, "password_confirm": {"battery stapler"},
+		})
+		if loc := tc.login("lena", "correct horse"); loc != "/" {
+			t.Error("Expected the password to be unchanged")
+		}
+	})
+
+	t.Run("UnknownAccountLooksTheSame", func(t *testing.T) {
+		tc, dso, _ := setup(t)
+		known := tc.postForm("/password/forgot", url.Values{"login": {"lena"}})
+		unknown := tc.postForm("/password/forgot", url.Values{"login": {"nobody"}})
+
+		if known.Code != unknown.Code || known.Header().Get("Location") != unknown.Header().Get("Location") {
+			t.Error("Expected the same response for known and unknown accounts")
+		}
+		if n := mailSent(t, dso).count(); n != 1 {
+			t.Errorf("Expected exactly one email, got %d", n)
+		}
+	})
+
+	t.Run("ResponseDoesNotWaitForEmail", func(t *testing.T) {
+		// A slow mail server mustn't make known accounts answer slower than unknown ones
+		tc, dso, _ := setup(t)
+		release := make(chan struct{})
+		dso.Mailer = blockingMailer{release}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			tc.postForm("/password/forgot", url.Values{"login": {"lena"}})
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Error("Expected the response before the email was sent")
+		}
+		close(release)
+		<-done
+	})
+
+	t.Run("ExpiredOrForeignTokensRejected", func(t *testing.T) {
+		tc, dso, u := setup(t)
+
+		expired := signUserToken(dso.AppConfig, USERTOKEN__PASSWORD_RESET, u, -time.Minute)
+		if w := tc.get("/password/reset?token=" + url.QueryEscape(expired)); w.Code != http.StatusSeeOther {
+			t.Errorf("Expected an expired link to be rejected, got %d", w.Code)
+		}
+		wrongPurpose := signUserToken(dso.AppConfig, USERTOKEN__VERIFY_EMAIL, u, time.Hour)
+		if w := tc.get("/password/reset?token=" + url.QueryEscape(wrongPurpose)); w.Code != http.StatusSeeOther {
+			t.Errorf("Expected a verification link to be rejected for password reset, got %d", w.Code)
+		}
+
+		forged := &AppConfig{SecureCookieSigningKey: securecookie.GenerateRandomKey(64)}
+		if w := tc.get("/password/reset?token=" + url.QueryEscape(signUserToken(forged, USERTOKEN__PASSWORD_RESET, u, time.Hour))); w.Code != http.StatusSeeOther {
+			t.Errorf("Expected a link signed with an unknown key to be rejected, got %d", w.Code)
+		}
+	})
+
+	t.Run("TokensSurviveKeyRotation", func(t *testing.T) {
+		_, dso, u := setup(t)
+		cfg := dso.AppConfig
+		token := signUserToken(cfg, USERTOKEN__PASSWORD_RESET, u, time.Hour)
+
+		rotated := &AppConfig{SecureCookieKeys: []SecureCookieKeyPair{
+			{SigningKey: securecookie.GenerateRandomKey(64), EncryptionKey: securecookie.GenerateRandomKey(32)},
+			{SigningKey: cfg.SecureCookieSigningKey, EncryptionKey: cfg.SecureCookieEncryptionKey},
+		}}
+		if err := verifyUserToken(rotated, USERTOKEN__PASSWORD_RESET, u, token); err != nil {
+			t.Errorf("Expected a token signed with a rotated-out key to still verify, got %v", err)
+		}
+	})
+}
+
+func TestEmailVerification(t *testing.T) {
+	setup := func(t *testing.T) (*testClient, *DataSourceOrchestration, *User) {
+		router, dso := setupTestRouterWithDSO()
+		u, err := createUser(dso.DB, "milo", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		tc := newTestClient(t, router)
+		tc.login("milo", "correct horse")
+		return tc, dso, u
+	}
+	verified := func(dso *DataSourceOrchestration, id uint) bool {
+		u, _ := findUserByID(dso.DB, id)
+		return u.EmailVerifiedAt != nil
+	}
+
+	t.Run("VerifyByEmailLink", func(t *testing.T) {
+		tc, dso, u := setup(t)
+
+		tc.postForm("/account/email", url.Values{"email": {"milo@example.com"}})
+		m := mailSent(t, dso).last(t)
+		if m.To != "milo@example.com" {
+			t.Errorf("Expected verification email to the new address, got %+v", m)
+		}
+		if verified(dso, u.ID) {
+			t.Fatal("Expected a new email address to start unverified")
+		}
+
+		path := emailedPath(t, dso)
+		tc.get(path)
+		if !verified(dso, u.ID) {
+			t.Error("Expected the email address to be verified after following the link")
+		}
+		if w := tc.get(path); w.Code != http.StatusSeeOther || !verified(dso, u.ID) {
+			t.Errorf("Expected a reused link to be harmless, got %d", w.Code)
+		}
+	})
+
+	t.Run("ChangingEmailInvalidatesLinkAndVerification", func(t *testing.T) {
+		tc, dso, u := setup(t)
+
+		tc.postForm("/account/email", url.Values{"email": {"milo@example.com"}})
+		oldPath := emailedPath(t, dso)
+		tc.postForm("/account/email", url.Values{"email": {"milo@example.org"}})
+
+		tc.get(oldPath)
+		if verified(dso, u.ID) {
+			t.Error("Expected a link for a previous address to be rejected")
+		}
+
+		tc.get(emailedPath(t, dso))
+		if !verified(dso, u.ID) {
+			t.Fatal("Expected the current address's link to verify it")
+		}
+		tc.postForm("/account/email", url.Values{"email": {"milo@example.net"}})
+		if verified(dso, u.ID) {
+			t.Error("Expected changing the address to clear its verification")
+		}
+	})
+
+	t.Run("InvalidEmailRejected", func(t *testing.T) {
+		tc, dso, u := setup(t)
+
+		tc.postForm("/account/email", url.Values{"email": {"not an email"}})
+		u, _ = findUserByID(dso.DB, u.ID)
+		if u.Email != "" || mailSent(t, dso).count() != 0 {
+			t.Errorf("Expected an invalid address to be rejected, got '%s'", u.Email)
+		}
+	})
+}
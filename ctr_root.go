@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
+	"io"
 	"net/http"
+	"strings"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
@@ -10,7 +13,7 @@ import (
 func route_Root_Index() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		dso := c.MustGet("dso").(*DataSourceOrchestration)
-		logger := dso.Logger
+		logger := loggerFrom(c)
 		logger.Debug("calling route_Root_Index()")
 
 		session := sessions.Default(c)
@@ -31,10 +34,150 @@ func route_Root_Index() gin.HandlerFunc {
 	}
 }
 
+// route_Root_Ping answers 503 once shutdown has begun, so load balancers stop sending traffic while we drain
 func route_Root_Ping() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		if !dso.Lifecycle.Ready() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"message": "shutting down",
+			})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{
 			"message": "pong",
 		})
 	}
 }
+
+// cspViolation is the part of a browser's CSP violation report worth logging
+type cspViolation struct {
+	DocumentURI        string `json:"document-uri"`
+	EffectiveDirective string `json:"effective-directive"`
+	ViolatedDirective  string `json:"violated-directive"`
+	BlockedURI         string `json:"blocked-uri"`
+	SourceFile         string `json:"source-file"`
+	LineNumber         int    `json:"line-number"`
+	Disposition        string `json:"disposition"` // "enforce" or "report"
+}
+
+// route_Root_CSPReport_POST logs the violation reports browsers send to the CSP's report-uri. Both the classic
+// `application/csp-report` body and the Reporting API's `application/reports+json` batches are accepted.
+func route_Root_CSPReport_POST() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := loggerFrom(c)
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, 64<<10))
+		if err != nil {
+			c.Status(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		var violations []cspViolation
+		if strings.HasPrefix(c.ContentType(), "application/reports+json") {
+			var reports []struct {
+				Type string `json:"type"`
+				Body struct {
+					DocumentURL        string `json:"documentURL"`
+					EffectiveDirective string `json:"effectiveDirective"`
+					BlockedURL         string `json:"blockedURL"`
+					SourceFile         string `json:"sourceFile"`
+					LineNumber         int    `json:"lineNumber"`
+					Disposition        string `json:"disposition"`
+				} `json:"body"`
+			}
+			err = json.Unmarshal(body, &reports)
+			for _, r := range reports {
+				if r.Type == "csp-violation" {
+					violations = append(violations, cspViolation{DocumentURI: r.Body.DocumentURL,
+						EffectiveDirective: r.Body.EffectiveDirective, BlockedURI: r.Body.BlockedURL,
+						SourceFile: r.Body.SourceFile, LineNumber: r.Body.LineNumber, Disposition: r.Body.Disposition})
+				}
+			}
+		} else {
+			var report struct {
+				Report cspViolation `json:"csp-report"`
+			}
+			if err = json.Unmarshal(body, &report); err == nil {
+				violations = append(violations, report.Report)
+			}
+		}
+		if err != nil {
+			logger.Debug("malformed csp report", "error", err)
+			c.Status(http.StatusBadRequest)
+			return
+		}
+
+		for _, v := range violations {
+			directive := v.EffectiveDirective
+			if directive == "" {
+				directive = v.ViolatedDirective
+			}
+			logger.Warn("csp violation", "document_uri", v.DocumentURI, "directive", directive,
+				"blocked_uri", v.BlockedURI, "source_file", v.SourceFile, "line", v.LineNumber,
+				"disposition", v.Disposition, "ip", c.ClientIP(), "user_agent", c.Request.UserAgent())
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// renderForbidden responds 403 with the "not allowed" page (e.g. when a policy denies an action)
+func renderForbidden(c *gin.Context) {
+	dso := c.MustGet("dso").(*DataSourceOrchestration)
+	session := sessions.Default(c)
+	user := getUser(session)
+	flashes := getFlashes(session)
+
+	c.HTML(http.StatusForbidden, "root/forbidden", struct {
+		AppConfig   *AppConfig
+		SessionUser *SessionUser
+		Flash       []string
+		RequestID   string
+	}{
+		dso.AppConfig,
+		&user,
+		flashes,
+		requestID(c),
+	})
+}
+
+// route_Root_NotFound answers requests that match no route
+func route_Root_NotFound() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderError(c, http.StatusNotFound, "There's nothing here.")
+	}
+}
+
+// renderError responds with status and the error page, which shows the request ID for users to quote to support.
+// API requests get JSON instead, as do requests that failed before mwDSO ran (there's no config to render with);
+// so it's safe to use from mwRecovery.
+func renderError(c *gin.Context, status int, message string) {
+	v, ok := c.Get("dso")
+	if !ok || strings.HasPrefix(c.Request.URL.Path, "/api/") {
+		c.JSON(status, gin.H{"error": message, "request_id": requestID(c)})
+		return
+	}
+	dso := v.(*DataSourceOrchestration)
+
+	// The session may not be there (e.g. for a panic in an earlier middleware); flashes are left for the next page
+	var user SessionUser
+	if s, ok := c.Get(sessions.DefaultKey); ok {
+		user = getUser(s.(sessions.Session))
+	}
+
+	c.HTML(status, "root/error", struct {
+		AppConfig   *AppConfig
+		SessionUser *SessionUser
+		Flash       []string
+		Title       string
+		Message     string
+		RequestID   string
+	}{
+		dso.AppConfig,
+		&user,
+		nil,
+		http.StatusText(status),
+		message,
+		requestID(c),
+	})
+}
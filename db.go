@@ -1,11 +1,19 @@
 package main
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
 // import (
-// 	"fmt"
-//
 // 	"gorm.io/driver/postgres"
-// 	"gorm.io/driver/sqlite"
-// 	"gorm.io/gorm"
 // )
 
 // bootstrapPostgresDb initializes a PostgreSQL database connection using GORM
@@ -16,26 +24,128 @@ package main
 // 		return nil, fmt.Errorf("gorm.Open(postgres.Open()): %w", err)
 // 	}
 //
-// 	err = db.AutoMigrate(&Book{})
+// 	err = migrateDb(db)
 // 	if err != nil {
-// 		return nil, fmt.Errorf("db.AutoMigrate(): %w", err)
+// 		return nil, fmt.Errorf("migrateDb(): %w", err)
 // 	}
 //
 // 	return db, nil
 // }
 
 // bootstrapSqliteDb initializes a SQLite database connection using GORM
-// func bootstrapSqliteDb(connStr string) (*gorm.DB, error) {
-// 	// Open connection to SQLite database
-// 	db, err := gorm.Open(sqlite.Open(connStr), &gorm.Config{})
-// 	if err != nil {
-// 		return nil, fmt.Errorf("gorm.Open(sqlite.Open()): %w", err)
-// 	}
+// (pure-Go driver, so the binary still builds with CGO_ENABLED=0)
+func bootstrapSqliteDb(connStr string) (*gorm.DB, error) {
+	// Open connection to SQLite database
+	db, err := gorm.Open(sqlite.Open(connStr), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("gorm.Open(sqlite.Open()): %w", err)
+	}
 
-// 	err = db.AutoMigrate(&Book{})
-// 	if err != nil {
-// 		return nil, fmt.Errorf("db.AutoMigrate(): %w", err)
-// 	}
+	// SQLite allows a single writer; funnel everything through one connection to avoid "database is locked"
+	// errors (this also keeps ":memory:" databases from being per-connection)
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, fmt.Errorf("db.DB(): %w", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
 
-// 	return db, nil
-// }
+	err = migrateDb(db)
+	if err != nil {
+		return nil, fmt.Errorf("migrateDb(): %w", err)
+	}
+
+	// Trace queries (registered after migrating, so startup doesn't emit a burst of root spans)
+	if err := db.Use(gormTracing{}); err != nil {
+		return nil, fmt.Errorf("db.Use(): %w", err)
+	}
+
+	return db, nil
+}
+
+// migrateDb creates/updates the schema for every persisted model
+func migrateDb(db *gorm.DB) error {
+	err := db.AutoMigrate(
+		&User{},
+		&RecoveryCode{},
+		&WebAuthnCredential{},
+		&APIToken{},
+		&ServerSession{},
+		&UserSession{},
+		&LoginThrottle{},
+		&AuditEvent{},
+		&Book{},
+	)
+	if err != nil {
+		return fmt.Errorf("db.AutoMigrate(): %w", err)
+	}
+
+	// Example data for the books pages (remove along with ctr_books.go)
+	if err := seedBooks(db); err != nil {
+		return fmt.Errorf("seedBooks(): %w", err)
+	}
+	return nil
+}
+
+// gormSlowQuery is how long a query can take before gormLogger logs it as a warning
+const gormSlowQuery = 200 * time.Millisecond
+
+// gormLogger sends GORM's logging to slog: every query at trace level, slow queries as warnings and failed ones as
+// errors. Give it a logger tagged with module=db, so `log_modules` can set its level. Queries are logged with their
+// placeholders, never the bound values (which may be password hashes, tokens, etc.).
+type gormLogger struct {
+	logger *slog.Logger
+}
+
+func newGormLogger(l *slog.Logger) logger.Interface {
+	return gormLogger{l}
+}
+
+// LogMode implements logger.Interface; levels come from LogLevels instead
+func (g gormLogger) LogMode(logger.LogLevel) logger.Interface {
+	return g
+}
+
+func (g gormLogger) Info(ctx context.Context, msg string, args ...any) {
+	g.logger.InfoContext(ctx, fmt.Sprintf(msg, args...))
+}
+
+func (g gormLogger) Warn(ctx context.Context, msg string, args ...any) {
+	g.logger.WarnContext(ctx, fmt.Sprintf(msg, args...))
+}
+
+func (g gormLogger) Error(ctx context.Context, msg string, args ...any) {
+	g.logger.ErrorContext(ctx, fmt.Sprintf(msg, args...))
+}
+
+func (g gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	elapsed := time.Since(begin)
+	var level slog.Level
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+		level = slog.LevelError
+	case elapsed >= gormSlowQuery:
+		level = slog.LevelWarn
+	default:
+		level = LevelTrace
+	}
+	if !g.logger.Enabled(ctx, level) {
+		return
+	}
+	sql, rows := fc()
+	attrs := []slog.Attr{
+		slog.String("sql", sql),
+		slog.Int64("rows", rows),
+		slog.Float64("duration_ms", float64(elapsed.Microseconds())/1000),
+	}
+	if level == slog.LevelError {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+	g.logger.LogAttrs(ctx, level, "query", attrs...)
+}
+
+// ParamsFilter implements gorm.ParamsFilter, keeping bound values out of the logged SQL
+func (g gormLogger) ParamsFilter(_ context.Context, sql string, _ ...any) (string, []any) {
+	return sql, nil
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	errorReportMaxBreadcrumbs = 30              // Per request (and for the records logged outside any request)
+	errorReportSendTimeout    = 5 * time.Second // Per event
+	errorReportMaxSeen        = 1000            // Fingerprints remembered for deduplication before expired ones are pruned
+)
+
+// errorScopeAttrs are record attributes that describe where an error happened rather than what happened. They
+// become the event's tags, user and trace instead of extra data.
+var errorScopeAttrs = []string{"request_id", "route", "user", "module", "trace_id", "span_id"}
+
+// ParseErrorReportingDSN splits `error_reporting_dsn` (https://<key>@<host>/<project_id>) into the endpoint events
+// are posted to and the key they're sent with
+func (a *AppConfig) ParseErrorReportingDSN() error {
+	a.ErrorReportingEndpoint, a.ErrorReportingKey = "", ""
+	if a.ErrorReportingDSN == "" {
+		return nil
+	}
+	// (The DSN holds a credential, so it's kept out of the error)
+	u, err := url.Parse(a.ErrorReportingDSN)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User.Username() == "" {
+		return fmt.Errorf("error_reporting_dsn isn't https://<key>@<host>/<project_id>")
+	}
+	dir, project := path.Split(strings.TrimSuffix(u.Path, "/"))
+	if project == "" {
+		return fmt.Errorf("error_reporting_dsn has no project ID")
+	}
+	a.ErrorReportingEndpoint = fmt.Sprintf("%s://%s%sapi/%s/envelope/", u.Scheme, u.Host, dir, project)
+	a.ErrorReportingKey = u.User.Username()
+	return nil
+}
+
+// errorReporter sends error-level log records (see errorReportHandler) and recovered panics (see mwRecovery) to a
+// Sentry-compatible error tracker. Events are queued and sent by a background worker, so logging never waits on the
+// network. Repeats of an event (same fingerprint) within `error_reporting_dedupe_window` aren't sent, and events
+// are dropped while the queue is full. Without `error_reporting_dsn` it's disabled and does nothing.
+type errorReporter struct {
+	endpoint     string
+	key          string
+	environment  string
+	release      string
+	serverName   string
+	dedupeWindow time.Duration
+	redactor     *redactor
+	client       *http.Client
+	now          func() time.Time
+
+	global *errorScope // Breadcrumbs of records logged outside a request
+
+	mu     sync.Mutex // Guards seen, closed and sends on queue
+	seen   map[string]time.Time
+	closed bool
+	queue  chan *sentryEvent
+	done   chan struct{}
+
+	dropped    atomic.Int64 // Events lost to a full queue or the tracker's rate limit
+	retryAfter time.Time    // Set when the tracker answers 429 (only touched by the worker)
+}
+
+func newErrorReporter(cfg *AppConfig) *errorReporter {
+	hostname, _ := os.Hostname()
+	r := &errorReporter{
+		endpoint:     cfg.ErrorReportingEndpoint,
+		key:          cfg.ErrorReportingKey,
+		environment:  cfg.ErrorReportingEnvironment,
+		release:      cmp.Or(cfg.ErrorReportingRelease, buildRevision()),
+		serverName:   hostname,
+		dedupeWindow: time.Duration(cfg.ErrorReportingDedupeWindow) * time.Second,
+		redactor:     newRedactor(cfg),
+		client:       &http.Client{Timeout: errorReportSendTimeout},
+		now:          time.Now,
+		global:       &errorScope{},
+		seen:         map[string]time.Time{},
+	}
+	if r.Enabled() {
+		r.queue = make(chan *sentryEvent, cfg.ErrorReportingQueueSize)
+		r.done = make(chan struct{})
+		go r.run()
+	}
+	return r
+}
+
+// buildRevision returns the git commit the binary was built from, if the toolchain recorded it
+func buildRevision() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				return s.Value
+			}
+		}
+	}
+	return ""
+}
+
+// Enabled reports whether `error_reporting_dsn` is set
+func (r *errorReporter) Enabled() bool {
+	return r.endpoint != ""
+}
+
+// Dropped returns the number of events lost to a full queue or the tracker's rate limit
+func (r *errorReporter) Dropped() int64 {
+	return r.dropped.Load()
+}
+
+// QueueDepth returns the number of events waiting to be sent
+func (r *errorReporter) QueueDepth() int {
+	return len(r.queue)
+}
+
+// CapturePanic reports a recovered panic. Call it from the deferred func that recovered value, so the stack still
+// leads to where the panic happened.
+func (r *errorReporter) CapturePanic(ctx context.Context, value any, username string) {
+	if !r.Enabled() {
+		return
+	}
+	pcs := make([]uintptr, 100)
+	frames := callerFrames(pcs[:runtime.Callers(1, pcs)])
+	if i := slices.IndexFunc(frames, func(f runtime.Frame) bool { return f.Function == "runtime.gopanic" }); i >= 0 {
+		frames = frames[i+1:]
+	}
+	stack := newSentryStacktrace(frames)
+
+	ev := &sentryEvent{
+		Level:  "fatal",
+		Logger: "panic",
+		Exception: &sentryExceptions{Values: []sentryException{{
+			Type:       "panic",
+			Value:      r.redactor.redactString(fmt.Sprint(value)),
+			Mechanism:  &sentryMechanism{Type: "gin.recovery", Handled: false},
+			Stacktrace: stack,
+		}}},
+		Fingerprint: []string{"panic", fmt.Sprintf("%T", value), stack.culprit()},
+	}
+	if username != "" {
+		ev.User = &sentryUser{Username: username}
+	}
+	r.applyScope(ctx, ev, nil)
+	r.capture(ev)
+}
+
+// captureRecord reports an error-level log record, attrs being its attributes flattened
+func (r *errorReporter) captureRecord(ctx context.Context, rec slog.Record, attrs map[string]any) {
+	pcs := make([]uintptr, 100)
+	pcs = pcs[:runtime.Callers(3, pcs)]
+	// Start from the code that logged, dropping slog's (and the handlers') frames
+	if i := slices.Index(pcs, rec.PC); i >= 0 {
+		pcs = pcs[i:]
+	} else {
+		pcs = []uintptr{rec.PC}
+	}
+	stack := newSentryStacktrace(callerFrames(pcs))
+
+	errText, _ := attrs["error"].(string)
+	ev := &sentryEvent{
+		Level:    "error",
+		Logger:   cmp.Or(attrString(attrs, "module"), "slog"),
+		LogEntry: &sentryLogEntry{Formatted: rec.Message},
+		Exception: &sentryExceptions{Values: []sentryException{{
+			Type:       rec.Message,
+			Value:      errText,
+			Mechanism:  &sentryMechanism{Type: "slog", Handled: true},
+			Stacktrace: stack,
+		}}},
+		Fingerprint: []string{"log", rec.Message, stack.culprit()},
+	}
+	if user := attrString(attrs, "user"); user != "" {
+		ev.User = &sentryUser{Username: user}
+	}
+	r.applyScope(ctx, ev, attrs)
+	r.capture(ev)
+}
+
+// applyScope fills in what's known about where the event happened: the request (from attrs or its errorScope), the
+// trace, and the breadcrumbs logged before it
+func (r *errorReporter) applyScope(ctx context.Context, ev *sentryEvent, attrs map[string]any) {
+	scope := r.scope(ctx)
+	ev.Transaction = cmp.Or(attrString(attrs, "route"), scope.route)
+	ev.Tags = map[string]string{}
+	for k, v := range map[string]string{
+		"request_id":  cmp.Or(attrString(attrs, "request_id"), scope.requestID),
+		"route":       ev.Transaction,
+		"http.method": scope.method,
+		"module":      attrString(attrs, "module"),
+	} {
+		if v != "" {
+			ev.Tags[k] = v
+		}
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		ev.Contexts = map[string]any{"trace": map[string]string{
+			"trace_id": sc.TraceID().String(),
+			"span_id":  sc.SpanID().String(),
+		}}
+	}
+	if extra := withoutScopeAttrs(attrs); len(extra) > 0 {
+		ev.Extra = extra
+	}
+	ev.Breadcrumbs = &sentryBreadcrumbs{Values: scope.breadcrumbs()}
+}
+
+// scope returns the errorScope of the request ctx belongs to, or the process-wide one
+func (r *errorReporter) scope(ctx context.Context) *errorScope {
+	if s, ok := ctx.Value(errorScopeKey{}).(*errorScope); ok {
+		return s
+	}
+	return r.global
+}
+
+// capture queues ev, unless it's a repeat within the dedupe window, the queue is full, or the reporter is closed
+func (r *errorReporter) capture(ev *sentryEvent) {
+	now := r.now()
+	ev.EventID = newEventID()
+	ev.Timestamp = now.UTC().Format(time.RFC3339Nano)
+	ev.Platform = "go"
+	ev.ServerName = r.serverName
+	ev.Environment = r.environment
+	ev.Release = r.release
+
+	fingerprint := strings.Join(ev.Fingerprint, "\x00")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if last, ok := r.seen[fingerprint]; ok && now.Sub(last) < r.dedupeWindow {
+		return
+	}
+	if len(r.seen) >= errorReportMaxSeen {
+		for fp, last := range r.seen {
+			if now.Sub(last) >= r.dedupeWindow {
+				delete(r.seen, fp)
+			}
+		}
+	}
+	select {
+	case r.queue <- ev:
+		r.seen[fingerprint] = now
+	default:
+		r.dropped.Add(1)
+	}
+}
+
+func newEventID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// run sends queued events until the queue is closed. Failures are logged as warnings, which aren't reported.
+func (r *errorReporter) run() {
+	defer close(r.done)
+	for ev := range r.queue {
+		if err := r.send(ev); err != nil {
+			slog.Warn("Failed to send error report", "event_id", ev.EventID, "error", err)
+		}
+	}
+}
+
+// send posts ev to the tracker as an envelope (https://develop.sentry.dev/sdk/data-model/envelopes/)
+func (r *errorReporter) send(ev *sentryEvent) error {
+	if r.now().Before(r.retryAfter) {
+		r.dropped.Add(1)
+		return nil
+	}
+
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("json.Marshal(): %w", err)
+	}
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "{\"event_id\":%q,\"sent_at\":%q}\n", ev.EventID, r.now().UTC().Format(time.RFC3339Nano))
+	fmt.Fprintf(&body, "{\"type\":\"event\",\"length\":%d}\n", len(payload))
+	body.Write(payload)
+	body.WriteByte('\n')
+
+	req, err := http.NewRequest(http.MethodPost, r.endpoint, &body)
+	if err != nil {
+		return fmt.Errorf("http.NewRequest(): %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=go-gin-starter/1.0, sentry_key=%s", r.key))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("r.client.Do(): %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		wait := 60 * time.Second
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			wait = time.Duration(secs) * time.Second
+		}
+		r.retryAfter = r.now().Add(wait)
+		return fmt.Errorf("rate limited for %s", wait)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close stops taking events and waits (as long as ctx allows) for the queued ones to be sent
+func (r *errorReporter) Close(ctx context.Context) error {
+	if !r.Enabled() {
+		return nil
+	}
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d error reports unsent: %w", len(r.queue), ctx.Err())
+	}
+}
+
+// errorScope is what the reporter knows about the request being handled, and the records logged while handling it
+// (the breadcrumbs sent along with any error)
+type errorScope struct {
+	requestID string
+	route     string
+	method    string
+
+	mu     sync.Mutex
+	crumbs []sentryBreadcrumb
+}
+
+type errorScopeKey struct{}
+
+func (s *errorScope) add(b sentryBreadcrumb) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.crumbs) >= errorReportMaxBreadcrumbs {
+		s.crumbs = append(s.crumbs[:0], s.crumbs[1:]...)
+	}
+	s.crumbs = append(s.crumbs, b)
+}
+
+func (s *errorScope) breadcrumbs() []sentryBreadcrumb {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.crumbs)
+}
+
+// mwErrorReporting gives each request an errorScope, so the records logged while handling it become the
+// breadcrumbs of any error reported for it. Register after mwRequestID and before mwTracing and mwDSO, which derive
+// their contexts from the request's.
+func mwErrorReporting(reporter *errorReporter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if reporter.Enabled() {
+			scope := &errorScope{requestID: requestID(c), route: c.FullPath(), method: c.Request.Method}
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), errorScopeKey{}, scope))
+		}
+		c.Next()
+	}
+}
+
+type errorReportedKey struct{}
+
+// withErrorReported marks ctx's records as already reported (e.g. the log record of a panic that was captured as
+// such), so errorReportHandler doesn't send them again
+func withErrorReported(ctx context.Context) context.Context {
+	return context.WithValue(ctx, errorReportedKey{}, true)
+}
+
+// errorReportHandler reports error-level records to the errorReporter and keeps the others as breadcrumbs: the
+// request's (see mwErrorReporting) when logged with its context, as the DSO's logger does, or else process-wide ones.
+// It only sees records that the levels let through. Put it inside redactHandler, so nothing is sent unredacted.
+type errorReportHandler struct {
+	slog.Handler
+	r     *errorReporter
+	attrs []slog.Attr // From WithAttrs, keys already prefixed with their groups
+	group string      // Prefix for keys added under WithGroup ("g." for WithGroup("g"))
+}
+
+func (h errorReportHandler) Handle(ctx context.Context, rec slog.Record) error {
+	err := h.Handler.Handle(ctx, rec)
+
+	attrs := map[string]any{}
+	for _, a := range h.attrs {
+		flattenAttr(attrs, "", a)
+	}
+	rec.Attrs(func(a slog.Attr) bool {
+		flattenAttr(attrs, h.group, a)
+		return true
+	})
+	// The access log's 5xx records follow errors that were reported already (by the handler, or as a panic)
+	if attrString(attrs, "module") == LOG_MODULE__HTTP {
+		return err
+	}
+
+	if rec.Level >= slog.LevelError && ctx.Value(errorReportedKey{}) == nil {
+		h.r.captureRecord(ctx, rec, attrs)
+	}
+	h.r.scope(ctx).add(sentryBreadcrumb{
+		Timestamp: rec.Time.UTC().Format(time.RFC3339Nano),
+		Category:  cmp.Or(attrString(attrs, "module"), "log"),
+		Level:     sentryLevel(rec.Level),
+		Message:   rec.Message,
+		Data:      withoutScopeAttrs(attrs),
+	})
+	return err
+}
+
+func (h errorReportHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := slices.Clip(h.attrs)
+	for _, a := range attrs {
+		out = append(out, slog.Attr{Key: h.group + a.Key, Value: a.Value})
+	}
+	return errorReportHandler{h.Handler.WithAttrs(attrs), h.r, out, h.group}
+}
+
+func (h errorReportHandler) WithGroup(name string) slog.Handler {
+	return errorReportHandler{h.Handler.WithGroup(name), h.r, h.attrs, h.group + name + "."}
+}
+
+// flattenAttr adds a to dst, with group members under dotted keys ("user.id")
+func flattenAttr(dst map[string]any, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			flattenAttr(dst, prefix, ga)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+	switch v.Kind() {
+	case slog.KindString:
+		dst[prefix+a.Key] = v.String()
+	case slog.KindInt64, slog.KindUint64, slog.KindFloat64, slog.KindBool:
+		dst[prefix+a.Key] = v.Any()
+	case slog.KindTime:
+		dst[prefix+a.Key] = v.Time().Format(time.RFC3339Nano)
+	default:
+		// Durations, errors, and anything that might not survive JSON encoding
+		dst[prefix+a.Key] = fmt.Sprint(v.Any())
+	}
+}
+
+func attrString(attrs map[string]any, key string) string {
+	s, _ := attrs[key].(string)
+	return s
+}
+
+// withoutScopeAttrs returns attrs without errorScopeAttrs (nil when nothing's left)
+func withoutScopeAttrs(attrs map[string]any) map[string]any {
+	var out map[string]any
+	for k, v := range attrs {
+		if slices.Contains(errorScopeAttrs, k) {
+			continue
+		}
+		if out == nil {
+			out = map[string]any{}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+func sentryLevel(l slog.Level) string {
+	switch {
+	case l >= slog.LevelError:
+		return "error"
+	case l >= slog.LevelWarn:
+		return "warning"
+	case l >= slog.LevelInfo:
+		return "info"
+	default:
+		return "debug"
+	}
+}
+
+func callerFrames(pcs []uintptr) []runtime.Frame {
+	var out []runtime.Frame
+	frames := runtime.CallersFrames(pcs)
+	for {
+		f, more := frames.Next()
+		if f.Function != "" {
+			out = append(out, f)
+		}
+		if !more {
+			return out
+		}
+	}
+}
+
+// The parts of Sentry's event payload (https://develop.sentry.dev/sdk/data-model/event-payloads/) sent here
+
+type sentryEvent struct {
+	EventID     string             `json:"event_id"`
+	Timestamp   string             `json:"timestamp"`
+	Platform    string             `json:"platform"`
+	Level       string             `json:"level"`
+	Logger      string             `json:"logger,omitempty"`
+	ServerName  string             `json:"server_name,omitempty"`
+	Environment string             `json:"environment,omitempty"`
+	Release     string             `json:"release,omitempty"`
+	Transaction string             `json:"transaction,omitempty"`
+	LogEntry    *sentryLogEntry    `json:"logentry,omitempty"`
+	Exception   *sentryExceptions  `json:"exception,omitempty"`
+	User        *sentryUser        `json:"user,omitempty"`
+	Tags        map[string]string  `json:"tags,omitempty"`
+	Extra       map[string]any     `json:"extra,omitempty"`
+	Contexts    map[string]any     `json:"contexts,omitempty"`
+	Breadcrumbs *sentryBreadcrumbs `json:"breadcrumbs,omitempty"`
+	Fingerprint []string           `json:"fingerprint,omitempty"`
+}
+
+type sentryLogEntry struct {
+	Formatted string `json:"formatted"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value,omitempty"`
+	Mechanism  *sentryMechanism  `json:"mechanism,omitempty"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryMechanism struct {
+	Type    string `json:"type"`
+	Handled bool   `json:"handled"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// newSentryStacktrace converts frames (innermost first, as runtime.CallersFrames gives them) to Sentry's order,
+// outermost first
+func newSentryStacktrace(frames []runtime.Frame) *sentryStacktrace {
+	st := &sentryStacktrace{}
+	for _, f := range slices.Backward(frames) {
+		st.Frames = append(st.Frames, sentryFrame{
+			Function: f.Function,
+			Filename: filepath.Base(f.File),
+			AbsPath:  f.File,
+			Lineno:   f.Line,
+			InApp:    strings.HasPrefix(f.Function, "main."),
+		})
+	}
+	return st
+}
+
+// culprit returns the function nearest the error that's part of the app (the innermost frame, failing that)
+func (st *sentryStacktrace) culprit() string {
+	for _, f := range slices.Backward(st.Frames) {
+		if f.InApp {
+			return f.Function
+		}
+	}
+	if len(st.Frames) == 0 {
+		return ""
+	}
+	return st.Frames[len(st.Frames)-1].Function
+}
+
+type sentryUser struct {
+	Username string `json:"username"`
+}
+
+type sentryBreadcrumbs struct {
+	Values []sentryBreadcrumb `json:"values"`
+}
+
+type sentryBreadcrumb struct {
+	Timestamp string         `json:"timestamp"`
+	Category  string         `json:"category"`
+	Level     string         `json:"level"`
+	Message   string         `json:"message"`
+	Data      map[string]any `json:"data,omitempty"`
+}
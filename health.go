@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// HealthChecker is one thing /healthz or /readyz checks. CheckHealth should give up when ctx is done.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// HealthCheckFunc lets a plain func be a HealthChecker
+type HealthCheckFunc func(ctx context.Context) error
+
+func (f HealthCheckFunc) CheckHealth(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Health runs the registered checks for /healthz (liveness: is the process working at all? failing means restart
+// it) and /readyz (readiness: can it serve traffic right now? failing means route around it). Results are cached
+// for cacheTTL, so frequent probes don't hammer the database. Register checks before serving.
+type Health struct {
+	lifecycle *Lifecycle
+	token     string // Bearer token that unlocks per-check detail (`health_token`)
+	timeout   time.Duration
+	cacheTTL  time.Duration
+
+	liveness  []*healthCheck
+	readiness []*healthCheck
+}
+
+type healthCheck struct {
+	name    string
+	checker HealthChecker
+
+	mu        sync.Mutex // Held while checking, so concurrent probes share one run
+	checkedAt time.Time
+	duration  time.Duration
+	err       error
+}
+
+func newHealth(cfg *AppConfig, lifecycle *Lifecycle) *Health {
+	return &Health{
+		lifecycle: lifecycle,
+		token:     cfg.HealthToken,
+		timeout:   time.Duration(cfg.HealthCheckTimeout) * time.Second,
+		cacheTTL:  time.Duration(cfg.HealthCacheTTL) * time.Second,
+	}
+}
+
+// AddLiveness registers a check for /healthz (and so /readyz too, since a broken process can't serve)
+func (h *Health) AddLiveness(name string, c HealthChecker) {
+	h.liveness = append(h.liveness, &healthCheck{name: name, checker: c})
+}
+
+// AddReadiness registers a check for /readyz only
+func (h *Health) AddReadiness(name string, c HealthChecker) {
+	h.readiness = append(h.readiness, &healthCheck{name: name, checker: c})
+}
+
+// run returns hc's result, re-checking (with the per-check timeout) once the cached one is older than cacheTTL
+func (h *Health) run(hc *healthCheck) (time.Duration, error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if !hc.checkedAt.IsZero() && time.Since(hc.checkedAt) < h.cacheTTL {
+		return hc.duration, hc.err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- hc.checker.CheckHealth(ctx) }()
+	select {
+	case hc.err = <-done:
+	case <-ctx.Done():
+		// A checker that ignores ctx is left to finish in the background
+		hc.err = fmt.Errorf("timed out after %s", h.timeout)
+	}
+	hc.duration = time.Since(start)
+	hc.checkedAt = time.Now()
+	return hc.duration, hc.err
+}
+
+type healthCheckResult struct {
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// check runs checks concurrently, reporting whether all passed
+func (h *Health) check(checks []*healthCheck) (bool, map[string]healthCheckResult) {
+	results := make(map[string]healthCheckResult, len(checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ok := true
+	for _, hc := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, err := h.run(hc)
+			r := healthCheckResult{Status: "ok", DurationMS: float64(d.Microseconds()) / 1000}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				r.Status, r.Error, ok = "fail", err.Error(), false
+			}
+			results[hc.name] = r
+		}()
+	}
+	wg.Wait()
+	return ok, results
+}
+
+// authorized reports whether the request may see per-check detail (which can include internal error messages)
+func (h *Health) authorized(c *gin.Context) bool {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return ok && h.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *Health) respond(c *gin.Context, status string, results map[string]healthCheckResult) {
+	code := http.StatusOK
+	if status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	c.Header("Cache-Control", "no-store")
+	body := gin.H{"status": status}
+	if results != nil && h.authorized(c) {
+		body["checks"] = results
+	}
+	c.JSON(code, body)
+}
+
+// route_Health_Live answers /healthz. It's served ahead of the session middleware, so probes never create sessions.
+func route_Health_Live(h *Health) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ok, results := h.check(h.liveness)
+		status := "ok"
+		if !ok {
+			status = "fail"
+		}
+		h.respond(c, status, results)
+	}
+}
+
+// route_Health_Ready answers /readyz: 503 until the server is listening, once shutdown begins, or if any check fails
+func route_Health_Ready(h *Health) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch {
+		case h.lifecycle.Stopping():
+			h.respond(c, "stopping", nil)
+			return
+		case !h.lifecycle.Ready():
+			h.respond(c, "starting", nil)
+			return
+		}
+		ok, results := h.check(slices.Concat(h.liveness, h.readiness))
+		status := "ok"
+		if !ok {
+			status = "fail"
+		}
+		h.respond(c, status, results)
+	}
+}
+
+// dbHealthCheck pings the database
+func dbHealthCheck(db *gorm.DB) HealthChecker {
+	return HealthCheckFunc(func(ctx context.Context) error {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return fmt.Errorf("db.DB(): %w", err)
+		}
+		return sqlDB.PingContext(ctx)
+	})
+}
+
+// diskSpaceHealthCheck fails when the filesystem holding path has less than minFree bytes available
+func diskSpaceHealthCheck(path string, minFree uint64) HealthChecker {
+	return HealthCheckFunc(func(ctx context.Context) error {
+		free, err := diskFree(filepath.Dir(path))
+		if errors.Is(err, errors.ErrUnsupported) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("diskFree(): %w", err)
+		}
+		if free < minFree {
+			return fmt.Errorf("%d MB free, want at least %d MB", free>>20, minFree>>20)
+		}
+		return nil
+	})
+}
+
+// templatesHealthCheck fails when the page templates can't be loaded (or, when reloading from disk, no longer parse)
+func templatesHealthCheck(r *htmlRender) HealthChecker {
+	return HealthCheckFunc(func(ctx context.Context) error {
+		tmpl := r.base
+		if r.load != nil {
+			var err error
+			if tmpl, err = r.load(); err != nil {
+				return fmt.Errorf("load(): %w", err)
+			}
+		}
+		if tmpl == nil || len(tmpl.Templates()) == 0 {
+			return errors.New("no templates loaded")
+		}
+		return nil
+	})
+}
+
+// queueDepthHealthCheck fails when a background queue has more than max items waiting, i.e. its workers have
+// stalled or can't keep up. Register one for each queue the app starts.
+func queueDepthHealthCheck(depth func() int, max int) HealthChecker {
+	return HealthCheckFunc(func(ctx context.Context) error {
+		if n := depth(); n > max {
+			return fmt.Errorf("%d items queued, limit %d", n, max)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthRouter serves h's probes on a bare engine
+func healthRouter(h *Health) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	register_health_routes(r, h)
+	return r
+}
+
+func probe(t *testing.T, r http.Handler, path, token string) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest("GET", path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s: invalid JSON %q", path, w.Body.String())
+	}
+	return w.Code, body
+}
+
+func TestHealth(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	t.Run("Lifecycle", func(t *testing.T) {
+		lc := newLifecycle(logger, 0, time.Second)
+		r := healthRouter(newHealth(&AppConfig{HealthCheckTimeout: 1}, lc))
+
+		for _, tc := range []struct {
+			state      int32
+			readyCode  int
+			readyState string
+		}{
+			{LIFECYCLE__STARTING, http.StatusServiceUnavailable, "starting"},
+			{LIFECYCLE__READY, http.StatusOK, "ok"},
+			{LIFECYCLE__STOPPING, http.StatusServiceUnavailable, "stopping"},
+		} {
+			lc.state.Store(tc.state)
+			if code, body := probe(t, r, "/readyz", ""); code != tc.readyCode || body["status"] != tc.readyState {
+				t.Errorf("state %d: expected /readyz %d %s, got %d %v", tc.state, tc.readyCode, tc.readyState, code, body)
+			}
+			// Draining isn't a reason to restart the process
+			if code, _ := probe(t, r, "/healthz", ""); code != http.StatusOK {
+				t.Errorf("state %d: expected /healthz 200, got %d", tc.state, code)
+			}
+		}
+	})
+
+	t.Run("ChecksAndDetail", func(t *testing.T) {
+		lc := newLifecycle(logger, 0, time.Second)
+		lc.state.Store(LIFECYCLE__READY)
+		h := newHealth(&AppConfig{HealthToken: "s3cret", HealthCheckTimeout: 1}, lc)
+		var dbDown atomic.Bool
+		h.AddLiveness("alive", HealthCheckFunc(func(context.Context) error { return nil }))
+		h.AddReadiness("database", HealthCheckFunc(func(context.Context) error {
+			if dbDown.Load() {
+				return errors.New("connection refused")
+			}
+			return nil
+		}))
+		r := healthRouter(h)
+
+		if code, body := probe(t, r, "/readyz", ""); code != http.StatusOK || body["checks"] != nil {
+			t.Errorf("Expected a bare 200 for anonymous callers, got %d %v", code, body)
+		}
+
+		dbDown.Store(true)
+		code, body := probe(t, r, "/readyz", "wrong")
+		if code != http.StatusServiceUnavailable || body["checks"] != nil {
+			t.Errorf("Expected a bare 503 without the right token, got %d %v", code, body)
+		}
+		code, body = probe(t, r, "/readyz", "s3cret")
+		checks, _ := body["checks"].(map[string]any)
+		db, _ := checks["database"].(map[string]any)
+		if code != http.StatusServiceUnavailable || db["status"] != "fail" || db["error"] != "connection refused" {
+			t.Errorf("Expected per-check detail with the token, got %d %v", code, body)
+		}
+		if alive, _ := checks["alive"].(map[string]any); alive["status"] != "ok" {
+			t.Errorf("Expected liveness checks in /readyz too, got %v", checks)
+		}
+
+		// A readiness failure doesn't fail liveness
+		if code, body := probe(t, r, "/healthz", "s3cret"); code != http.StatusOK || len(body["checks"].(map[string]any)) != 1 {
+			t.Errorf("Expected /healthz to run only liveness checks, got %d %v", code, body)
+		}
+	})
+
+	t.Run("TimeoutAndCache", func(t *testing.T) {
+		lc := newLifecycle(logger, 0, time.Second)
+		lc.state.Store(LIFECYCLE__READY)
+		h := newHealth(&AppConfig{HealthToken: "t", HealthCheckTimeout: 1, HealthCacheTTL: 60}, lc)
+		var runs atomic.Int32
+		release := make(chan struct{})
+		defer close(release)
+		h.AddReadiness("slow", HealthCheckFunc(func(ctx context.Context) error {
+			runs.Add(1)
+			<-release // Ignores ctx, so only the per-check timeout stops it
+			return nil
+		}))
+		r := healthRouter(h)
+
+		start := time.Now()
+		code, body := probe(t, r, "/readyz", "t")
+		if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+			t.Errorf("Expected the check to be cut off after 1s, took %s", elapsed)
+		}
+		slow := body["checks"].(map[string]any)["slow"].(map[string]any)
+		if code != http.StatusServiceUnavailable || slow["error"] != "timed out after 1s" {
+			t.Errorf("Expected a timeout failure, got %d %v", code, body)
+		}
+
+		if code, _ := probe(t, r, "/readyz", ""); code != http.StatusServiceUnavailable || runs.Load() != 1 {
+			t.Errorf("Expected the cached result to be reused, got %d after %d runs", code, runs.Load())
+		}
+	})
+}
+
+func TestHealthCheckers(t *testing.T) {
+	_, dso := setupTestRouterWithDSO()
+	if err := dbHealthCheck(dso.DB).CheckHealth(context.Background()); err != nil {
+		t.Errorf("Expected the database check to pass, got %v", err)
+	}
+	sqlDB, _ := dso.DB.DB()
+	sqlDB.Close()
+	if err := dbHealthCheck(dso.DB).CheckHealth(context.Background()); err == nil {
+		t.Error("Expected the database check to fail once the database is closed")
+	}
+
+	logFile := t.TempDir() + "/app.log"
+	if err := diskSpaceHealthCheck(logFile, 1).CheckHealth(context.Background()); err != nil {
+		t.Errorf("Expected the disk check to pass, got %v", err)
+	}
+	if err := diskSpaceHealthCheck(logFile, 1<<62).CheckHealth(context.Background()); err == nil {
+		t.Error("Expected the disk check to fail when too little space is free")
+	}
+
+	broken := newReloadingHTMLRender(func() (*template.Template, error) { return nil, errors.New("parse error") })
+	if err := templatesHealthCheck(broken).CheckHealth(context.Background()); err == nil {
+		t.Error("Expected the templates check to fail when templates don't parse")
+	}
+
+	depth := 5
+	if err := queueDepthHealthCheck(func() int { return depth }, 10).CheckHealth(context.Background()); err != nil {
+		t.Errorf("Expected the queue check to pass, got %v", err)
+	}
+	depth = 11
+	if err := queueDepthHealthCheck(func() int { return depth }, 10).CheckHealth(context.Background()); err == nil {
+		t.Error("Expected the queue check to fail over its limit")
+	}
+
+	// The app's own router serves the probes without creating a session
+	w := newTestClient(t, setupTestRouter()).get("/readyz")
+	if w.Code != http.StatusOK || w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("Expected a cookie-less 200 from /readyz, got %d %q", w.Code, w.Header().Get("Set-Cookie"))
+	}
+}
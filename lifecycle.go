@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lifecycle runs the HTTP server until its context is cancelled (SIGINT/SIGTERM in main), then shuts down in order:
+// readiness starts failing, the server stops accepting connections and drains in-flight requests, and finally the
+// registered shutdown hooks run, newest first (so things are torn down in the reverse of the order they were set up).
+type Lifecycle struct {
+	logger  *slog.Logger
+	delay   time.Duration // How long to keep serving after readiness fails, so load balancers notice first
+	timeout time.Duration // How long in-flight requests get to finish, and then how long the hooks get
+
+	state atomic.Int32
+
+	mu    sync.Mutex
+	hooks []shutdownHook
+
+	tasks       sync.WaitGroup  // Background work started with Go
+	tasksCtx    context.Context // Cancelled (cancelTasks) once shutdown has stopped waiting for tasks
+	cancelTasks context.CancelFunc
+}
+
+// Lifecycle states
+const (
+	LIFECYCLE__STARTING int32 = iota
+	LIFECYCLE__READY
+	LIFECYCLE__STOPPING
+)
+
+type shutdownHook struct {
+	name string
+	fn   func(context.Context) error
+}
+
+func newLifecycle(logger *slog.Logger, delay, timeout time.Duration) *Lifecycle {
+	l := &Lifecycle{logger: logger, delay: delay, timeout: timeout}
+	l.tasksCtx, l.cancelTasks = context.WithCancel(context.Background())
+	return l
+}
+
+// Go runs fn in the background, for work a response shouldn't wait on (e.g. sending email). fn gets ctx's values
+// (its trace, say) but not its cancellation, so it outlives the request; shutdown waits for it before running the
+// hooks, and only cancels it once the shutdown timeout is up.
+func (l *Lifecycle) Go(ctx context.Context, name string, fn func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(l.tasksCtx, cancel)
+	l.tasks.Add(1)
+	go func() {
+		defer l.tasks.Done()
+		defer stop()
+		defer cancel()
+		defer func() {
+			if r := recover(); r != nil {
+				l.logger.Error("Background task panicked", "task", name, "panic", r)
+			}
+		}()
+		fn(ctx)
+	}()
+}
+
+// WaitTasks waits for the tasks started with Go to finish, or for ctx to be done
+func (l *Lifecycle) WaitTasks(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		l.tasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// OnShutdown registers fn to run after the server has drained. Hooks run in reverse registration order, and one
+// failing doesn't stop the rest.
+func (l *Lifecycle) OnShutdown(name string, fn func(context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, shutdownHook{name, fn})
+}
+
+// Ready reports whether the server is accepting traffic (false before it's listening and once shutdown starts)
+func (l *Lifecycle) Ready() bool {
+	return l.state.Load() == LIFECYCLE__READY
+}
+
+// Stopping reports whether shutdown has begun
+func (l *Lifecycle) Stopping() bool {
+	return l.state.Load() == LIFECYCLE__STOPPING
+}
+
+// Serve serves srv on ln (over TLS when certFile is set) until ctx is done or the server fails, then shuts down.
+// It always runs the shutdown hooks before returning.
+func (l *Lifecycle) Serve(ctx context.Context, srv *http.Server, ln net.Listener, certFile, keyFile string) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		if certFile != "" {
+			serveErr <- srv.ServeTLS(ln, certFile, keyFile)
+		} else {
+			serveErr <- srv.Serve(ln)
+		}
+	}()
+	l.state.Store(LIFECYCLE__READY)
+
+	var err error
+	select {
+	case err = <-serveErr:
+		l.state.Store(LIFECYCLE__STOPPING)
+		err = fmt.Errorf("srv.Serve(): %w", err)
+	case <-ctx.Done():
+		l.state.Store(LIFECYCLE__STOPPING)
+		l.logger.Info("Shutting down", "delay", l.delay, "timeout", l.timeout)
+		time.Sleep(l.delay)
+
+		drainCtx, cancel := context.WithTimeout(context.Background(), l.timeout)
+		defer cancel()
+		if err = srv.Shutdown(drainCtx); err != nil {
+			err = fmt.Errorf("srv.Shutdown(): %w", err)
+			l.logger.Error("Server did not drain in time, closing remaining connections", "error", err)
+			srv.Close()
+		} else {
+			l.logger.Info("Server drained")
+		}
+	}
+
+	return errors.Join(err, l.Shutdown())
+}
+
+// Shutdown waits for background tasks, which may still need what the hooks tear down, then runs the shutdown hooks
+// (once; later calls do nothing), giving them all the shutdown timeout between them
+func (l *Lifecycle) Shutdown() error {
+	l.mu.Lock()
+	hooks := l.hooks
+	l.hooks = nil
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+	if err := l.WaitTasks(ctx); err != nil {
+		l.logger.Error("Background tasks did not finish in time, cancelling them", "error", err)
+	}
+	l.cancelTasks()
+	var errs []error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		l.logger.Debug("running shutdown hook", "hook", hooks[i].name)
+		if err := hooks[i].fn(ctx); err != nil {
+			l.logger.Error("Shutdown hook failed", "hook", hooks[i].name, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", hooks[i].name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
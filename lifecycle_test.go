@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLifecycle(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// serve starts lc on a free port with a handler that blocks until release is closed
+	serve := func(t *testing.T, lc *Lifecycle) (url string, started, release chan struct{}, cancel func(), done chan error) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("net.Listen(): %v", err)
+		}
+		started, release = make(chan struct{}, 1), make(chan struct{})
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+			io.WriteString(w, "finished")
+		})}
+		ctx, cancel := context.WithCancel(context.Background())
+		done = make(chan error, 1)
+		go func() { done <- lc.Serve(ctx, srv, ln, "", "") }()
+		return "http://" + ln.Addr().String(), started, release, cancel, done
+	}
+
+	t.Run("DrainsThenRunsHooksInReverse", func(t *testing.T) {
+		lc := newLifecycle(logger, 0, 5*time.Second)
+		var mu sync.Mutex
+		var order []string
+		for _, name := range []string{"log file", "database", "session reaper"} {
+			lc.OnShutdown(name, func(context.Context) error {
+				mu.Lock()
+				defer mu.Unlock()
+				order = append(order, name)
+				return nil
+			})
+		}
+		url, started, release, cancel, done := serve(t, lc)
+
+		// A request is in flight when the shutdown signal arrives...
+		resp := make(chan string, 1)
+		go func() {
+			r, err := http.Get(url)
+			if err != nil {
+				resp <- err.Error()
+				return
+			}
+			defer r.Body.Close()
+			b, _ := io.ReadAll(r.Body)
+			resp <- string(b)
+		}()
+		<-started
+		if !lc.Ready() {
+			t.Error("Expected to be ready while serving")
+		}
+		cancel()
+
+		// ...readiness fails straight away, but the hooks wait for it to finish
+		deadline := time.Now().Add(2 * time.Second)
+		for lc.Ready() && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if lc.Ready() {
+			t.Fatal("Expected readiness to fail once shutdown begins")
+		}
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		if len(order) != 0 {
+			t.Errorf("Expected hooks to wait for in-flight requests, ran %v", order)
+		}
+		mu.Unlock()
+
+		close(release)
+		if got := <-resp; got != "finished" {
+			t.Errorf("Expected the in-flight request to complete, got %q", got)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("Serve(): %v", err)
+		}
+		if strings.Join(order, ",") != "session reaper,database,log file" {
+			t.Errorf("Expected hooks in reverse registration order, got %v", order)
+		}
+		if _, err := http.Get(url); err == nil {
+			t.Error("Expected new connections to be refused after shutdown")
+		}
+	})
+
+	t.Run("DrainTimeout", func(t *testing.T) {
+		lc := newLifecycle(logger, 0, 100*time.Millisecond)
+		hookErr := errors.New("boom")
+		var ran bool
+		lc.OnShutdown("ok", func(context.Context) error { ran = true; return nil })
+		lc.OnShutdown("failing", func(context.Context) error { return hookErr })
+		url, started, release, cancel, done := serve(t, lc)
+		defer close(release)
+
+		go http.Get(url)
+		<-started
+		cancel()
+		err := <-done
+		if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, hookErr) {
+			t.Errorf("Expected the drain timeout and the hook error, got %v", err)
+		}
+		if !ran {
+			t.Error("Expected a failing hook not to stop the others")
+		}
+	})
+
+	t.Run("BackgroundTasks", func(t *testing.T) {
+		lc := newLifecycle(logger, 0, 100*time.Millisecond)
+		var mu sync.Mutex
+		var order []string
+		record := func(s string) {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, s)
+		}
+		lc.OnShutdown("mailer", func(context.Context) error { record("hook"); return nil })
+
+		// Outlives the request that started it, but shutdown waits for it before the hooks
+		reqCtx, endRequest := context.WithCancel(context.Background())
+		lc.Go(reqCtx, "email", func(ctx context.Context) {
+			time.Sleep(20 * time.Millisecond)
+			if ctx.Err() != nil {
+				t.Error("Expected the task not to be cancelled with its request")
+			}
+			record("task")
+		})
+		endRequest()
+		// Cancelled once shutdown gives up on it
+		lc.Go(context.Background(), "stuck", func(ctx context.Context) {
+			<-ctx.Done()
+			record("stuck cancelled")
+		})
+		lc.Go(context.Background(), "panicking", func(context.Context) { panic("boom") })
+
+		lc.Shutdown()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := lc.WaitTasks(ctx); err != nil {
+			t.Errorf("Expected the stuck task to have been cancelled, got %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(order) != 3 || order[0] != "task" || !slices.Contains(order, "hook") {
+			t.Errorf("Expected the task to finish before the hooks ran, and the stuck one to be cancelled, got %v", order)
+		}
+	})
+}
+
+func TestPingDuringShutdown(t *testing.T) {
+	router, dso := setupTestRouterWithDSO()
+	tc := newTestClient(t, router)
+	if w := tc.get("/ping"); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 while serving, got %d", w.Code)
+	}
+	dso.Lifecycle.state.Store(LIFECYCLE__STOPPING)
+	if w := tc.get("/ping"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 once shutdown begins, got %d", w.Code)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// LevelTrace is below slog.LevelDebug, for detail too noisy even for debugging (e.g. every SQL query)
+const LevelTrace = slog.Level(-8)
+
+// Values for the `log_format` config option
+const (
+	LOG_FORMAT__JSON = "json" // One JSON object per line; for production, where logs are shipped and queried
+	LOG_FORMAT__TEXT = "text" // key=value lines; easier on the eyes in a local terminal
+)
+
+// Modules that can be given their own level (`log_modules`). A module's records carry module=<name>; log through
+// logger.With("module", LOG_MODULE__X).
+const (
+	LOG_MODULE__HTTP = "http" // The access log
+	LOG_MODULE__DB   = "db"   // GORM: every query at trace level, slow queries as warnings, failures as errors
+)
+
+// logLevelNames are accepted by `log_modules` and the log levels API, most verbose first
+var logLevelNames = []string{"trace", "debug", "info", "warn", "error"}
+
+var logLevelsByName = map[string]slog.Level{
+	"trace": LevelTrace,
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// parseLogLevel reads a level name (case-insensitive)
+func parseLogLevel(name string) (slog.Level, error) {
+	l, ok := logLevelsByName[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level '%s' (use one of %s)", name, strings.Join(logLevelNames, ", "))
+	}
+	return l, nil
+}
+
+// logLevelName is parseLogLevel's inverse
+func logLevelName(l slog.Level) string {
+	for _, name := range logLevelNames {
+		if l <= logLevelsByName[name] {
+			return name
+		}
+	}
+	return "error"
+}
+
+// configLogLevel maps `log_level` (1-5) to a slog.Level
+func configLogLevel(n int) slog.Level {
+	switch n {
+	case 1:
+		return slog.LevelError
+	case 2:
+		return slog.LevelWarn
+	case 4:
+		return slog.LevelDebug
+	case 5:
+		return LevelTrace
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// ParseLogSettings validates `log_format` and parses `log_modules` ("db=debug, http=warn") into LogModuleLevels
+func (a *AppConfig) ParseLogSettings() error {
+	switch a.LogFormat {
+	case "":
+		a.LogFormat = LOG_FORMAT__JSON
+	case LOG_FORMAT__JSON, LOG_FORMAT__TEXT:
+	default:
+		return fmt.Errorf("unknown log_format '%s'", a.LogFormat)
+	}
+
+	a.LogModuleLevels = map[string]slog.Level{}
+	for entry := range strings.SplitSeq(a.LogModules, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		module, name, ok := strings.Cut(entry, "=")
+		module = strings.TrimSpace(module)
+		if !ok || module == "" {
+			return fmt.Errorf("log_modules entry '%s' isn't module=level", strings.TrimSpace(entry))
+		}
+		level, err := parseLogLevel(name)
+		if err != nil {
+			return fmt.Errorf("log_modules '%s': %w", module, err)
+		}
+		a.LogModuleLevels[module] = level
+	}
+	return nil
+}
+
+// LogLevels are the logger's levels, adjustable at runtime (the admin API, SIGUSR1/SIGUSR2): a base level, and
+// overrides for modules. The configured levels are kept, for Reset().
+type LogLevels struct {
+	base *slog.LevelVar
+
+	mu      sync.RWMutex
+	modules map[string]slog.Level
+
+	configured        slog.Level
+	configuredModules map[string]slog.Level
+}
+
+func newLogLevels(base slog.Level, modules map[string]slog.Level) *LogLevels {
+	l := &LogLevels{base: new(slog.LevelVar), configured: base, configuredModules: maps.Clone(modules)}
+	l.Reset()
+	return l
+}
+
+// Level returns the base level (the one for records outside any overridden module)
+func (l *LogLevels) Level() slog.Level {
+	return l.base.Level()
+}
+
+// SetLevel changes the base level
+func (l *LogLevels) SetLevel(level slog.Level) {
+	l.base.Set(level)
+}
+
+// SetModule overrides module's level
+func (l *LogLevels) SetModule(module string, level slog.Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.modules[module] = level
+}
+
+// ClearModule drops module's override, so it follows the base level again
+func (l *LogLevels) ClearModule(module string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.modules, module)
+}
+
+// Modules returns the module overrides
+func (l *LogLevels) Modules() map[string]slog.Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return maps.Clone(l.modules)
+}
+
+// Reset restores the configured levels
+func (l *LogLevels) Reset() {
+	l.base.Set(l.configured)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.modules = maps.Clone(l.configuredModules)
+	if l.modules == nil {
+		l.modules = map[string]slog.Level{}
+	}
+}
+
+// MoreVerbose lowers the base level one step (error → warn → info → debug → trace), returning the new level
+func (l *LogLevels) MoreVerbose() slog.Level {
+	current := logLevelName(l.Level())
+	if i := slices.Index(logLevelNames, current); i > 0 {
+		l.base.Set(logLevelsByName[logLevelNames[i-1]])
+	}
+	return l.Level()
+}
+
+// enabled reports whether a record at level is logged for module ("" for none)
+func (l *LogLevels) enabled(module string, level slog.Level) bool {
+	if module != "" {
+		l.mu.RLock()
+		override, ok := l.modules[module]
+		l.mu.RUnlock()
+		if ok {
+			return level >= override
+		}
+	}
+	return level >= l.base.Level()
+}
+
+// levelHandler filters records by LogLevels, using the level of the module its logger was tagged with
+type levelHandler struct {
+	slog.Handler
+	levels *LogLevels
+	module string
+}
+
+func (h levelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return h.levels.enabled(h.module, level)
+}
+
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	module := h.module
+	for _, a := range attrs {
+		if a.Key == "module" {
+			module = a.Value.String()
+		}
+	}
+	return levelHandler{h.Handler.WithAttrs(attrs), h.levels, module}
+}
+
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{h.Handler.WithGroup(name), h.levels, h.module}
+}
+
+// replaceLevelName shows LevelTrace as "TRACE" rather than slog's "DEBUG-4"
+func replaceLevelName(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		if l, ok := a.Value.Any().(slog.Level); ok && l <= LevelTrace {
+			a.Value = slog.StringValue("TRACE")
+		}
+	}
+	return a
+}
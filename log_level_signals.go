@@ -0,0 +1,35 @@
+//go:build unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchLogLevelSignals makes SIGUSR1 turn the base log level up a step (info → debug → trace) and SIGUSR2 restore
+// the configured levels, for a look inside a running process without a restart. The returned func stops listening.
+func watchLogLevelSignals(levels *LogLevels, logger *slog.Logger) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for sig := range sigs {
+			if sig == syscall.SIGUSR1 {
+				levels.MoreVerbose()
+			} else {
+				levels.Reset()
+			}
+			// Warn, so it shows at all but the quietest levels
+			logger.Warn("Log level changed", "signal", sig.String(), "level", logLevelName(levels.Level()))
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(sigs)
+		<-done
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "log/slog"
+
+// watchLogLevelSignals is a no-op where there's no SIGUSR1/SIGUSR2; use the log levels API instead
+func watchLogLevelSignals(*LogLevels, *slog.Logger) (stop func()) {
+	return func() {}
+}
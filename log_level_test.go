@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseLogSettings(t *testing.T) {
+	cfg := &AppConfig{LogModules: " db=Debug,http = warn, "}
+	if err := cfg.ParseLogSettings(); err != nil {
+		t.Fatalf("ParseLogSettings(): %v", err)
+	}
+	if cfg.LogFormat != LOG_FORMAT__JSON || len(cfg.LogModuleLevels) != 2 ||
+		cfg.LogModuleLevels["db"] != slog.LevelDebug || cfg.LogModuleLevels["http"] != slog.LevelWarn {
+		t.Errorf("Unexpected settings: format %q, modules %v", cfg.LogFormat, cfg.LogModuleLevels)
+	}
+
+	for _, bad := range []*AppConfig{
+		{LogModules: "db=verbose"},
+		{LogModules: "db"},
+		{LogModules: "=debug"},
+		{LogFormat: "xml"},
+	} {
+		if err := bad.ParseLogSettings(); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	var buf bytes.Buffer
+	levels := newLogLevels(slog.LevelInfo, map[string]slog.Level{LOG_MODULE__DB: LevelTrace})
+	logger := slog.New(levelHandler{
+		Handler: slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: LevelTrace, ReplaceAttr: replaceLevelName}),
+		levels:  levels,
+	})
+	db := logger.With("module", LOG_MODULE__DB)
+	logged := func(fn func()) string {
+		buf.Reset()
+		fn()
+		return buf.String()
+	}
+
+	t.Run("ModuleOverride", func(t *testing.T) {
+		if out := logged(func() { logger.Debug("base debug") }); out != "" {
+			t.Errorf("Expected debug to be filtered at info, got %s", out)
+		}
+		out := logged(func() { db.Log(t.Context(), LevelTrace, "select") })
+		if !strings.Contains(out, `"level":"TRACE"`) || !strings.Contains(out, `"module":"db"`) {
+			t.Errorf("Expected the db module's trace record, got %s", out)
+		}
+	})
+
+	t.Run("MoreVerboseAndReset", func(t *testing.T) {
+		for _, want := range []slog.Level{slog.LevelDebug, LevelTrace, LevelTrace} {
+			if got := levels.MoreVerbose(); got != want {
+				t.Errorf("Expected %v, got %v", want, got)
+			}
+		}
+		if out := logged(func() { logger.Debug("base debug") }); out == "" {
+			t.Error("Expected debug to be logged once turned up")
+		}
+
+		levels.ClearModule(LOG_MODULE__DB)
+		levels.SetLevel(slog.LevelError)
+		if out := logged(func() { db.Warn("slow query") }); out != "" {
+			t.Errorf("Expected the db module to follow the base level without its override, got %s", out)
+		}
+
+		levels.Reset()
+		if levels.Level() != slog.LevelInfo || levels.Modules()[LOG_MODULE__DB] != LevelTrace {
+			t.Errorf("Expected the configured levels back, got %v %v", levels.Level(), levels.Modules())
+		}
+	})
+}
+
+func TestGormLogger(t *testing.T) {
+	var buf bytes.Buffer
+	levels := newLogLevels(slog.LevelInfo, nil)
+	logger := slog.New(levelHandler{Handler: slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: LevelTrace}), levels: levels})
+	db, err := bootstrapSqliteDb(":memory:")
+	if err != nil {
+		t.Fatalf("bootstrapSqliteDb(): %v", err)
+	}
+	db.Logger = newGormLogger(logger.With("module", LOG_MODULE__DB))
+
+	if _, err := createUser(db, "frank", "correct horse", SESSUSR__USER); err != nil {
+		t.Fatalf("createUser(): %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected queries to stay out of the log at info, got %s", buf.String())
+	}
+
+	levels.SetModule(LOG_MODULE__DB, LevelTrace)
+	if _, err := findUserByUsername(db, "frank"); err != nil {
+		t.Fatalf("findUserByUsername(): %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, `"msg":"query"`) || !strings.Contains(out, `"sql":"SELECT`) {
+		t.Errorf("Expected the query at trace level, got %s", out)
+	}
+	if strings.Contains(out, "frank") {
+		t.Errorf("Expected bound values to be left out of the SQL, got %s", out)
+	}
+}
+
+func TestLogLevelsAPI(t *testing.T) {
+	router, dso := setupTestRouterWithDSO(func(cfg *AppConfig) {
+		cfg.Roles = map[string][]string{"ops": {PERM__LOGS_MANAGE}}
+	})
+	dso.LogLevels = newLogLevels(slog.LevelInfo, map[string]slog.Level{LOG_MODULE__HTTP: slog.LevelWarn})
+	tc := newTestClient(t, router)
+	token := func(username string, role uint64, scopes ...string) string {
+		u, err := createUser(dso.DB, username, "correct horse", role)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		plaintext, _, err := createAPIToken(dso.DB, u, "ops", scopes, 0)
+		if err != nil {
+			t.Fatalf("createAPIToken(): %v", err)
+		}
+		return plaintext
+	}
+	admin := token("alice", SESSUSR__ADMIN, APISCOPE__READ, APISCOPE__ADMIN)
+	adminReadOnly := token("bob", SESSUSR__ADMIN, APISCOPE__READ)
+	user := token("frank", SESSUSR__USER, APISCOPE__READ)
+
+	t.Run("AdminOnly", func(t *testing.T) {
+		for _, tok := range []string{adminReadOnly, user} {
+			if w := apiRequest(t, tc, "GET", "/api/admin/log-levels", tok, nil); w.Code != http.StatusForbidden {
+				t.Errorf("Expected 403, got %d", w.Code)
+			}
+		}
+	})
+
+	t.Run("PermissionNotRoleBit", func(t *testing.T) {
+		// Granted through a named role, with a cookie session (admin-scoped tokens are for admins only)
+		u, err := createUser(dso.DB, "carol", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		dso.DB.Model(u).Update("roles", "ops")
+		ops := newTestClient(t, router)
+		ops.login("carol", "correct horse")
+		if w := apiRequest(t, ops, "GET", "/api/admin/log-levels", "", nil); w.Code != http.StatusOK {
+			t.Errorf("Expected the ops role to grant access, got %d", w.Code)
+		}
+
+		// logs.manage is AdminOnly, so an admin impersonating carol doesn't get it
+		root := newTestClient(t, router)
+		root.login("alice", "correct horse")
+		root.postForm(adminUserPath(u)+"/impersonate", url.Values{})
+		if w := apiRequest(t, root, "GET", "/api/admin/log-levels", "", nil); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 while impersonating, got %d", w.Code)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		body := []byte(`{"level": "debug", "modules": {"db": "trace", "http": ""}}`)
+		w := apiRequest(t, tc, "PUT", "/api/admin/log-levels", admin, body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var got struct {
+			Level   string            `json:"level"`
+			Modules map[string]string `json:"modules"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &got)
+		if got.Level != "debug" || len(got.Modules) != 1 || got.Modules["db"] != "trace" {
+			t.Errorf("Unexpected levels %+v", got)
+		}
+		if dso.LogLevels.Level() != slog.LevelDebug {
+			t.Errorf("Expected the logger's level to change, got %v", dso.LogLevels.Level())
+		}
+	})
+
+	t.Run("InvalidLevel", func(t *testing.T) {
+		before := dso.LogLevels.Level()
+		w := apiRequest(t, tc, "PUT", "/api/admin/log-levels", admin, []byte(`{"level": "error", "modules": {"db": "loud"}}`))
+		if w.Code != http.StatusBadRequest || dso.LogLevels.Level() != before {
+			t.Errorf("Expected 400 and nothing changed, got %d and %v", w.Code, dso.LogLevels.Level())
+		}
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		w := apiRequest(t, tc, "DELETE", "/api/admin/log-levels", admin, nil)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `{"level":"info","modules":{"http":"warn"}}`) {
+			t.Errorf("Expected the configured levels back, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotateRetryDelay is how long Write waits before trying again after a rotation failed
+const rotateRetryDelay = time.Minute
+
+// backupTimeFormat stamps rotated log files: app.log becomes app-2006-01-02T15-04-05.000.log(.gz)
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingFile is the log_file writer. It rotates the file once it reaches maxSize bytes or a rotation interval
+// boundary passes, gzips the rotated file and prunes backups beyond maxBackups or older than maxAge, all in the
+// background. Reopen() supports external rotation (logrotate's `postrotate kill -HUP`). Zero values disable the
+// respective limit.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	maxAge     time.Duration
+	compress   bool
+	now        func() time.Time
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	retryAt  time.Time // No automatic rotation before this, after one failed
+
+	millMu sync.Mutex // Serializes background compress/prune runs
+	mill   sync.WaitGroup
+}
+
+func newRotatingFile(cfg *AppConfig) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path:       cfg.LogFile,
+		maxSize:    int64(cfg.LogMaxSizeMB) << 20,
+		interval:   time.Duration(cfg.LogRotateInterval) * time.Hour,
+		maxBackups: cfg.LogMaxBackups,
+		maxAge:     time.Duration(cfg.LogMaxAge) * 24 * time.Hour,
+		compress:   cfg.LogCompress,
+		now:        time.Now,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// open (re)opens path for appending; the current period starts when the file was last written, so a file left
+// over from an earlier period is rotated on the first write
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile(): %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("f.Stat(): %w", err)
+	}
+	rf.file, rf.size, rf.openedAt = f, info.Size(), rf.now()
+	if info.Size() > 0 {
+		rf.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+// Write implements io.Writer, rotating first when p would take the file past maxSize or the period has ended
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if rf.size > 0 && !rf.now().Before(rf.retryAt) && (rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize ||
+		rf.interval > 0 && !rf.now().Before(rf.openedAt.Truncate(rf.interval).Add(rf.interval))) {
+		// A failed rotation has already been reported and the file reopened; keep logging unless even that failed
+		if err := rf.rotate(); err != nil && rf.file == nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the file now
+func (rf *rotatingFile) Rotate() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return os.ErrClosed
+	}
+	return rf.rotate()
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return fmt.Errorf("file.Close(): %w", err)
+	}
+	rf.file = nil
+	now := rf.now()
+	ext := filepath.Ext(rf.path)
+	backup := strings.TrimSuffix(rf.path, ext) + "-" + now.Format(backupTimeFormat) + ext
+	if err := os.Rename(rf.path, backup); err != nil {
+		return rf.recoverRotation(fmt.Errorf("os.Rename(): %w", err))
+	}
+	if err := rf.open(); err != nil {
+		// Put the old file back, so logging can carry on in it
+		if rerr := os.Rename(backup, rf.path); rerr != nil {
+			err = errors.Join(err, fmt.Errorf("os.Rename(): %w", rerr))
+		}
+		return rf.recoverRotation(err)
+	}
+
+	rf.mill.Add(1)
+	go func() {
+		defer rf.mill.Done()
+		rf.millMu.Lock()
+		defer rf.millMu.Unlock()
+		// Nowhere to log these but the file itself, which is just what's failing; STDERR it is
+		if rf.compress {
+			if err := gzipFile(backup); err != nil {
+				fmt.Fprintf(os.Stderr, "log rotation: gzipFile(): %v\n", err)
+			}
+		}
+		if err := rf.prune(now); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation: prune(): %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// recoverRotation reopens path after rotate failed with err, so logging carries on in the unrotated file rather than
+// every later Write failing. With the file itself unusable the failure goes to STDERR. Returns err (plus any error
+// reopening).
+func (rf *rotatingFile) recoverRotation(err error) error {
+	rf.retryAt = rf.now().Add(rotateRetryDelay)
+	if oerr := rf.open(); oerr != nil {
+		err = errors.Join(err, oerr)
+		fmt.Fprintf(os.Stderr, "log rotation: %v; logging to %s has stopped\n", err, rf.path)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "log rotation: %v; still logging to %s, retrying in %s\n", err, rf.path, rotateRetryDelay)
+	return err
+}
+
+// Reopen reopens the file at path, for after something else has moved it aside. The old file is only closed once
+// the new one is open, so a failure leaves logging going where it was.
+func (rf *rotatingFile) Reopen() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return os.ErrClosed
+	}
+	old := rf.file
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if err := old.Close(); err != nil {
+		return fmt.Errorf("file.Close(): %w", err)
+	}
+	return nil
+}
+
+// Close flushes and closes the file, after waiting for any compression/pruning under way
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.mill.Wait()
+	if rf.file == nil {
+		return nil
+	}
+	err := errors.Join(rf.file.Sync(), rf.file.Close())
+	rf.file = nil
+	return err
+}
+
+// logBackup is a rotated log file
+type logBackup struct {
+	path string
+	at   time.Time // When it was rotated
+}
+
+// backups lists the rotated files, newest first
+func (rf *rotatingFile) backups() ([]logBackup, error) {
+	dir, ext := filepath.Dir(rf.path), filepath.Ext(rf.path)
+	prefix := filepath.Base(strings.TrimSuffix(rf.path, ext)) + "-"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadDir(): %w", err)
+	}
+	var found []logBackup
+	for _, e := range entries {
+		stamp, ok := strings.CutPrefix(strings.TrimSuffix(e.Name(), ".gz"), prefix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		if stamp, ok = strings.CutSuffix(stamp, ext); !ok {
+			continue
+		}
+		if at, err := time.ParseInLocation(backupTimeFormat, stamp, time.Local); err == nil {
+			found = append(found, logBackup{filepath.Join(dir, e.Name()), at})
+		}
+	}
+	slices.SortFunc(found, func(a, b logBackup) int { return b.at.Compare(a.at) })
+	return found, nil
+}
+
+// prune removes the backups beyond maxBackups and those older than maxAge (as of now)
+func (rf *rotatingFile) prune(now time.Time) error {
+	if rf.maxBackups <= 0 && rf.maxAge <= 0 {
+		return nil
+	}
+	found, err := rf.backups()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i, b := range found {
+		if rf.maxBackups > 0 && i >= rf.maxBackups || rf.maxAge > 0 && now.Sub(b.at) > rf.maxAge {
+			if err := os.Remove(b.path); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// gzipFile replaces name with name.gz
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("os.Open(): %w", err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile(): %w", err)
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(name + ".gz")
+		return fmt.Errorf("io.Copy(): %w", err)
+	}
+	if err := errors.Join(zw.Close(), dst.Close()); err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	src.Close()
+	return os.Remove(name)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	// setup opens dir/app.log, with a clock the test moves forward by hand
+	setup := func(t *testing.T, cfg AppConfig) (*rotatingFile, *time.Time) {
+		t.Helper()
+		cfg.LogFile = filepath.Join(t.TempDir(), "app.log")
+		rf, err := newRotatingFile(&cfg)
+		if err != nil {
+			t.Fatalf("newRotatingFile(): %v", err)
+		}
+		now := time.Date(2026, 3, 14, 9, 0, 0, 0, time.Local)
+		rf.now = func() time.Time { return now }
+		rf.openedAt = now
+		t.Cleanup(func() { rf.Close() })
+		return rf, &now
+	}
+	write := func(t *testing.T, rf *rotatingFile, s string) {
+		t.Helper()
+		if _, err := rf.Write([]byte(s)); err != nil {
+			t.Fatalf("Write(): %v", err)
+		}
+	}
+	// read returns a (possibly gzipped) file's contents
+	read := func(t *testing.T, name string) string {
+		t.Helper()
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatalf("os.Open(): %v", err)
+		}
+		defer f.Close()
+		var r io.Reader = f
+		if strings.HasSuffix(name, ".gz") {
+			if r, err = gzip.NewReader(f); err != nil {
+				t.Fatalf("gzip.NewReader(): %v", err)
+			}
+		}
+		b, _ := io.ReadAll(r)
+		return string(b)
+	}
+	backups := func(t *testing.T, rf *rotatingFile) []logBackup {
+		t.Helper()
+		rf.mill.Wait()
+		found, err := rf.backups()
+		if err != nil {
+			t.Fatalf("backups(): %v", err)
+		}
+		return found
+	}
+
+	t.Run("BySize", func(t *testing.T) {
+		rf, now := setup(t, AppConfig{LogCompress: true})
+		rf.maxSize = 10
+		write(t, rf, "0123456789")
+		*now = now.Add(time.Second)
+		write(t, rf, "abc") // Would take it past 10 bytes
+
+		found := backups(t, rf)
+		if len(found) != 1 || !strings.HasSuffix(found[0].path, "app-2026-03-14T09-00-01.000.log.gz") {
+			t.Fatalf("Expected one gzipped backup, got %v", found)
+		}
+		if got := read(t, found[0].path); got != "0123456789" {
+			t.Errorf("Expected the rotated content in the backup, got %q", got)
+		}
+		if got := read(t, rf.path); got != "abc" {
+			t.Errorf("Expected a fresh log file, got %q", got)
+		}
+	})
+
+	t.Run("ByInterval", func(t *testing.T) {
+		rf, now := setup(t, AppConfig{LogRotateInterval: 24})
+		write(t, rf, "day one\n")
+		*now = now.Add(time.Hour)
+		write(t, rf, "still day one\n")
+		if found := backups(t, rf); len(found) != 0 {
+			t.Fatalf("Expected no rotation within the day, got %v", found)
+		}
+		*now = now.Add(24 * time.Hour)
+		write(t, rf, "day two\n")
+
+		found := backups(t, rf)
+		if len(found) != 1 || read(t, found[0].path) != "day one\nstill day one\n" {
+			t.Fatalf("Expected day one in an uncompressed backup, got %v", found)
+		}
+	})
+
+	t.Run("MaxBackups", func(t *testing.T) {
+		rf, now := setup(t, AppConfig{LogMaxBackups: 2})
+		for _, s := range []string{"1", "2", "3", "4"} {
+			write(t, rf, s)
+			*now = now.Add(time.Minute)
+			if err := rf.Rotate(); err != nil {
+				t.Fatalf("Rotate(): %v", err)
+			}
+		}
+		found := backups(t, rf)
+		if len(found) != 2 || read(t, found[0].path) != "4" || read(t, found[1].path) != "3" {
+			t.Errorf("Expected only the two newest backups to be kept, got %v", found)
+		}
+	})
+
+	t.Run("MaxAge", func(t *testing.T) {
+		rf, now := setup(t, AppConfig{LogMaxAge: 7})
+		write(t, rf, "old")
+		rf.Rotate()
+		*now = now.Add(8 * 24 * time.Hour)
+		write(t, rf, "new")
+		rf.Rotate()
+		found := backups(t, rf)
+		if len(found) != 1 || read(t, found[0].path) != "new" {
+			t.Errorf("Expected the week-old backup to be removed, got %v", found)
+		}
+	})
+
+	t.Run("FailedRotationKeepsLogging", func(t *testing.T) {
+		rf, now := setup(t, AppConfig{})
+		rf.maxSize = 10
+		write(t, rf, "0123456789")
+		// A directory in the way of the backup makes the rename fail
+		*now = now.Add(time.Second)
+		backup := filepath.Join(filepath.Dir(rf.path), "app-"+now.Format(backupTimeFormat)+".log")
+		if err := os.MkdirAll(filepath.Join(backup, "x"), 0755); err != nil {
+			t.Fatalf("os.MkdirAll(): %v", err)
+		}
+		write(t, rf, "abc")
+		write(t, rf, "def") // Not retried until rotateRetryDelay has passed
+		if got := read(t, rf.path); got != "0123456789abcdef" {
+			t.Errorf("Expected logging to carry on in the unrotated file, got %q", got)
+		}
+		if err := rf.Rotate(); err == nil {
+			t.Error("Expected Rotate() to report the failure")
+		}
+		write(t, rf, "ghi")
+
+		// Once the way is clear, the next write after the delay rotates
+		os.RemoveAll(backup)
+		*now = now.Add(rotateRetryDelay)
+		write(t, rf, "jkl")
+		if found := backups(t, rf); len(found) != 1 || read(t, found[0].path) != "0123456789abcdefghi" {
+			t.Errorf("Expected the retried rotation to succeed, got %v", found)
+		}
+		if got := read(t, rf.path); got != "jkl" {
+			t.Errorf("Expected a fresh log file, got %q", got)
+		}
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		rf, _ := setup(t, AppConfig{})
+		write(t, rf, "before")
+		// What logrotate does before sending SIGHUP
+		moved := rf.path + ".1"
+		if err := os.Rename(rf.path, moved); err != nil {
+			t.Fatalf("os.Rename(): %v", err)
+		}
+		if err := rf.Reopen(); err != nil {
+			t.Fatalf("Reopen(): %v", err)
+		}
+		write(t, rf, "after")
+		if read(t, moved) != "before" || read(t, rf.path) != "after" {
+			t.Errorf("Expected writes after Reopen() to go to a new file, got %q and %q", read(t, moved), read(t, rf.path))
+		}
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		rf, _ := setup(t, AppConfig{})
+		if err := rf.Close(); err != nil {
+			t.Fatalf("Close(): %v", err)
+		}
+		if _, err := rf.Write([]byte("late")); err == nil {
+			t.Error("Expected writes after Close() to fail")
+		}
+	})
+}
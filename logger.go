@@ -1,47 +1,66 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
-// SetupLogger initializes and configures the slog logger based on AppConfig settings
-func SetupLogger(logLevel int, logFile string) *slog.Logger {
-	// Map log level (1-5) to slog.Level
-	var level slog.Level
-	switch logLevel {
-	case 1:
-		level = slog.LevelError
-	case 2:
-		level = slog.LevelWarn
-	case 4, 5: // Map both Debug and Trace to Debug (slog doesn't have Trace)
-		level = slog.LevelDebug
-	default: // Default to Info
-		level = slog.LevelInfo
-	}
+// SetupLogger initializes and configures the slog logger based on AppConfig settings. A log_file is rotated as
+// configured (see rotatingFile) and reopened on SIGHUP. Error-level records go to reporter, when it's enabled. It
+// also returns the levels, which can be changed at runtime (see LogLevels), and a func that flushes and closes the
+// log file (a no-op when logging to STDOUT).
+func SetupLogger(cfg *AppConfig, reporter *errorReporter) (*slog.Logger, *LogLevels, func() error) {
+	logFile := cfg.LogFile
+
+	// Map log level (1-5) to slog.Level, plus any per-module overrides
+	levels := newLogLevels(configLogLevel(cfg.LogLevel), cfg.LogModuleLevels)
 
 	// Determine output destination
 	var output io.Writer
+	closeLog := func() error { return nil }
 	if logFile == "" {
 		output = os.Stdout
 	} else {
-		logf, err := os.OpenFile(logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		logf, err := newRotatingFile(cfg)
 		if err != nil {
 			// Can't use logger yet, use stderr
 			slog.Error("Error opening log file", "file", logFile, "error", err)
 			os.Exit(1)
 		}
 		output = logf
+		stopReopen := reopenOnSIGHUP(logf)
+		closeLog = func() error {
+			stopReopen()
+			if err := logf.Close(); err != nil {
+				return fmt.Errorf("logf.Close(): %w", err)
+			}
+			return nil
+		}
 	}
 
 	// Create handler options
+	// (levelHandler does the filtering, so the handler itself lets everything through)
 	opts := &slog.HandlerOptions{
-		Level: level,
+		Level:       LevelTrace,
+		ReplaceAttr: replaceLevelName,
 	}
 
-	// Create JSON handler for structured logging
-	handler := slog.NewJSONHandler(output, opts)
+	// Create JSON (or, for local development, text) handler for structured logging
+	// (traceLogHandler adds trace_id/span_id to records logged with a request's context)
+	var base slog.Handler = slog.NewJSONHandler(output, opts)
+	if cfg.LogFormat == LOG_FORMAT__TEXT {
+		base = slog.NewTextHandler(output, opts)
+	}
+	var filtered slog.Handler = levelHandler{Handler: base, levels: levels}
+	if reporter.Enabled() {
+		filtered = errorReportHandler{Handler: filtered, r: reporter}
+	}
+	// (redactHandler masks secrets and personal data before anything else sees the record)
+	handler := redactHandler{traceLogHandler{filtered}, newRedactor(cfg)}
 	logger := slog.New(handler)
 
 	// Set as default logger
@@ -54,5 +73,36 @@ func SetupLogger(logLevel int, logFile string) *slog.Logger {
 		logger.Info("Logging to file", "file", logFile)
 	}
 
-	return logger
+	// SIGUSR1/SIGUSR2 turn verbosity up/back (where the platform has them)
+	stopSignals := watchLogLevelSignals(levels, logger)
+	closeFile := closeLog
+	closeLog = func() error {
+		stopSignals()
+		return closeFile()
+	}
+
+	return logger, levels, closeLog
+}
+
+// reopenOnSIGHUP reopens logf whenever the process gets SIGHUP, so external tools (logrotate) can move the file
+// aside. The returned func stops listening.
+func reopenOnSIGHUP(logf *rotatingFile) (stop func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range hup {
+			if err := logf.Reopen(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error reopening log file: %v\n", err)
+				continue
+			}
+			slog.Info("Reopened log file on SIGHUP")
+		}
+	}()
+	return func() {
+		signal.Stop(hup)
+		close(hup)
+		<-done
+	}
 }
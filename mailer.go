@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Supported values for the `mailer` config option
+const (
+	MAILER__OUTBOX = "outbox" // Write messages to `outbox_dir` (and the log) instead of sending them; for dev/tests
+	MAILER__SMTP   = "smtp"   // Deliver via an SMTP relay
+)
+
+// Mail is a single plain-text email
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers email. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(ctx context.Context, m Mail) error
+}
+
+// newMailer builds the Mailer chosen by the `mailer` config option
+func newMailer(cfg *AppConfig, logger *slog.Logger) (Mailer, error) {
+	switch cfg.Mailer {
+	case MAILER__OUTBOX, "":
+		if err := os.MkdirAll(cfg.OutboxDir, 0700); err != nil {
+			return nil, fmt.Errorf("os.MkdirAll(): %w", err)
+		}
+		return &outboxMailer{from: cfg.MailFrom, dir: cfg.OutboxDir, logger: logger}, nil
+	case MAILER__SMTP:
+		if cfg.SMTPHost == "" {
+			return nil, fmt.Errorf("'smtp_host' is required when mailer = 'smtp'")
+		}
+		// `mail_from` may carry a display name, which is only valid in the From: header, not in MAIL FROM
+		sender, err := mail.ParseAddress(cfg.MailFrom)
+		if err != nil {
+			return nil, fmt.Errorf("'mail_from' is not a valid address: %w", err)
+		}
+		return &smtpMailer{
+			from:     cfg.MailFrom,
+			envelope: sender.Address,
+			addr:     net.JoinHostPort(cfg.SMTPHost, fmt.Sprint(cfg.SMTPPort)),
+			host:     cfg.SMTPHost,
+			username: cfg.SMTPUsername,
+			password: cfg.SMTPPassword,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer '%s'", cfg.Mailer)
+	}
+}
+
+// buildMessage renders m as an RFC 5322 message
+func buildMessage(from string, m Mail) ([]byte, error) {
+	for _, v := range []string{from, m.To, m.Subject} {
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, fmt.Errorf("header value contains a line break")
+		}
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("rand.Read(): %w", err)
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = strings.Trim(from[at+1:], "> ")
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes(), nil
+}
+
+// smtpMailer sends through an SMTP relay, upgrading to TLS via STARTTLS when the server offers it
+type smtpMailer struct {
+	from     string // From: header, possibly with a display name
+	envelope string // Bare address used as the SMTP envelope sender
+	addr     string
+	host     string
+	username string
+	password string
+}
+
+// smtpTimeout bounds a whole SMTP conversation when the caller's context has no deadline of its own
+const smtpTimeout = 30 * time.Second
+
+func (s *smtpMailer) Send(ctx context.Context, m Mail) error {
+	msg, err := buildMessage(s.from, m)
+	if err != nil {
+		return fmt.Errorf("buildMessage(): %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("d.DialContext(): %w", err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return fmt.Errorf("conn.SetDeadline(): %w", err)
+	}
+	// Unblock any pending read/write as soon as the context is cancelled (e.g. on shutdown)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		return fmt.Errorf("smtp.NewClient(): %w", err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return fmt.Errorf("c.StartTLS(): %w", err)
+		}
+	}
+	if s.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.username, s.password, s.host)); err != nil {
+			return fmt.Errorf("c.Auth(): %w", err)
+		}
+	}
+	if err := c.Mail(s.envelope); err != nil {
+		return fmt.Errorf("c.Mail(): %w", err)
+	}
+	if err := c.Rcpt(m.To); err != nil {
+		return fmt.Errorf("c.Rcpt(): %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("c.Data(): %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("w.Write(): %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("w.Close(): %w", err)
+	}
+	if err := c.Quit(); err != nil {
+		return fmt.Errorf("c.Quit(): %w", err)
+	}
+	return nil
+}
+
+// outboxMailer writes each message to a .eml file (and logs it) instead of delivering it, so flows that send email
+// work offline
+type outboxMailer struct {
+	from   string
+	dir    string
+	logger *slog.Logger
+}
+
+func (o *outboxMailer) Send(ctx context.Context, m Mail) error {
+	msg, err := buildMessage(o.from, m)
+	if err != nil {
+		return fmt.Errorf("buildMessage(): %w", err)
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Errorf("rand.Read(): %w", err)
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405"), hex.EncodeToString(suffix))
+	path := filepath.Join(o.dir, name)
+	if err := os.WriteFile(path, msg, 0600); err != nil {
+		return fmt.Errorf("os.WriteFile(): %w", err)
+	}
+	o.logger.Info("mail written to outbox", "to", m.To, "subject", m.Subject, "file", path)
+	return nil
+}
+
+// loadMailTemplates parses the plain-text email templates (templates/email), from the embedded files when
+// templates are cached and from disk otherwise (mirroring the HTML templates)
+func loadMailTemplates(cfg *AppConfig) (*template.Template, error) {
+	if cfg.CacheTemplates || os.Getenv("ENVIRONMENT") == "production" {
+		t, err := template.New("email").ParseFS(embeddedFiles, "templates/email/*.tmpl")
+		if err != nil {
+			return nil, fmt.Errorf("template.ParseFS(): %w", err)
+		}
+		return t, nil
+	}
+	t, err := template.New("email").ParseGlob(filepath.Join(cfg.WorkingDir, "templates/email/*.tmpl"))
+	if err != nil {
+		return nil, fmt.Errorf("template.ParseGlob(): %w", err)
+	}
+	return t, nil
+}
+
+// renderMail executes the named email template. Templates start with a "Subject: ..." line followed by a blank
+// line and the body.
+func renderMail(t *template.Template, name string, to string, data any) (Mail, error) {
+	var b bytes.Buffer
+	if err := t.ExecuteTemplate(&b, name, data); err != nil {
+		return Mail{}, fmt.Errorf("t.ExecuteTemplate(): %w", err)
+	}
+	head, body, ok := strings.Cut(b.String(), "\n\n")
+	subject, hasSubject := strings.CutPrefix(strings.TrimSpace(head), "Subject:")
+	if !ok || !hasSubject {
+		return Mail{}, fmt.Errorf("email template '%s' must start with a 'Subject:' line and a blank line", name)
+	}
+	return Mail{To: to, Subject: strings.TrimSpace(subject), Body: strings.TrimLeft(body, "\n")}, nil
+}
+
+// sendTemplatedMail renders the named email template and delivers it with the configured Mailer
+func sendTemplatedMail(ctx context.Context, dso *DataSourceOrchestration, to string, name string, data any) error {
+	m, err := renderMail(dso.MailTemplates, name, to, data)
+	if err != nil {
+		return fmt.Errorf("renderMail(): %w", err)
+	}
+	if err := dso.Mailer.Send(ctx, m); err != nil {
+		return fmt.Errorf("dso.Mailer.Send(): %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// recordingMailer keeps sent mail in memory so tests can inspect it
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []Mail
+}
+
+func (r *recordingMailer) Send(ctx context.Context, m Mail) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, m)
+	return nil
+}
+
+// last returns the most recently sent mail, failing the test if there is none
+func (r *recordingMailer) last(t *testing.T) Mail {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.sent) == 0 {
+		t.Fatal("Expected an email to have been sent")
+	}
+	return r.sent[len(r.sent)-1]
+}
+
+func (r *recordingMailer) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sent)
+}
+
+func TestOutboxMailer(t *testing.T) {
+	dir := t.TempDir()
+	mailer, err := newMailer(&AppConfig{Mailer: MAILER__OUTBOX, OutboxDir: dir, MailFrom: "App <noreply@example.com>"},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("newMailer(): %v", err)
+	}
+
+	if err := mailer.Send(context.Background(), Mail{To: "a@example.com", Subject: "Héllo", Body: "line 1\nline 2\n"}); err != nil {
+		t.Fatalf("Send(): %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one .eml file in the outbox, got %d", len(files))
+	}
+	b, _ := os.ReadFile(files[0])
+	msg := string(b)
+	for _, want := range []string{"From: App <noreply@example.com>\r\n", "To: a@example.com\r\n", "Subject: =?utf-8?q?H=C3=A9llo?=\r\n", "\r\n\r\nline 1\r\nline 2\r\n"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Expected message to contain %q, got:\n%s", want, msg)
+		}
+	}
+}
+
+func TestBuildMessageRejectsHeaderInjection(t *testing.T) {
+	if _, err := buildMessage("noreply@example.com", Mail{To: "a@example.com\r\nBcc: victim@example.com", Subject: "x"}); err == nil {
+		t.Error("Expected a line break in a header value to be rejected")
+	}
+}
+
+func TestRenderMail(t *testing.T) {
+	tmpl := template.Must(template.New("email").Parse(`{{define "greeting"}}Subject: Hi {{.}}
+
+Hello {{.}}!{{end}}`))
+	m, err := renderMail(tmpl, "greeting", "a@example.com", "Ann")
+	if err != nil {
+		t.Fatalf("renderMail(): %v", err)
+	}
+	if m.Subject != "Hi Ann" || m.Body != "Hello Ann!" || m.To != "a@example.com" {
+		t.Errorf("Unexpected mail: %+v", m)
+	}
+
+	bad := template.Must(template.New("email").Parse(`{{define "nosubject"}}Hello{{end}}`))
+	if _, err := renderMail(bad, "nosubject", "a@example.com", nil); err == nil {
+		t.Error("Expected a template without a Subject line to be rejected")
+	}
+}
+
+func TestSMTPMailerEnvelopeSender(t *testing.T) {
+	mailer, err := newMailer(&AppConfig{Mailer: MAILER__SMTP, SMTPHost: "localhost", SMTPPort: 25, MailFrom: "My App <noreply@example.com>"}, nil)
+	if err != nil {
+		t.Fatalf("newMailer(): %v", err)
+	}
+	s := mailer.(*smtpMailer)
+	if s.envelope != "noreply@example.com" || s.from != "My App <noreply@example.com>" {
+		t.Errorf("Expected envelope 'noreply@example.com' and header 'My App <noreply@example.com>', got %q and %q", s.envelope, s.from)
+	}
+
+	if _, err := newMailer(&AppConfig{Mailer: MAILER__SMTP, SMTPHost: "localhost", SMTPPort: 25, MailFrom: "not an address"}, nil); err == nil {
+		t.Error("Expected an unparseable mail_from to be rejected")
+	}
+}
+
+// fakeSMTPServer accepts one connection on a local listener and speaks just enough SMTP to take a message,
+// reporting the envelope sender and the message data on the returned channel
+func fakeSMTPServer(t *testing.T) (host string, port int, got <-chan [2]string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan [2]string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tc := textproto.NewConn(conn)
+		var from, data string
+		tc.PrintfLine("220 fake ESMTP")
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			cmd, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(cmd) {
+			case "EHLO", "HELO":
+				tc.PrintfLine("250 fake")
+			case "MAIL":
+				from = arg
+				tc.PrintfLine("250 OK")
+			case "RCPT":
+				tc.PrintfLine("250 OK")
+			case "DATA":
+				tc.PrintfLine("354 Go ahead")
+				b, _ := tc.ReadDotBytes()
+				data = string(b)
+				tc.PrintfLine("250 OK")
+			case "QUIT":
+				tc.PrintfLine("221 Bye")
+				ch <- [2]string{from, data}
+				return
+			default:
+				tc.PrintfLine("502 Unknown command")
+			}
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, ch
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	host, port, got := fakeSMTPServer(t)
+	mailer, err := newMailer(&AppConfig{Mailer: MAILER__SMTP, SMTPHost: host, SMTPPort: port, MailFrom: "My App <noreply@example.com>"}, nil)
+	if err != nil {
+		t.Fatalf("newMailer(): %v", err)
+	}
+	if err := mailer.Send(context.Background(), Mail{To: "a@example.com", Subject: "Hi", Body: "Hello"}); err != nil {
+		t.Fatalf("Send(): %v", err)
+	}
+	select {
+	case r := <-got:
+		if r[0] != "FROM:<noreply@example.com>" {
+			t.Errorf("Expected envelope sender 'FROM:<noreply@example.com>', got %q", r[0])
+		}
+		if !strings.Contains(r[1], "From: My App <noreply@example.com>\n") {
+			t.Errorf("Expected the From: header to keep the display name, got:\n%s", r[1])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the fake server to receive a message")
+	}
+}
+
+func TestSMTPMailerSendHonorsContext(t *testing.T) {
+	// A server that accepts but never greets, so the client would otherwise wait forever
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	mailer, err := newMailer(&AppConfig{Mailer: MAILER__SMTP, SMTPHost: addr.IP.String(), SMTPPort: addr.Port, MailFrom: "noreply@example.com"}, nil)
+	if err != nil {
+		t.Fatalf("newMailer(): %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if err := mailer.Send(ctx, Mail{To: "a@example.com", Subject: "Hi", Body: "Hello"}); err == nil {
+		t.Error("Expected Send to fail once its context was cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected Send to return promptly after cancellation, took %v", elapsed)
+	}
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"fmt"
 	"html/template"
+	"io/fs"
 	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
@@ -14,82 +21,225 @@ import (
 	_ "github.com/joho/godotenv/autoload"
 )
 
-// DO NOT REMOVE: This triggers generated code. (One day we will also need: `go:embed public`)
+// DO NOT REMOVE: This triggers generated code.
 //
-//go:embed templates/**/*
+//go:embed templates/**/* public
 var embeddedFiles embed.FS
 
 func main() {
+	// Add CLI subcommand to download the vendored front-end libraries into ./public, or with `check` to verify the
+	// committed copies offline (needs no config; see assets.go)
+	if len(os.Args) > 1 && os.Args[1] == "assets" {
+		run := cliDownloadAssets
+		if len(os.Args) > 2 && os.Args[2] == "check" {
+			run = cliCheckAssets
+		}
+		if err := run("public"); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	appConfig, err := NewAppConfigFromFile("config")
 	if err != nil {
 		slog.Error("Failed to load config", "error", err)
 		os.Exit(1)
 	}
 
-	// Setup structured logger as early as possible
-	logger := SetupLogger(appConfig.LogLevel, appConfig.LogFile)
-	logger.Info("Logger initialized", "level", appConfig.LogLevel)
+	// Setup structured logger as early as possible, reporting errors to the error tracker if one is configured
+	reporter := newErrorReporter(appConfig)
+	logger, logLevels, closeLog := SetupLogger(appConfig, reporter)
+	logger.Info("Logger initialized", "level", logLevelName(logLevels.Level()), "format", appConfig.LogFormat,
+		"error_reporting", reporter.Enabled())
+
+	// Shutdown hooks run in reverse order of registration, so the log file (registered first) is closed last, after
+	// queued error reports are sent
+	lifecycle := newLifecycle(logger, time.Duration(appConfig.ShutdownDelay)*time.Second, time.Duration(appConfig.ShutdownTimeout)*time.Second)
+	lifecycle.OnShutdown("log file", func(context.Context) error { return closeLog() })
+	lifecycle.OnShutdown("error reporting", reporter.Close)
+
+	// OpenTelemetry tracing (see tracing.go)
+	shutdownTracing, err := setupTracing(appConfig)
+	if err != nil {
+		logger.Error("Failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	lifecycle.OnShutdown("tracing", shutdownTracing)
+
+	// Open the database (also applies schema migrations)
+	db, err := bootstrapSqliteDb(appConfig.DBConnStr)
+	if err != nil {
+		logger.Error("Failed to open database", "db_conn_str", appConfig.DBConnStr, "error", err)
+		os.Exit(1)
+	}
+	db.Logger = newGormLogger(logger.With("module", LOG_MODULE__DB))
+	lifecycle.OnShutdown("database", func(context.Context) error {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return fmt.Errorf("db.DB(): %w", err)
+		}
+		return sqlDB.Close()
+	})
+
+	// Add CLI subcommand to create a user account (e.g. the first admin)
+	if len(os.Args) > 1 && os.Args[1] == "createuser" {
+		if err := cliCreateUser(db, os.Args[2:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	if appConfig.CacheTemplates {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
+	// Prometheus metrics (see metrics.go)
+	metrics, err := newMetrics(db)
+	if err != nil {
+		logger.Error("Failed to set up metrics", "error", err)
+		os.Exit(1)
+	}
+
 	// Initialize Gin router
 	r := gin.New()
 	r.Use(
-		// Don't log requests to root '/' or ping, as the load balancers abuse them
-		gin.LoggerWithWriter(gin.DefaultWriter, "/", "/ping"),
-		gin.Recovery(),
+		mwRequestID(),
+		mwErrorReporting(reporter),
+		mwAccessLog(appConfig, logger.With("module", LOG_MODULE__HTTP)),
+		mwMetrics(metrics),
+		mwTracing(),
+		mwRecovery(logger, reporter),
 	)
 
-	// Load web view templates conditionally based on cache setting
-	// (This enables us to load changed templates from disk on page refresh during development)
+	// Load web view templates and public/ files conditionally based on cache setting
+	// (This enables us to load changed templates and assets from disk on page refresh during development)
+	var assets *publicAssets
+	var pages *htmlRender
 	if appConfig.CacheTemplates || os.Getenv("ENVIRONMENT") == "production" {
+		publicSub, err := fs.Sub(embeddedFiles, "public")
+		if err != nil {
+			logger.Error("fs.Sub(embeddedFiles, \"public\") failed", "error", err)
+			os.Exit(1)
+		}
+		assets = newPublicAssets(publicSub, false)
 		// Build+serve a template set from embedded templates w/ our custom function map
-		tmpl := template.Must(template.New("base").Funcs(customTmplFuncMap(appConfig, logger)).ParseFS(embeddedFiles, "templates/**/*.tmpl"))
-		r.SetHTMLTemplate(tmpl)
+		// (htmlRender binds each request's CSP nonce to {{ csp_nonce }})
+		tmpl := template.Must(template.New("base").Funcs(customTmplFuncMap(appConfig, logger, assets)).ParseFS(embeddedFiles, "templates/**/*.tmpl"))
+		pages = newHTMLRender(tmpl)
 	} else {
-		// Add our custom template function map
-		r.SetFuncMap(customTmplFuncMap(appConfig, logger))
-		// Build+serve a template set from disk
-		r.LoadHTMLGlob(filepath.Join(appConfig.WorkingDir, "templates/**/*"))
+		assets = newPublicAssets(os.DirFS(filepath.Join(appConfig.WorkingDir, "public")), true)
+		// Build+serve a template set from disk, with our custom function map, on every request
+		glob := filepath.Join(appConfig.WorkingDir, "templates/**/*")
+		pages = newReloadingHTMLRender(func() (*template.Template, error) {
+			return template.New("").Funcs(customTmplFuncMap(appConfig, logger, assets)).ParseGlob(glob)
+		})
+	}
+
+	// Pages are broken without their libraries, so refuse to start rather than serve them that way
+	if err := verifyVendoredAssets(assets.fsys); err != nil {
+		logger.Error("Vendored front-end libraries are not ready", "error", err)
+		os.Exit(1)
+	}
+
+	pages.observe = metrics.observeRender
+	r.HTMLRender = pages
+
+	// Health probes: /healthz (liveness) and /readyz (readiness)
+	health := newHealth(appConfig, lifecycle)
+	health.AddLiveness("templates", templatesHealthCheck(pages))
+	health.AddReadiness("database", dbHealthCheck(db))
+	if appConfig.LogFile != "" {
+		health.AddReadiness("log_disk_space", diskSpaceHealthCheck(appConfig.LogFile, uint64(appConfig.HealthMinFreeDiskMB)<<20))
+	}
+	if reporter.Enabled() {
+		// Fails once the queue is full, i.e. errors are being dropped rather than reported
+		health.AddReadiness("error_report_queue", queueDepthHealthCheck(reporter.QueueDepth, appConfig.ErrorReportingQueueSize-1))
+	}
+	register_health_routes(r, health)
+	if _, err := serveMetrics(r, metrics, appConfig, lifecycle, logger); err != nil {
+		logger.Error("Failed to serve metrics", "error", err)
+		os.Exit(1)
 	}
 
-	// // Serve embedded "public" files (there are none at the moment)
-	// publicSub, err := fs.Sub(embeddedFiles, "public")
-	// if err != nil {
-	// 	logger.Error("fs.Sub(embeddedFiles, \"public\") failed", "error", err)
-	// 	os.Exit(1)
-	// }
-	// r.StaticFS("/public", http.FS(publicSub))
+	// Serve public/ files (registered ahead of the session middleware, so they're cacheable and never set cookies)
+	r.GET(publicPrefix+"*filepath", gin.WrapH(assets))
+	r.HEAD(publicPrefix+"*filepath", gin.WrapH(assets))
 
-	sesh := instantiateSessionStore(appConfig)
-	r.Use(sessions.Sessions("mysession", sesh))
+	sesh, err := instantiateSessionStore(appConfig, db)
+	if err != nil {
+		logger.Error("Failed to configure session store", "error", err)
+		os.Exit(1)
+	}
+	r.Use(sessions.Sessions("mysession", metrics.instrumentSessionStore(traceSessionStore(sesh))))
+	stopSessionReaper := startSessionReaper(sesh, time.Duration(appConfig.SessionReapInterval)*time.Second, logger)
+	lifecycle.OnShutdown("session reaper", func(context.Context) error {
+		stopSessionReaper()
+		return nil
+	})
 
-	// Create DSO with logger (you would also add DB connections, etc here)
+	// Passkey (WebAuthn) relying party
+	wa, err := newWebAuthn(appConfig)
+	if err != nil {
+		logger.Error("Failed to configure WebAuthn", "error", err)
+		os.Exit(1)
+	}
+
+	// Outgoing email (password reset, email verification)
+	mailer, err := newMailer(appConfig, logger)
+	if err != nil {
+		logger.Error("Failed to configure mailer", "error", err)
+		os.Exit(1)
+	}
+	mailTemplates, err := loadMailTemplates(appConfig)
+	if err != nil {
+		logger.Error("Failed to load email templates", "error", err)
+		os.Exit(1)
+	}
+
+	// Create DSO with logger and DB connection (you would also add other data sources here)
 	dso := &DataSourceOrchestration{
-		AppConfig: appConfig,
-		Logger:    logger,
+		AppConfig:     appConfig,
+		DB:            db,
+		Logger:        logger,
+		WebAuthn:      wa,
+		Mailer:        mailer,
+		MailTemplates: mailTemplates,
+		Lifecycle:     lifecycle,
+		LogLevels:     logLevels,
 	}
 
 	// Add DSO middleware to make it (and it's conns) available to all routes/handlers
 	r.Use(mwDSO(dso))
+	r.Use(mwSecurityHeaders())
+	r.Use(mwSessionValidity())
+	r.Use(mwCSRF())
+	r.Use(mwReadOnlyWhenImpersonating())
 
 	// Register routes
 	register_routes(r)
 
-	// Start server (blocks indefinitely)
+	// Serve until SIGINT (Ctrl-C) or SIGTERM (`docker stop`, rolling deploys), then drain and run the shutdown hooks
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ln, err := net.Listen("tcp", appConfig.HostPort)
+	if err != nil {
+		logger.Error("Failed to listen", "host_port", appConfig.HostPort, "error", err)
+		os.Exit(1)
+	}
+	srv := &http.Server{Addr: appConfig.HostPort, Handler: r}
+	var certFile, keyFile string
 	if appConfig.SSLDisabled {
 		logger.Info(fmt.Sprintf("HTTP Web server (no TLS) listening on http://localhost%s", appConfig.HostPort), "host_port", appConfig.HostPort)
-		if err := r.Run(appConfig.HostPort); err != nil {
-			logger.Error("Server failed", "error", err)
-			os.Exit(1)
-		}
 	} else {
 		logger.Info("Starting TLS server", "host_port", appConfig.HostPort, "cert", appConfig.SSLCertFile, "key", appConfig.SSLKeyFile)
-		if err := r.RunTLS(appConfig.HostPort, appConfig.SSLCertFile, appConfig.SSLKeyFile); err != nil {
-			logger.Error("TLS server failed", "error", err)
-			os.Exit(1)
-		}
+		certFile, keyFile = appConfig.SSLCertFile, appConfig.SSLKeyFile
+	}
+	if err := lifecycle.Serve(ctx, srv, ln, certFile, keyFile); err != nil {
+		// Not logged: the log file is closed by now
+		fmt.Fprintf(os.Stderr, "Server failed: %v\n", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	gsessions "github.com/gorilla/sessions"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+)
+
+// Metrics holds the app's Prometheus collectors, registered on their own registry (not the global default), which
+// /metrics serves
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests              *prometheus.CounterVec
+	requestDuration       *prometheus.HistogramVec
+	inFlight              prometheus.Gauge
+	renderDuration        *prometheus.HistogramVec
+	sessionDecodeFailures prometheus.Counter
+}
+
+func newMetrics(db *gorm.DB) (*Metrics, error) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, fmt.Errorf("db.DB(): %w", err)
+	}
+
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests by method, route template and status.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency by method, route template and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "HTTP requests currently being served.",
+		}),
+		renderDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "template_render_duration_seconds",
+			Help:    "Time to execute each page template.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"template"}),
+		sessionDecodeFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "session_decode_failures_total",
+			Help: "Session cookies that couldn't be decoded or loaded (tampered with, signed by a retired key, store errors).",
+		}),
+	}
+	m.registry.MustRegister(
+		m.requests, m.requestDuration, m.inFlight, m.renderDuration, m.sessionDecodeFailures,
+		collectors.NewDBStatsCollector(sqlDB, "app"),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m, nil
+}
+
+// mwMetrics counts and times every request. Register it ahead of gin.Recovery(), so panics are counted as 500s.
+func mwMetrics(m *Metrics) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+
+		c.Next()
+
+		// The route template (e.g. /books/:id), never the raw path, so the number of series stays bounded
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		m.requests.WithLabelValues(c.Request.Method, route, status).Inc()
+		m.requestDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeRender records one page template execution (see htmlRender.observe)
+func (m *Metrics) observeRender(name string, d time.Duration) {
+	m.renderDuration.WithLabelValues(name).Observe(d.Seconds())
+}
+
+// instrumentSessionStore counts the session cookies store fails to decode
+func (m *Metrics) instrumentSessionStore(store sessions.Store) sessions.Store {
+	return &instrumentedSessionStore{Store: store, failures: m.sessionDecodeFailures}
+}
+
+type instrumentedSessionStore struct {
+	sessions.Store
+	failures prometheus.Counter
+}
+
+// Get implements gsessions.Store
+func (s *instrumentedSessionStore) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	session, err := s.Store.Get(r, name)
+	if err != nil {
+		s.failures.Inc()
+	}
+	return session, err
+}
+
+// Handler serves the metrics in the Prometheus exposition format, behind HTTP basic auth when username is set
+func (m *Metrics) Handler(username, password string) http.Handler {
+	h := promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	if username == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveMetrics exposes /metrics as configured: on its own listener when `metrics_listen_addr` is set (returning its
+// address), otherwise on r when basic auth credentials are set, otherwise not at all
+func serveMetrics(r *gin.Engine, m *Metrics, cfg *AppConfig, lifecycle *Lifecycle, logger *slog.Logger) (net.Addr, error) {
+	if cfg.MetricsUsername != "" && cfg.MetricsPassword == "" {
+		return nil, errors.New("metrics_username is set but metrics_password is empty")
+	}
+	h := m.Handler(cfg.MetricsUsername, cfg.MetricsPassword)
+
+	switch {
+	case cfg.MetricsListenAddr != "":
+		ln, err := net.Listen("tcp", cfg.MetricsListenAddr)
+		if err != nil {
+			return nil, fmt.Errorf("net.Listen(): %w", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", h)
+		srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("Metrics server failed", "error", err)
+			}
+		}()
+		lifecycle.OnShutdown("metrics server", srv.Shutdown)
+		logger.Info("Serving metrics", "addr", ln.Addr().String())
+		return ln.Addr(), nil
+	case cfg.MetricsUsername != "":
+		r.GET("/metrics", gin.WrapH(h))
+		logger.Info("Serving metrics at /metrics (basic auth)")
+	default:
+		logger.Info("Metrics not exposed: set metrics_listen_addr or metrics_username/metrics_password")
+	}
+	return nil, nil
+}
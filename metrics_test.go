@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	router := setupTestRouter(func(cfg *AppConfig) {
+		cfg.MetricsUsername = "prometheus"
+		cfg.MetricsPassword = "scrape-me"
+	})
+	tc := newTestClient(t, router)
+
+	scrape := func(t *testing.T) string {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		req.SetBasicAuth("prometheus", "scrape-me")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 from /metrics, got %d", w.Code)
+		}
+		return w.Body.String()
+	}
+
+	t.Run("RequiresBasicAuth", func(t *testing.T) {
+		for _, auth := range [][2]string{{"", ""}, {"prometheus", "wrong"}} {
+			req, _ := http.NewRequest("GET", "/metrics", nil)
+			if auth[0] != "" {
+				req.SetBasicAuth(auth[0], auth[1])
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected 401 for %v, got %d", auth, w.Code)
+			}
+		}
+	})
+
+	t.Run("RequestsByRouteTemplate", func(t *testing.T) {
+		tc.get("/books/1")
+		tc.get("/books/2")
+		tc.get("/books")
+		tc.get("/no/such/page")
+
+		body := scrape(t)
+		for _, want := range []string{
+			`http_requests_total{method="GET",route="/books/:id",status="200"} 2`,
+			`http_requests_total{method="GET",route="/books",status="200"} 1`,
+			`http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+			`http_request_duration_seconds_count{method="GET",route="/books/:id",status="200"} 2`,
+			`template_render_duration_seconds_count{template="books/show"} 2`,
+			`template_render_duration_seconds_count{template="books/index"} 1`,
+			"http_requests_in_flight 1", // The scrape itself
+			`go_sql_open_connections{db_name="app"}`,
+			"go_goroutines",
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("Expected %s in:\n%s", want, body)
+			}
+		}
+		if strings.Contains(body, `route="/books/1"`) {
+			t.Error("Expected raw paths never to be used as labels")
+		}
+	})
+
+	t.Run("SessionDecodeFailures", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/books", nil)
+		req.AddCookie(&http.Cookie{Name: "test-session", Value: "not-a-valid-cookie"})
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		if body := scrape(t); !strings.Contains(body, "session_decode_failures_total 1") {
+			t.Errorf("Expected the bad cookie to be counted, got:\n%s", body)
+		}
+	})
+}
+
+func TestServeMetrics(t *testing.T) {
+	_, dso := setupTestRouterWithDSO()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	metrics, err := newMetrics(dso.DB)
+	if err != nil {
+		t.Fatalf("newMetrics(): %v", err)
+	}
+
+	t.Run("NotExposedByDefault", func(t *testing.T) {
+		w := newTestClient(t, setupTestRouter()).get("/metrics")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected no /metrics without configuration, got %d", w.Code)
+		}
+	})
+
+	t.Run("PasswordRequired", func(t *testing.T) {
+		cfg := &AppConfig{MetricsUsername: "prometheus"}
+		if _, err := serveMetrics(nil, metrics, cfg, newLifecycle(logger, 0, time.Second), logger); err == nil {
+			t.Error("Expected a username without a password to be rejected")
+		}
+	})
+
+	t.Run("SeparateListener", func(t *testing.T) {
+		lc := newLifecycle(logger, 0, time.Second)
+		addr, err := serveMetrics(nil, metrics, &AppConfig{MetricsListenAddr: "127.0.0.1:0"}, lc, logger)
+		if err != nil {
+			t.Fatalf("serveMetrics(): %v", err)
+		}
+		resp, err := http.Get("http://" + addr.String() + "/metrics")
+		if err != nil {
+			t.Fatalf("http.Get(): %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "go_goroutines") {
+			t.Errorf("Expected metrics from the separate listener, got %d", resp.StatusCode)
+		}
+
+		// It's stopped by the shutdown hooks
+		if err := lc.Shutdown(); err != nil {
+			t.Fatalf("Shutdown(): %v", err)
+		}
+		if _, err := http.Get("http://" + addr.String() + "/metrics"); err == nil {
+			t.Error("Expected the metrics listener to be closed on shutdown")
+		}
+	})
+}
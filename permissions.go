@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Named permissions. Check these (userCan, mwRequirePermission, the `can` template func) rather than testing role
+// bits directly; roles are just named sets of them.
+const (
+	PERM__BOOKS_CREATE      = "books.create"
+	PERM__BOOKS_UPDATE      = "books.update"
+	PERM__BOOKS_DELETE      = "books.delete"
+	PERM__USERS_MANAGE      = "users.manage"
+	PERM__USERS_IMPERSONATE = "users.impersonate"
+	PERM__AUDIT_VIEW        = "audit.view"
+	PERM__LOGS_MANAGE       = "logs.manage"
+)
+
+// Permission is one entry in the registry
+type Permission struct {
+	Name        string
+	Description string
+	AdminOnly   bool // Never granted to impersonated sessions, whatever their roles
+}
+
+// permissionRegistry lists every permission; roles may only grant these (or wildcards over them)
+var permissionRegistry = []Permission{
+	{PERM__BOOKS_CREATE, "Add books", false},
+	{PERM__BOOKS_UPDATE, "Edit books", false},
+	{PERM__BOOKS_DELETE, "Delete books", false},
+	{PERM__USERS_MANAGE, "Manage user accounts", true},
+	{PERM__USERS_IMPERSONATE, "Impersonate users", true},
+	{PERM__AUDIT_VIEW, "View the audit log", true},
+	{PERM__LOGS_MANAGE, "Change log levels at runtime", true},
+}
+
+// defaultRoles are the built-in roles. "admin" and "user" are granted by the SESSUSR__* bits of the same name
+// (see roleBits); the `roles` config option can redefine them or add more.
+var defaultRoles = map[string][]string{
+	"admin": {"*"},
+	"user":  {PERM__BOOKS_CREATE},
+}
+
+// permissionMatches reports whether granted ("books.create", "books.*" or "*") covers perm
+func permissionMatches(granted string, perm string) bool {
+	if granted == "*" || granted == perm {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(granted, "*")
+	return ok && strings.HasSuffix(prefix, ".") && strings.HasPrefix(perm, prefix)
+}
+
+func findPermission(name string) (Permission, bool) {
+	for _, p := range permissionRegistry {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Permission{}, false
+}
+
+// rolePermissions returns what role grants: its `roles` config entry if there is one, else the built-in default
+func (a *AppConfig) rolePermissions(role string) []string {
+	if perms, ok := a.Roles[role]; ok {
+		return perms
+	}
+	return defaultRoles[role]
+}
+
+// roleNamesAvailable lists every defined role (built-in and configured), sorted
+func (a *AppConfig) roleNamesAvailable() []string {
+	var names []string
+	for name := range defaultRoles {
+		names = append(names, name)
+	}
+	for name := range a.Roles {
+		if _, ok := defaultRoles[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// namedRoles lists the roles assigned by name (User.Roles) rather than by SESSUSR__* bit
+func (a *AppConfig) namedRoles() []string {
+	var names []string
+	for _, name := range a.roleNamesAvailable() {
+		if !slices.ContainsFunc(roleBits, func(r RoleBit) bool { return r.Name == name }) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ValidateRoles checks that every configured role only grants registered permissions
+func (a *AppConfig) ValidateRoles() error {
+	for role, perms := range a.Roles {
+		for _, granted := range perms {
+			ok := slices.ContainsFunc(permissionRegistry, func(p Permission) bool { return permissionMatches(granted, p.Name) })
+			if !ok {
+				return fmt.Errorf("role '%s' grants unknown permission '%s'", role, granted)
+			}
+		}
+	}
+	return nil
+}
+
+// userCan reports whether su holds perm through any of its roles
+func userCan(cfg *AppConfig, su *SessionUser, perm string) bool {
+	if su == nil || !su.SessionIsValid() {
+		return false
+	}
+	if p, ok := findPermission(perm); !ok || (p.AdminOnly && su.IsImpersonated()) {
+		return false
+	}
+	return cfg.rolesGrant(su.RoleNames(), perm)
+}
+
+// userPermissions lists the registered permissions su holds
+func userPermissions(cfg *AppConfig, su *SessionUser) []string {
+	perms := []string{}
+	for _, p := range permissionRegistry {
+		if userCan(cfg, su, p.Name) {
+			perms = append(perms, p.Name)
+		}
+	}
+	return perms
+}
+
+// rolesGrant reports whether any of roles grants perm
+func (a *AppConfig) rolesGrant(roles []string, perm string) bool {
+	for _, role := range roles {
+		for _, granted := range a.rolePermissions(role) {
+			if permissionMatches(granted, perm) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseNamedRoles keeps the submitted values (e.g. checkbox values) that are defined named roles
+func (a *AppConfig) parseNamedRoles(values []string) []string {
+	var roles []string
+	for _, name := range a.namedRoles() {
+		if slices.Contains(values, name) {
+			roles = append(roles, name)
+		}
+	}
+	return roles
+}
+
+// mwRequirePermission only lets users holding perm through (register after mwRequireAuth, or after mwAPIAuth on
+// API routes, where it checks the API user and answers 403 JSON instead of redirecting)
+func mwRequirePermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		if _, ok := c.Get(ctxKeyAPIUser); ok {
+			user := getAPIUser(c)
+			if !userCan(dso.AppConfig, user, perm) {
+				dso.Logger.Warn("permission denied", "username", user.Username, "permission", perm,
+					"impersonator", user.Impersonator, "path", c.Request.URL.Path)
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+				return
+			}
+			c.Next()
+			return
+		}
+		session := sessions.Default(c)
+		user := getUser(session)
+		if !userCan(dso.AppConfig, &user, perm) {
+			dso.Logger.Warn("permission denied", "username", user.Username, "permission", perm,
+				"impersonator", user.Impersonator, "path", c.Request.URL.Path)
+			addFlash("You are not authorized to access that page", session)
+			c.Redirect(http.StatusSeeOther, "/")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPermissionMatches(t *testing.T) {
+	for _, tc := range []struct {
+		granted, perm string
+		want          bool
+	}{
+		{"books.create", "books.create", true},
+		{"books.create", "books.delete", false},
+		{"books.*", "books.delete", true},
+		{"books.*", "booksx.delete", false},
+		{"*", "users.manage", true},
+		{"book*", "books.create", false},
+	} {
+		if got := permissionMatches(tc.granted, tc.perm); got != tc.want {
+			t.Errorf("permissionMatches(%q, %q) = %t, want %t", tc.granted, tc.perm, got, tc.want)
+		}
+	}
+}
+
+func TestValidateRoles(t *testing.T) {
+	cfg := &AppConfig{Roles: map[string][]string{"editor": {"books.*"}, "support": {PERM__USERS_MANAGE}}}
+	if err := cfg.ValidateRoles(); err != nil {
+		t.Errorf("Expected valid roles, got %v", err)
+	}
+	cfg.Roles["typo"] = []string{"book.create"}
+	if err := cfg.ValidateRoles(); err == nil {
+		t.Error("Expected an unknown permission to be rejected")
+	}
+}
+
+func TestUserCan(t *testing.T) {
+	cfg := &AppConfig{Roles: map[string][]string{"editor": {"books.*"}}}
+	user := NewAuthenticatedSessionUser("alice")
+	user.Role = SESSUSR__USER
+	admin := NewAuthenticatedSessionUser("root")
+	admin.Role = SESSUSR__USER | SESSUSR__ADMIN
+	editor := NewAuthenticatedSessionUser("ed")
+	editor.Role = SESSUSR__USER
+	editor.Roles = []string{"editor"}
+
+	for _, tc := range []struct {
+		su   *SessionUser
+		perm string
+		want bool
+	}{
+		{user, PERM__BOOKS_CREATE, true},
+		{user, PERM__BOOKS_DELETE, false},
+		{editor, PERM__BOOKS_DELETE, true},
+		{editor, PERM__USERS_MANAGE, false},
+		{admin, PERM__USERS_MANAGE, true},
+		{admin, "no.such.permission", false},
+		{&SessionUser{Role: SESSUSR__ADMIN}, PERM__USERS_MANAGE, false}, // Not logged in
+		{nil, PERM__BOOKS_CREATE, false},
+	} {
+		name := "<nil>"
+		if tc.su != nil {
+			name = tc.su.Username
+		}
+		if got := userCan(cfg, tc.su, tc.perm); got != tc.want {
+			t.Errorf("userCan(%s, %s) = %t, want %t", name, tc.perm, got, tc.want)
+		}
+	}
+
+	// Impersonated sessions never get admin-only permissions, whatever their roles
+	cfg.Roles["support"] = []string{PERM__USERS_MANAGE, PERM__BOOKS_UPDATE}
+	impersonated := NewAuthenticatedSessionUser("sam")
+	impersonated.Roles = []string{"support"}
+	impersonated.Impersonator = "root"
+	if userCan(cfg, impersonated, PERM__USERS_MANAGE) || !userCan(cfg, impersonated, PERM__BOOKS_UPDATE) {
+		t.Error("Expected impersonation to drop admin-only permissions only")
+	}
+
+	if perms := userPermissions(cfg, editor); !slices.Equal(perms, []string{PERM__BOOKS_CREATE, PERM__BOOKS_UPDATE, PERM__BOOKS_DELETE}) {
+		t.Errorf("Unexpected editor permissions %v", perms)
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	router, dso := setupTestRouterWithDSO(func(cfg *AppConfig) {
+		cfg.Roles = map[string][]string{"support": {PERM__USERS_MANAGE}}
+	})
+	sam, err := createUser(dso.DB, "sam", "correct horse", SESSUSR__USER)
+	if err != nil {
+		t.Fatalf("createUser(): %v", err)
+	}
+	if err := updateUserProfile(dso.DB, sam, "", "", SESSUSR__USER, []string{"support"}); err != nil {
+		t.Fatalf("updateUserProfile(): %v", err)
+	}
+	alice, err := createUser(dso.DB, "alice", "correct horse", SESSUSR__USER)
+	if err != nil {
+		t.Fatalf("createUser(): %v", err)
+	}
+
+	tc := newTestClient(t, router)
+	tc.login("sam", "correct horse")
+
+	// The support role can manage users without being an admin...
+	w := tc.get("/admin/users")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected users.manage to grant /admin/users, got %d", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `href="/admin/users"`) || strings.Contains(body, `href="/admin/audit"`) {
+		t.Error("Expected the Admin menu to show only what the user can do")
+	}
+	// ...but not view the audit log or impersonate
+	if w := tc.get("/admin/audit"); w.Code != http.StatusSeeOther {
+		t.Errorf("Expected /admin/audit to be denied, got %d", w.Code)
+	}
+	tc.postForm(adminUserPath(alice)+"/impersonate", url.Values{})
+	if strings.Contains(tc.get("/").Body.String(), "impersonationBanner") {
+		t.Error("Expected impersonation to require users.impersonate")
+	}
+
+	// Named roles can be granted from the admin page
+	root, err := createUser(dso.DB, "root", "correct horse", SESSUSR__USER|SESSUSR__ADMIN)
+	if err != nil {
+		t.Fatalf("createUser(): %v", err)
+	}
+	admin := newTestClient(t, router)
+	admin.login("root", "correct horse")
+	admin.postForm(adminUserPath(alice), url.Values{"role": {itoa(SESSUSR__USER)}, "named_role": {"support", "bogus"}})
+	alice, _ = findUserByID(dso.DB, alice.ID)
+	if alice.Roles != "support" {
+		t.Errorf("Expected alice to get only the defined role, got %q", alice.Roles)
+	}
+
+	// An admin whose user management comes from a named role can't remove it from themselves either
+	updateUserProfile(dso.DB, root, "", "", SESSUSR__USER, []string{"support"})
+	admin.postForm(adminUserPath(root), url.Values{"role": {itoa(SESSUSR__USER)}})
+	if root, _ = findUserByID(dso.DB, root.ID); root.Roles != "support" {
+		t.Error("Expected admins to be unable to remove their own user management access")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+// Actions a policy decides on
+const (
+	ACTION__CREATE = "create"
+	ACTION__UPDATE = "update"
+	ACTION__DELETE = "delete"
+)
+
+// Owned is implemented by resources that belong to a user
+type Owned interface {
+	OwnerID() uint
+}
+
+// Authorize decides whether user may perform action on resource. Permissions grant an action on every record of a
+// type (e.g. books.update); ownership additionally lets users update/delete their own records. Resource types
+// without a policy are always denied.
+func (a *AppConfig) Authorize(user *SessionUser, action string, resource any) bool {
+	switch r := resource.(type) {
+	case *Book:
+		return a.authorizeBook(user, action, r)
+	}
+	return false
+}
+
+func (a *AppConfig) authorizeBook(user *SessionUser, action string, b *Book) bool {
+	if action == ACTION__CREATE {
+		return userCan(a, user, PERM__BOOKS_CREATE)
+	}
+	if b == nil {
+		return false
+	}
+	switch action {
+	case ACTION__UPDATE:
+		return userCan(a, user, PERM__BOOKS_UPDATE) || isOwner(user, b)
+	case ACTION__DELETE:
+		return userCan(a, user, PERM__BOOKS_DELETE) || isOwner(user, b)
+	}
+	return false
+}
+
+// isOwner reports whether the logged-in user owns r (ownerless records, with an owner ID of 0, belong to no one)
+func isOwner(user *SessionUser, r Owned) bool {
+	return user != nil && user.SessionIsValid() && user.UserID != 0 && r.OwnerID() == user.UserID
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAuthorizeBook(t *testing.T) {
+	cfg := &AppConfig{Roles: map[string][]string{"editor": {"books.*"}}}
+	alice := NewAuthenticatedSessionUser("alice")
+	alice.UserID, alice.Role = 1, SESSUSR__USER
+	bob := NewAuthenticatedSessionUser("bob")
+	bob.UserID, bob.Role = 2, SESSUSR__USER
+	editor := NewAuthenticatedSessionUser("ed")
+	editor.UserID, editor.Role, editor.Roles = 3, SESSUSR__USER, []string{"editor"}
+	anon := &SessionUser{}
+
+	owned := &Book{ID: 10, CreatedBy: alice.UserID}
+	seeded := &Book{ID: 1}
+
+	for _, tc := range []struct {
+		name   string
+		su     *SessionUser
+		action string
+		book   *Book
+		want   bool
+	}{
+		{"owner updates", alice, ACTION__UPDATE, owned, true},
+		{"owner deletes", alice, ACTION__DELETE, owned, true},
+		{"non-owner updates", bob, ACTION__UPDATE, owned, false},
+		{"non-owner deletes", bob, ACTION__DELETE, owned, false},
+		{"editor updates any", editor, ACTION__UPDATE, owned, true},
+		{"editor deletes ownerless", editor, ACTION__DELETE, seeded, true},
+		{"nobody owns seeded books", &SessionUser{UserID: 0, Role: SESSUSR__USER}, ACTION__UPDATE, seeded, false},
+		{"user creates", bob, ACTION__CREATE, nil, true},
+		{"anonymous creates", anon, ACTION__CREATE, nil, false},
+		{"anonymous updates", anon, ACTION__UPDATE, owned, false},
+		{"unknown action", alice, "publish", owned, false},
+	} {
+		if got := cfg.Authorize(tc.su, tc.action, tc.book); got != tc.want {
+			t.Errorf("%s: Authorize() = %t, want %t", tc.name, got, tc.want)
+		}
+	}
+
+	if cfg.Authorize(alice, ACTION__UPDATE, &User{}) {
+		t.Error("Expected resources without a policy to be denied")
+	}
+}
+
+func TestBookOwnershipRoutes(t *testing.T) {
+	router, dso := setupTestRouterWithDSO()
+	alice, err := createUser(dso.DB, "alice", "correct horse", SESSUSR__USER)
+	if err != nil {
+		t.Fatalf("createUser(): %v", err)
+	}
+	if _, err := createUser(dso.DB, "bob", "correct horse", SESSUSR__USER); err != nil {
+		t.Fatalf("createUser(): %v", err)
+	}
+	if _, err := createUser(dso.DB, "root", "correct horse", SESSUSR__USER|SESSUSR__ADMIN); err != nil {
+		t.Fatalf("createUser(): %v", err)
+	}
+
+	owner := newTestClient(t, router)
+	owner.login("alice", "correct horse")
+	owner.postForm("/books", url.Values{"title": {"Mine"}, "author": {"Alice"}, "isbn": {"978-0000000001"}})
+	books, _ := listBooks(dso.DB)
+	book := books[len(books)-1]
+	if book.Title != "Mine" || book.CreatedBy != alice.ID {
+		t.Fatalf("Expected the new book to be owned by alice, got %+v", book)
+	}
+	path := "/books/" + itoa(book.ID)
+
+	t.Run("NonOwnerIsForbidden", func(t *testing.T) {
+		other := newTestClient(t, router)
+		other.login("bob", "correct horse")
+
+		if body := other.get(path).Body.String(); strings.Contains(body, path+"/edit") {
+			t.Error("Expected the edit button to be hidden from non-owners")
+		}
+		if w := other.get(path + "/edit"); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for the edit page, got %d", w.Code)
+		}
+		if w := other.postForm(path, url.Values{"title": {"Theirs"}, "author": {"Bob"}, "isbn": {"1"}}); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for an update, got %d", w.Code)
+		}
+		if w := other.postForm(path+"/delete", url.Values{}); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for a delete, got %d", w.Code)
+		}
+		if b, _ := findBookByID(dso.DB, book.ID); b == nil || b.Title != "Mine" {
+			t.Error("Expected the book to be unchanged")
+		}
+	})
+
+	t.Run("OwnerCanEdit", func(t *testing.T) {
+		if body := owner.get(path).Body.String(); !strings.Contains(body, path+"/edit") {
+			t.Error("Expected the owner to see the edit button")
+		}
+		w := owner.postForm(path, url.Values{"title": {"Still mine"}, "author": {"Alice"}, "isbn": {"978-0000000001"}})
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != path {
+			t.Fatalf("Expected a redirect to the book, got %d %s", w.Code, w.Header().Get("Location"))
+		}
+		if b, _ := findBookByID(dso.DB, book.ID); b.Title != "Still mine" || b.CreatedBy != alice.ID {
+			t.Errorf("Expected the title to change and the owner to stay, got %+v", b)
+		}
+	})
+
+	t.Run("API", func(t *testing.T) {
+		other := newTestClient(t, router)
+		bob, _ := findUserByUsername(dso.DB, "bob")
+		token, _, err := createAPIToken(dso.DB, bob, "test", []string{APISCOPE__READ, APISCOPE__WRITE}, 0)
+		if err != nil {
+			t.Fatalf("createAPIToken(): %v", err)
+		}
+		body := []byte(`{"title":"Bob's","author":"Bob","isbn":"2"}`)
+		if w := apiRequest(t, other, "PUT", "/api/books/"+itoa(book.ID), token, body); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 updating someone else's book, got %d", w.Code)
+		}
+		if w := apiRequest(t, other, "DELETE", "/api/books/"+itoa(book.ID), token, nil); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 deleting someone else's book, got %d", w.Code)
+		}
+		if w := apiRequest(t, other, "POST", "/api/books", token, body); w.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 creating a book, got %d", w.Code)
+		}
+		books, _ := listBooks(dso.DB)
+		own := "/api/books/" + itoa(books[len(books)-1].ID)
+		if w := apiRequest(t, other, "PUT", own, token, []byte(`{"title":"Bob's 2","author":"Bob","isbn":"2"}`)); w.Code != http.StatusOK {
+			t.Errorf("Expected 200 updating their own book, got %d", w.Code)
+		}
+		if w := apiRequest(t, other, "DELETE", own, token, nil); w.Code != http.StatusNoContent {
+			t.Errorf("Expected 204 deleting their own book, got %d", w.Code)
+		}
+		if w := apiRequest(t, other, "DELETE", "/api/books/9999", token, nil); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for a missing book, got %d", w.Code)
+		}
+	})
+
+	t.Run("AdminCanDeleteAnyBook", func(t *testing.T) {
+		admin := newTestClient(t, router)
+		admin.login("root", "correct horse")
+		if w := admin.postForm(path+"/delete", url.Values{}); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/books" {
+			t.Fatalf("Expected a redirect to /books, got %d %s", w.Code, w.Header().Get("Location"))
+		}
+		if _, err := findBookByID(dso.DB, book.ID); err == nil {
+			t.Error("Expected the book to be deleted")
+		}
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// defaultLogRedactKeys are masked unless `log_redact_keys` says otherwise
+var defaultLogRedactKeys = []string{"password", "token", "secure_cookie_*", "authorization", "email"}
+
+// cardNumber finds runs of 13-19 digits, optionally split by spaces or dashes, that might be payment card numbers.
+// Matches are only masked if they pass the Luhn check, so long IDs and timestamps mostly survive.
+var cardNumber = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+
+// ParseLogRedactPatterns compiles `log_redact_patterns` into LogRedactRegexps
+func (a *AppConfig) ParseLogRedactPatterns() error {
+	a.LogRedactRegexps = nil
+	for _, expr := range a.LogRedactPatterns {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("log_redact_patterns '%s': %w", expr, err)
+		}
+		a.LogRedactRegexps = append(a.LogRedactRegexps, re)
+	}
+	return nil
+}
+
+// redactor decides what gets masked in log records
+type redactor struct {
+	keys     []string // Lowercase; globs match the whole key, plain words also match a `_word` suffix (api_token)
+	patterns []*regexp.Regexp
+}
+
+func newRedactor(cfg *AppConfig) *redactor {
+	r := &redactor{patterns: cfg.LogRedactRegexps}
+	for _, k := range cfg.LogRedactKeys {
+		r.keys = append(r.keys, strings.ToLower(k))
+	}
+	return r
+}
+
+func (r *redactor) sensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range r.keys {
+		if ok, _ := path.Match(k, key); ok || strings.HasSuffix(key, "_"+k) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactString masks the card numbers and configured patterns in s
+func (r *redactor) redactString(s string) string {
+	s = cardNumber.ReplaceAllStringFunc(s, func(m string) string {
+		if luhnValid(m) {
+			return redacted
+		}
+		return m
+	})
+	for _, re := range r.patterns {
+		s = re.ReplaceAllString(s, redacted)
+	}
+	return s
+}
+
+func (r *redactor) redactAttr(a slog.Attr) slog.Attr {
+	if r.sensitiveKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, r.redactString(v.String()))
+	case slog.KindGroup:
+		attrs := v.Group()
+		out := make([]slog.Attr, len(attrs))
+		for i, ga := range attrs {
+			out[i] = r.redactAttr(ga)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(out...)}
+	case slog.KindAny:
+		// Errors are logged as their message, which can quote input
+		if err, ok := v.Any().(error); ok {
+			if msg := r.redactString(err.Error()); msg != err.Error() {
+				return slog.String(a.Key, msg)
+			}
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// luhnValid reports whether the digits in s pass the Luhn checksum payment card numbers carry
+func luhnValid(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// redactHandler masks sensitive attributes (by key) and values (card numbers, `log_redact_patterns`) in every
+// record, including the message, before they reach the output
+type redactHandler struct {
+	slog.Handler
+	r *redactor
+}
+
+func (h redactHandler) Handle(ctx context.Context, rec slog.Record) error {
+	out := slog.NewRecord(rec.Time, rec.Level, h.r.redactString(rec.Message), rec.PC)
+	rec.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(h.r.redactAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, out)
+}
+
+func (h redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		out[i] = h.r.redactAttr(a)
+	}
+	return redactHandler{h.Handler.WithAttrs(out), h.r}
+}
+
+func (h redactHandler) WithGroup(name string) slog.Handler {
+	return redactHandler{h.Handler.WithGroup(name), h.r}
+}
+
+// maskSecret keeps just enough of a secret to tell which one is configured
+func maskSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	if len(s) < 16 {
+		return redacted
+	}
+	return s[:4] + "…" + redacted
+}
+
+// Redacted returns a copy of the config that's safe to print: secrets are masked (key material is dropped)
+func (a *AppConfig) Redacted() AppConfig {
+	out := *a
+	out.SecureCookieSigningKey, out.SecureCookieEncryptionKey = nil, nil
+	out.SecureCookieSigningKeyHex = maskSecret(a.SecureCookieSigningKeyHex)
+	out.SecureCookieEncryptionKeyHex = maskSecret(a.SecureCookieEncryptionKeyHex)
+	out.SecureCookieKeys = make([]SecureCookieKeyPair, len(a.SecureCookieKeys))
+	for i, kp := range a.SecureCookieKeys {
+		out.SecureCookieKeys[i] = SecureCookieKeyPair{
+			SigningKeyHex:    maskSecret(kp.SigningKeyHex),
+			EncryptionKeyHex: maskSecret(kp.EncryptionKeyHex),
+		}
+	}
+	out.HealthToken = maskSecret(a.HealthToken)
+	out.MetricsPassword = maskSecret(a.MetricsPassword)
+	out.SMTPPassword = maskSecret(a.SMTPPassword)
+	out.ErrorReportingDSN = maskSecret(a.ErrorReportingDSN)
+	out.ErrorReportingKey = maskSecret(a.ErrorReportingKey)
+	return out
+}
+
+// LogValue implements slog.LogValuer, so logging the config never writes out its secrets
+func (a *AppConfig) LogValue() slog.Value {
+	return slog.AnyValue(a.Redacted())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestRedactHandler(t *testing.T) {
+	cfg := &AppConfig{LogRedactKeys: defaultLogRedactKeys, LogRedactPatterns: []string{`\bssn=\d+`}}
+	if err := cfg.ParseLogRedactPatterns(); err != nil {
+		t.Fatalf("ParseLogRedactPatterns(): %v", err)
+	}
+	if err := (&AppConfig{LogRedactPatterns: []string{`ssn=(\d+`}}).ParseLogRedactPatterns(); err == nil {
+		t.Error("Expected an invalid pattern to be rejected")
+	}
+	var buf bytes.Buffer
+	logger := slog.New(redactHandler{slog.NewJSONHandler(&buf, nil), newRedactor(cfg)})
+
+	t.Run("Keys", func(t *testing.T) {
+		buf.Reset()
+		logger.With("Authorization", "Bearer ggs_abc").WithGroup("form").Info("login attempt",
+			"username", "frank", "password", "correct horse", "api_token", "ggs_def", "token_id", 7,
+			"secure_cookie_signing_key", "0a1b2c", "new_email", "frank@example.com",
+			slog.Group("user", "email", "frank@example.com"))
+		out := buf.String()
+		for _, leaked := range []string{"ggs_abc", "correct horse", "ggs_def", "0a1b2c", "@example.com"} {
+			if strings.Contains(out, leaked) {
+				t.Errorf("Expected %q to be masked in:\n%s", leaked, out)
+			}
+		}
+		for _, kept := range []string{`"username":"frank"`, `"token_id":7`, `"password":"[REDACTED]"`} {
+			if !strings.Contains(out, kept) {
+				t.Errorf("Expected %s in:\n%s", kept, out)
+			}
+		}
+	})
+
+	t.Run("Patterns", func(t *testing.T) {
+		buf.Reset()
+		logger.Info("charge 4111 1111 1111 1111 declined",
+			"note", "card 5500-0000-0000-0004, ssn=123456789",
+			"order_id", "1234567890123", // Not a valid card number
+			"error", errors.New("bad card 4012888888881881"))
+		out := buf.String()
+		for _, leaked := range []string{"4111 1111", "5500-0000", "123456789\"", "4012888888881881"} {
+			if strings.Contains(out, leaked) {
+				t.Errorf("Expected %q to be masked in:\n%s", leaked, out)
+			}
+		}
+		if !strings.Contains(out, `"order_id":"1234567890123"`) {
+			t.Errorf("Expected numbers failing the Luhn check to be left alone, got:\n%s", out)
+		}
+	})
+}
+
+func TestConfigRedacted(t *testing.T) {
+	const signing, encryption = "5f2b8c1d9e3a7f604b1c2d3e4f5a6b7c", "9a8b7c6d5e4f30211203f4e5d6c7b8a9"
+	cfg := &AppConfig{
+		SecureCookieSigningKeyHex:    signing,
+		SecureCookieEncryptionKeyHex: encryption,
+		SecureCookieSigningKey:       []byte(signing),
+		SecureCookieKeys:             []SecureCookieKeyPair{{SigningKeyHex: signing, EncryptionKeyHex: encryption}},
+		SMTPPassword:                 "hunter2",
+		HealthToken:                  "probe-token-0123456789",
+		HostPort:                     ":8080",
+	}
+
+	var logs bytes.Buffer
+	slog.New(slog.NewJSONHandler(&logs, nil)).Info("config", "config", cfg)
+	for name, out := range map[string]string{"spew": spew.Sdump(cfg.Redacted()), "slog": logs.String()} {
+		for _, secret := range []string{signing, encryption, "hunter2", "probe-token-0123456789"} {
+			if strings.Contains(out, secret) {
+				t.Errorf("%s: expected %q to be masked in:\n%s", name, secret, out)
+			}
+		}
+		if !strings.Contains(out, "5f2b…") || !strings.Contains(out, ":8080") {
+			t.Errorf("%s: expected masked key prefixes and the rest of the config in:\n%s", name, out)
+		}
+	}
+	if cfg.SMTPPassword != "hunter2" || len(cfg.SecureCookieSigningKey) == 0 {
+		t.Error("Expected Redacted() to leave the config itself alone")
+	}
+}
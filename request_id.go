@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/rand"
+	"log/slog"
+	"regexp"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID limits the IDs accepted from clients/proxies to something safe to log and display
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:+/=-]{1,128}$`)
+
+// mwRequestID gives each request an ID: the caller's X-Request-ID when it sends a sane one (so a proxy's ID follows
+// the request through), otherwise a fresh random one. It's echoed in the response's X-Request-ID header, logged
+// with every record made through the DSO's logger (see mwDSO) and shown on error pages. Register it first.
+func mwRequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = rand.Text()
+		}
+		c.Set("request_id", id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// requestID returns the ID mwRequestID gave the request ("" if it didn't run)
+func requestID(c *gin.Context) string {
+	return c.GetString("request_id")
+}
+
+// loggerFrom returns the logger handlers should use: the request's (tagged with request_id and route by mwDSO), plus
+// the signed-in user, if there is one
+func loggerFrom(c *gin.Context) *slog.Logger {
+	dso := c.MustGet("dso").(*DataSourceOrchestration)
+	if username := requestUsername(c); username != "" {
+		return dso.Logger.With("user", username)
+	}
+	return dso.Logger
+}
+
+// requestUsername returns the signed-in user's username ("" if there's none, or the session middleware hasn't run)
+func requestUsername(c *gin.Context) string {
+	if s, ok := c.Get(sessions.DefaultKey); ok {
+		return getUser(s.(sessions.Session)).Username
+	}
+	return ""
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestID(t *testing.T) {
+	router := setupTestRouter()
+	get := func(path, id string) *http.Response {
+		req, _ := http.NewRequest("GET", path, nil)
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		return newTestClient(t, router).do(req).Result()
+	}
+
+	t.Run("Generated", func(t *testing.T) {
+		a, b := get("/ping", "").Header.Get(requestIDHeader), get("/ping", "").Header.Get(requestIDHeader)
+		if a == "" || a == b {
+			t.Errorf("Expected a fresh ID per request, got %q and %q", a, b)
+		}
+	})
+
+	t.Run("Accepted", func(t *testing.T) {
+		if got := get("/ping", "lb-4f2a.9").Header.Get(requestIDHeader); got != "lb-4f2a.9" {
+			t.Errorf("Expected the caller's ID to be echoed, got %q", got)
+		}
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		for _, id := range []string{"has spaces", "<script>", strings.Repeat("a", 129)} {
+			if got := get("/ping", id).Header.Get(requestIDHeader); got == id || got == "" {
+				t.Errorf("Expected %q to be replaced, got %q", id, got)
+			}
+		}
+	})
+}
+
+func TestRequestLogger(t *testing.T) {
+	router, dso := setupTestRouterWithDSO()
+	var logs bytes.Buffer
+	dso.Logger = slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	if _, err := createUser(dso.DB, "frank", "correct horse", SESSUSR__USER); err != nil {
+		t.Fatalf("createUser(): %v", err)
+	}
+	tc := newTestClient(t, router)
+	tc.login("frank", "correct horse")
+
+	logs.Reset()
+	req, _ := http.NewRequest("GET", "/account", nil)
+	req.Header.Set(requestIDHeader, "req-42")
+	if w := tc.do(req); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	out := logs.String()
+	for _, want := range []string{`"msg":"calling route_Account_Index()"`, `"request_id":"req-42"`, `"route":"/account"`, `"user":"frank"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %s in:\n%s", want, out)
+		}
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	router, dso := setupTestRouterWithDSO()
+	var logs bytes.Buffer
+	dso.Logger = slog.New(slog.NewJSONHandler(&logs, nil))
+	router.GET("/boom", func(c *gin.Context) { panic("kaboom") })
+
+	t.Run("NotFound", func(t *testing.T) {
+		w := newTestClient(t, router).get("/no/such/page")
+		id := w.Header().Get(requestIDHeader)
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "<code>"+id+"</code>") {
+			t.Errorf("Expected the 404 page to show request ID %q, got %d:\n%s", id, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("NotFoundAPI", func(t *testing.T) {
+		w := newTestClient(t, router).get("/api/no/such/thing")
+		id := w.Header().Get(requestIDHeader)
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), `"request_id":"`+id+`"`) {
+			t.Errorf("Expected a JSON 404 carrying request ID %q, got %d: %s", id, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		w := newTestClient(t, router).get("/boom")
+		id := w.Header().Get(requestIDHeader)
+		if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "<code>"+id+"</code>") {
+			t.Errorf("Expected the 500 page to show request ID %q, got %d:\n%s", id, w.Code, w.Body.String())
+		}
+		if out := logs.String(); !strings.Contains(out, `"msg":"panic recovered"`) || !strings.Contains(out, `"request_id":"`+id+`"`) {
+			t.Errorf("Expected the panic to be logged with its request ID, got:\n%s", out)
+		}
+	})
+}
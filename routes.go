@@ -8,10 +8,90 @@ func register_routes(r *gin.Engine) {
 	// Serve the homepage
 	r.GET("/", route_Root_Index())
 	r.GET("/ping", route_Root_Ping())
+	r.POST(cspReportPath, route_Root_CSPReport_POST())
+
+	// Authentication routes
+	r.GET("/login", route_Auth_Login())
+	r.POST("/login", route_Auth_Login_POST())
+	r.GET("/login/2fa", route_Auth_TOTP())
+	r.POST("/login/2fa", route_Auth_TOTP_POST())
+	r.POST("/login/passkey/begin", route_Auth_Passkey_Begin_POST())
+	r.POST("/login/passkey/finish", route_Auth_Passkey_Finish_POST())
+	r.GET("/logout", route_Auth_Logout())
+	r.GET("/password/forgot", route_Password_Forgot())
+	r.POST("/password/forgot", route_Password_Forgot_POST())
+	r.GET("/password/reset", route_Password_Reset())
+	r.POST("/password/reset", route_Password_Reset_POST())
+	r.GET("/email/verify", route_Email_Verify())
+
+	// Account (self-service) routes
+	account := r.Group("/account", mwRequireAuth())
+	account.GET("", route_Account_Index())
+	account.POST("/email", route_Account_Email_POST())
+	account.POST("/email/verify", route_Account_Email_Verify_POST())
+	account.GET("/2fa/setup", route_Account_TOTP_Setup())
+	account.POST("/2fa/setup", route_Account_TOTP_Setup_POST())
+	account.POST("/2fa/disable", route_Account_TOTP_Disable_POST())
+	account.POST("/2fa/recovery-codes", route_Account_TOTP_RecoveryCodes_POST())
+	account.GET("/passkeys", route_Account_Passkeys_Index())
+	account.POST("/passkeys/begin", route_Account_Passkeys_Begin_POST())
+	account.POST("/passkeys/finish", route_Account_Passkeys_Finish_POST())
+	account.POST("/passkeys/:id/delete", route_Account_Passkeys_Delete_POST())
+	account.GET("/tokens", route_Account_Tokens_Index())
+	account.POST("/tokens", route_Account_Tokens_Create_POST())
+	account.POST("/tokens/:id/revoke", route_Account_Tokens_Revoke_POST())
+	account.GET("/sessions", route_Account_Sessions_Index())
+	account.POST("/sessions/revoke-all", route_Account_Sessions_RevokeAll_POST())
+	account.POST("/sessions/:id/revoke", route_Account_Sessions_Revoke_POST())
+
+	// Admin routes
+	admin := r.Group("/admin", mwRequireAuth())
+	users := admin.Group("/users", mwRequirePermission(PERM__USERS_MANAGE))
+	users.GET("", route_Admin_Users_Index())
+	users.GET("/new", route_Admin_Users_New())
+	users.POST("", route_Admin_Users_Create_POST())
+	users.GET("/:id", route_Admin_Users_Show())
+	users.POST("/:id", route_Admin_Users_Update_POST())
+	users.POST("/:id/disable", route_Admin_Users_Disable_POST())
+	users.POST("/:id/enable", route_Admin_Users_Enable_POST())
+	users.POST("/:id/password", route_Admin_Users_Password_POST())
+	users.POST("/:id/2fa/reset", route_Admin_Users_TOTP_Reset_POST())
+	users.POST("/:id/sessions/revoke", route_Admin_Users_Sessions_Revoke_POST())
+	users.POST("/:id/unlock", route_Admin_Users_Unlock_POST())
+	users.POST("/:id/impersonate", mwRequirePermission(PERM__USERS_IMPERSONATE), route_Admin_Users_Impersonate_POST())
+	admin.GET("/audit", mwRequirePermission(PERM__AUDIT_VIEW), route_Admin_Audit_Index())
+	// Reached as the impersonated user, so it can't sit behind the admin permissions
+	r.POST("/impersonation/stop", mwRequireAuth(), route_Impersonation_Stop_POST())
 
 	// Books routes
 	r.GET("/books", route_Books_Index())
 	r.GET("/books/:id", route_Books_Show())
 	r.GET("/books/new", route_Books_New())
 	r.POST("/books", route_Books_Create_POST())
+	r.GET("/books/:id/edit", route_Books_Edit())
+	r.POST("/books/:id", route_Books_Update_POST())
+	r.POST("/books/:id/delete", route_Books_Delete_POST())
+
+	// API routes (bearer token or cookie session)
+	api := r.Group("/api", mwAPIAuth())
+	api.GET("/me", route_Api_Me())
+	api.GET("/books", mwRequireAPIScope(APISCOPE__READ), route_Api_Books_Index())
+	api.GET("/books/:id", mwRequireAPIScope(APISCOPE__READ), route_Api_Books_Show())
+	api.POST("/books", mwRequireAPIScope(APISCOPE__WRITE), route_Api_Books_Create_POST())
+	api.PUT("/books/:id", mwRequireAPIScope(APISCOPE__WRITE), route_Api_Books_Update_PUT())
+	api.DELETE("/books/:id", mwRequireAPIScope(APISCOPE__WRITE), route_Api_Books_Delete())
+	apiAdmin := api.Group("/admin", mwRequireAPIScope(APISCOPE__ADMIN), mwRequirePermission(PERM__LOGS_MANAGE))
+	apiAdmin.GET("/log-levels", route_Api_Admin_LogLevels_Index())
+	apiAdmin.PUT("/log-levels", route_Api_Admin_LogLevels_Update_PUT())
+	apiAdmin.DELETE("/log-levels", route_Api_Admin_LogLevels_Reset_DELETE())
+
+	// Everything else gets the 404 page
+	r.NoRoute(route_Root_NotFound())
+}
+
+// register_health_routes adds the health probes. Call it before the session middleware is added, so probes are
+// answered without loading (or creating) a session.
+func register_health_routes(r *gin.Engine, h *Health) {
+	r.GET("/healthz", route_Health_Live(h))
+	r.GET("/readyz", route_Health_Ready(h))
 }
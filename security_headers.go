@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+)
+
+// cspNoncePlaceholder marks where the per-request nonce goes in the `csp` config option
+const cspNoncePlaceholder = "{nonce}"
+
+// cspReportPath is where browsers POST CSP violation reports (see route_Root_CSPReport_POST)
+const cspReportPath = "/csp-report"
+
+// defaultCSP allows the app's own assets (public/, vendored libraries included) and inline <script>/<style> blocks
+// carrying the request's nonce. Inline style="" attributes are allowed; inline event handlers (onclick="", ...) are not.
+const defaultCSP = "default-src 'self'; " +
+	"script-src 'self' 'nonce-{nonce}'; " +
+	"style-src 'self' 'nonce-{nonce}'; style-src-attr 'unsafe-inline'; " +
+	"font-src 'self'; img-src 'self' data:; object-src 'none'; base-uri 'self'; form-action 'self'"
+
+func newCSPNonce() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("rand.Read(): %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// contentSecurityPolicy builds the CSP header value for one request
+func (a *AppConfig) contentSecurityPolicy(nonce string) string {
+	policy := strings.TrimRight(strings.TrimSpace(a.CSP), ";")
+	policy = strings.ReplaceAll(policy, cspNoncePlaceholder, nonce)
+	if a.FrameAncestors != "" {
+		policy += "; frame-ancestors " + a.FrameAncestors
+	}
+	return policy + "; report-uri " + cspReportPath
+}
+
+// mwSecurityHeaders sets the security headers on every response and gives each request a CSP nonce, which
+// templates read with {{ csp_nonce }}. Register before any middleware that wraps the response writer.
+func mwSecurityHeaders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		cfg := dso.AppConfig
+
+		nonce, err := newCSPNonce()
+		if err != nil {
+			dso.Logger.Error("failed to generate csp nonce", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		h := c.Writer.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		if cfg.ReferrerPolicy != "" {
+			h.Set("Referrer-Policy", cfg.ReferrerPolicy)
+		}
+		if cfg.PermissionsPolicy != "" {
+			h.Set("Permissions-Policy", cfg.PermissionsPolicy)
+		}
+		// Older browsers only understand X-Frame-Options
+		switch cfg.FrameAncestors {
+		case "'none'":
+			h.Set("X-Frame-Options", "DENY")
+		case "'self'":
+			h.Set("X-Frame-Options", "SAMEORIGIN")
+		}
+		if !cfg.SSLDisabled && cfg.HSTSMaxAge > 0 {
+			h.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(cfg.HSTSMaxAge)+"; includeSubDomains")
+		}
+		if cfg.CSP != "" {
+			header := "Content-Security-Policy"
+			if cfg.CSPReportOnly {
+				header = "Content-Security-Policy-Report-Only"
+			}
+			h.Set(header, cfg.contentSecurityPolicy(nonce))
+		}
+
+		c.Writer = &cspNonceWriter{ResponseWriter: c.Writer, nonce: nonce}
+		c.Next()
+	}
+}
+
+// cspNonceWriter carries the request's CSP nonce to the HTML renderer, which only gets to see the response writer
+type cspNonceWriter struct {
+	gin.ResponseWriter
+	nonce string
+}
+
+func (w *cspNonceWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// cspNonce finds the nonce mwSecurityHeaders attached to w ("" if there is none, e.g. in a bare test router)
+func cspNonce(w http.ResponseWriter) string {
+	for {
+		switch v := w.(type) {
+		case *cspNonceWriter:
+			return v.nonce
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return ""
+		}
+	}
+}
+
+// htmlRender renders pages with the request's nonce bound to {{ csp_nonce }}. A template set can't change its
+// functions between executions, so each concurrent render gets its own clone of base, kept in a pool for reuse.
+// With load set, templates are instead re-read from disk for every render (cache_templates = false).
+type htmlRender struct {
+	base    *template.Template
+	load    func() (*template.Template, error)
+	clones  sync.Pool
+	observe func(name string, d time.Duration) // Optional, called after each render (see Metrics.observeRender)
+}
+
+// nonceTemplate is a clone of the base template set whose csp_nonce returns nonce
+type nonceTemplate struct {
+	tmpl  *template.Template
+	nonce string
+}
+
+// newHTMLRender renders from tmpl, which must not be executed elsewhere (html/template can't clone it after that)
+func newHTMLRender(tmpl *template.Template) *htmlRender {
+	return &htmlRender{base: tmpl}
+}
+
+// newReloadingHTMLRender renders from a template set freshly loaded for every request
+func newReloadingHTMLRender(load func() (*template.Template, error)) *htmlRender {
+	return &htmlRender{load: load}
+}
+
+// Instance implements render.HTMLRender
+func (r *htmlRender) Instance(name string, data any) render.Render {
+	return &htmlInstance{r: r, name: name, data: data}
+}
+
+func (r *htmlRender) get() (*nonceTemplate, error) {
+	if nt, ok := r.clones.Get().(*nonceTemplate); ok {
+		return nt, nil
+	}
+	nt := &nonceTemplate{}
+	tmpl, err := r.base.Clone()
+	if err != nil {
+		return nil, fmt.Errorf("tmpl.Clone(): %w", err)
+	}
+	nt.tmpl = tmpl.Funcs(template.FuncMap{"csp_nonce": func() string { return nt.nonce }})
+	return nt, nil
+}
+
+type htmlInstance struct {
+	r    *htmlRender
+	name string
+	data any
+}
+
+func (h *htmlInstance) Render(w http.ResponseWriter) error {
+	h.WriteContentType(w)
+	nonce := cspNonce(w)
+	if h.r.observe != nil {
+		defer func(start time.Time) { h.r.observe(h.name, time.Since(start)) }(time.Now())
+	}
+	_, span := tracer().Start(writerContext(w), "template "+h.name)
+	defer span.End()
+
+	if h.r.load != nil {
+		tmpl, err := h.r.load()
+		if err != nil {
+			return fmt.Errorf("load(): %w", err)
+		}
+		tmpl.Funcs(template.FuncMap{"csp_nonce": func() string { return nonce }})
+		return tmpl.ExecuteTemplate(w, h.name, h.data)
+	}
+
+	nt, err := h.r.get()
+	if err != nil {
+		return err
+	}
+	nt.nonce = nonce
+	defer func() {
+		nt.nonce = ""
+		h.r.clones.Put(nt)
+	}()
+	return nt.tmpl.ExecuteTemplate(w, h.name, h.data)
+}
+
+func (h *htmlInstance) WriteContentType(w http.ResponseWriter) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+}
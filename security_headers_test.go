@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	t.Run("SetOnEveryResponse", func(t *testing.T) {
+		tc := newTestClient(t, setupTestRouter(func(cfg *AppConfig) {
+			cfg.SSLDisabled = false
+			cfg.CSP = defaultCSP
+			cfg.FrameAncestors = "'none'"
+			cfg.ReferrerPolicy = "no-referrer"
+			cfg.PermissionsPolicy = "camera=()"
+			cfg.HSTSMaxAge = 600
+		}))
+		for _, path := range []string{"/books", "/ping"} {
+			h := tc.get(path).Header()
+			for name, want := range map[string]string{
+				"X-Content-Type-Options":    "nosniff",
+				"X-Frame-Options":           "DENY",
+				"Referrer-Policy":           "no-referrer",
+				"Permissions-Policy":        "camera=()",
+				"Strict-Transport-Security": "max-age=600; includeSubDomains",
+			} {
+				if got := h.Get(name); got != want {
+					t.Errorf("%s: expected %s %q, got %q", path, name, want, got)
+				}
+			}
+			csp := h.Get("Content-Security-Policy")
+			if !strings.Contains(csp, "frame-ancestors 'none'") || !strings.HasSuffix(csp, "report-uri "+cspReportPath) {
+				t.Errorf("%s: unexpected CSP %q", path, csp)
+			}
+		}
+	})
+
+	t.Run("NoHSTSWithoutTLS", func(t *testing.T) {
+		tc := newTestClient(t, setupTestRouter(func(cfg *AppConfig) { cfg.HSTSMaxAge = 600 }))
+		if h := tc.get("/ping").Header().Get("Strict-Transport-Security"); h != "" {
+			t.Errorf("Expected no HSTS header over plain HTTP, got %q", h)
+		}
+	})
+
+	t.Run("ReportOnly", func(t *testing.T) {
+		tc := newTestClient(t, setupTestRouter(func(cfg *AppConfig) {
+			cfg.CSP = defaultCSP
+			cfg.CSPReportOnly = true
+		}))
+		h := tc.get("/ping").Header()
+		if h.Get("Content-Security-Policy") != "" || h.Get("Content-Security-Policy-Report-Only") == "" {
+			t.Error("Expected the policy to be sent report-only")
+		}
+	})
+
+	t.Run("NonceIsPerRequestAndMatchesPage", func(t *testing.T) {
+		router := setupTestRouter(func(cfg *AppConfig) { cfg.CSP = defaultCSP })
+		headerNonce := regexp.MustCompile(`script-src 'self' 'nonce-([A-Za-z0-9_-]+)'`)
+		pageNonce := regexp.MustCompile(`<script type="text/javascript" nonce="([^"]+)">`)
+
+		// Concurrent renders share pooled template clones; each must still see its own nonce
+		var mu sync.Mutex
+		seen := map[string]bool{}
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := newTestClient(t, router).get("/books")
+				h := headerNonce.FindStringSubmatch(w.Header().Get("Content-Security-Policy"))
+				p := pageNonce.FindStringSubmatch(w.Body.String())
+				if h == nil || p == nil || h[1] != p[1] {
+					t.Errorf("Expected the page's nonce to match its CSP header, got %v and %v", h, p)
+					return
+				}
+				if !strings.Contains(w.Body.String(), `<style nonce="`+h[1]+`">`) {
+					t.Error("Expected the inline style to carry the nonce")
+				}
+				mu.Lock()
+				seen[h[1]] = true
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		if len(seen) != 20 {
+			t.Errorf("Expected 20 distinct nonces, got %d", len(seen))
+		}
+	})
+}
+
+func TestCSPReport(t *testing.T) {
+	router, dso := setupTestRouterWithDSO()
+	var logs bytes.Buffer
+	dso.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	tc := newTestClient(t, router)
+
+	post := func(contentType, body string) int {
+		req, _ := http.NewRequest("POST", cspReportPath, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		return tc.do(req).Code
+	}
+
+	// No CSRF token: browsers can't send one with a report
+	code := post("application/csp-report", `{"csp-report":{"document-uri":"http://localhost/books",`+
+		`"violated-directive":"script-src-elem","blocked-uri":"https://evil.example/x.js","disposition":"enforce"}}`)
+	if code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+	code = post("application/reports+json", `[{"type":"csp-violation","body":{"documentURL":"http://localhost/",`+
+		`"effectiveDirective":"style-src-elem","blockedURL":"inline","disposition":"report"}}]`)
+	if code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+	out := logs.String()
+	for _, want := range []string{"blocked_uri=https://evil.example/x.js", "directive=script-src-elem", "directive=style-src-elem"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected the violation to be logged with %s, got:\n%s", want, out)
+		}
+	}
+
+	if code := post("application/csp-report", "not json"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a malformed report, got %d", code)
+	}
+}
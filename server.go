@@ -4,13 +4,20 @@ import (
 	"bytes"
 	"fmt"
 	"html/template"
+	"io"
 	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	texttemplate "text/template"
 	"time"
 
 	"github.com/Masterminds/sprig/v3"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/dustin/go-humanize"
+	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark/extension"
 	"github.com/yuin/goldmark/parser"
@@ -27,9 +34,14 @@ const datetimeFormat_MonthYear = "Jan 2006" // e.g., "Feb 2024"
 // This approach is far preferred over using global variables.
 // It also reduces churn when adding new data sources to the application and needing to pass them down.
 type DataSourceOrchestration struct {
-	AppConfig *AppConfig
-	DB        *gorm.DB
-	Logger    *slog.Logger
+	AppConfig     *AppConfig
+	DB            *gorm.DB
+	Logger        *slog.Logger
+	WebAuthn      *webauthn.WebAuthn
+	Mailer        Mailer
+	MailTemplates *texttemplate.Template
+	Lifecycle     *Lifecycle
+	LogLevels     *LogLevels
 }
 
 // mwAppConfig adds the AppConfig object as a middleware for the Gin context
@@ -49,7 +61,137 @@ func mwAppConfig(cfg *AppConfig) gin.HandlerFunc {
 // mwDSO adds the DataSourceOrchestration object as a middleware for the Gin context
 func mwDSO(dso *DataSourceOrchestration) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Set("dso", dso)
+		// Each request gets a shallow copy whose DB and Logger carry the request's context, so queries and log
+		// records are tied to its trace (see tracing.go), and whose Logger tags records with the request ID and route
+		ctx := c.Request.Context()
+		reqDSO := *dso
+		reqDSO.DB = dso.DB.WithContext(ctx)
+		reqDSO.Logger = slog.New(contextLogHandler{dso.Logger.Handler(), ctx}).With("request_id", requestID(c), "route", c.FullPath())
+		c.Set("dso", &reqDSO)
+		c.Next()
+	}
+}
+
+// mwRecovery is gin.Recovery(), but reports the panic (see errorReporter), logs it with the request's ID and answers
+// with the error page (see renderError) rather than a bare 500
+func mwRecovery(logger *slog.Logger, reporter *errorReporter) gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		reporter.CapturePanic(c.Request.Context(), err, requestUsername(c))
+		l := logger.With("request_id", requestID(c), "route", c.FullPath())
+		if v, ok := c.Get("dso"); ok {
+			l = v.(*DataSourceOrchestration).Logger // Already tagged
+		}
+		// (Reported above with its stack, so the log record isn't reported again)
+		l.ErrorContext(withErrorReported(c.Request.Context()), "panic recovered", "error", fmt.Sprint(err), "stack", string(debug.Stack()))
+		renderError(c, http.StatusInternalServerError, "Something went wrong on our end. Please try again later.")
+	})
+}
+
+// mwSessionValidity logs out sessions that have been revoked (individually, via "sign out everywhere", or by an
+// admin) or whose account was disabled, by removing the SessionUser from the session so getUser() treats the
+// request as unauthenticated. The check lives here rather than in getUser(), which has no DB handle and is called
+// several times per request: this way it costs one query per request, and every later getUser() (mwRequireAuth,
+// mwAPIAuth's cookie path, templates) sees the result. Register after mwDSO and before any route.
+func mwSessionValidity() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		session := sessions.Default(c)
+		user := getUser(session)
+		if !user.SessionIsValid() {
+			c.Next()
+			return
+		}
+
+		valid, err := checkUserSession(dso.DB, &user)
+		if err != nil {
+			// Fail open: a database hiccup shouldn't log everyone out (handlers needing the DB will fail anyway)
+			dso.Logger.Error("failed to check session validity", "username", user.Username, "error", err)
+			c.Next()
+			return
+		}
+		// While impersonating, the admin's own login must stay valid too
+		if admin, ok := getImpersonator(session); ok && valid {
+			valid, err = checkUserSession(dso.DB, &admin)
+			if err != nil {
+				dso.Logger.Error("failed to check session validity", "username", admin.Username, "error", err)
+				c.Next()
+				return
+			}
+		}
+		if !valid {
+			dso.Logger.Info("revoked session rejected", "username", user.Username, "session_id", user.SessionID)
+			session.Delete(gin.AuthUserKey)
+			session.Delete(sessionKeyImpersonator)
+			addFlash("Your session has ended, please log in again", session)
+		}
+		c.Next()
+	}
+}
+
+// mwRequireAuth redirects to the login page unless the session holds a valid, fully-authenticated user
+func mwRequireAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session := sessions.Default(c)
+		user := getUser(session)
+		if !user.SessionIsValid() {
+			addFlash("Please log in to continue", session)
+			c.Redirect(http.StatusSeeOther, "/login")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// mwRequireAdmin only allows users with the SESSUSR__ADMIN role bit through (register after mwRequireAuth). Prefer
+// mwRequirePermission for new routes.
+func mwRequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		session := sessions.Default(c)
+		user := getUser(session)
+		// Impersonated sessions never get admin access, even when the impersonated user is an admin
+		if !user.IsAdmin() || user.IsImpersonated() {
+			dso.Logger.Warn("non-admin denied access to admin route", "username", user.Username,
+				"impersonator", user.Impersonator, "path", c.Request.URL.Path)
+			addFlash("You are not authorized to access that page", session)
+			c.Redirect(http.StatusSeeOther, "/")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// mwReadOnlyWhenImpersonating blocks changes (anything but GET/HEAD) while an admin is impersonating, so they can
+// see what the user sees without acting as them, e.g. editing books, creating API tokens or changing 2FA. Stopping the
+// impersonation (and CSP reports, which change nothing) stay open. Register globally, after the sessions middleware.
+func mwReadOnlyWhenImpersonating() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+		switch c.Request.URL.Path {
+		case "/impersonation/stop", cspReportPath:
+			c.Next()
+			return
+		}
+		dso := c.MustGet("dso").(*DataSourceOrchestration)
+		session := sessions.Default(c)
+		user := getUser(session)
+		if user.IsImpersonated() {
+			dso.Logger.Warn("change blocked while impersonating", "username", user.Username,
+				"impersonator", user.Impersonator, "path", c.Request.URL.Path)
+			if strings.HasPrefix(c.Request.URL.Path, "/api/") {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "not available while impersonating a user"})
+				return
+			}
+			addFlash("That isn't available while impersonating a user", session)
+			c.Redirect(http.StatusSeeOther, "/account")
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
@@ -69,7 +211,7 @@ func mwDatabase(db *gorm.DB) gin.HandlerFunc {
 */
 
 // customTmplFuncMap returns a template.FuncMap with custom functions for templates
-func customTmplFuncMap(cfg *AppConfig, logger *slog.Logger) template.FuncMap {
+func customTmplFuncMap(cfg *AppConfig, logger *slog.Logger, assets *publicAssets) template.FuncMap {
 	fm := sprig.FuncMap()
 	fm["fdateyear"] = func(t *time.Time) string {
 		if t == nil {
@@ -92,6 +234,16 @@ func customTmplFuncMap(cfg *AppConfig, logger *slog.Logger) template.FuncMap {
 	fm["fdatetime"] = func(t time.Time) string {
 		return t.Local().Format("01-02-2006 03:04 PM")
 	}
+	fm["role_names"] = roleNames
+	fm["role_permissions"] = cfg.rolePermissions
+	fm["authorize"] = cfg.Authorize
+	fm["asset"] = assets.URL
+	fm["asset_sri"] = assets.Integrity
+	fm["csrf_field"] = csrfField
+	fm["csp_nonce"] = func() string { return "" } // Bound per request by htmlRender
+	fm["can"] = func(su *SessionUser, perm string) bool {
+		return userCan(cfg, su, perm)
+	}
 	fm["to_days"] = func(d time.Duration) int {
 		return int(d.Hours() / 24)
 	}
@@ -3,15 +3,21 @@ package main
 import (
 	"encoding/gob"
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
+	gsessions "github.com/gorilla/sessions"
 	"github.com/jinzhu/now"
+	"gorm.io/gorm"
 )
 
 type SessionUser struct {
+	UserID    uint
 	Username  string
 	DN        string
 	FirstName string
@@ -22,6 +28,22 @@ type SessionUser struct {
 	AuthTime       time.Time
 	AuthExpiration time.Time
 	Role           uint64
+	Roles          []string // Named roles beyond the Role bits (see permissions.go)
+
+	// Set after a correct password for an account with 2FA enrolled; Authenticated stays false until the TOTP
+	// (or recovery code) challenge is passed
+	TOTPPending bool
+
+	// Identify this login for "sign out everywhere"/revocation (see user_session.go); checked by mwSessionValidity
+	SessionID  string
+	Generation uint64
+
+	// Set while an admin is impersonating this user (the admin's own SessionUser is kept under
+	// sessionKeyImpersonator); impersonated sessions never carry admin rights
+	Impersonator string
+
+	// The session's CSRF token, filled in by getUser for templates (see csrf.go); not meaningful once stored
+	CSRFToken string
 
 	// IsOauth        bool
 	// OauthSessionID string
@@ -33,6 +55,47 @@ const (
 	SESSUSR__USER              // Regular user
 )
 
+// RoleBit describes one SESSUSR__* bit for display and for the admin user forms
+type RoleBit struct {
+	Bit         uint64
+	Name        string
+	Description string
+}
+
+// roleBits lists every SESSUSR__* bit (keep in sync with the constants above)
+var roleBits = []RoleBit{
+	{SESSUSR__ADMIN, "admin", "Overall application admin"},
+	{SESSUSR__USER, "user", "Regular user"},
+}
+
+// roleNames lists the names of the bits set in role
+func roleNames(role uint64) []string {
+	var names []string
+	for _, r := range roleBits {
+		if role&r.Bit != 0 {
+			names = append(names, r.Name)
+		}
+	}
+	return names
+}
+
+// parseRoleBits ORs together role bits submitted as decimal strings (e.g. checkbox values), ignoring unknown bits
+func parseRoleBits(values []string) uint64 {
+	var role uint64
+	for _, v := range values {
+		b, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		for _, r := range roleBits {
+			if b == r.Bit {
+				role |= b
+			}
+		}
+	}
+	return role
+}
+
 // NewAuthenticatedSessionUser creates a new session user with a valid session flag/timestamp set
 func NewAuthenticatedSessionUser(username string) *SessionUser {
 	return &SessionUser{
@@ -48,9 +111,58 @@ func NewAuthenticatedSessionUser(username string) *SessionUser {
 	}
 }
 
-// Instantiate secure session store
-func instantiateSessionStore(cfg *AppConfig) cookie.Store {
-	store := cookie.NewStore(cfg.SecureCookieSigningKey, cfg.SecureCookieEncryptionKey)
+// NewTOTPPendingSessionUser creates a not-yet-authenticated session user awaiting a second factor
+func NewTOTPPendingSessionUser(u *User) *SessionUser {
+	su := u.SessionUser()
+	su.Authenticated = false
+	su.TOTPPending = true
+	su.AuthExpiration = time.Now().Add(totpChallengeWindow)
+	return su
+}
+
+// How long a user has to answer the 2FA challenge after entering a correct password
+const totpChallengeWindow = 5 * time.Minute
+
+// cookieSameSite maps the `session_same_site` config option to the cookie attribute (Lax unless configured)
+func cookieSameSite(cfg *AppConfig) (http.SameSite, error) {
+	switch strings.ToLower(cfg.SessionSameSite) {
+	case "lax", "":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		// Browsers drop SameSite=None cookies that aren't also Secure
+		if cfg.SSLDisabled {
+			return 0, fmt.Errorf("session_same_site 'none' requires TLS (ssl_disabled = false)")
+		}
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("unknown session_same_site '%s'", cfg.SessionSameSite)
+}
+
+// Instantiate secure session store, as chosen by the `session_store` config option
+func instantiateSessionStore(cfg *AppConfig, db *gorm.DB) (sessions.Store, error) {
+	var store sessions.Store
+	switch cfg.SessionStore {
+	case SESSION_STORE__COOKIE, "":
+		store = cookieSessionStore{cookie.NewStore(cfg.SecureCookieKeyPairs()...)}
+	case SESSION_STORE__FILESYSTEM:
+		backend, err := newFSSessionBackend(cfg.SessionDir, serverSessionLifetime(cfg))
+		if err != nil {
+			return nil, fmt.Errorf("newFSSessionBackend(): %w", err)
+		}
+		store = newServerSessionStore(backend, serverSessionLifetime(cfg), cfg.SecureCookieKeyPairs()...)
+	case SESSION_STORE__DATABASE:
+		backend := &dbSessionBackend{db: db}
+		store = newServerSessionStore(backend, serverSessionLifetime(cfg), cfg.SecureCookieKeyPairs()...)
+	default:
+		return nil, fmt.Errorf("unknown session_store '%s'", cfg.SessionStore)
+	}
+
+	sameSite, err := cookieSameSite(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	// Secure sessions
 	store.Options(sessions.Options{
@@ -59,12 +171,24 @@ func instantiateSessionStore(cfg *AppConfig) cookie.Store {
 		MaxAge:   cfg.SecureCookieMaxAge, // 86400 * 7
 		Secure:   !cfg.SSLDisabled,
 		HttpOnly: true,
+		SameSite: sameSite,
 	})
 
 	// Register the SessionUser{} type to be serialized for inclusion in our sessions via `gob` encoding
 	gob.Register(&SessionUser{})
 
-	return store
+	return store, nil
+}
+
+// cookieSessionStore is gin-contrib's cookie store, minus the renewSessionID marker (it has no ID to renew)
+type cookieSessionStore struct {
+	cookie.Store
+}
+
+// Save implements gsessions.Store
+func (s cookieSessionStore) Save(r *http.Request, w http.ResponseWriter, session *gsessions.Session) error {
+	delete(session.Values, sessionKeyRenewID)
+	return s.Store.Save(r, w, session)
 }
 
 func (s *SessionUser) SessionIsValid() bool {
@@ -91,6 +215,11 @@ func (s *SessionUser) IsRole(b uint64) bool {
 	return ((s.Role & b) != 0)
 }
 
+// RoleNames lists every role the user holds: those named by the Role bits, then the named Roles
+func (s *SessionUser) RoleNames() []string {
+	return append(roleNames(s.Role), s.Roles...)
+}
+
 // Convenience method to test for admin
 func (s *SessionUser) IsAdmin() bool {
 	return s.IsRole(SESSUSR__ADMIN)
@@ -122,13 +251,73 @@ func getFlashes(session sessions.Session) []string {
 	return fs
 }
 
+// sessionKeyRenewID asks a server-side session store to move the session to a fresh ID on its next save
+const sessionKeyRenewID = "renew_id"
+
+// renewSessionID has the session saved under a new ID, dropping the old one, so an ID planted or seen before login
+// (session fixation) is useless afterwards. Only server-side stores have an ID to renew; the cookie store just
+// re-encrypts the whole session.
+func renewSessionID(session sessions.Session) {
+	session.Set(sessionKeyRenewID, true)
+}
+
+// setUser stores the SessionUser in the session (e.g. on login)
+func setUser(user *SessionUser, session sessions.Session) {
+	session.Set(gin.AuthUserKey, user)
+	errsess := session.Save()
+	if errsess != nil {
+		panic(errsess.Error())
+	}
+}
+
+// sessionKeyImpersonator holds the admin's own SessionUser while they impersonate someone else
+const sessionKeyImpersonator = "impersonator"
+
+// IsImpersonated reports whether an admin is viewing the site as this user
+func (s *SessionUser) IsImpersonated() bool {
+	return s.Impersonator != ""
+}
+
+// startImpersonation swaps the session over to target, stashing the admin's SessionUser so it can be restored
+func startImpersonation(admin *SessionUser, target *SessionUser, session sessions.Session) {
+	target.Impersonator = admin.Username
+	target.RemoveRole(SESSUSR__ADMIN)
+	// Don't outlive the admin's own login
+	target.AuthTime = admin.AuthTime
+	target.AuthExpiration = admin.AuthExpiration
+	session.Set(sessionKeyImpersonator, admin)
+	setUser(target, session)
+}
+
+// getImpersonator returns the admin's SessionUser while impersonating
+func getImpersonator(session sessions.Session) (SessionUser, bool) {
+	admin, ok := session.Get(sessionKeyImpersonator).(*SessionUser)
+	if !ok {
+		return SessionUser{}, false
+	}
+	return *admin, true
+}
+
+// stopImpersonation restores the admin's SessionUser, returning it
+func stopImpersonation(session sessions.Session) (SessionUser, bool) {
+	admin, ok := getImpersonator(session)
+	if !ok {
+		return SessionUser{}, false
+	}
+	session.Delete(sessionKeyImpersonator)
+	setUser(&admin, session)
+	return admin, true
+}
+
 func getUser(session sessions.Session) SessionUser {
 	// Retrieve our struct and type-assert it
 	val := session.Get(gin.AuthUserKey)
 	var user = &SessionUser{}
 	var ok bool
 	if user, ok = val.(*SessionUser); !ok {
-		return SessionUser{}
+		return SessionUser{CSRFToken: sessionCSRFToken(session)}
 	}
-	return *user
+	su := *user
+	su.CSRFToken = sessionCSRFToken(session)
+	return su
 }
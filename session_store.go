@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gorilla/securecookie"
+	gsessions "github.com/gorilla/sessions"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Supported values for the `session_store` config option
+const (
+	SESSION_STORE__COOKIE     = "cookie"     // All session data in the (signed+encrypted) cookie; ~4KB limit
+	SESSION_STORE__FILESYSTEM = "filesystem" // Data in files under `session_dir`; cookie holds only the session ID
+	SESSION_STORE__DATABASE   = "database"   // Data in the `server_sessions` table; cookie holds only the session ID
+)
+
+// sessionReaper is implemented by server-side stores that need expired sessions cleaned up periodically
+type sessionReaper interface {
+	Reap(now time.Time) (int, error)
+}
+
+// serverSessionLifetime is how long an idle server-side session is kept. It follows the cookie's MaxAge when set;
+// for browser-session cookies (MaxAge 0) it falls back to `session_lifetime`.
+func serverSessionLifetime(cfg *AppConfig) time.Duration {
+	if cfg.SecureCookieMaxAge > 0 {
+		return time.Duration(cfg.SecureCookieMaxAge) * time.Second
+	}
+	return time.Duration(cfg.SessionLifetime) * time.Second
+}
+
+// startSessionReaper periodically deletes expired sessions from store (if it needs it). Call the returned
+// function to stop it; it waits for a sweep in progress to finish.
+func startSessionReaper(store sessions.Store, interval time.Duration, logger *slog.Logger) (stop func()) {
+	reaper, ok := store.(sessionReaper)
+	if !ok || interval <= 0 {
+		return func() {}
+	}
+
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				n, err := reaper.Reap(now)
+				if err != nil {
+					logger.Error("failed to reap expired sessions", "error", err)
+					continue
+				}
+				if n > 0 {
+					logger.Debug("reaped expired sessions", "count", n)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+func newSessionID() string {
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+}
+
+// serverSessionBackend persists gob-encoded session values by ID
+type serverSessionBackend interface {
+	load(id string, now time.Time) ([]byte, error) // errSessionNotFound if missing or expired
+	save(id string, data []byte, expiresAt time.Time) error
+	delete(id string) error
+	reap(now time.Time) (int, error)
+}
+
+var errSessionNotFound = errors.New("session not found")
+
+// serverSessionStore keeps session data server-side; the cookie only carries the (signed, encrypted) session ID.
+// Modeled on gorilla's FilesystemStore, but with no size limit, support for browser-session cookies (MaxAge 0)
+// and sliding server-side expiry.
+type serverSessionStore struct {
+	backend  serverSessionBackend
+	codecs   []securecookie.Codec
+	options  *gsessions.Options
+	lifetime time.Duration
+}
+
+func newServerSessionStore(backend serverSessionBackend, lifetime time.Duration, keyPairs ...[]byte) *serverSessionStore {
+	return &serverSessionStore{
+		backend:  backend,
+		codecs:   securecookie.CodecsFromPairs(keyPairs...),
+		options:  &gsessions.Options{Path: "/"},
+		lifetime: lifetime,
+	}
+}
+
+// Options implements sessions.Store
+func (s *serverSessionStore) Options(options sessions.Options) {
+	s.options = options.ToGorillaOptions()
+	for _, c := range s.codecs {
+		if sc, ok := c.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(options.MaxAge)
+		}
+	}
+}
+
+// Get implements gsessions.Store
+func (s *serverSessionStore) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	return gsessions.GetRegistry(r).Get(s, name)
+}
+
+// New implements gsessions.Store. An unknown, expired or tampered-with session ID yields a fresh empty session; like
+// gorilla's stores, a cookie that doesn't decode is also reported as an error (which gin-contrib/sessions logs).
+func (s *serverSessionStore) New(r *http.Request, name string) (*gsessions.Session, error) {
+	session := gsessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, c.Value, &session.ID, s.codecs...); err != nil {
+		session.ID = ""
+		return session, fmt.Errorf("securecookie.DecodeMulti(): %w", err)
+	}
+
+	data, err := s.backend.load(session.ID, time.Now())
+	if errors.Is(err, errSessionNotFound) {
+		session.ID = ""
+		return session, nil
+	}
+	if err != nil {
+		return session, fmt.Errorf("backend.load(): %w", err)
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+		return session, fmt.Errorf("securecookie.GobEncoder.Deserialize(): %w", err)
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save implements gsessions.Store. A negative MaxAge deletes the session; renewSessionID moves it to a new ID.
+func (s *serverSessionStore) Save(r *http.Request, w http.ResponseWriter, session *gsessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.delete(session.ID); err != nil {
+				return fmt.Errorf("backend.delete(): %w", err)
+			}
+		}
+		http.SetCookie(w, gsessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if _, renew := session.Values[sessionKeyRenewID]; renew {
+		delete(session.Values, sessionKeyRenewID)
+		if session.ID != "" {
+			if err := s.backend.delete(session.ID); err != nil {
+				return fmt.Errorf("backend.delete(): %w", err)
+			}
+			session.ID = ""
+		}
+	}
+	if session.ID == "" {
+		session.ID = newSessionID()
+	}
+	data, err := (securecookie.GobEncoder{}).Serialize(session.Values)
+	if err != nil {
+		return fmt.Errorf("securecookie.GobEncoder.Serialize(): %w", err)
+	}
+	if err := s.backend.save(session.ID, data, time.Now().Add(s.lifetime)); err != nil {
+		return fmt.Errorf("backend.save(): %w", err)
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return fmt.Errorf("securecookie.EncodeMulti(): %w", err)
+	}
+	http.SetCookie(w, gsessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Reap implements sessionReaper
+func (s *serverSessionStore) Reap(now time.Time) (int, error) {
+	return s.backend.reap(now)
+}
+
+// ServerSession is a session stored by dbSessionBackend
+type ServerSession struct {
+	ID        string    `gorm:"primaryKey"`
+	Data      []byte    // gob-encoded session values
+	ExpiresAt time.Time `gorm:"index"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// dbSessionBackend stores sessions in the `server_sessions` table
+type dbSessionBackend struct {
+	db *gorm.DB
+}
+
+func (b *dbSessionBackend) load(id string, now time.Time) ([]byte, error) {
+	var rec ServerSession
+	err := b.db.Where("id = ? AND expires_at > ?", id, now).First(&rec).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("db.First(): %w", err)
+	}
+	return rec.Data, nil
+}
+
+func (b *dbSessionBackend) save(id string, data []byte, expiresAt time.Time) error {
+	err := b.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"data", "expires_at", "updated_at"}),
+	}).Create(&ServerSession{ID: id, Data: data, ExpiresAt: expiresAt}).Error
+	if err != nil {
+		return fmt.Errorf("db.Create(): %w", err)
+	}
+	return nil
+}
+
+func (b *dbSessionBackend) delete(id string) error {
+	if err := b.db.Delete(&ServerSession{}, "id = ?", id).Error; err != nil {
+		return fmt.Errorf("db.Delete(): %w", err)
+	}
+	return nil
+}
+
+func (b *dbSessionBackend) reap(now time.Time) (int, error) {
+	res := b.db.Where("expires_at <= ?", now).Delete(&ServerSession{})
+	if res.Error != nil {
+		return 0, fmt.Errorf("db.Delete(): %w", res.Error)
+	}
+	return int(res.RowsAffected), nil
+}
+
+// fsSessionBackend stores each session in its own file under dir. Files are rewritten on every save, so a file's
+// mtime is the session's last activity and it expires `lifetime` after that.
+type fsSessionBackend struct {
+	dir      string
+	lifetime time.Duration
+}
+
+const fsSessionFilePrefix = "session_"
+
+func newFSSessionBackend(dir string, lifetime time.Duration) (*fsSessionBackend, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll(): %w", err)
+	}
+	return &fsSessionBackend{dir: dir, lifetime: lifetime}, nil
+}
+
+func (b *fsSessionBackend) path(id string) string {
+	return filepath.Join(b.dir, fsSessionFilePrefix+filepath.Base(id))
+}
+
+func (b *fsSessionBackend) load(id string, now time.Time) ([]byte, error) {
+	info, err := os.Stat(b.path(id))
+	if os.IsNotExist(err) || (err == nil && now.Sub(info.ModTime()) >= b.lifetime) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("os.Stat(): %w", err)
+	}
+	data, err := os.ReadFile(b.path(id))
+	if os.IsNotExist(err) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile(): %w", err)
+	}
+	return data, nil
+}
+
+func (b *fsSessionBackend) save(id string, data []byte, expiresAt time.Time) error {
+	// Write-then-rename so concurrent readers never see a partial file
+	tmp, err := os.CreateTemp(b.dir, ".tmp_")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp(): %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("tmp.Write(): %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("tmp.Close(): %w", err)
+	}
+	if err := os.Rename(tmp.Name(), b.path(id)); err != nil {
+		return fmt.Errorf("os.Rename(): %w", err)
+	}
+	return nil
+}
+
+func (b *fsSessionBackend) delete(id string) error {
+	if err := os.Remove(b.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("os.Remove(): %w", err)
+	}
+	return nil
+}
+
+func (b *fsSessionBackend) reap(now time.Time) (int, error) {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return 0, fmt.Errorf("os.ReadDir(): %w", err)
+	}
+	n := 0
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), fsSessionFilePrefix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || now.Sub(info.ModTime()) < b.lifetime {
+			continue
+		}
+		if err := os.Remove(filepath.Join(b.dir, e.Name())); err != nil && !os.IsNotExist(err) {
+			return n, fmt.Errorf("os.Remove(): %w", err)
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gorilla/securecookie"
+)
+
+func testServerSessionStores(t *testing.T, lifetime time.Duration) map[string]*serverSessionStore {
+	db, err := bootstrapSqliteDb(":memory:")
+	if err != nil {
+		t.Fatalf("bootstrapSqliteDb(): %v", err)
+	}
+	fsBackend, err := newFSSessionBackend(t.TempDir(), lifetime)
+	if err != nil {
+		t.Fatalf("newFSSessionBackend(): %v", err)
+	}
+	hashKey, blockKey := securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32)
+	stores := map[string]*serverSessionStore{
+		SESSION_STORE__DATABASE:   newServerSessionStore(&dbSessionBackend{db: db}, lifetime, hashKey, blockKey),
+		SESSION_STORE__FILESYSTEM: newServerSessionStore(fsBackend, lifetime, hashKey, blockKey),
+	}
+	for _, s := range stores {
+		s.Options(sessions.Options{Path: "/", MaxAge: 0, HttpOnly: true})
+	}
+	return stores
+}
+
+// saveSession saves values into a new session and returns the cookie the browser would get back
+func saveSession(t *testing.T, store *serverSessionStore, values map[any]any) *http.Cookie {
+	req := httptest.NewRequest("GET", "/", nil)
+	session, err := store.New(req, "s")
+	if err != nil {
+		t.Fatalf("store.New(): %v", err)
+	}
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	w := httptest.NewRecorder()
+	if err := store.Save(req, w, session); err != nil {
+		t.Fatalf("store.Save(): %v", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected one cookie, got %d", len(cookies))
+	}
+	return cookies[0]
+}
+
+func loadSession(t *testing.T, store *serverSessionStore, cookie *http.Cookie) map[any]any {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	session, err := store.New(req, "s")
+	if err != nil {
+		t.Fatalf("store.New(): %v", err)
+	}
+	return session.Values
+}
+
+func TestServerSessionStores(t *testing.T) {
+	t.Run("LargeSessionsRoundTrip", func(t *testing.T) {
+		for name, store := range testServerSessionStores(t, time.Hour) {
+			big := strings.Repeat("x", 16*1024)
+			cookie := saveSession(t, store, map[any]any{"big": big, "user": &SessionUser{Username: "alice"}})
+			if len(cookie.Value) > 512 {
+				t.Errorf("%s: expected cookie to hold only an opaque ID, got %d bytes", name, len(cookie.Value))
+			}
+
+			values := loadSession(t, store, cookie)
+			if values["big"] != big {
+				t.Errorf("%s: expected large value to survive a round trip", name)
+			}
+			if u, ok := values["user"].(*SessionUser); !ok || u.Username != "alice" {
+				t.Errorf("%s: expected SessionUser to survive a round trip, got %#v", name, values["user"])
+			}
+		}
+	})
+
+	t.Run("TamperedCookieGetsFreshSession", func(t *testing.T) {
+		for name, store := range testServerSessionStores(t, time.Hour) {
+			cookie := saveSession(t, store, map[any]any{"k": "v"})
+			mid := len(cookie.Value) / 2
+			flipped := byte('A')
+			if cookie.Value[mid] == 'A' {
+				flipped = 'B'
+			}
+			cookie.Value = cookie.Value[:mid] + string(flipped) + cookie.Value[mid+1:]
+			req := httptest.NewRequest("GET", "/", nil)
+			req.AddCookie(cookie)
+			session, err := store.New(req, "s")
+			if err == nil {
+				t.Errorf("%s: expected a tampered cookie to be reported", name)
+			}
+			if len(session.Values) != 0 || !session.IsNew {
+				t.Errorf("%s: expected a tampered cookie to yield an empty session, got %v", name, session.Values)
+			}
+		}
+	})
+
+	t.Run("ReaperRemovesExpiredSessions", func(t *testing.T) {
+		for name, store := range testServerSessionStores(t, time.Hour) {
+			cookie := saveSession(t, store, map[any]any{"k": "v"})
+
+			if n, err := store.Reap(time.Now()); err != nil || n != 0 {
+				t.Errorf("%s: expected nothing to reap yet, got %d (%v)", name, n, err)
+			}
+			if n, err := store.Reap(time.Now().Add(2 * time.Hour)); err != nil || n != 1 {
+				t.Errorf("%s: expected one expired session to be reaped, got %d (%v)", name, n, err)
+			}
+			if values := loadSession(t, store, cookie); len(values) != 0 {
+				t.Errorf("%s: expected a reaped session to be gone, got %v", name, values)
+			}
+		}
+	})
+
+	t.Run("NegativeMaxAgeDeletes", func(t *testing.T) {
+		for name, store := range testServerSessionStores(t, time.Hour) {
+			cookie := saveSession(t, store, map[any]any{"k": "v"})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.AddCookie(cookie)
+			session, _ := store.New(req, "s")
+			session.Options.MaxAge = -1
+			if err := store.Save(req, httptest.NewRecorder(), session); err != nil {
+				t.Fatalf("%s: store.Save(): %v", name, err)
+			}
+			if values := loadSession(t, store, cookie); len(values) != 0 {
+				t.Errorf("%s: expected a deleted session to be gone, got %v", name, values)
+			}
+		}
+	})
+}
+
+func TestServerSessionLogin(t *testing.T) {
+	for _, kind := range []string{SESSION_STORE__DATABASE, SESSION_STORE__FILESYSTEM} {
+		t.Run(kind, func(t *testing.T) {
+			dir := t.TempDir()
+			router, dso := setupTestRouterWithDSO(func(cfg *AppConfig) {
+				cfg.SessionStore = kind
+				cfg.SessionDir = dir
+			})
+			if _, err := createUser(dso.DB, "alice", "correct horse", SESSUSR__USER); err != nil {
+				t.Fatalf("createUser(): %v", err)
+			}
+			tc := newTestClient(t, router)
+
+			// storedIDs lists the session IDs the backend currently holds
+			storedIDs := func() map[string]bool {
+				ids := map[string]bool{}
+				switch kind {
+				case SESSION_STORE__DATABASE:
+					var rows []ServerSession
+					dso.DB.Find(&rows)
+					for _, row := range rows {
+						ids[row.ID] = true
+					}
+				case SESSION_STORE__FILESYSTEM:
+					files, _ := filepath.Glob(filepath.Join(dir, fsSessionFilePrefix+"*"))
+					for _, f := range files {
+						ids[strings.TrimPrefix(filepath.Base(f), fsSessionFilePrefix)] = true
+					}
+				}
+				return ids
+			}
+
+			// A session exists before login (e.g. for its CSRF token), and one planted on a victim must not survive it
+			tc.get("/ping")
+			preLogin, preLoginCookie := storedIDs(), tc.cookies["test-session"]
+			if len(preLogin) != 1 || preLoginCookie == nil {
+				t.Fatalf("Expected one pre-login session, got %v", preLogin)
+			}
+
+			if loc := tc.login("alice", "correct horse"); loc != "/" {
+				t.Fatalf("Expected redirect to '/', got '%s'", loc)
+			}
+			if w := tc.get("/account"); w.Code != http.StatusOK {
+				t.Errorf("Expected account page to be accessible after login, got %d", w.Code)
+			}
+
+			postLogin := storedIDs()
+			for id := range preLogin {
+				if postLogin[id] {
+					t.Errorf("Expected login to issue a new session ID, but %s is still stored", id)
+				}
+			}
+			if len(postLogin) != 1 || tc.cookies["test-session"].Value == preLoginCookie.Value {
+				t.Errorf("Expected the client to have moved to a new session, stored %v", postLogin)
+			}
+			attacker := newTestClient(t, router)
+			attacker.cookies["test-session"] = preLoginCookie
+			if w := attacker.get("/account"); w.Code == http.StatusOK {
+				t.Error("Expected the pre-login session ID to be useless after login")
+			}
+
+			// Logging out drops the stored session rather than emptying it in place, so its ID can't be replayed
+			loggedInCookie := tc.cookies["test-session"]
+			tc.get("/logout")
+			postLogout := storedIDs()
+			for id := range postLogin {
+				if postLogout[id] {
+					t.Errorf("Expected logout to delete the stored session, but %s is still stored", id)
+				}
+			}
+			if tc.cookies["test-session"].Value == loggedInCookie.Value {
+				t.Error("Expected logout to move the client to a new session ID")
+			}
+			attacker = newTestClient(t, router)
+			attacker.cookies["test-session"] = loggedInCookie
+			if w := attacker.get("/account"); w.Code == http.StatusOK {
+				t.Error("Expected the logged-out session ID to be useless")
+			}
+
+			switch kind {
+			case SESSION_STORE__DATABASE:
+				var n int64
+				dso.DB.Model(&ServerSession{}).Count(&n)
+				if n == 0 {
+					t.Error("Expected the session to be stored in the database")
+				}
+			case SESSION_STORE__FILESYSTEM:
+				files, _ := filepath.Glob(filepath.Join(dir, fsSessionFilePrefix+"*"))
+				if len(files) == 0 {
+					t.Error("Expected the session to be stored on disk")
+				}
+			}
+		})
+	}
+}
+
+func TestInstantiateSessionStoreRejectsUnknownKind(t *testing.T) {
+	cfg := &AppConfig{SessionStore: "redis", SecureCookieSigningKey: securecookie.GenerateRandomKey(64)}
+	if _, err := instantiateSessionStore(cfg, nil); err == nil {
+		t.Error("Expected an error for an unknown session_store")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LoginThrottle counts recent failed logins for one key: a username ("user:<name>") or a client IP ("ip:<addr>").
+// Usernames are tracked whether or not the account exists, so throttling/lockout behaves identically for unknown
+// usernames and can't be used to discover accounts.
+type LoginThrottle struct {
+	Key           string `gorm:"primaryKey"`
+	Failures      int
+	LastFailureAt time.Time
+	BlockedUntil  time.Time
+}
+
+// loginThrottlePolicy is the brute-force protection configuration (see the login_* config options)
+type loginThrottlePolicy struct {
+	FreeAttempts     int           // Failures allowed per username before backoff starts
+	MaxDelay         time.Duration // Cap on the exponential backoff
+	LockoutThreshold int           // Failures per username that lock the account (and start backoff per IP)
+	LockoutDuration  time.Duration // How long a lockout lasts; also how long until old failures are forgotten
+}
+
+func (a *AppConfig) loginThrottlePolicy() loginThrottlePolicy {
+	return loginThrottlePolicy{
+		FreeAttempts:     a.LoginThrottleFreeAttempts,
+		MaxDelay:         time.Duration(a.LoginThrottleMaxDelay) * time.Second,
+		LockoutThreshold: a.LoginLockoutThreshold,
+		LockoutDuration:  time.Duration(a.LoginLockoutDuration) * time.Second,
+	}
+}
+
+func userThrottleKey(username string) string {
+	return "user:" + normalizeUsername(username)
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// backoff is 1s, 2s, 4s, ... for each failure past free, capped at max
+func backoff(failures int, free int, max time.Duration) time.Duration {
+	if failures < free {
+		return 0
+	}
+	shift := failures - free
+	if shift > 30 {
+		return max
+	}
+	return min(time.Second<<shift, max)
+}
+
+// checkLoginThrottle returns when the login may next be attempted, if it's currently blocked for either the
+// username or the client IP
+func checkLoginThrottle(db *gorm.DB, username string, ip string, now time.Time) (time.Time, bool, error) {
+	var rows []LoginThrottle
+	err := db.Where("key IN ? AND blocked_until > ?", []string{userThrottleKey(username), ipThrottleKey(ip)}, now).
+		Find(&rows).Error
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("db.Find(): %w", err)
+	}
+	var until time.Time
+	for _, r := range rows {
+		if r.BlockedUntil.After(until) {
+			until = r.BlockedUntil
+		}
+	}
+	return until, !until.IsZero(), nil
+}
+
+// recordLoginFailure counts a failed attempt against the username and IP, applying backoff and (for the username)
+// lockout. Returns whether this failure locked the username.
+func recordLoginFailure(db *gorm.DB, p loginThrottlePolicy, username string, ip string, now time.Time) (bool, error) {
+	locked := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		n, err := bumpLoginThrottle(tx, userThrottleKey(username), now, p.LockoutDuration, func(failures int) time.Duration {
+			if failures >= p.LockoutThreshold {
+				return p.LockoutDuration
+			}
+			return backoff(failures, p.FreeAttempts, p.MaxDelay)
+		})
+		if err != nil {
+			return err
+		}
+		locked = n == p.LockoutThreshold
+
+		// Per-IP throttling catches password spraying across many usernames; it never locks, only slows down
+		_, err = bumpLoginThrottle(tx, ipThrottleKey(ip), now, p.LockoutDuration, func(failures int) time.Duration {
+			return backoff(failures, p.LockoutThreshold, p.MaxDelay)
+		})
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("db.Transaction(): %w", err)
+	}
+	return locked, nil
+}
+
+func bumpLoginThrottle(tx *gorm.DB, key string, now time.Time, forgetAfter time.Duration, delay func(int) time.Duration) (int, error) {
+	var t LoginThrottle
+	err := tx.Where("key = ?", key).First(&t).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, fmt.Errorf("tx.First(): %w", err)
+	}
+	if t.Key == "" || now.Sub(t.LastFailureAt) > forgetAfter {
+		t = LoginThrottle{Key: key}
+	}
+	t.Failures++
+	t.LastFailureAt = now
+	if d := delay(t.Failures); d > 0 {
+		t.BlockedUntil = now.Add(d)
+	}
+	if err := tx.Save(&t).Error; err != nil {
+		return 0, fmt.Errorf("tx.Save(): %w", err)
+	}
+	return t.Failures, nil
+}
+
+// clearLoginFailures forgets failures for a username (after a successful login, or when an admin unlocks it).
+// Per-IP counts are left to expire on their own, so logging into one's own account can't reset them.
+func clearLoginFailures(db *gorm.DB, username string) error {
+	if err := db.Where("key = ?", userThrottleKey(username)).Delete(&LoginThrottle{}).Error; err != nil {
+		return fmt.Errorf("db.Delete(): %w", err)
+	}
+	return nil
+}
+
+// userLockedUntil reports whether a username is locked out (as opposed to briefly backed off)
+func userLockedUntil(db *gorm.DB, p loginThrottlePolicy, username string, now time.Time) (time.Time, bool, error) {
+	var t LoginThrottle
+	err := db.Where("key = ?", userThrottleKey(username)).First(&t).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("db.First(): %w", err)
+	}
+	if t.Failures < p.LockoutThreshold || !t.BlockedUntil.After(now) {
+		return time.Time{}, false, nil
+	}
+	return t.BlockedUntil, true, nil
+}
+
+// logSecurityEvent records authentication-related events (failures, lockouts, unlocks, ...) in a consistent shape
+// so they're easy to filter and alert on
+func logSecurityEvent(logger *slog.Logger, event string, args ...any) {
+	logger.Warn("security event", append([]any{"event", event}, args...)...)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	policy := loginThrottlePolicy{FreeAttempts: 3, MaxDelay: time.Minute, LockoutThreshold: 10, LockoutDuration: 15 * time.Minute}
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("Backoff", func(t *testing.T) {
+		for _, tc := range []struct {
+			failures int
+			want     time.Duration
+		}{{2, 0}, {3, time.Second}, {4, 2 * time.Second}, {6, 8 * time.Second}, {9, time.Minute}, {200, time.Minute}} {
+			if got := backoff(tc.failures, 3, time.Minute); got != tc.want {
+				t.Errorf("backoff(%d) = %v, want %v", tc.failures, got, tc.want)
+			}
+		}
+	})
+
+	t.Run("BacksOffThenLocks", func(t *testing.T) {
+		_, dso := setupTestRouterWithDSO()
+		for i := 1; i <= policy.LockoutThreshold; i++ {
+			if _, blocked, _ := checkLoginThrottle(dso.DB, "alice", "192.0.2.1", now); blocked != (i > policy.FreeAttempts) {
+				t.Fatalf("Attempt %d: expected blocked=%t", i, !blocked)
+			}
+			locked, err := recordLoginFailure(dso.DB, policy, "Alice", "192.0.2.1", now)
+			if err != nil {
+				t.Fatalf("recordLoginFailure(): %v", err)
+			}
+			if locked != (i == policy.LockoutThreshold) {
+				t.Fatalf("Attempt %d: expected locked=%t", i, !locked)
+			}
+		}
+
+		until, locked, err := userLockedUntil(dso.DB, policy, "alice", now)
+		if err != nil || !locked || !until.Equal(now.Add(policy.LockoutDuration)) {
+			t.Fatalf("Expected alice locked until %v, got %v/%t (%v)", now.Add(policy.LockoutDuration), until, locked, err)
+		}
+		// Another IP is still blocked for this username
+		if _, blocked, _ := checkLoginThrottle(dso.DB, "alice", "198.51.100.7", now.Add(time.Hour/4-time.Second)); !blocked {
+			t.Error("Expected the lockout to apply from any IP")
+		}
+		if _, blocked, _ := checkLoginThrottle(dso.DB, "alice", "198.51.100.7", now.Add(time.Hour/4+time.Second)); blocked {
+			t.Error("Expected the lockout to expire")
+		}
+
+		if err := clearLoginFailures(dso.DB, "alice"); err != nil {
+			t.Fatalf("clearLoginFailures(): %v", err)
+		}
+		if _, locked, _ := userLockedUntil(dso.DB, policy, "alice", now); locked {
+			t.Error("Expected clearing failures to unlock the account")
+		}
+	})
+
+	t.Run("ThrottlesPerIP", func(t *testing.T) {
+		_, dso := setupTestRouterWithDSO()
+		// Spraying one guess at many usernames never trips a per-username limit...
+		for i := 0; i < policy.LockoutThreshold; i++ {
+			if _, err := recordLoginFailure(dso.DB, policy, "user"+itoa(uint(i)), "192.0.2.1", now); err != nil {
+				t.Fatalf("recordLoginFailure(): %v", err)
+			}
+		}
+		// ...but the IP gets slowed down
+		if _, blocked, _ := checkLoginThrottle(dso.DB, "someone-else", "192.0.2.1", now); !blocked {
+			t.Error("Expected the IP to be throttled")
+		}
+		if _, blocked, _ := checkLoginThrottle(dso.DB, "someone-else", "198.51.100.7", now); blocked {
+			t.Error("Expected other IPs to be unaffected")
+		}
+	})
+
+	t.Run("ForgetsOldFailures", func(t *testing.T) {
+		_, dso := setupTestRouterWithDSO()
+		for i := 0; i < policy.LockoutThreshold-1; i++ {
+			recordLoginFailure(dso.DB, policy, "alice", "192.0.2.1", now)
+		}
+		later := now.Add(policy.LockoutDuration + time.Second)
+		if locked, _ := recordLoginFailure(dso.DB, policy, "alice", "192.0.2.1", later); locked {
+			t.Error("Expected failures older than the lockout window to be forgotten")
+		}
+	})
+}
+
+func TestLoginThrottleRoutes(t *testing.T) {
+	flash := func(tc *testClient, path string) string {
+		return tc.get(path).Body.String()
+	}
+
+	t.Run("GenericMessageForUnknownAndExistingUsers", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO()
+		if _, err := createUser(dso.DB, "alice", "correct horse", SESSUSR__USER); err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+
+		for _, username := range []string{"alice", "nobody"} {
+			tc := newTestClient(t, router)
+			for i := 0; i < dso.AppConfig.LoginThrottleFreeAttempts; i++ {
+				tc.login(username, "wrong")
+				if body := flash(tc, "/login"); !strings.Contains(body, "Invalid username or password") {
+					t.Fatalf("%s: expected the generic failure message", username)
+				}
+			}
+			// Now backed off: even the right password isn't checked
+			if loc := tc.login(username, "correct horse"); loc != "/login" {
+				t.Errorf("%s: expected a throttled login to be refused, redirected to %s", username, loc)
+			}
+			if body := flash(tc, "/login"); !strings.Contains(body, "Too many failed login attempts") {
+				t.Errorf("%s: expected the throttle message", username)
+			}
+		}
+	})
+
+	t.Run("SuccessClearsFailures", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO()
+		if _, err := createUser(dso.DB, "alice", "correct horse", SESSUSR__USER); err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		tc := newTestClient(t, router)
+		tc.login("alice", "wrong")
+		if loc := tc.login("alice", "correct horse"); loc != "/" {
+			t.Fatalf("Expected login to succeed, redirected to %s", loc)
+		}
+		var count int64
+		dso.DB.Model(&LoginThrottle{}).Where("key = ?", userThrottleKey("alice")).Count(&count)
+		if count != 0 {
+			t.Error("Expected a successful login to clear the username's failures")
+		}
+	})
+
+	t.Run("AdminUnlock", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO()
+		u, err := createUser(dso.DB, "alice", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		if _, err := createUser(dso.DB, "root", "correct horse", SESSUSR__USER|SESSUSR__ADMIN); err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		policy := dso.AppConfig.loginThrottlePolicy()
+		for i := 0; i < policy.LockoutThreshold; i++ {
+			recordLoginFailure(dso.DB, policy, "alice", "203.0.113.9", time.Now())
+		}
+
+		tc := newTestClient(t, router)
+		if loc := tc.login("alice", "correct horse"); loc != "/login" {
+			t.Fatalf("Expected a locked account to be refused, redirected to %s", loc)
+		}
+
+		admin := newTestClient(t, router)
+		admin.login("root", "correct horse")
+		admin.postForm("/admin/users/"+itoa(u.ID)+"/unlock", url.Values{})
+		if body := flash(admin, "/"); !strings.Contains(body, "has been unlocked") {
+			t.Error("Expected the unlock to be confirmed")
+		}
+		if loc := tc.login("alice", "correct horse"); loc != "/" {
+			t.Errorf("Expected login to succeed after unlock, redirected to %s", loc)
+		}
+		if w := tc.get("/account"); w.Code != http.StatusOK {
+			t.Errorf("Expected alice to be logged in, got %d", w.Code)
+		}
+	})
+}
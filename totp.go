@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// TOTP (RFC 6238) parameters. These match what every common authenticator app expects by default.
+const (
+	totpPeriod = 30 // Seconds per time step
+	totpDigits = 6
+	totpSkew   = 1 // Number of time steps either side of "now" that are accepted, to tolerate clock drift
+
+	recoveryCodeCount = 10
+)
+
+var totpBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a fresh random 160-bit shared secret, base32 encoded (the format authenticator apps expect)
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("rand.Read(): %v", err))
+	}
+	return totpBase32.EncodeToString(b)
+}
+
+// totpStep returns the RFC 6238 time step counter for t
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode computes the HOTP value (RFC 4226) of a base32 secret for the given time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpBase32.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", fmt.Errorf("base32.DecodeString(): %w", err)
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, bin%mod), nil
+}
+
+// totpValidate checks code against secret at time t, allowing +/- totpSkew steps of clock drift.
+// Steps at or before lastStep are rejected so that a code can never be used twice (replay prevention).
+// On success it returns the matched step, which the caller must persist as the new lastStep.
+func totpValidate(secret string, code string, t time.Time, lastStep int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	now := totpStep(t)
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURL builds the otpauth:// provisioning URI that authenticator apps scan from the QR code
+func totpURL(issuer string, account string, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", totpDigits))
+	v.Set("period", fmt.Sprintf("%d", totpPeriod))
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(issuer), url.PathEscape(account), v.Encode())
+}
+
+// totpQRCode renders the provisioning URI as a PNG QR code, returned as a data: URI suitable for an inline <img>
+func totpQRCode(otpauthURL string) (template.URL, error) {
+	png, err := qrcode.Encode(otpauthURL, qrcode.Medium, 256)
+	if err != nil {
+		return "", fmt.Errorf("qrcode.Encode(): %w", err)
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)), nil
+}
+
+// generateRecoveryCodes returns n random single-use recovery codes formatted as "xxxxx-xxxxx"
+func generateRecoveryCodes(n int) []string {
+	// Lowercase base32 alphabet (no ambiguous 0/1/8/9), 10 characters = 50 bits of entropy per code
+	enc := base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+	codes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			panic(fmt.Sprintf("rand.Read(): %v", err))
+		}
+		s := enc.EncodeToString(b)[:10]
+		codes = append(codes, s[:5]+"-"+s[5:])
+	}
+	return codes
+}
+
+// hashRecoveryCode normalizes and hashes a recovery code for storage/lookup.
+// Recovery codes are high-entropy random values, so a fast hash is sufficient (unlike passwords).
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 Appendix B secret ("12345678901234567890"), base32 encoded
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 Appendix B (SHA1) vectors, truncated to the last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, totpStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("totpCode(): %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("At %d expected code %s, got %s", tt.unix, tt.want, got)
+		}
+	}
+}
+
+func TestTOTPValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := totpStep(now)
+	code := func(s int64) string {
+		c, err := totpCode(rfc6238Secret, s)
+		if err != nil {
+			t.Fatalf("totpCode(): %v", err)
+		}
+		return c
+	}
+
+	t.Run("CurrentStep", func(t *testing.T) {
+		got, ok := totpValidate(rfc6238Secret, code(step), now, 0)
+		if !ok || got != step {
+			t.Errorf("Expected current code to validate at step %d, got %d/%v", step, got, ok)
+		}
+	})
+
+	t.Run("ToleratesOneStepOfSkew", func(t *testing.T) {
+		if _, ok := totpValidate(rfc6238Secret, code(step-1), now, 0); !ok {
+			t.Error("Expected previous step's code to validate")
+		}
+		if _, ok := totpValidate(rfc6238Secret, code(step+1), now, 0); !ok {
+			t.Error("Expected next step's code to validate")
+		}
+	})
+
+	t.Run("RejectsLargeSkew", func(t *testing.T) {
+		if _, ok := totpValidate(rfc6238Secret, code(step-2), now, 0); ok {
+			t.Error("Expected code from two steps ago to be rejected")
+		}
+	})
+
+	t.Run("RejectsReplay", func(t *testing.T) {
+		if _, ok := totpValidate(rfc6238Secret, code(step), now, step); ok {
+			t.Error("Expected already-used step to be rejected")
+		}
+	})
+
+	t.Run("RejectsMalformed", func(t *testing.T) {
+		if _, ok := totpValidate(rfc6238Secret, "12345", now, 0); ok {
+			t.Error("Expected short code to be rejected")
+		}
+	})
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes := generateRecoveryCodes(recoveryCodeCount)
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("Expected %d codes, got %d", recoveryCodeCount, len(codes))
+	}
+
+	seen := map[string]bool{}
+	for _, c := range codes {
+		if len(c) != 11 || c[5] != '-' {
+			t.Errorf("Unexpected code format '%s'", c)
+		}
+		if seen[c] {
+			t.Errorf("Duplicate code '%s'", c)
+		}
+		seen[c] = true
+	}
+
+	// Hashing is insensitive to case and the separator so users can type codes loosely
+	if hashRecoveryCode(codes[0]) != hashRecoveryCode(strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))) {
+		t.Error("Expected recovery code hash to ignore case and dashes")
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	gsessions "github.com/gorilla/sessions"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// Values for the `tracing_exporter` config option
+const (
+	TRACING_EXPORTER__NONE   = "none"   // Spans aren't recorded, but incoming trace context is still passed on
+	TRACING_EXPORTER__STDOUT = "stdout" // JSON to `tracing_file`, or STDOUT
+	TRACING_EXPORTER__OTLP   = "otlp"   // OTLP/HTTP to `tracing_endpoint`
+)
+
+const tracerName = "github.com/astockwell/go_gin_starter"
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// ValidateTracingSampleRatio checks tracing_sample_ratio is a fraction; 0 records no new traces
+func (a *AppConfig) ValidateTracingSampleRatio() error {
+	if a.TracingSampleRatio < 0 || a.TracingSampleRatio > 1 {
+		return fmt.Errorf("tracing_sample_ratio %v is outside 0-1", a.TracingSampleRatio)
+	}
+	return nil
+}
+
+// setupTracing installs the global tracer provider and W3C trace context propagator. The returned func flushes
+// buffered spans and closes the exporter.
+func setupTracing(cfg *AppConfig) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	closeFile := func() error { return nil }
+	switch cfg.TracingExporter {
+	case TRACING_EXPORTER__NONE, "":
+		return func(context.Context) error { return nil }, nil
+	case TRACING_EXPORTER__STDOUT:
+		var w io.Writer = os.Stdout
+		if cfg.TracingFile != "" {
+			f, err := os.OpenFile(cfg.TracingFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return nil, fmt.Errorf("os.OpenFile(): %w", err)
+			}
+			w, closeFile = f, f.Close
+		}
+		if exporter, err = stdouttrace.New(stdouttrace.WithWriter(w)); err != nil {
+			return nil, fmt.Errorf("stdouttrace.New(): %w", err)
+		}
+	case TRACING_EXPORTER__OTLP:
+		if exporter, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.TracingEndpoint)); err != nil {
+			return nil, fmt.Errorf("otlptracehttp.New(): %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown tracing_exporter '%s'", cfg.TracingExporter)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TracingSampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", cfg.TracingServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+	return func(ctx context.Context) error {
+		return errors.Join(tp.Shutdown(ctx), closeFile())
+	}, nil
+}
+
+// mwTracing starts a server span for each request, continuing the caller's trace when it sends a traceparent
+// header. The span's context becomes the request's, which mwDSO hands on to DB calls and log records.
+func mwTracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		name := c.Request.Method
+		if route := c.FullPath(); route != "" {
+			name += " " + route
+		}
+		ctx, span := tracer().Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("http.route", c.FullPath()),
+				attribute.String("url.path", c.Request.URL.Path),
+				attribute.String("client.address", c.ClientIP()),
+				attribute.String("user_agent.original", c.Request.UserAgent()),
+			))
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Writer = &tracingWriter{ResponseWriter: c.Writer, ctx: ctx}
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		for _, err := range c.Errors {
+			span.RecordError(err.Err)
+		}
+		if status >= 500 {
+			span.SetStatus(codes.Error, strconv.Itoa(status))
+		}
+	}
+}
+
+// tracingWriter carries the request's context to the HTML renderer, which only gets to see the response writer
+type tracingWriter struct {
+	gin.ResponseWriter
+	ctx context.Context
+}
+
+func (w *tracingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writerContext finds the request context mwTracing attached to w (context.Background() if there is none)
+func writerContext(w http.ResponseWriter) context.Context {
+	for {
+		switch v := w.(type) {
+		case *tracingWriter:
+			return v.ctx
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return context.Background()
+		}
+	}
+}
+
+// traceSessionStore wraps store so loading a session gets its own span
+func traceSessionStore(store sessions.Store) sessions.Store {
+	return &tracedSessionStore{Store: store}
+}
+
+type tracedSessionStore struct {
+	sessions.Store
+}
+
+// Get implements gsessions.Store
+func (s *tracedSessionStore) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	_, span := tracer().Start(r.Context(), "session.load")
+	defer span.End()
+	session, err := s.Store.Get(r, name)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "session decode failed")
+	}
+	return session, err
+}
+
+// gormTracing is a GORM plugin giving each query a child span of the context it was run with
+// (dso.DB.WithContext(...), which mwDSO has already done for handlers)
+type gormTracing struct{}
+
+func (gormTracing) Name() string {
+	return "otel_tracing"
+}
+
+func (gormTracing) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:create").Register("otel:before_create", gormSpanStart("create")),
+		cb.Create().After("gorm:create").Register("otel:after_create", gormSpanEnd),
+		cb.Query().Before("gorm:query").Register("otel:before_query", gormSpanStart("query")),
+		cb.Query().After("gorm:query").Register("otel:after_query", gormSpanEnd),
+		cb.Update().Before("gorm:update").Register("otel:before_update", gormSpanStart("update")),
+		cb.Update().After("gorm:update").Register("otel:after_update", gormSpanEnd),
+		cb.Delete().Before("gorm:delete").Register("otel:before_delete", gormSpanStart("delete")),
+		cb.Delete().After("gorm:delete").Register("otel:after_delete", gormSpanEnd),
+		cb.Row().Before("gorm:row").Register("otel:before_row", gormSpanStart("row")),
+		cb.Row().After("gorm:row").Register("otel:after_row", gormSpanEnd),
+		cb.Raw().Before("gorm:raw").Register("otel:before_raw", gormSpanStart("raw")),
+		cb.Raw().After("gorm:raw").Register("otel:after_raw", gormSpanEnd),
+	)
+}
+
+func gormSpanStart(op string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		_, span := tracer().Start(tx.Statement.Context, "gorm."+op, trace.WithSpanKind(trace.SpanKindClient))
+		tx.InstanceSet("otel:span", span)
+	}
+}
+
+func gormSpanEnd(tx *gorm.DB) {
+	v, ok := tx.InstanceGet("otel:span")
+	if !ok {
+		return
+	}
+	span := v.(trace.Span)
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("db.system", tx.Dialector.Name()),
+		attribute.String("db.collection.name", tx.Statement.Table),
+		attribute.String("db.query.text", tx.Statement.SQL.String()),
+		attribute.Int64("db.rows_affected", tx.Statement.RowsAffected),
+	)
+	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		span.RecordError(tx.Error)
+		span.SetStatus(codes.Error, tx.Error.Error())
+	}
+}
+
+// traceLogHandler adds trace_id and span_id to records logged with a context that carries a span
+type traceLogHandler struct {
+	slog.Handler
+}
+
+func (h traceLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h traceLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceLogHandler) WithGroup(name string) slog.Handler {
+	return traceLogHandler{h.Handler.WithGroup(name)}
+}
+
+// contextLogHandler logs records made without a context (logger.Info rather than logger.InfoContext) with ctx,
+// so a request's logger tags everything with its trace
+type contextLogHandler struct {
+	slog.Handler
+	ctx context.Context
+}
+
+func (h contextLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx == context.Background() {
+		ctx = h.ctx
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextLogHandler{h.Handler.WithAttrs(attrs), h.ctx}
+}
+
+func (h contextLogHandler) WithGroup(name string) slog.Handler {
+	return contextLogHandler{h.Handler.WithGroup(name), h.ctx}
+}
+
+// tracingTransport propagates the current trace to outgoing requests (req.Context() must carry it) and gives each
+// one a client span. Use it for HTTP clients called while handling a request.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func newTracingTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &tracingTransport{base: base}
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer().Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.URL.Redacted()),
+		))
+	defer span.End()
+
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a tracer provider that keeps finished spans in memory, restoring the previous one afterwards
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	})
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return sr
+}
+
+func TestTracing(t *testing.T) {
+	sr := recordSpans(t)
+	router, dso := setupTestRouterWithDSO()
+	var logs bytes.Buffer
+	dso.Logger = slog.New(traceLogHandler{slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})})
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req, _ := http.NewRequest("GET", "/books/1", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range sr.Ended() {
+		spans[s.Name()] = s
+	}
+	server, ok := spans["GET /books/:id"]
+	if !ok {
+		t.Fatalf("Expected a server span named after the route, got %v", spans)
+	}
+	if server.SpanKind() != trace.SpanKindServer || server.SpanContext().TraceID().String() != traceID ||
+		server.Parent().SpanID().String() != parentID {
+		t.Errorf("Expected the server span to continue the caller's trace, got %v parent %v", server.SpanContext(), server.Parent())
+	}
+	attrs := map[string]string{}
+	for _, kv := range server.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["http.route"] != "/books/:id" || attrs["url.path"] != "/books/1" || attrs["http.response.status_code"] != "200" {
+		t.Errorf("Unexpected server span attributes %v", attrs)
+	}
+
+	for _, name := range []string{"session.load", "template books/show", "gorm.query"} {
+		child, ok := spans[name]
+		if !ok {
+			t.Errorf("Expected a %s span", name)
+			continue
+		}
+		if child.Parent().SpanID() != server.SpanContext().SpanID() {
+			t.Errorf("Expected %s to be a child of the server span", name)
+		}
+	}
+
+	if out := logs.String(); !strings.Contains(out, `"trace_id":"`+traceID+`"`) ||
+		!strings.Contains(out, `"span_id":"`+server.SpanContext().SpanID().String()+`"`) {
+		t.Errorf("Expected handler log records to carry the trace, got:\n%s", out)
+	}
+}
+
+func TestTracingTransport(t *testing.T) {
+	recordSpans(t)
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+
+	ctx, span := tracer().Start(context.Background(), "outer")
+	defer span.End()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+	resp, err := (&http.Client{Transport: newTracingTransport(nil)}).Do(req)
+	if err != nil {
+		t.Fatalf("Do(): %v", err)
+	}
+	resp.Body.Close()
+	if !strings.Contains(got, span.SpanContext().TraceID().String()) {
+		t.Errorf("Expected the outgoing request to carry the trace, got traceparent %q", got)
+	}
+}
+
+func TestSetupTracing(t *testing.T) {
+	cfg := func(exporter string) *AppConfig {
+		return &AppConfig{TracingExporter: exporter, TracingSampleRatio: 1, TracingServiceName: "test-service"}
+	}
+	emit := func(t *testing.T, c *AppConfig) {
+		t.Helper()
+		recordSpans(t) // Just for the restore
+		shutdown, err := setupTracing(c)
+		if err != nil {
+			t.Fatalf("setupTracing(): %v", err)
+		}
+		_, span := tracer().Start(context.Background(), "unit-of-work")
+		span.End()
+		if err := shutdown(context.Background()); err != nil {
+			t.Fatalf("shutdown(): %v", err)
+		}
+	}
+
+	t.Run("StdoutToFile", func(t *testing.T) {
+		c := cfg(TRACING_EXPORTER__STDOUT)
+		c.TracingFile = filepath.Join(t.TempDir(), "traces.json")
+		emit(t, c)
+		out, _ := os.ReadFile(c.TracingFile)
+		if !strings.Contains(string(out), `"Name":"unit-of-work"`) || !strings.Contains(string(out), "test-service") {
+			t.Errorf("Expected the span in the trace file, got:\n%s", out)
+		}
+	})
+
+	t.Run("OTLP", func(t *testing.T) {
+		var mu sync.Mutex
+		var paths []string
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			paths = append(paths, r.URL.Path+" "+r.Header.Get("Content-Type"))
+		}))
+		defer collector.Close()
+
+		c := cfg(TRACING_EXPORTER__OTLP)
+		c.TracingEndpoint = collector.URL
+		emit(t, c)
+		mu.Lock()
+		defer mu.Unlock()
+		if len(paths) != 1 || paths[0] != "/v1/traces application/x-protobuf" {
+			t.Errorf("Expected one OTLP export, got %v", paths)
+		}
+	})
+
+	t.Run("SampleRatioRange", func(t *testing.T) {
+		for ratio, valid := range map[float64]bool{0: true, 0.1: true, 1: true, -0.5: false, 2: false} {
+			c := cfg(TRACING_EXPORTER__NONE)
+			c.TracingSampleRatio = ratio
+			if err := c.ValidateTracingSampleRatio(); (err == nil) != valid {
+				t.Errorf("%v: expected valid=%v, got %v", ratio, valid, err)
+			}
+		}
+	})
+
+	t.Run("UnknownExporter", func(t *testing.T) {
+		recordSpans(t)
+		if _, err := setupTracing(cfg("jaeger")); err == nil {
+			t.Error("Expected an unknown exporter to be rejected")
+		}
+	})
+}
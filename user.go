@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// User is a locally-stored application account
+type User struct {
+	ID           uint   `gorm:"primaryKey"`
+	Username     string `gorm:"uniqueIndex;not null"`
+	PasswordHash string
+	FirstName    string
+	LastName     string
+	Email        string `gorm:"index"`
+	Role         uint64 // SESSUSR__* permission bits, copied into SessionUser.Role at login
+	Roles        string // Comma-separated named roles (see permissions.go), copied into SessionUser.Roles at login
+	Disabled     bool
+	LastLoginAt  *time.Time
+
+	// Set once the user follows a verification link sent to Email; cleared when Email changes
+	EmailVerifiedAt *time.Time
+
+	// Two-factor authentication (TOTP)
+	TOTPSecret   string `gorm:"column:totp_secret"`
+	TOTPEnabled  bool   `gorm:"column:totp_enabled"`
+	TOTPLastStep int64  `gorm:"column:totp_last_step"` // Last accepted time step, for replay prevention
+
+	// Passkeys (WebAuthn): random opaque user handle stored on the user's authenticators
+	WebAuthnID []byte `gorm:"column:webauthn_id;index"`
+
+	// Bumped to sign the user out everywhere; sessions carrying an older value are treated as logged out
+	SessionGeneration uint64
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// RecoveryCode is a single-use 2FA bypass code. Only the hash is stored.
+type RecoveryCode struct {
+	ID       uint   `gorm:"primaryKey"`
+	UserID   uint   `gorm:"index;not null"`
+	CodeHash string `gorm:"not null"`
+	UsedAt   *time.Time
+
+	CreatedAt time.Time
+}
+
+// dummyPasswordHash is compared against when a username doesn't exist, so failed logins take the same time either way
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+
+// SetPassword hashes and stores a new password (does not save the record)
+func (u *User) SetPassword(password string) error {
+	if len(password) < 8 {
+		return errors.New("password must be at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("bcrypt.GenerateFromPassword(): %w", err)
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+// HasRole reports whether any of the SESSUSR__* bits in b are set
+func (u *User) HasRole(b uint64) bool {
+	return u.Role&b != 0
+}
+
+// RoleList splits the named Roles
+func (u *User) RoleList() []string {
+	var roles []string
+	for _, r := range strings.Split(u.Roles, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
+
+// HasNamedRole reports whether role is among the named Roles
+func (u *User) HasNamedRole(role string) bool {
+	return slices.Contains(u.RoleList(), role)
+}
+
+// CheckPassword reports whether password matches the stored hash
+func (u *User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// SessionUser builds an authenticated SessionUser for this account
+func (u *User) SessionUser() *SessionUser {
+	su := NewAuthenticatedSessionUser(u.Username)
+	su.UserID = u.ID
+	su.FirstName = u.FirstName
+	su.LastName = u.LastName
+	su.Email = u.Email
+	su.Role = u.Role
+	su.Roles = u.RoleList()
+	su.Generation = u.SessionGeneration
+	return su
+}
+
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func findUserByUsername(db *gorm.DB, username string) (*User, error) {
+	var u User
+	err := db.Where("username = ?", normalizeUsername(username)).First(&u).Error
+	if err != nil {
+		return nil, fmt.Errorf("db.First(): %w", err)
+	}
+	return &u, nil
+}
+
+func findUserByID(db *gorm.DB, id uint) (*User, error) {
+	var u User
+	err := db.First(&u, id).Error
+	if err != nil {
+		return nil, fmt.Errorf("db.First(): %w", err)
+	}
+	return &u, nil
+}
+
+// authenticateUser checks a username/password pair, returning the user on success
+func authenticateUser(db *gorm.DB, username string, password string) (*User, error) {
+	u, err := findUserByUsername(db, username)
+	if err != nil {
+		// Burn the same amount of time as a real comparison to avoid leaking which usernames exist
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, fmt.Errorf("findUserByUsername(): %w", err)
+	}
+	if !u.CheckPassword(password) {
+		return nil, errors.New("password mismatch")
+	}
+	if u.Disabled {
+		return nil, errors.New("account disabled")
+	}
+	return u, nil
+}
+
+// findUserByLogin looks a user up by username or email address (e.g. for "forgot password")
+func findUserByLogin(db *gorm.DB, login string) (*User, error) {
+	login = strings.TrimSpace(login)
+	if login == "" {
+		return nil, errors.New("login is required")
+	}
+	var u User
+	err := db.Where("username = ? OR (email <> '' AND LOWER(email) = ?)", normalizeUsername(login), strings.ToLower(login)).
+		First(&u).Error
+	if err != nil {
+		return nil, fmt.Errorf("db.First(): %w", err)
+	}
+	return &u, nil
+}
+
+// updateUserPassword sets a new password (e.g. after a reset)
+func updateUserPassword(db *gorm.DB, u *User, password string) error {
+	if err := u.SetPassword(password); err != nil {
+		return fmt.Errorf("u.SetPassword(): %w", err)
+	}
+	if err := db.Model(u).Update("password_hash", u.PasswordHash).Error; err != nil {
+		return fmt.Errorf("db.Update(): %w", err)
+	}
+	return nil
+}
+
+// validateEmail accepts a bare address (or an empty string)
+func validateEmail(email string) error {
+	if email == "" {
+		return nil
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return errors.New("invalid email address")
+	}
+	return nil
+}
+
+// updateUserEmail changes a user's email address, which then needs verifying again
+func updateUserEmail(db *gorm.DB, u *User, email string) error {
+	email = strings.TrimSpace(email)
+	if err := validateEmail(email); err != nil {
+		return err
+	}
+	if email == u.Email {
+		return nil
+	}
+	u.Email = email
+	u.EmailVerifiedAt = nil
+	err := db.Model(u).Updates(map[string]any{"email": email, "email_verified_at": nil}).Error
+	if err != nil {
+		return fmt.Errorf("db.Updates(): %w", err)
+	}
+	return nil
+}
+
+func markUserEmailVerified(db *gorm.DB, u *User) error {
+	t := time.Now()
+	u.EmailVerifiedAt = &t
+	if err := db.Model(u).Update("email_verified_at", t).Error; err != nil {
+		return fmt.Errorf("db.Update(): %w", err)
+	}
+	return nil
+}
+
+func createUser(db *gorm.DB, username string, password string, role uint64) (*User, error) {
+	u := &User{
+		Username: normalizeUsername(username),
+		Role:     role,
+	}
+	if u.Username == "" {
+		return nil, errors.New("username is required")
+	}
+	if err := u.SetPassword(password); err != nil {
+		return nil, fmt.Errorf("u.SetPassword(): %w", err)
+	}
+	if err := db.Create(u).Error; err != nil {
+		return nil, fmt.Errorf("db.Create(): %w", err)
+	}
+	return u, nil
+}
+
+// searchUsers lists users whose username, name or email contains q (all users when q is empty)
+func searchUsers(db *gorm.DB, q string, limit int) ([]User, error) {
+	tx := db.Order("username").Limit(limit)
+	if s := strings.ToLower(strings.TrimSpace(q)); s != "" {
+		like := "%" + s + "%"
+		tx = tx.Where("username LIKE ? OR LOWER(first_name) LIKE ? OR LOWER(last_name) LIKE ? OR LOWER(email) LIKE ?",
+			like, like, like, like)
+	}
+	var users []User
+	if err := tx.Find(&users).Error; err != nil {
+		return nil, fmt.Errorf("db.Find(): %w", err)
+	}
+	return users, nil
+}
+
+// updateUserProfile saves an admin's edits to a user's name, role bits and named roles
+func updateUserProfile(db *gorm.DB, u *User, firstName string, lastName string, role uint64, roles []string) error {
+	u.FirstName = strings.TrimSpace(firstName)
+	u.LastName = strings.TrimSpace(lastName)
+	u.Role = role
+	u.Roles = strings.Join(roles, ",")
+	err := db.Model(u).Updates(map[string]any{
+		"first_name": u.FirstName,
+		"last_name":  u.LastName,
+		"role":       u.Role,
+		"roles":      u.Roles,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("db.Updates(): %w", err)
+	}
+	return nil
+}
+
+// setUserDisabled disables or re-enables an account. Disabled users can't log in, and mwSessionValidity ends
+// their existing sessions.
+func setUserDisabled(db *gorm.DB, u *User, disabled bool) error {
+	u.Disabled = disabled
+	if err := db.Model(u).Update("disabled", disabled).Error; err != nil {
+		return fmt.Errorf("db.Update(): %w", err)
+	}
+	return nil
+}
+
+func recordLogin(db *gorm.DB, u *User) error {
+	t := time.Now()
+	u.LastLoginAt = &t
+	err := db.Model(u).Update("last_login_at", t).Error
+	if err != nil {
+		return fmt.Errorf("db.Update(): %w", err)
+	}
+	return nil
+}
+
+// consumeTOTPStep atomically advances the user's last-used TOTP step, failing if the step (or a later one) was
+// already used. This is what makes each code single-use, even across concurrent requests.
+func consumeTOTPStep(db *gorm.DB, userID uint, step int64) (bool, error) {
+	res := db.Model(&User{}).Where("id = ? AND totp_last_step < ?", userID, step).Update("totp_last_step", step)
+	if res.Error != nil {
+		return false, fmt.Errorf("db.Update(): %w", res.Error)
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// enableUserTOTP saves a verified TOTP secret and issues a fresh set of recovery codes (returned in plaintext once)
+func enableUserTOTP(db *gorm.DB, userID uint, secret string, step int64) ([]string, error) {
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).Where("id = ?", userID).Updates(map[string]any{
+			"totp_secret":    secret,
+			"totp_enabled":   true,
+			"totp_last_step": step,
+		}).Error
+		if err != nil {
+			return fmt.Errorf("tx.Updates(): %w", err)
+		}
+		codes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("db.Transaction(): %w", err)
+	}
+	return codes, nil
+}
+
+// replaceRecoveryCodes discards any existing recovery codes and stores hashes of a new set
+func replaceRecoveryCodes(db *gorm.DB, userID uint) ([]string, error) {
+	if err := db.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, fmt.Errorf("db.Delete(): %w", err)
+	}
+	codes := generateRecoveryCodes(recoveryCodeCount)
+	rows := make([]RecoveryCode, 0, len(codes))
+	for _, c := range codes {
+		rows = append(rows, RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(c)})
+	}
+	if err := db.Create(&rows).Error; err != nil {
+		return nil, fmt.Errorf("db.Create(): %w", err)
+	}
+	return codes, nil
+}
+
+// consumeRecoveryCode marks a matching unused recovery code as used
+func consumeRecoveryCode(db *gorm.DB, userID uint, code string) (bool, error) {
+	res := db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		return false, fmt.Errorf("db.Update(): %w", res.Error)
+	}
+	return res.RowsAffected == 1, nil
+}
+
+func countUnusedRecoveryCodes(db *gorm.DB, userID uint) (int64, error) {
+	var n int64
+	err := db.Model(&RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&n).Error
+	if err != nil {
+		return 0, fmt.Errorf("db.Count(): %w", err)
+	}
+	return n, nil
+}
+
+// resetUserTOTP turns 2FA off and removes the secret and all recovery codes
+func resetUserTOTP(db *gorm.DB, userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).Where("id = ?", userID).Updates(map[string]any{
+			"totp_secret":    "",
+			"totp_enabled":   false,
+			"totp_last_step": 0,
+		}).Error
+		if err != nil {
+			return fmt.Errorf("tx.Updates(): %w", err)
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return fmt.Errorf("tx.Delete(): %w", err)
+		}
+		return nil
+	})
+}
+
+// cliCreateUser implements the `createuser <username> [admin]` CLI subcommand; the password is read from STDIN
+func cliCreateUser(db *gorm.DB, args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: createuser <username> [admin]")
+	}
+	role := uint64(SESSUSR__USER)
+	if len(args) > 1 && args[1] == "admin" {
+		role |= SESSUSR__ADMIN
+	}
+
+	fmt.Printf("Password for %s: ", args[0])
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return fmt.Errorf("ReadString(): %w", err)
+	}
+
+	u, err := createUser(db, args[0], strings.TrimRight(password, "\r\n"), role)
+	if err != nil {
+		return fmt.Errorf("createUser(): %w", err)
+	}
+	fmt.Printf("User '%s' created (id %d)\n", u.Username, u.ID)
+	return nil
+}
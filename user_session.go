@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// How often UserSession.LastSeenAt is written; avoids a DB write on every request
+const userSessionLastSeenResolution = time.Minute
+
+// UserSession records a single login (browser/device) so users can review and revoke their sessions. It is
+// independent of the session store, so revocation works with cookie sessions too.
+type UserSession struct {
+	ID         string `gorm:"primaryKey"` // Also stored in SessionUser.SessionID
+	UserID     uint   `gorm:"index;not null"`
+	Method     string // How the user authenticated, e.g. "password", "totp", "passkey"
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time
+	RevokedAt  *time.Time
+
+	CreatedAt time.Time
+}
+
+// Device is a short, human-friendly description of the session's browser/OS
+func (s *UserSession) Device() string {
+	return describeUserAgent(s.UserAgent)
+}
+
+func createUserSession(db *gorm.DB, userID uint, method, userAgent, ip string) (*UserSession, error) {
+	now := time.Now()
+	s := &UserSession{
+		ID:         newSessionID(),
+		UserID:     userID,
+		Method:     method,
+		UserAgent:  userAgent,
+		IP:         ip,
+		LastSeenAt: now,
+	}
+	if err := db.Create(s).Error; err != nil {
+		return nil, fmt.Errorf("db.Create(): %w", err)
+	}
+	return s, nil
+}
+
+// listUserSessions returns a user's active (unrevoked) sessions, most recently used first
+func listUserSessions(db *gorm.DB, userID uint) ([]UserSession, error) {
+	var sessions []UserSession
+	err := db.Where("user_id = ? AND revoked_at IS NULL", userID).Order("last_seen_at DESC").Find(&sessions).Error
+	if err != nil {
+		return nil, fmt.Errorf("db.Find(): %w", err)
+	}
+	return sessions, nil
+}
+
+func revokeUserSession(db *gorm.DB, userID uint, id string) (bool, error) {
+	res := db.Model(&UserSession{}).
+		Where("user_id = ? AND id = ? AND revoked_at IS NULL", userID, id).
+		Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return false, fmt.Errorf("db.Update(): %w", res.Error)
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// revokeAllUserSessions signs a user out everywhere: every recorded session is revoked and the user's session
+// generation is bumped, which also invalidates any session that predates session tracking
+func revokeAllUserSessions(db *gorm.DB, userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).Where("id = ?", userID).
+			Update("session_generation", gorm.Expr("session_generation + 1")).Error
+		if err != nil {
+			return fmt.Errorf("tx.Update(session_generation): %w", err)
+		}
+		err = tx.Model(&UserSession{}).Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", time.Now()).Error
+		if err != nil {
+			return fmt.Errorf("tx.Update(revoked_at): %w", err)
+		}
+		return nil
+	})
+}
+
+// checkUserSession reports whether su (an authenticated SessionUser) is still current: the account exists and is
+// enabled, its session generation matches, and the recorded session hasn't been revoked. It runs on every
+// authenticated request, so the user and session rows come back in one query. LastSeenAt is refreshed.
+func checkUserSession(db *gorm.DB, su *SessionUser) (bool, error) {
+	var row struct {
+		Disabled          bool
+		SessionGeneration uint64
+		SessionID         *string
+		RevokedAt         *time.Time
+		LastSeenAt        *time.Time
+	}
+	res := db.Table("users").
+		Select("users.disabled, users.session_generation, user_sessions.id AS session_id, user_sessions.revoked_at, user_sessions.last_seen_at").
+		Joins("LEFT JOIN user_sessions ON user_sessions.id = ? AND user_sessions.user_id = users.id", su.SessionID).
+		Where("users.id = ?", su.UserID).
+		Limit(1).
+		Scan(&row)
+	if res.Error != nil {
+		return false, fmt.Errorf("db.Scan(): %w", res.Error)
+	}
+	if res.RowsAffected == 0 || row.Disabled || row.SessionGeneration != su.Generation {
+		return false, nil
+	}
+
+	// Sessions created before tracking existed have no ID; the generation check above still covers them
+	if su.SessionID == "" {
+		return true, nil
+	}
+	if row.SessionID == nil || row.RevokedAt != nil {
+		return false, nil
+	}
+	if row.LastSeenAt == nil || time.Since(*row.LastSeenAt) > userSessionLastSeenResolution {
+		err := db.Model(&UserSession{}).Where("id = ?", su.SessionID).Update("last_seen_at", time.Now()).Error
+		if err != nil {
+			return false, fmt.Errorf("db.Update(last_seen_at): %w", err)
+		}
+	}
+	return true, nil
+}
+
+// describeUserAgent turns a User-Agent header into e.g. "Firefox on Windows". It's deliberately rough: good enough
+// for a user to recognize their own devices.
+func describeUserAgent(ua string) string {
+	if ua == "" {
+		return "Unknown device"
+	}
+
+	browser := "Unknown browser"
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	os := ""
+	for _, o := range []struct{ token, name string }{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, o.token) {
+			os = o.name
+			break
+		}
+	}
+
+	if os == "" {
+		return browser
+	}
+	return browser + " on " + os
+}
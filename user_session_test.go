@@ -0,0 +1,220 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserSessions(t *testing.T) {
+	// setup logs the same user in from two "devices"
+	setup := func(t *testing.T) (*testClient, *testClient, *DataSourceOrchestration, *User) {
+		router, dso := setupTestRouterWithDSO()
+		u, err := createUser(dso.DB, "judy", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		laptop, phone := newTestClient(t, router), newTestClient(t, router)
+		phone.userAgent = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) Version/17.1 Mobile/15E148 Safari/604.1"
+		laptop.login("judy", "correct horse")
+		phone.login("judy", "correct horse")
+		return laptop, phone, dso, u
+	}
+	loggedIn := func(tc *testClient) bool {
+		return tc.get("/account").Code == http.StatusOK
+	}
+
+	t.Run("ListsActiveSessions", func(t *testing.T) {
+		laptop, _, dso, u := setup(t)
+
+		sessions, err := listUserSessions(dso.DB, u.ID)
+		if err != nil || len(sessions) != 2 {
+			t.Fatalf("Expected 2 active sessions, got %d (%v)", len(sessions), err)
+		}
+		w := laptop.get("/account/sessions")
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "This session") {
+			t.Errorf("Expected sessions page to mark the current session, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "Safari on iPhone") {
+			t.Error("Expected sessions page to describe the other device")
+		}
+	})
+
+	t.Run("RevokeOneSession", func(t *testing.T) {
+		laptop, phone, dso, u := setup(t)
+		sessions, _ := listUserSessions(dso.DB, u.ID)
+
+		// From the laptop, sign out the phone
+		for _, s := range sessions {
+			if s.Device() == "Safari on iPhone" {
+				laptop.postForm("/account/sessions/"+s.ID+"/revoke", url.Values{})
+			}
+		}
+
+		if !loggedIn(laptop) || loggedIn(phone) {
+			t.Error("Expected only the revoked session to be signed out")
+		}
+		if remaining, _ := listUserSessions(dso.DB, u.ID); len(remaining) != 1 {
+			t.Errorf("Expected 1 remaining session, got %d", len(remaining))
+		}
+	})
+
+	t.Run("SignOutEverywhere", func(t *testing.T) {
+		laptop, phone, dso, u := setup(t)
+
+		w := laptop.postForm("/account/sessions/revoke-all", url.Values{})
+		if loc := w.Header().Get("Location"); loc != "/login" {
+			t.Errorf("Expected redirect to '/login', got '%s'", loc)
+		}
+		if loggedIn(laptop) || loggedIn(phone) {
+			t.Error("Expected every session to be signed out")
+		}
+		if remaining, _ := listUserSessions(dso.DB, u.ID); len(remaining) != 0 {
+			t.Errorf("Expected no remaining sessions, got %d", len(remaining))
+		}
+
+		// Logging back in works as normal
+		laptop.login("judy", "correct horse")
+		if !loggedIn(laptop) {
+			t.Error("Expected a fresh login to succeed after signing out everywhere")
+		}
+	})
+
+	t.Run("StaleGenerationIsLoggedOut", func(t *testing.T) {
+		laptop, _, dso, u := setup(t)
+
+		// e.g. a session minted before a sign-out-everywhere that its record somehow survived
+		dso.DB.Model(u).Update("session_generation", u.SessionGeneration+1)
+		if loggedIn(laptop) {
+			t.Error("Expected a session with a stale generation to be treated as logged out")
+		}
+	})
+
+	t.Run("DisabledAccountIsLoggedOut", func(t *testing.T) {
+		laptop, _, dso, u := setup(t)
+
+		dso.DB.Model(u).Update("disabled", true)
+		if loggedIn(laptop) {
+			t.Error("Expected a disabled account's sessions to be treated as logged out")
+		}
+	})
+
+	t.Run("RevokedSessionIsRejectedByAPI", func(t *testing.T) {
+		laptop, phone, dso, u := setup(t)
+		if w := apiRequest(t, phone, "GET", "/api/me", "", nil); w.Code != http.StatusOK {
+			t.Fatalf("Expected the cookie session to reach the API, got %d", w.Code)
+		}
+		for _, s := range mustListUserSessions(t, dso, u) {
+			if s.Device() == "Safari on iPhone" {
+				laptop.postForm("/account/sessions/"+s.ID+"/revoke", url.Values{})
+			}
+		}
+		if w := apiRequest(t, phone, "GET", "/api/me", "", nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for a revoked cookie session, got %d", w.Code)
+		}
+	})
+
+	t.Run("CheckRefreshesLastSeen", func(t *testing.T) {
+		_, _, dso, u := setup(t)
+		s := mustListUserSessions(t, dso, u)[0]
+		stale := time.Now().Add(-time.Hour)
+		dso.DB.Model(&s).Update("last_seen_at", stale)
+
+		su := SessionUser{UserID: u.ID, Generation: u.SessionGeneration, SessionID: s.ID}
+		if valid, err := checkUserSession(dso.DB, &su); !valid || err != nil {
+			t.Fatalf("Expected the session to be valid, got %v (%v)", valid, err)
+		}
+		var after UserSession
+		dso.DB.First(&after, "id = ?", s.ID)
+		if !after.LastSeenAt.After(stale.Add(time.Minute)) {
+			t.Errorf("Expected last_seen_at to be refreshed, got %v", after.LastSeenAt)
+		}
+
+		su.SessionID = "unknown"
+		if valid, err := checkUserSession(dso.DB, &su); valid || err != nil {
+			t.Errorf("Expected an unknown session to be invalid, got %v (%v)", valid, err)
+		}
+		su.UserID = u.ID + 100
+		if valid, err := checkUserSession(dso.DB, &su); valid || err != nil {
+			t.Errorf("Expected an unknown user to be invalid, got %v (%v)", valid, err)
+		}
+	})
+
+	t.Run("RevokeIsScopedToOwner", func(t *testing.T) {
+		laptop, _, dso, u := setup(t)
+		if _, err := createUser(dso.DB, "mallory", "correct horse", SESSUSR__USER); err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		sessions, _ := listUserSessions(dso.DB, u.ID)
+
+		mallory := newTestClient(t, laptop.router)
+		mallory.login("mallory", "correct horse")
+		for _, s := range sessions {
+			mallory.postForm("/account/sessions/"+s.ID+"/revoke", url.Values{})
+		}
+
+		if !loggedIn(laptop) {
+			t.Error("Expected another user's sessions to survive a revoke attempt")
+		}
+	})
+
+	t.Run("AdminForceLogout", func(t *testing.T) {
+		laptop, phone, dso, u := setup(t)
+		if _, err := createUser(dso.DB, "root", "correct horse", SESSUSR__USER|SESSUSR__ADMIN); err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+
+		// A non-admin (here, judy herself from the laptop) can't use the admin route on someone else's behalf
+		other, err := createUser(dso.DB, "ken", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		ken := newTestClient(t, laptop.router)
+		ken.login("ken", "correct horse")
+		laptop.postForm("/admin/users/"+itoa(other.ID)+"/sessions/revoke", url.Values{})
+		if !loggedIn(ken) {
+			t.Error("Expected a non-admin to be unable to force-logout another user")
+		}
+
+		admin := newTestClient(t, laptop.router)
+		admin.login("root", "correct horse")
+		admin.postForm("/admin/users/"+itoa(u.ID)+"/sessions/revoke", url.Values{})
+		if loggedIn(laptop) || loggedIn(phone) {
+			t.Error("Expected admin force-logout to sign the user out everywhere")
+		}
+		if !loggedIn(admin) {
+			t.Error("Expected the admin's own session to be unaffected")
+		}
+	})
+}
+
+func TestDescribeUserAgent(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want string
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", "Chrome on Windows"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15", "Safari on macOS"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1", "Safari on iPhone"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0", "Firefox on Linux"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0", "Edge on Windows"},
+		{"curl/8.4.0", "curl"},
+		{"", "Unknown device"},
+	}
+	for _, tt := range tests {
+		if got := describeUserAgent(tt.ua); got != tt.want {
+			t.Errorf("describeUserAgent(%q) = %q, want %q", tt.ua, got, tt.want)
+		}
+	}
+}
+
+func mustListUserSessions(t *testing.T, dso *DataSourceOrchestration, u *User) []UserSession {
+	t.Helper()
+	sessions, err := listUserSessions(dso.DB, u.ID)
+	if err != nil || len(sessions) == 0 {
+		t.Fatalf("Expected active sessions, got %d (%v)", len(sessions), err)
+	}
+	return sessions
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"gorm.io/gorm"
+)
+
+// Session keys holding in-flight WebAuthn ceremony state (challenge etc.) between the begin and finish requests
+const (
+	sessionKeyWebAuthnRegistration = "webauthn_registration"
+	sessionKeyWebAuthnLogin        = "webauthn_login"
+)
+
+// WebAuthnCredential is a passkey registered to a user. The library's full Credential (public key, sign counter,
+// flags, etc.) is kept as JSON so nothing is lost when it is fed back into later ceremonies.
+type WebAuthnCredential struct {
+	ID           uint   `gorm:"primaryKey"`
+	UserID       uint   `gorm:"index;not null"`
+	CredentialID []byte `gorm:"uniqueIndex;not null"`
+	Name         string
+	Data         []byte `gorm:"not null"`
+	LastUsedAt   *time.Time
+
+	CreatedAt time.Time
+}
+
+// Credential decodes the stored library credential
+func (wc *WebAuthnCredential) Credential() (webauthn.Credential, error) {
+	var cred webauthn.Credential
+	if err := json.Unmarshal(wc.Data, &cred); err != nil {
+		return cred, fmt.Errorf("json.Unmarshal(): %w", err)
+	}
+	return cred, nil
+}
+
+// webauthnUser adapts a User (plus their registered credentials) to the webauthn.User interface
+type webauthnUser struct {
+	user        *User
+	credentials []webauthn.Credential
+}
+
+func (wu *webauthnUser) WebAuthnID() []byte                         { return wu.user.WebAuthnID }
+func (wu *webauthnUser) WebAuthnName() string                       { return wu.user.Username }
+func (wu *webauthnUser) WebAuthnCredentials() []webauthn.Credential { return wu.credentials }
+func (wu *webauthnUser) WebAuthnDisplayName() string {
+	if wu.user.FirstName != "" {
+		return wu.user.FirstName + " " + wu.user.LastName
+	}
+	return wu.user.Username
+}
+
+// newWebAuthn configures the relying party from AppConfig. Attestation is "none": we trust the browser/authenticator
+// to create the key pair and don't verify device make/model.
+func newWebAuthn(cfg *AppConfig) (*webauthn.WebAuthn, error) {
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:                  cfg.WebAuthnRPID,
+		RPDisplayName:         cfg.WebAuthnRPDisplayName,
+		RPOrigins:             cfg.WebAuthnRPOrigins,
+		AttestationPreference: protocol.PreferNoAttestation,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationPreferred,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("webauthn.New(): %w", err)
+	}
+	return wa, nil
+}
+
+// loadWebAuthnUser loads a user's passkeys, assigning them a random WebAuthn user handle on first use
+func loadWebAuthnUser(db *gorm.DB, u *User) (*webauthnUser, error) {
+	if len(u.WebAuthnID) == 0 {
+		handle := make([]byte, 32)
+		if _, err := rand.Read(handle); err != nil {
+			return nil, fmt.Errorf("rand.Read(): %w", err)
+		}
+		if err := db.Model(u).Update("webauthn_id", handle).Error; err != nil {
+			return nil, fmt.Errorf("db.Update(): %w", err)
+		}
+		u.WebAuthnID = handle
+	}
+
+	rows, err := listWebAuthnCredentials(db, u.ID)
+	if err != nil {
+		return nil, fmt.Errorf("listWebAuthnCredentials(): %w", err)
+	}
+	wu := &webauthnUser{user: u}
+	for _, row := range rows {
+		cred, err := row.Credential()
+		if err != nil {
+			return nil, fmt.Errorf("row.Credential(): %w", err)
+		}
+		wu.credentials = append(wu.credentials, cred)
+	}
+	return wu, nil
+}
+
+// findWebAuthnUserByHandle resolves the user handle returned by a discoverable (passkey) assertion
+func findWebAuthnUserByHandle(db *gorm.DB, handle []byte) (*webauthnUser, error) {
+	if len(handle) == 0 {
+		return nil, errors.New("empty user handle")
+	}
+	var u User
+	if err := db.Where("webauthn_id = ?", handle).First(&u).Error; err != nil {
+		return nil, fmt.Errorf("db.First(): %w", err)
+	}
+	return loadWebAuthnUser(db, &u)
+}
+
+func listWebAuthnCredentials(db *gorm.DB, userID uint) ([]WebAuthnCredential, error) {
+	var rows []WebAuthnCredential
+	err := db.Where("user_id = ?", userID).Order("created_at").Find(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("db.Find(): %w", err)
+	}
+	return rows, nil
+}
+
+func saveWebAuthnCredential(db *gorm.DB, userID uint, name string, cred *webauthn.Credential) error {
+	data, err := json.Marshal(cred)
+	if err != nil {
+		return fmt.Errorf("json.Marshal(): %w", err)
+	}
+	row := WebAuthnCredential{
+		UserID:       userID,
+		CredentialID: cred.ID,
+		Name:         name,
+		Data:         data,
+	}
+	if err := db.Create(&row).Error; err != nil {
+		return fmt.Errorf("db.Create(): %w", err)
+	}
+	return nil
+}
+
+// updateWebAuthnCredential persists the post-login state of a credential (sign counter, flags) and its last use
+func updateWebAuthnCredential(db *gorm.DB, cred *webauthn.Credential) error {
+	data, err := json.Marshal(cred)
+	if err != nil {
+		return fmt.Errorf("json.Marshal(): %w", err)
+	}
+	err = db.Model(&WebAuthnCredential{}).Where("credential_id = ?", cred.ID).Updates(map[string]any{
+		"data":         data,
+		"last_used_at": time.Now(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("db.Updates(): %w", err)
+	}
+	return nil
+}
+
+func deleteWebAuthnCredential(db *gorm.DB, userID uint, id uint) (bool, error) {
+	res := db.Where("user_id = ? AND id = ?", userID, id).Delete(&WebAuthnCredential{})
+	if res.Error != nil {
+		return false, fmt.Errorf("db.Delete(): %w", res.Error)
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// saveWebAuthnSession stashes ceremony state in the user's session (JSON, so only a string needs gob encoding)
+func saveWebAuthnSession(session sessions.Session, key string, data *webauthn.SessionData) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("json.Marshal(): %w", err)
+	}
+	session.Set(key, string(b))
+	if err := session.Save(); err != nil {
+		return fmt.Errorf("session.Save(): %w", err)
+	}
+	return nil
+}
+
+// popWebAuthnSession retrieves and removes ceremony state, so each challenge can only be answered once
+func popWebAuthnSession(session sessions.Session, key string) (*webauthn.SessionData, error) {
+	raw, _ := session.Get(key).(string)
+	session.Delete(key)
+	if err := session.Save(); err != nil {
+		return nil, fmt.Errorf("session.Save(): %w", err)
+	}
+	if raw == "" {
+		return nil, errors.New("no ceremony in progress")
+	}
+	var data webauthn.SessionData
+	if err := json.Unmarshal([]byte(raw), &data); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal(): %w", err)
+	}
+	return &data, nil
+}
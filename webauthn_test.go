@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const testWebAuthnOrigin = "http://localhost"
+
+var b64url = base64.RawURLEncoding
+
+// softAuthenticator is a minimal in-memory FIDO2 authenticator ("none" attestation, ES256) for driving the
+// registration and assertion ceremonies in tests, standing in for a browser + security key/platform authenticator
+type softAuthenticator struct {
+	t            *testing.T
+	rpID         string
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+	noUV         bool // Assert user presence only, like a security key without a PIN
+}
+
+func newSoftAuthenticator(t *testing.T, rpID string) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(): %v", err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &softAuthenticator{t: t, rpID: rpID, key: key, credentialID: credentialID}
+}
+
+func (a *softAuthenticator) clientData(typ string, challenge string) []byte {
+	b, _ := json.Marshal(map[string]any{
+		"type":        typ,
+		"challenge":   challenge,
+		"origin":      testWebAuthnOrigin,
+		"crossOrigin": false,
+	})
+	return b
+}
+
+func (a *softAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	buf := bytes.NewBuffer(rpIDHash[:])
+	buf.WriteByte(flags)
+	binary.Write(buf, binary.BigEndian, a.signCount)
+	buf.Write(attested)
+	return buf.Bytes()
+}
+
+// create answers a navigator.credentials.create() challenge, returning the JSON body the browser would POST
+func (a *softAuthenticator) create(options []byte) []byte {
+	var opts struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			User      struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		a.t.Fatalf("json.Unmarshal(creation options): %v", err)
+	}
+	handle, err := b64url.DecodeString(opts.PublicKey.User.ID)
+	if err != nil {
+		a.t.Fatalf("decode user handle: %v", err)
+	}
+	a.userHandle = handle
+
+	// COSE_Key for an EC2 P-256 public key used with ES256
+	coseKey, err := cbor.Marshal(map[int]any{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatalf("cbor.Marshal(cose key): %v", err)
+	}
+	attested := bytes.NewBuffer(make([]byte, 16)) // AAGUID (all zero)
+	binary.Write(attested, binary.BigEndian, uint16(len(a.credentialID)))
+	attested.Write(a.credentialID)
+	attested.Write(coseKey)
+
+	// Flags: UP (0x01) | UV (0x04) | AT (0x40)
+	attObj, err := cbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(0x45, attested.Bytes()),
+	})
+	if err != nil {
+		a.t.Fatalf("cbor.Marshal(attestation object): %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"id":    b64url.EncodeToString(a.credentialID),
+		"rawId": b64url.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64url.EncodeToString(a.clientData("webauthn.create", opts.PublicKey.Challenge)),
+			"attestationObject": b64url.EncodeToString(attObj),
+			"transports":        []string{"internal"},
+		},
+	})
+	return body
+}
+
+// get answers a navigator.credentials.get() challenge, returning the JSON body the browser would POST
+func (a *softAuthenticator) get(options []byte) []byte {
+	var opts struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		a.t.Fatalf("json.Unmarshal(assertion options): %v", err)
+	}
+
+	a.signCount++
+	flags := byte(0x05) // UP | UV
+	if a.noUV {
+		flags = 0x01
+	}
+	authData := a.authData(flags, nil)
+	clientData := a.clientData("webauthn.get", opts.PublicKey.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatalf("ecdsa.SignASN1(): %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"id":    b64url.EncodeToString(a.credentialID),
+		"rawId": b64url.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64url.EncodeToString(clientData),
+			"authenticatorData": b64url.EncodeToString(authData),
+			"signature":         b64url.EncodeToString(sig),
+			"userHandle":        b64url.EncodeToString(a.userHandle),
+		},
+	})
+	return body
+}
+
+func (tc *testClient) postJSON(path string, body []byte) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", path, bytes.NewReader(body))
+	if err != nil {
+		tc.t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(csrfHeader, tc.csrfToken())
+	return tc.do(req)
+}
+
+// registerPasskey logs in with a password and registers a new passkey from a software authenticator
+func registerPasskey(t *testing.T, tc *testClient, username string) *softAuthenticator {
+	if loc := tc.login(username, "correct horse"); loc != "/" {
+		t.Fatalf("Expected password login to succeed, got redirect to '%s'", loc)
+	}
+
+	auth := newSoftAuthenticator(t, "localhost")
+	w := tc.postJSON("/account/passkeys/begin", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected registration begin to return 200, got %d: %s", w.Code, w.Body.String())
+	}
+	w = tc.postJSON("/account/passkeys/finish?name="+url.QueryEscape("Test key"), auth.create(w.Body.Bytes()))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected registration finish to return 200, got %d: %s", w.Code, w.Body.String())
+	}
+	return auth
+}
+
+func TestPasskeys(t *testing.T) {
+	t.Run("RegisterAndSignIn", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO()
+		u, err := createUser(dso.DB, "dave", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		auth := registerPasskey(t, newTestClient(t, router), "dave")
+
+		creds, err := listWebAuthnCredentials(dso.DB, u.ID)
+		if err != nil || len(creds) != 1 || creds[0].Name != "Test key" {
+			t.Fatalf("Expected one stored passkey named 'Test key', got %+v (%v)", creds, err)
+		}
+
+		// Fresh browser: passwordless sign-in
+		tc := newTestClient(t, router)
+		w := tc.postJSON("/login/passkey/begin", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected login begin to return 200, got %d", w.Code)
+		}
+		w = tc.postJSON("/login/passkey/finish", auth.get(w.Body.Bytes()))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected login finish to return 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if w := tc.get("/account"); w.Code != http.StatusOK {
+			t.Errorf("Expected account page to be accessible after passkey login, got %d", w.Code)
+		}
+
+		creds, _ = listWebAuthnCredentials(dso.DB, u.ID)
+		if creds[0].LastUsedAt == nil {
+			t.Error("Expected passkey last-used time to be recorded")
+		}
+	})
+
+	t.Run("TOTPRequiredWithoutUserVerification", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO()
+		u, err := createUser(dso.DB, "dave", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		auth := registerPasskey(t, newTestClient(t, router), "dave")
+		if _, err := enableUserTOTP(dso.DB, u.ID, newTOTPSecret(), 0); err != nil {
+			t.Fatalf("enableUserTOTP(): %v", err)
+		}
+
+		for _, uv := range []bool{false, true} {
+			auth.noUV = !uv
+			tc := newTestClient(t, router)
+			w := tc.postJSON("/login/passkey/begin", nil)
+			w = tc.postJSON("/login/passkey/finish", auth.get(w.Body.Bytes()))
+			var res struct{ Redirect string }
+			json.Unmarshal(w.Body.Bytes(), &res)
+			account := tc.get("/account").Code
+			if uv && (res.Redirect != "/" || account != http.StatusOK) {
+				t.Errorf("Expected a user-verified passkey to sign in directly, got %q and %d", res.Redirect, account)
+			}
+			if !uv && (res.Redirect != "/login/2fa" || account != http.StatusSeeOther) {
+				t.Errorf("Expected the TOTP challenge without user verification, got %q and %d", res.Redirect, account)
+			}
+		}
+	})
+
+	t.Run("ChallengeCannotBeReplayed", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO()
+		if _, err := createUser(dso.DB, "dave", "correct horse", SESSUSR__USER); err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		auth := registerPasskey(t, newTestClient(t, router), "dave")
+
+		tc := newTestClient(t, router)
+		w := tc.postJSON("/login/passkey/begin", nil)
+		assertion := auth.get(w.Body.Bytes())
+		tc.postJSON("/login/passkey/finish", assertion)
+
+		w = tc.postJSON("/login/passkey/finish", assertion)
+		if w.Code == http.StatusOK {
+			t.Error("Expected a replayed assertion to be rejected")
+		}
+	})
+
+	t.Run("UnknownAuthenticatorRejected", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO()
+		if _, err := createUser(dso.DB, "dave", "correct horse", SESSUSR__USER); err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		registerPasskey(t, newTestClient(t, router), "dave")
+
+		// Same user handle, but a key the server has never seen
+		stranger := newSoftAuthenticator(t, "localhost")
+		tc := newTestClient(t, router)
+		w := tc.postJSON("/login/passkey/begin", nil)
+		stranger.userHandle = []byte("not-a-real-handle")
+		w = tc.postJSON("/login/passkey/finish", stranger.get(w.Body.Bytes()))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for unknown authenticator, got %d", w.Code)
+		}
+		if w := tc.get("/account"); w.Code != http.StatusSeeOther {
+			t.Errorf("Expected account page to remain inaccessible, got %d", w.Code)
+		}
+	})
+
+	t.Run("DeleteIsScopedToOwner", func(t *testing.T) {
+		router, dso := setupTestRouterWithDSO()
+		owner, err := createUser(dso.DB, "dave", "correct horse", SESSUSR__USER)
+		if err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		if _, err := createUser(dso.DB, "erin", "correct horse", SESSUSR__USER); err != nil {
+			t.Fatalf("createUser(): %v", err)
+		}
+		registerPasskey(t, newTestClient(t, router), "dave")
+		creds, _ := listWebAuthnCredentials(dso.DB, owner.ID)
+
+		tc := newTestClient(t, router)
+		tc.login("erin", "correct horse")
+		tc.postForm("/account/passkeys/"+itoa(creds[0].ID)+"/delete", url.Values{})
+
+		if creds, _ := listWebAuthnCredentials(dso.DB, owner.ID); len(creds) != 1 {
+			t.Error("Expected another user's passkey to survive a delete attempt")
+		}
+	})
+}